@@ -2,95 +2,617 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mullvad/wg-manager/tracing"
 )
 
+// ErrIncompletePeerList is returned when the API signals that the list of peers is incomplete
+var ErrIncompletePeerList = errors.New("incomplete wireguard peer list")
+
+// ErrResponseTooLarge is returned when a response body exceeds the max size
+var ErrResponseTooLarge = errors.New("response body too large")
+
+// ErrCombinedEndpointUnsupported is returned by SyncWireguardPeers when the API doesn't have the combined endpoint
+var ErrCombinedEndpointUnsupported = errors.New("combined sync endpoint is not supported by the api")
+
 // API is a utility for communicating with the Mullvad API
 type API struct {
 	Username string
 	Password string
 	BaseURL  string
 	Hostname string
-	Client   *http.Client
+	// Version is the version of wg-manager, sent along with the hostname so that the API can inventory the servers
+	// It's left out of requests if it's empty
+	Version string
+	Client  *http.Client
+	// MaxResponseBytes is the max size of a response body, defaultMaxResponseBytes is used if it's zero
+	MaxResponseBytes int64
+	// StrictDecoding rejects responses with fields that aren't known, to detect changes to the API schema
+	StrictDecoding bool
+	// GetRetry configures retries of fetching peers, which synchronization depends on
+	GetRetry Retry
+	// PostRetry configures retries of posting connections, which is best-effort
+	PostRetry Retry
+	// GetTimeout is the max duration of each attempt of fetching a page of peers, including reading the response
+	// Only the timeout of the client applies if it's zero
+	GetTimeout time.Duration
+	// PostTimeout is the max duration of each attempt of posting connections or endpoints, including reading the response
+	// Only the timeout of the client applies if it's zero
+	PostTimeout time.Duration
+	// ConnectionsFormat is the format of the body of PostWireguardConnections, ConnectionsFormatMap is used if it's empty
+	ConnectionsFormat ConnectionsFormat
+	// Msgpack requests the peers encoded as MessagePack, which is much faster to decode than JSON for large lists
+	// Responses are decoded according to their content type, so APIs that only support JSON keep working
+	Msgpack bool
+	// ConditionalRequests makes GetWireguardPeers send the ETag and Last-Modified of the last list of peers,
+	// returning the last list again if the API responds that it's not modified
+	// Only unpaginated lists are kept, as the validators of the first page don't cover the following ones
+	ConditionalRequests bool
+
+	// The sync interval suggested by the last successful GetWireguardPeers
+	suggestedInterval time.Duration
+	// The validators of the last list of peers, and the list itself, set if conditional requests are enabled
+	etag         string
+	lastModified string
+	lastPeers    WireguardPeerList
+	// Whether the last GetWireguardPeers returned the last list again, as it wasn't modified
+	notModified bool
 }
 
+// The max size of a response body if none is configured
+const defaultMaxResponseBytes = 64 << 20
+
 // WireguardPeerList is a list of Wireguard peers
 type WireguardPeerList []WireguardPeer
 
 // WireguardPeer is a wireguard peer
 type WireguardPeer struct {
-	IPv4   string `json:"ipv4"`
-	IPv6   string `json:"ipv6"`
-	Ports  []int  `json:"ports"`
-	Pubkey string `json:"pubkey"`
+	IPv4   string `json:"ipv4" msgpack:"ipv4"`
+	IPv6   string `json:"ipv6" msgpack:"ipv6"`
+	Ports  []int  `json:"ports" msgpack:"ports"`
+	Pubkey string `json:"pubkey" msgpack:"pubkey"`
+	DSCP   int    `json:"dscp,omitempty" msgpack:"dscp,omitempty"`
+	// ForwardTargets are addresses to distribute forwarded connections over, instead of the peer ip
+	ForwardTargets []string `json:"forward_targets,omitempty" msgpack:"forward_targets,omitempty"`
+	// ForwardComment is used as the comment of the portforwarding rules of the peer, instead of the fingerprint of the public key
+	ForwardComment string `json:"forward_comment,omitempty" msgpack:"forward_comment,omitempty"`
+	// ForwardFamily limits portforwarding to the addresses of one family, either FamilyIPv4 or FamilyIPv6
+	// Both families are forwarded if it's empty
+	ForwardFamily string `json:"forward_family,omitempty" msgpack:"forward_family,omitempty"`
+	// ForwardInterface limits portforwarding to traffic arriving on the given interface, such as in multi-homed setups
+	// Traffic arriving on any interface is forwarded if it's empty
+	ForwardInterface string `json:"forward_interface,omitempty" msgpack:"forward_interface,omitempty"`
+	// ExcludeIPs are networks to leave out of the allowed ips of the peer
+	ExcludeIPs []string `json:"exclude_ips,omitempty" msgpack:"exclude_ips,omitempty"`
+	// Kind is whether the record is a peer, forwarding configuration, or both if it's empty
+	Kind string `json:"kind,omitempty" msgpack:"kind,omitempty"`
+	// DisableIPv6 excludes the IPv6 address from the allowed ips and portforwarding of the peer
+	DisableIPv6 bool `json:"disable_ipv6,omitempty" msgpack:"disable_ipv6,omitempty"`
+	// AlertOnIdle enables alerting when the peer hasn't had a handshake for longer than the idle threshold
+	AlertOnIdle bool `json:"alert_on_idle,omitempty" msgpack:"alert_on_idle,omitempty"`
+	// ExpiresAt is when the peer should be removed, peers without it set never expire
+	ExpiresAt *time.Time `json:"expires_at,omitempty" msgpack:"expires_at,omitempty"`
+}
+
+// Kinds of records returned by the API
+const (
+	KindPeer       = "peer"
+	KindForwarding = "forwarding"
+)
+
+// Address families that portforwarding can be limited to
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// HasPeer checks whether the record should be configured as a wireguard peer
+func (p WireguardPeer) HasPeer() bool {
+	return p.Kind != KindForwarding
+}
+
+// HasForwarding checks whether the record should be configured for portforwarding
+func (p WireguardPeer) HasForwarding() bool {
+	return p.Kind != KindPeer
+}
+
+// ForwardsIPv4 checks whether ports should be forwarded to the IPv4 address of the peer
+func (p WireguardPeer) ForwardsIPv4() bool {
+	return p.ForwardFamily != FamilyIPv6
+}
+
+// ForwardsIPv6 checks whether ports should be forwarded to the IPv6 address of the peer
+func (p WireguardPeer) ForwardsIPv6() bool {
+	return p.ForwardFamily != FamilyIPv4 && !p.DisableIPv6
+}
+
+// Fingerprint returns a short identifier of the peer for logs, see Fingerprint
+func (p WireguardPeer) Fingerprint() string {
+	return Fingerprint(p.Pubkey)
+}
+
+// Fingerprint returns a short identifier of a public key for logs, consisting of the start of the hex encoded SHA-256 of it
+func Fingerprint(pubkey string) string {
+	sum := sha256.Sum256([]byte(pubkey))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Sorted returns a copy of the peers sorted by public key, so that they're applied in the same order regardless of the order from the API
+// The list itself is left as is, since it may be cached and shared
+func (l WireguardPeerList) Sorted() WireguardPeerList {
+	sorted := make(WireguardPeerList, len(l))
+	copy(sorted, l)
+
+	sort.SliceStable(sorted, func(i int, j int) bool {
+		return sorted[i].Pubkey < sorted[j].Pubkey
+	})
+
+	return sorted
+}
+
+// Expired checks whether the peer has an expiry time which has passed
+func (p WireguardPeer) Expired(now time.Time) bool {
+	return p.ExpiresAt != nil && !now.Before(*p.ExpiresAt)
+}
+
+// wireguardPeerPage is a single page of a paginated list of wireguard peers
+type wireguardPeerPage struct {
+	Peers WireguardPeerList `json:"peers" msgpack:"peers"`
+	// Next is the url of the following page, if any
+	Next string `json:"next" msgpack:"next"`
+	// Complete is set to false by the API if it could not return all peers
+	Complete *bool `json:"complete" msgpack:"complete"`
+	// SyncInterval is the number of seconds the API suggests waiting before the next synchronization
+	// It may also be given in the X-Sync-Interval header, which is the only way to give it for unpaginated responses
+	SyncInterval int `json:"sync_interval" msgpack:"sync_interval"`
 }
 
 // ConnectedKeysMap contains connected keys and their respective numer of keys
 type ConnectedKeysMap map[string]int
 
 // GetWireguardPeers fetches a list of wireguard peers from the API and returns it
-func (a *API) GetWireguardPeers() (WireguardPeerList, error) {
-	req, err := http.NewRequest("GET", a.BaseURL+"/internal/active-wireguard-peers/", nil)
+// If the API paginates the list, all pages are fetched, and ErrIncompletePeerList is returned if the list is incomplete
+// If conditional requests are enabled, the last list is returned again if the API responds that it's not modified, see NotModified
+func (a *API) GetWireguardPeers(ctx context.Context) (WireguardPeerList, error) {
+	a.notModified = false
+	if !a.ConditionalRequests {
+		return a.getWireguardPeers(ctx, a.BaseURL+"/internal/active-wireguard-peers/", a.getWireguardPeerPage)
+	}
+
+	return a.getWireguardPeers(ctx, a.BaseURL+"/internal/active-wireguard-peers/", a.getConditionalWireguardPeerPage)
+}
+
+// NotModified returns whether the last GetWireguardPeers returned the list of the one before it again,
+// as the API responded that it wasn't modified
+func (a *API) NotModified() bool {
+	return a.notModified
+}
+
+// SyncWireguardPeers posts the number of connected wireguard keys and fetches the list of wireguard peers in one request
+// Any following pages of the list are fetched like in GetWireguardPeers
+// ErrCombinedEndpointUnsupported is returned if the API doesn't have the combined endpoint
+func (a *API) SyncWireguardPeers(ctx context.Context, keys ConnectedKeysMap) (WireguardPeerList, error) {
+	body, err := json.Marshal(map[string]ConnectedKeysMap{"connections": keys})
 	if err != nil {
 		return WireguardPeerList{}, err
 	}
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("X-Relay-Hostname", a.Hostname)
+	return a.getWireguardPeers(ctx, a.BaseURL+"/internal/wireguard-sync/", func(ctx context.Context, pageURL string) (wireguardPeerPage, error) {
+		response, err := a.do(ctx, a.GetRetry, a.GetTimeout, func(ctx context.Context) (*http.Request, error) {
+			return a.newPeersRequest(ctx, "POST", pageURL, bytes.NewReader(body))
+		})
+		if err != nil {
+			return wireguardPeerPage{}, err
+		}
 
-	if a.Username != "" && a.Password != "" {
-		req.SetBasicAuth(a.Username, a.Password)
-	}
+		if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusMethodNotAllowed {
+			response.Body.Close()
+			return wireguardPeerPage{}, ErrCombinedEndpointUnsupported
+		}
+
+		return a.decodeWireguardPeerPage(response)
+	})
+}
 
-	response, err := a.Client.Do(req)
+// Fetch all pages of the list of wireguard peers, fetching the first page with the given function
+func (a *API) getWireguardPeers(ctx context.Context, firstURL string,
+	getFirstPage func(ctx context.Context, pageURL string) (wireguardPeerPage, error)) (WireguardPeerList, error) {
+	pageURL, err := url.Parse(firstURL)
 	if err != nil {
 		return WireguardPeerList{}, err
 	}
 
+	var peers WireguardPeerList
+	var syncInterval int
+	visited := make(map[string]bool)
+
+	for {
+		// Guard against the API linking back to a page we've already fetched
+		if visited[pageURL.String()] {
+			return WireguardPeerList{}, fmt.Errorf("%w: page %s was already fetched", ErrIncompletePeerList, pageURL)
+		}
+		visited[pageURL.String()] = true
+
+		getPage := a.getWireguardPeerPage
+		if len(visited) == 1 {
+			getPage = getFirstPage
+		}
+
+		page, err := getPage(ctx, pageURL.String())
+		if err != nil {
+			return WireguardPeerList{}, err
+		}
+
+		peers = append(peers, page.Peers...)
+
+		// The suggestion of the first page is used
+		if len(visited) == 1 {
+			syncInterval = page.SyncInterval
+		}
+
+		if page.Next == "" {
+			if page.Complete != nil && !*page.Complete {
+				return WireguardPeerList{}, ErrIncompletePeerList
+			}
+
+			a.suggestedInterval = time.Duration(syncInterval) * time.Second
+			return peers, nil
+		}
+
+		next, err := url.Parse(page.Next)
+		if err != nil {
+			return WireguardPeerList{}, fmt.Errorf("error parsing next page url %s", page.Next)
+		}
+
+		// The next page may be given relative to the current one
+		next = pageURL.ResolveReference(next)
+
+		// Only follow pages on the same server, as the credentials are sent along with every request
+		if next.Scheme != pageURL.Scheme || next.Host != pageURL.Host {
+			return WireguardPeerList{}, fmt.Errorf("next page url %s is not on the api server", page.Next)
+		}
+
+		pageURL = next
+	}
+}
+
+func (a *API) getWireguardPeerPage(ctx context.Context, pageURL string) (wireguardPeerPage, error) {
+	response, err := a.do(ctx, a.GetRetry, a.GetTimeout, func(ctx context.Context) (*http.Request, error) {
+		return a.newPeersRequest(ctx, "GET", pageURL, nil)
+	})
+	if err != nil {
+		return wireguardPeerPage{}, err
+	}
+
+	return a.decodeWireguardPeerPage(response)
+}
+
+// Fetch the first page of wireguard peers, sending the validators of the last list if there is one
+func (a *API) getConditionalWireguardPeerPage(ctx context.Context, pageURL string) (wireguardPeerPage, error) {
+	response, err := a.do(ctx, a.GetRetry, a.GetTimeout, func(ctx context.Context) (*http.Request, error) {
+		req, err := a.newPeersRequest(ctx, "GET", pageURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if a.etag != "" {
+			req.Header.Set("If-None-Match", a.etag)
+		}
+
+		if a.lastModified != "" {
+			req.Header.Set("If-Modified-Since", a.lastModified)
+		}
+
+		return req, nil
+	})
+	if err != nil {
+		return wireguardPeerPage{}, err
+	}
+
+	cached := a.etag != "" || a.lastModified != ""
+	if response.StatusCode == http.StatusNotModified && cached {
+		response.Body.Close()
+		a.notModified = true
+
+		// Return a copy, so that changes by the caller don't leak into the next response
+		peers := make(WireguardPeerList, len(a.lastPeers))
+		copy(peers, a.lastPeers)
+		return wireguardPeerPage{Peers: peers, SyncInterval: int(a.suggestedInterval / time.Second)}, nil
+	}
+
+	etag := response.Header.Get("ETag")
+	lastModified := response.Header.Get("Last-Modified")
+
+	page, err := a.decodeWireguardPeerPage(response)
+	if err != nil {
+		return page, err
+	}
+
+	a.etag, a.lastModified, a.lastPeers = "", "", nil
+	if page.Next == "" && (page.Complete == nil || *page.Complete) {
+		a.etag, a.lastModified = etag, lastModified
+		a.lastPeers = make(WireguardPeerList, len(page.Peers))
+		copy(a.lastPeers, page.Peers)
+	}
+
+	return page, nil
+}
+
+// Decode a page of wireguard peers from a response, closing the response body
+func (a *API) decodeWireguardPeerPage(response *http.Response) (wireguardPeerPage, error) {
+	var page wireguardPeerPage
+
 	defer response.Body.Close()
 
-	body, err := ioutil.ReadAll(response.Body)
+	// Error responses may have a body that decodes as a page without peers, which would remove every peer
+	err := checkStatus(response)
 	if err != nil {
-		return WireguardPeerList{}, err
+		return page, err
+	}
+
+	body, err := a.readBody(response)
+	if err != nil {
+		return page, err
+	}
+
+	if isMsgpack(response.Header.Get("Content-Type")) {
+		page, err = decodeMsgpackPeerPage(body, a.StrictDecoding)
+	} else {
+		// Unpaginated responses are a plain list of peers
+		body = bytes.TrimSpace(body)
+		if len(body) > 0 && body[0] == '[' {
+			err = a.decode(body, &page.Peers)
+		} else {
+			err = a.decode(body, &page)
+		}
+	}
+
+	if err != nil {
+		if a.StrictDecoding {
+			return page, fmt.Errorf("error decoding wireguard peers: %s", err.Error())
+		}
+
+		return page, fmt.Errorf("error decoding wireguard peers")
+	}
+
+	// An empty list of peers is decoded as an empty slice, so it's only nil if the field is missing or null
+	if page.Peers == nil {
+		return page, errors.New("no wireguard peers in the response")
+	}
+
+	if header := response.Header.Get("X-Sync-Interval"); header != "" && page.SyncInterval == 0 {
+		page.SyncInterval, _ = strconv.Atoi(header)
+	}
+
+	return page, nil
+}
+
+// Check that the response has a successful status code
+func checkStatus(response *http.Response) error {
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status code %d from the api", response.StatusCode)
 	}
 
-	var decodedResponse WireguardPeerList
-	err = json.Unmarshal(body, &decodedResponse)
+	return nil
+}
+
+// SuggestedInterval returns the sync interval suggested by the API in the last successful GetWireguardPeers
+// It's zero if the API didn't suggest one
+func (a *API) SuggestedInterval() time.Duration {
+	return a.suggestedInterval
+}
+
+// Decode a JSON response body, rejecting unknown fields if strict decoding is enabled
+func (a *API) decode(body []byte, v interface{}) error {
+	if !a.StrictDecoding {
+		return json.Unmarshal(body, v)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
 	if err != nil {
-		return WireguardPeerList{}, fmt.Errorf("error decoding wireguard peers")
+		return err
+	}
+
+	// Match json.Unmarshal, which doesn't allow anything after the value
+	if decoder.More() {
+		return errors.New("unexpected data after wireguard peers")
 	}
 
-	return decodedResponse, nil
+	return nil
+}
+
+// Read the body of a response, returning an error instead of reading past the max size
+func (a *API) readBody(response *http.Response) ([]byte, error) {
+	maxBytes := a.MaxResponseBytes
+	if maxBytes == 0 {
+		maxBytes = defaultMaxResponseBytes
+	}
+
+	// Read one byte past the limit, to tell a body of exactly the max size from a larger one
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > maxBytes {
+		return nil, fmt.Errorf("%w, exceeds %d bytes", ErrResponseTooLarge, maxBytes)
+	}
+
+	return body, nil
 }
 
 // PostWireguardConnections posts the number of connected wireguard keys to the API
-func (a *API) PostWireguardConnections(keys ConnectedKeysMap) error {
-	connectionsMap := make(map[string]ConnectedKeysMap)
-	connectionsMap["connections"] = keys
+func (a *API) PostWireguardConnections(ctx context.Context, keys ConnectedKeysMap) error {
+	body, err := a.marshalConnections(keys)
+	if err != nil {
+		return err
+	}
 
-	buffer := new(bytes.Buffer)
-	json.NewEncoder(buffer).Encode(connectionsMap)
-	req, err := http.NewRequest("POST", a.BaseURL+"/internal/wireguard-connection-report/", buffer)
+	response, err := a.do(ctx, a.PostRetry, a.PostTimeout, func(ctx context.Context) (*http.Request, error) {
+		return a.newRequest(ctx, "POST", a.BaseURL+"/internal/wireguard-connection-report/", bytes.NewReader(body))
+	})
 	if err != nil {
 		return err
 	}
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("X-Relay-Hostname", a.Hostname)
+	defer response.Body.Close()
 
-	if a.Username != "" && a.Password != "" {
-		req.SetBasicAuth(a.Username, a.Password)
+	return checkStatus(response)
+}
+
+// PeerEndpoint is the remote endpoint of a connected peer
+type PeerEndpoint struct {
+	Pubkey   string `json:"pubkey"`
+	Endpoint string `json:"endpoint"`
+}
+
+// PostWireguardEndpoints posts the remote endpoints of the connected peers to the API
+func (a *API) PostWireguardEndpoints(ctx context.Context, endpoints []PeerEndpoint) error {
+	body, err := json.Marshal(map[string][]PeerEndpoint{"endpoints": endpoints})
+	if err != nil {
+		return err
 	}
 
-	response, err := a.Client.Do(req)
+	response, err := a.do(ctx, a.PostRetry, a.PostTimeout, func(ctx context.Context) (*http.Request, error) {
+		return a.newRequest(ctx, "POST", a.BaseURL+"/internal/wireguard-endpoint-report/", bytes.NewReader(body))
+	})
 	if err != nil {
 		return err
 	}
 
 	defer response.Body.Close()
 
-	return nil
+	return checkStatus(response)
+}
+
+// PeerRejection is a peer that wasn't applied, along with why
+type PeerRejection struct {
+	Pubkey string `json:"pubkey"`
+	Reason string `json:"reason"`
+	// Detail describes the reason further, such as the validation error of an invalid peer
+	Detail string `json:"detail,omitempty"`
+}
+
+// PostWireguardRejections posts the peers that weren't applied to the API, so that it can surface why
+// Every rejected peer is posted each time, an empty list means that every peer was applied
+func (a *API) PostWireguardRejections(ctx context.Context, rejections []PeerRejection) error {
+	body, err := json.Marshal(map[string][]PeerRejection{"rejections": rejections})
+	if err != nil {
+		return err
+	}
+
+	response, err := a.do(ctx, a.PostRetry, a.PostTimeout, func(ctx context.Context) (*http.Request, error) {
+		return a.newRequest(ctx, "POST", a.BaseURL+"/internal/wireguard-rejection-report/", bytes.NewReader(body))
+	})
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	return checkStatus(response)
+}
+
+// ConnectionsDelta is the change in connected wireguard keys since the previous report
+// Added contains the keys that are newly connected, or whose number of connections changed
+type ConnectionsDelta struct {
+	Added   ConnectedKeysMap `json:"added"`
+	Removed []string         `json:"removed"`
+}
+
+// DiffConnections returns the change from the previous to the current connected keys
+func DiffConnections(previous ConnectedKeysMap, current ConnectedKeysMap) ConnectionsDelta {
+	delta := ConnectionsDelta{
+		Added:   make(ConnectedKeysMap),
+		Removed: []string{},
+	}
+
+	for key, count := range current {
+		if previous[key] != count {
+			delta.Added[key] = count
+		}
+	}
+
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			delta.Removed = append(delta.Removed, key)
+		}
+	}
+
+	sort.Strings(delta.Removed)
+	return delta
+}
+
+// PostWireguardConnectionsDelta posts the change in connected wireguard keys since the previous report to the API
+func (a *API) PostWireguardConnectionsDelta(ctx context.Context, delta ConnectionsDelta) error {
+	body, err := json.Marshal(map[string]ConnectionsDelta{"connections_delta": delta})
+	if err != nil {
+		return err
+	}
+
+	response, err := a.do(ctx, a.PostRetry, a.PostTimeout, func(ctx context.Context) (*http.Request, error) {
+		return a.newRequest(ctx, "POST", a.BaseURL+"/internal/wireguard-connection-report/", bytes.NewReader(body))
+	})
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	return checkStatus(response)
+}
+
+// Create a request for a page of peers, accepting MessagePack if it's enabled
+func (a *API) newPeersRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := a.newRequest(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Msgpack {
+		req.Header.Set("Accept", MsgpackContentType+", application/json;q=0.9")
+	}
+
+	return req, nil
+}
+
+// Create a request to the API, with the headers and credentials set
+func (a *API) newRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Relay-Hostname", a.Hostname)
+	if a.Version != "" {
+		req.Header.Add("X-Relay-Version", a.Version)
+	}
+
+	// Propagate the trace of the request, so that it can be correlated with the one of the API
+	if traceParent := tracing.TraceParent(ctx); traceParent != "" {
+		req.Header.Add("traceparent", traceParent)
+	}
+
+	if a.Username != "" && a.Password != "" {
+		req.SetBasicAuth(a.Username, a.Password)
+	}
+
+	return req, nil
 }
@@ -1,16 +1,21 @@
 package api_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"math/rand"
 	"reflect"
 	"strings"
 
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/tracing"
 )
 
 var peerFixture = api.WireguardPeerList{
@@ -48,7 +53,7 @@ func TestGetWireguardPeers(t *testing.T) {
 		Hostname: "test",
 	}
 
-	peers, err := api.GetWireguardPeers()
+	peers, err := api.GetWireguardPeers(context.Background())
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
@@ -58,6 +63,172 @@ func TestGetWireguardPeers(t *testing.T) {
 	}
 }
 
+func TestVersionHeader(t *testing.T) {
+	var headers []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		headers = append(headers, req.Header)
+		if req.Method == "GET" {
+			bytes, _ := json.Marshal(peerFixture)
+			rw.Write(bytes)
+		}
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL:  server.URL,
+		Client:   server.Client(),
+		Hostname: "test",
+		Version:  "2021.1",
+	}
+
+	_, err := a.GetWireguardPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.PostWireguardConnections(context.Background(), connectedKeysFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(headers) != 2 {
+		t.Fatalf("got unexpected number of requests %d", len(headers))
+	}
+
+	for _, header := range headers {
+		if header.Get("X-Relay-Version") != "2021.1" || header.Get("X-Relay-Hostname") != "test" {
+			t.Errorf("got unexpected headers %+v", header)
+		}
+	}
+
+	// Builds without a version leave the header out
+	headers = nil
+	a.Version = ""
+	_, err = a.GetWireguardPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := headers[0]["X-Relay-Version"]; ok {
+		t.Errorf("got unexpected version header %+v", headers[0])
+	}
+}
+
+func TestGetWireguardPeersPaginated(t *testing.T) {
+	secondPeer := api.WireguardPeer{
+		IPv4:   "10.99.0.2/32",
+		IPv6:   "fc00:bbbb:bbbb:bb01::2/128",
+		Ports:  []int{5678},
+		Pubkey: strings.Repeat("b", 44),
+	}
+
+	complete := true
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("cursor") == "" {
+			rw.Write([]byte(`{"peers": [{"ipv4": "10.99.0.1/32", "ipv6": "fc00:bbbb:bbbb:bb01::1/128", "ports": [1234, 4321], "pubkey": "` + peerFixture[0].Pubkey + `"}], "next": "?cursor=2"}`))
+			return
+		}
+
+		bytes, _ := json.Marshal(map[string]interface{}{
+			"peers":    api.WireguardPeerList{secondPeer},
+			"complete": complete,
+		})
+		rw.Write(bytes)
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL: server.URL,
+		Client:  server.Client(),
+	}
+
+	t.Run("complete", func(t *testing.T) {
+		peers, err := a.GetWireguardPeers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := append(api.WireguardPeerList{}, peerFixture[0], secondPeer)
+		if !reflect.DeepEqual(peers, expected) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", expected, peers)
+		}
+	})
+
+	t.Run("incomplete", func(t *testing.T) {
+		complete = false
+
+		_, err := a.GetWireguardPeers(context.Background())
+		if !errors.Is(err, api.ErrIncompletePeerList) {
+			t.Errorf("got unexpected error, wanted %s, got %v", api.ErrIncompletePeerList, err)
+		}
+	})
+}
+
+func TestGetWireguardPeersPaginatedOtherHost(t *testing.T) {
+	var otherHostRequested bool
+	otherServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		otherHostRequested = true
+		rw.Write([]byte(`{"peers": []}`))
+	}))
+	defer otherServer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"peers": [], "next": "` + otherServer.URL + `/?cursor=2"}`))
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL:  server.URL,
+		Client:   server.Client(),
+		Username: "foo",
+		Password: "bar",
+	}
+
+	_, err := a.GetWireguardPeers(context.Background())
+	if err == nil {
+		t.Error("followed a next page url on another host")
+	}
+
+	if otherHostRequested {
+		t.Error("sent a request to another host")
+	}
+}
+
+func TestGetWireguardPeersErrorResponse(t *testing.T) {
+	var status int
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(status)
+		rw.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL: server.URL,
+		Client:  server.Client(),
+	}
+
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"server error", http.StatusInternalServerError, `{"detail": "internal error"}`},
+		{"unauthorized", http.StatusUnauthorized, `{"detail": "invalid credentials"}`},
+		{"missing peers", http.StatusOK, `{"detail": "no peers"}`},
+		{"null peers", http.StatusOK, `{"peers": null}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, body = tc.status, tc.body
+
+			peers, err := a.GetWireguardPeers(context.Background())
+			if err == nil {
+				t.Errorf("no error for a response without peers, got %d peers", len(peers))
+			}
+		})
+	}
+}
+
 func TestPostWireguardPeers(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		body, err := ioutil.ReadAll(req.Body)
@@ -96,8 +267,801 @@ func TestPostWireguardPeers(t *testing.T) {
 		connectedKeysCopy[k] = v
 	}
 
-	err := a.PostWireguardConnections(connectedKeysCopy)
+	err := a.PostWireguardConnections(context.Background(), connectedKeysCopy)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 }
+
+func TestPostWireguardConnectionsFormats(t *testing.T) {
+	tests := []struct {
+		Format       api.ConnectionsFormat
+		ExpectedBody string
+	}{
+		{"", `{"connections":{"a":1,"b":2}}`},
+		{api.ConnectionsFormatMap, `{"connections":{"a":1,"b":2}}`},
+		{api.ConnectionsFormatKeys, `{"connections":["a","b"]}`},
+		{api.ConnectionsFormatList, `{"hostname":"test","connections":[{"pubkey":"a","connections":1},{"pubkey":"b","connections":2}]}`},
+	}
+
+	for _, test := range tests {
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, _ = ioutil.ReadAll(req.Body)
+			rw.WriteHeader(http.StatusOK)
+		}))
+
+		a := api.API{
+			BaseURL:           server.URL,
+			Client:            server.Client(),
+			Hostname:          "test",
+			ConnectionsFormat: test.Format,
+		}
+
+		err := a.PostWireguardConnections(context.Background(), api.ConnectedKeysMap{"b": 2, "a": 1})
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(body) != test.ExpectedBody {
+			t.Errorf("got unexpected body for format %q, wanted %s, got %s", test.Format, test.ExpectedBody, body)
+		}
+	}
+}
+
+func TestParseConnectionsFormat(t *testing.T) {
+	format, err := api.ParseConnectionsFormat("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if format != api.ConnectionsFormatMap {
+		t.Errorf("got unexpected default format %s", format)
+	}
+
+	_, err = api.ParseConnectionsFormat("xml")
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestDiffConnections(t *testing.T) {
+	previous := api.ConnectedKeysMap{"a": 1, "b": 1, "c": 2}
+	current := api.ConnectedKeysMap{"a": 1, "b": 2, "d": 1}
+
+	delta := api.DiffConnections(previous, current)
+
+	expected := api.ConnectionsDelta{
+		Added:   api.ConnectedKeysMap{"b": 2, "d": 1},
+		Removed: []string{"c"},
+	}
+	if !reflect.DeepEqual(delta, expected) {
+		t.Errorf("got unexpected delta, wanted %+v, got %+v", expected, delta)
+	}
+}
+
+func TestPostWireguardConnectionsDelta(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		expected := `{"connections_delta":{"added":{"a":1},"removed":["b"]}}`
+		if string(body) != expected {
+			t.Errorf("got unexpected body, wanted %s, got %s", expected, body)
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL:  server.URL,
+		Client:   server.Client(),
+		Hostname: "test",
+	}
+
+	err := a.PostWireguardConnectionsDelta(context.Background(), api.DiffConnections(api.ConnectedKeysMap{"b": 1}, api.ConnectedKeysMap{"a": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPostWireguardEndpoints(t *testing.T) {
+	endpoints := []api.PeerEndpoint{
+		{Pubkey: peerFixture[0].Pubkey, Endpoint: "192.0.2.1:51820"},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/internal/wireguard-endpoint-report/" {
+			t.Errorf("got unexpected path %s", req.URL.Path)
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		expected := `{"endpoints":[{"pubkey":"` + peerFixture[0].Pubkey + `","endpoint":"192.0.2.1:51820"}]}`
+		if string(body) != expected {
+			t.Errorf("got unexpected body, wanted %s, got %s", expected, body)
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL:  server.URL,
+		Client:   server.Client(),
+		Hostname: "test",
+	}
+
+	err := a.PostWireguardEndpoints(context.Background(), endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPostWireguardRejections(t *testing.T) {
+	rejections := []api.PeerRejection{
+		{Pubkey: "foo", Reason: "invalid", Detail: "wgtypes: failed to parse base64-encoded key"},
+		{Pubkey: peerFixture[0].Pubkey, Reason: "over_capacity"},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/internal/wireguard-rejection-report/" {
+			t.Errorf("got unexpected path %s", req.URL.Path)
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		expected := `{"rejections":[{"pubkey":"foo","reason":"invalid","detail":"wgtypes: failed to parse base64-encoded key"},` +
+			`{"pubkey":"` + peerFixture[0].Pubkey + `","reason":"over_capacity"}]}`
+		if string(body) != expected {
+			t.Errorf("got unexpected body, wanted %s, got %s", expected, body)
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL:  server.URL,
+		Client:   server.Client(),
+		Hostname: "test",
+	}
+
+	err := a.PostWireguardRejections(context.Background(), rejections)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPostErrorResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL: server.URL,
+		Client:  server.Client(),
+	}
+
+	for name, post := range map[string]func() error{
+		"connections": func() error {
+			return a.PostWireguardConnections(context.Background(), connectedKeysFixture)
+		},
+		"connections delta": func() error {
+			return a.PostWireguardConnectionsDelta(context.Background(), api.DiffConnections(nil, connectedKeysFixture))
+		},
+		"endpoints": func() error {
+			return a.PostWireguardEndpoints(context.Background(), []api.PeerEndpoint{})
+		},
+		"rejections": func() error {
+			return a.PostWireguardRejections(context.Background(), []api.PeerRejection{})
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := post()
+			if err == nil {
+				t.Error("no error for an unauthorized response")
+			}
+		})
+	}
+}
+
+func TestGetWireguardPeersTooLarge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		bytes, _ := json.Marshal(peerFixture)
+		rw.Write(bytes)
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL:          server.URL,
+		Client:           server.Client(),
+		MaxResponseBytes: 16,
+	}
+
+	_, err := a.GetWireguardPeers(context.Background())
+	if !errors.Is(err, api.ErrResponseTooLarge) {
+		t.Errorf("got unexpected error, wanted %s, got %v", api.ErrResponseTooLarge, err)
+	}
+}
+
+func TestGetWireguardPeersCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		bytes, _ := json.Marshal(peerFixture)
+		rw.Write(bytes)
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL: server.URL,
+		Client:  server.Client(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := a.GetWireguardPeers(ctx)
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestWireguardPeerKind(t *testing.T) {
+	tests := []struct {
+		Kind                  string
+		ExpectedHasPeer       bool
+		ExpectedHasForwarding bool
+	}{
+		{"", true, true},
+		{api.KindPeer, true, false},
+		{api.KindForwarding, false, true},
+	}
+
+	for _, test := range tests {
+		peer := api.WireguardPeer{Kind: test.Kind}
+
+		if peer.HasPeer() != test.ExpectedHasPeer {
+			t.Errorf("kind %q: got unexpected HasPeer, wanted %v", test.Kind, test.ExpectedHasPeer)
+		}
+
+		if peer.HasForwarding() != test.ExpectedHasForwarding {
+			t.Errorf("kind %q: got unexpected HasForwarding, wanted %v", test.Kind, test.ExpectedHasForwarding)
+		}
+	}
+}
+
+func TestWireguardPeerForwardFamily(t *testing.T) {
+	tests := []struct {
+		ForwardFamily        string
+		DisableIPv6          bool
+		ExpectedForwardsIPv4 bool
+		ExpectedForwardsIPv6 bool
+	}{
+		{"", false, true, true},
+		{"", true, true, false},
+		{api.FamilyIPv4, false, true, false},
+		{api.FamilyIPv6, false, false, true},
+		{api.FamilyIPv6, true, false, false},
+	}
+
+	for _, test := range tests {
+		peer := api.WireguardPeer{ForwardFamily: test.ForwardFamily, DisableIPv6: test.DisableIPv6}
+
+		if peer.ForwardsIPv4() != test.ExpectedForwardsIPv4 {
+			t.Errorf("family %q, ipv6 disabled %v: got unexpected ForwardsIPv4, wanted %v", test.ForwardFamily, test.DisableIPv6, test.ExpectedForwardsIPv4)
+		}
+
+		if peer.ForwardsIPv6() != test.ExpectedForwardsIPv6 {
+			t.Errorf("family %q, ipv6 disabled %v: got unexpected ForwardsIPv6, wanted %v", test.ForwardFamily, test.DisableIPv6, test.ExpectedForwardsIPv6)
+		}
+	}
+}
+
+func TestWireguardPeerExpiresAt(t *testing.T) {
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	// Peers without an expiry time are serialized without it, such as to the peer snapshot
+	peer := api.WireguardPeer{Pubkey: "a"}
+	encoded, err := json.Marshal(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(encoded), "expires_at") {
+		t.Errorf("got unexpected expiry time in %s", encoded)
+	}
+
+	if peer.Expired(now) {
+		t.Error("peer without an expiry time expired")
+	}
+
+	expiresAt := now.Add(-time.Minute)
+	peer.ExpiresAt = &expiresAt
+	encoded, err = json.Marshal(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(encoded), `"expires_at":"2020-10-01T11:59:00Z"`) {
+		t.Errorf("got unexpected expiry time in %s", encoded)
+	}
+
+	if !peer.Expired(now) {
+		t.Error("peer didn't expire")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fingerprint := peerFixture[0].Fingerprint()
+	if fingerprint != "16849877" {
+		t.Errorf("got unexpected fingerprint %s", fingerprint)
+	}
+
+	if api.Fingerprint(peerFixture[0].Pubkey) != fingerprint {
+		t.Error("fingerprint of the public key differs from the fingerprint of the peer")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests%3 != 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if req.Method == "POST" {
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+
+		bytes, _ := json.Marshal(peerFixture)
+		rw.Write(bytes)
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL:   server.URL,
+		Client:    server.Client(),
+		GetRetry:  api.Retry{Attempts: 2, Backoff: time.Millisecond},
+		PostRetry: api.Retry{Attempts: 2, Backoff: time.Millisecond},
+	}
+
+	t.Run("get", func(t *testing.T) {
+		requests = 0
+
+		peers, err := a.GetWireguardPeers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(peers, peerFixture) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", peerFixture, peers)
+		}
+
+		if requests != 3 {
+			t.Errorf("unexpected number of requests %d", requests)
+		}
+	})
+
+	t.Run("post", func(t *testing.T) {
+		requests = 0
+
+		err := a.PostWireguardConnections(context.Background(), connectedKeysFixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if requests != 3 {
+			t.Errorf("unexpected number of requests %d", requests)
+		}
+	})
+
+	t.Run("independent", func(t *testing.T) {
+		requests = 0
+		a.PostRetry = api.Retry{}
+
+		err := a.PostWireguardConnections(context.Background(), connectedKeysFixture)
+		if err == nil {
+			t.Error("no error after the retries ran out")
+		}
+
+		if requests != 1 {
+			t.Errorf("unexpected number of requests %d", requests)
+		}
+	})
+
+	t.Run("retries run out", func(t *testing.T) {
+		requests = 0
+		a.GetRetry = api.Retry{Attempts: 1, Backoff: time.Millisecond}
+
+		_, err := a.GetWireguardPeers(context.Background())
+		if err == nil {
+			t.Error("no error after the retries ran out")
+		}
+
+		if requests != 2 {
+			t.Errorf("unexpected number of requests %d", requests)
+		}
+	})
+}
+
+func TestTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(time.Millisecond * 50)
+
+		if req.Method == "POST" {
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+
+		bytes, _ := json.Marshal(peerFixture)
+		rw.Write(bytes)
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL:     server.URL,
+		Client:      server.Client(),
+		GetTimeout:  time.Second,
+		PostTimeout: time.Millisecond * 10,
+	}
+
+	t.Run("get within timeout", func(t *testing.T) {
+		peers, err := a.GetWireguardPeers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(peers, peerFixture) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", peerFixture, peers)
+		}
+	})
+
+	t.Run("post exceeding timeout", func(t *testing.T) {
+		err := a.PostWireguardConnections(context.Background(), connectedKeysFixture)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}
+
+func TestGetWireguardPeersStrictDecoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`[{"ipv4":"10.99.0.1/32","pubkey":"foo","unexpected":true}]`))
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL: server.URL,
+		Client:  server.Client(),
+	}
+
+	t.Run("lenient", func(t *testing.T) {
+		peers, err := a.GetWireguardPeers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := api.WireguardPeerList{{IPv4: "10.99.0.1/32", Pubkey: "foo"}}
+		if !reflect.DeepEqual(peers, expected) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", expected, peers)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		a.StrictDecoding = true
+
+		_, err := a.GetWireguardPeers(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "unexpected") {
+			t.Errorf("got unexpected error %v", err)
+		}
+	})
+}
+
+func TestWireguardPeerListSorted(t *testing.T) {
+	peers := api.WireguardPeerList{
+		{Pubkey: "c"},
+		{Pubkey: "a"},
+		{Pubkey: "d"},
+		{Pubkey: "b"},
+	}
+
+	expected := api.WireguardPeerList{
+		{Pubkey: "a"},
+		{Pubkey: "b"},
+		{Pubkey: "c"},
+		{Pubkey: "d"},
+	}
+
+	for i := 0; i < 10; i++ {
+		rand.Shuffle(len(peers), func(i int, j int) {
+			peers[i], peers[j] = peers[j], peers[i]
+		})
+
+		shuffled := append(api.WireguardPeerList{}, peers...)
+
+		sorted := peers.Sorted()
+		if !reflect.DeepEqual(sorted, expected) {
+			t.Fatalf("got unexpected result, wanted %+v, got %+v", expected, sorted)
+		}
+
+		if !reflect.DeepEqual(peers, shuffled) {
+			t.Fatalf("the list was modified, wanted %+v, got %+v", shuffled, peers)
+		}
+	}
+}
+
+func TestSuggestedInterval(t *testing.T) {
+	var body string
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if header != "" {
+			rw.Header().Set("X-Sync-Interval", header)
+		}
+
+		rw.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL: server.URL,
+		Client:  server.Client(),
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		header   string
+		expected time.Duration
+	}{
+		{"none", `[]`, "", 0},
+		{"header", `[]`, "120", time.Minute * 2},
+		{"body", `{"peers":[],"sync_interval":30}`, "", time.Second * 30},
+		{"body before header", `{"peers":[],"sync_interval":30}`, "120", time.Second * 30},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body = test.body
+			header = test.header
+
+			_, err := a.GetWireguardPeers(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if interval := a.SuggestedInterval(); interval != test.expected {
+				t.Errorf("got unexpected interval, wanted %s, got %s", test.expected, interval)
+			}
+		})
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	const etag = `"v1"`
+	const lastModified = "Wed, 14 Oct 2026 12:00:00 GMT"
+
+	var requests int
+	var ifNoneMatch, ifModifiedSince string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		ifNoneMatch = req.Header.Get("If-None-Match")
+		ifModifiedSince = req.Header.Get("If-Modified-Since")
+
+		if ifNoneMatch == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		rw.Header().Set("ETag", etag)
+		rw.Header().Set("Last-Modified", lastModified)
+		json.NewEncoder(rw).Encode(peerFixture)
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL:             server.URL,
+		Client:              server.Client(),
+		ConditionalRequests: true,
+	}
+
+	peers, err := a.GetWireguardPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(peers, peerFixture) || a.NotModified() {
+		t.Fatalf("got unexpected result %+v, not modified %t", peers, a.NotModified())
+	}
+
+	if ifNoneMatch != "" || ifModifiedSince != "" {
+		t.Errorf("got unexpected validators in the first request %q %q", ifNoneMatch, ifModifiedSince)
+	}
+
+	// The API responds with 304, so the last list is returned again
+	peers, err = a.GetWireguardPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(peers, peerFixture) || !a.NotModified() {
+		t.Fatalf("got unexpected result %+v, not modified %t", peers, a.NotModified())
+	}
+
+	if ifNoneMatch != etag || ifModifiedSince != lastModified {
+		t.Errorf("got unexpected validators %q %q", ifNoneMatch, ifModifiedSince)
+	}
+
+	// Changes to the returned list don't leak into the next response
+	peers[0].Pubkey = "changed"
+	peers, err = a.GetWireguardPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(peers, peerFixture) {
+		t.Fatalf("got unexpected result %+v", peers)
+	}
+
+	if requests != 3 {
+		t.Errorf("got unexpected number of requests %d", requests)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		a := api.API{
+			BaseURL: server.URL,
+			Client:  server.Client(),
+		}
+
+		for i := 0; i < 2; i++ {
+			_, err := a.GetWireguardPeers(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ifNoneMatch != "" || a.NotModified() {
+				t.Fatalf("sent a conditional request while disabled")
+			}
+		}
+	})
+}
+
+func TestSyncWireguardPeers(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.Method+" "+req.URL.Path)
+
+		switch req.URL.Path {
+		case "/internal/wireguard-sync/":
+			if req.Method != "POST" {
+				rw.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+
+			var connectedKeys map[string]api.ConnectedKeysMap
+			err := json.NewDecoder(req.Body).Decode(&connectedKeys)
+			if err != nil {
+				t.Error(err)
+			}
+
+			if !reflect.DeepEqual(connectedKeys, connectionsFixture) {
+				t.Errorf("got unexpected connections, wanted %+v, got %+v", connectionsFixture, connectedKeys)
+			}
+
+			bytes, _ := json.Marshal(peerFixture)
+			rw.Write(bytes)
+		case "/internal/active-wireguard-peers/":
+			bytes, _ := json.Marshal(peerFixture)
+			rw.Write(bytes)
+		case "/internal/wireguard-connection-report/":
+			rw.WriteHeader(http.StatusOK)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Run("combined", func(t *testing.T) {
+		requests = nil
+		a := api.API{
+			BaseURL: server.URL,
+			Client:  server.Client(),
+		}
+
+		peers, err := a.SyncWireguardPeers(context.Background(), connectedKeysFixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(peers, peerFixture) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", peerFixture, peers)
+		}
+
+		expected := []string{"POST /internal/wireguard-sync/"}
+		if !reflect.DeepEqual(requests, expected) {
+			t.Errorf("got unexpected requests, wanted %v, got %v", expected, requests)
+		}
+	})
+
+	t.Run("split", func(t *testing.T) {
+		requests = nil
+		a := api.API{
+			BaseURL: server.URL,
+			Client:  server.Client(),
+		}
+
+		peers, err := a.GetWireguardPeers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(peers, peerFixture) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", peerFixture, peers)
+		}
+
+		err = a.PostWireguardConnections(context.Background(), connectedKeysFixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"GET /internal/active-wireguard-peers/", "POST /internal/wireguard-connection-report/"}
+		if !reflect.DeepEqual(requests, expected) {
+			t.Errorf("got unexpected requests, wanted %v, got %v", expected, requests)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		a := api.API{
+			BaseURL: server.URL + "/old",
+			Client:  server.Client(),
+		}
+
+		_, err := a.SyncWireguardPeers(context.Background(), connectedKeysFixture)
+		if !errors.Is(err, api.ErrCombinedEndpointUnsupported) {
+			t.Errorf("got unexpected error, wanted %s, got %v", api.ErrCombinedEndpointUnsupported, err)
+		}
+	})
+}
+
+func TestTracePropagation(t *testing.T) {
+	var traceParent string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		traceParent = req.Header.Get("traceparent")
+		rw.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL: server.URL,
+		Client:  server.Client(),
+	}
+
+	tracer, err := tracing.New("http://127.0.0.1", "wg-manager", time.Second, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, _ := tracer.Start(context.Background(), "get_peers")
+
+	_, err = a.GetWireguardPeers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if traceParent == "" || traceParent != tracing.TraceParent(ctx) {
+		t.Errorf("got unexpected traceparent %q, wanted %q", traceParent, tracing.TraceParent(ctx))
+	}
+}
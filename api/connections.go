@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// ConnectionsFormat is the shape of the JSON body that connections are posted to the API in
+type ConnectionsFormat string
+
+// Formats of the connection report
+const (
+	// ConnectionsFormatMap posts an object of the number of connections keyed by public key
+	// {"connections": {"<pubkey>": 1}}
+	ConnectionsFormatMap ConnectionsFormat = "map"
+	// ConnectionsFormatKeys posts a sorted array of the connected public keys
+	// {"connections": ["<pubkey>"]}
+	ConnectionsFormatKeys ConnectionsFormat = "keys"
+	// ConnectionsFormatList posts a sorted array of objects with the public key and number of connections, along with the hostname
+	// {"hostname": "<hostname>", "connections": [{"pubkey": "<pubkey>", "connections": 1}]}
+	ConnectionsFormatList ConnectionsFormat = "list"
+)
+
+// ParseConnectionsFormat parses the name of a connections format, an empty name is ConnectionsFormatMap
+func ParseConnectionsFormat(name string) (ConnectionsFormat, error) {
+	switch f := ConnectionsFormat(name); f {
+	case "":
+		return ConnectionsFormatMap, nil
+	case ConnectionsFormatMap, ConnectionsFormatKeys, ConnectionsFormatList:
+		return f, nil
+	default:
+		return "", fmt.Errorf("invalid connections format %s", name)
+	}
+}
+
+type keyConnections struct {
+	Pubkey      string `json:"pubkey"`
+	Connections int    `json:"connections"`
+}
+
+// Marshal the connected keys in the configured format
+func (a *API) marshalConnections(keys ConnectedKeysMap) ([]byte, error) {
+	pubkeys := make([]string, 0, len(keys))
+	for pubkey := range keys {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	sort.Strings(pubkeys)
+
+	switch a.ConnectionsFormat {
+	case "", ConnectionsFormatMap:
+		return json.Marshal(map[string]ConnectedKeysMap{"connections": keys})
+	case ConnectionsFormatKeys:
+		return json.Marshal(map[string][]string{"connections": pubkeys})
+	case ConnectionsFormatList:
+		connections := make([]keyConnections, 0, len(pubkeys))
+		for _, pubkey := range pubkeys {
+			connections = append(connections, keyConnections{Pubkey: pubkey, Connections: keys[pubkey]})
+		}
+
+		return json.Marshal(struct {
+			Hostname    string           `json:"hostname"`
+			Connections []keyConnections `json:"connections"`
+		}{a.Hostname, connections})
+	default:
+		return nil, fmt.Errorf("invalid connections format %s", a.ConnectionsFormat)
+	}
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"reflect"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// MsgpackContentType is the media type of peer lists encoded as MessagePack, see API.Msgpack
+const MsgpackContentType = "application/msgpack"
+
+// Media types that are decoded as MessagePack, the unregistered x- type is still commonly used
+var msgpackContentTypes = map[string]bool{
+	MsgpackContentType:        true,
+	"application/x-msgpack":   true,
+	"application/vnd.msgpack": true,
+}
+
+// The max nesting depth of arrays and maps, as the decoder recurses into them when skipping unknown fields
+const maxMsgpackDepth = 32
+
+func init() {
+	// By default times can only be decoded from timestamps, in the local time zone
+	msgpack.Register(time.Time{}, nil, decodeMsgpackTime)
+}
+
+// Check whether the content type of a response is MessagePack
+func isMsgpack(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && msgpackContentTypes[mediaType]
+}
+
+// Decode a page of wireguard peers encoded as MessagePack
+// The page has the same structure and field names as the JSON one, and may also be a plain list of peers
+// Times may be given either as MessagePack timestamps or as RFC 3339 strings like in JSON
+func decodeMsgpackPeerPage(body []byte, strict bool) (wireguardPeerPage, error) {
+	var page wireguardPeerPage
+
+	err := checkMsgpack(body)
+	if err != nil {
+		return page, err
+	}
+
+	d := msgpack.NewDecoder(bytes.NewReader(body))
+	d.DisallowUnknownFields(strict)
+
+	code, err := d.PeekCode()
+	if err != nil {
+		return page, err
+	}
+
+	// Unpaginated responses are a plain list of peers
+	if isMsgpackArray(code) {
+		err = d.Decode(&page.Peers)
+	} else {
+		err = d.Decode(&page)
+	}
+
+	if err != nil {
+		return page, err
+	}
+
+	return page, nil
+}
+
+// Check that the data is a single MessagePack value, with arrays and maps nested no deeper than maxMsgpackDepth
+// This walks the data without recursing, so that deeply nested data can't exhaust the stack of the decoder
+func checkMsgpack(body []byte) error {
+	r := bytes.NewReader(body)
+	d := msgpack.NewDecoder(r)
+
+	// The number of values left in each of the enclosing arrays and maps
+	remaining := []int{1}
+	for len(remaining) > 0 {
+		if remaining[len(remaining)-1] == 0 {
+			remaining = remaining[:len(remaining)-1]
+			continue
+		}
+		remaining[len(remaining)-1]--
+
+		code, err := d.PeekCode()
+		if err != nil {
+			return err
+		}
+
+		var length int
+		switch {
+		case isMsgpackArray(code):
+			length, err = d.DecodeArrayLen()
+		case msgpcode.IsFixedMap(code) || code == msgpcode.Map16 || code == msgpcode.Map32:
+			length, err = d.DecodeMapLen()
+			length *= 2
+		default:
+			err = d.Skip()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if len(remaining) > maxMsgpackDepth {
+			return errors.New("msgpack data is nested too deeply")
+		}
+
+		remaining = append(remaining, length)
+	}
+
+	if r.Len() != 0 {
+		return errors.New("unexpected data after wireguard peers")
+	}
+
+	return nil
+}
+
+// Decode a time, given either as a MessagePack timestamp or an RFC 3339 string, in UTC like in JSON
+func decodeMsgpackTime(d *msgpack.Decoder, v reflect.Value) error {
+	code, err := d.PeekCode()
+	if err != nil {
+		return err
+	}
+
+	if code == msgpcode.Nil {
+		v.Set(reflect.ValueOf(time.Time{}))
+		return d.DecodeNil()
+	}
+
+	t, err := d.DecodeTime()
+	if err != nil {
+		return err
+	}
+
+	v.Set(reflect.ValueOf(t.UTC()))
+	return nil
+}
+
+func isMsgpackArray(code byte) bool {
+	return msgpcode.IsFixedArray(code) || code == msgpcode.Array16 || code == msgpcode.Array32
+}
@@ -0,0 +1,334 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// Encode a value decoded from JSON with UseNumber as MessagePack, along with timestamps and floats
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) {
+	writeLen := func(fix byte, fixMax int, b16 byte, b32 byte, n int) {
+		switch {
+		case n <= fixMax:
+			buf.WriteByte(fix | byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(b16)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(b32)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+	}
+
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			panic(err)
+		}
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	case int:
+		encodeMsgpack(buf, json.Number(fmt.Sprint(v)))
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, v)
+	case string:
+		writeLen(0xa0, 31, 0xda, 0xdb, len(v))
+		buf.WriteString(v)
+	case time.Time:
+		buf.Write([]byte{0xc7, 12, 0xff})
+		binary.Write(buf, binary.BigEndian, uint32(v.Nanosecond()))
+		binary.Write(buf, binary.BigEndian, v.Unix())
+	case []interface{}:
+		writeLen(0x90, 15, 0xdc, 0xdd, len(v))
+		for _, e := range v {
+			encodeMsgpack(buf, e)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		writeLen(0x80, 15, 0xde, 0xdf, len(v))
+		for _, k := range keys {
+			encodeMsgpack(buf, k)
+			encodeMsgpack(buf, v[k])
+		}
+	default:
+		panic(fmt.Sprintf("can't encode %T", v))
+	}
+}
+
+// Encode a value as JSON and MessagePack, with the same structure
+func encodeBoth(t testing.TB, v interface{}) (jsonBody []byte, msgpackBody []byte) {
+	t.Helper()
+
+	jsonBody, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonBody))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	encodeMsgpack(&buf, generic)
+	return jsonBody, buf.Bytes()
+}
+
+func largePeerFixture(count int) api.WireguardPeerList {
+	peers := make(api.WireguardPeerList, count)
+	for i := range peers {
+		expiresAt := time.Date(2030, 1, 1, 0, 0, i%60, 0, time.UTC)
+		peers[i] = api.WireguardPeer{
+			IPv4:           fmt.Sprintf("10.%d.%d.%d/32", i>>16&0xff, i>>8&0xff, i&0xff),
+			IPv6:           fmt.Sprintf("fc00:bbbb:bbbb:bb01::%x/128", i),
+			Ports:          []int{1024 + i%60000, 2048 + i%60000},
+			Pubkey:         base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%032d", i))),
+			ForwardTargets: []string{"10.64.0.1"},
+			ExpiresAt:      &expiresAt,
+		}
+	}
+
+	return peers
+}
+
+// Serve the given bodies, in MessagePack if the request accepts it
+func msgpackServer(jsonBody []byte, msgpackBody []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.Header.Get("Accept"), api.MsgpackContentType) {
+			rw.Header().Set("Content-Type", api.MsgpackContentType)
+			rw.Write(msgpackBody)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(jsonBody)
+	}))
+}
+
+func TestGetWireguardPeersMsgpack(t *testing.T) {
+	expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	peers := api.WireguardPeerList{
+		{
+			IPv4:           "10.99.0.1/32",
+			IPv6:           "fc00:bbbb:bbbb:bb01::1/128",
+			Ports:          []int{1234, 4321},
+			Pubkey:         strings.Repeat("a", 44),
+			DSCP:           -1,
+			ForwardTargets: []string{"10.64.0.1", "10.64.0.2"},
+			ForwardComment: "comment",
+			ForwardFamily:  api.FamilyIPv4,
+			ExcludeIPs:     []string{"10.99.0.0/24"},
+			Kind:           api.KindPeer,
+			DisableIPv6:    true,
+			AlertOnIdle:    true,
+			ExpiresAt:      &expiresAt,
+		},
+		{Pubkey: strings.Repeat("b", 44)},
+	}
+
+	page := map[string]interface{}{
+		"peers":         peers,
+		"next":          "",
+		"complete":      true,
+		"sync_interval": 30,
+	}
+
+	jsonBody, msgpackBody := encodeBoth(t, page)
+
+	for _, tc := range []struct {
+		name    string
+		msgpack bool
+	}{
+		{"msgpack", true},
+		{"json fallback", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := msgpackServer(jsonBody, msgpackBody)
+			defer server.Close()
+
+			a := api.API{
+				BaseURL:        server.URL,
+				Client:         server.Client(),
+				StrictDecoding: true,
+				Msgpack:        tc.msgpack,
+			}
+
+			result, err := a.GetWireguardPeers(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(result, peers) {
+				t.Errorf("got unexpected result, wanted %+v, got %+v", peers, result)
+			}
+
+			if a.SuggestedInterval() != 30*time.Second {
+				t.Errorf("got unexpected suggested interval %s", a.SuggestedInterval())
+			}
+		})
+	}
+}
+
+func TestGetWireguardPeersMsgpackTimestamp(t *testing.T) {
+	expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 5, time.UTC)
+
+	var body bytes.Buffer
+	encodeMsgpack(&body, []interface{}{
+		map[string]interface{}{
+			"pubkey":     "foo",
+			"expires_at": expiresAt,
+			"unexpected": []interface{}{1.5, map[string]interface{}{"nested": nil}},
+		},
+	})
+
+	server := msgpackServer(nil, body.Bytes())
+	defer server.Close()
+
+	a := api.API{
+		BaseURL: server.URL,
+		Client:  server.Client(),
+		Msgpack: true,
+	}
+
+	t.Run("lenient", func(t *testing.T) {
+		peers, err := a.GetWireguardPeers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := api.WireguardPeerList{{Pubkey: "foo", ExpiresAt: &expiresAt}}
+		if !reflect.DeepEqual(peers, expected) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", expected, peers)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		a.StrictDecoding = true
+
+		_, err := a.GetWireguardPeers(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "unexpected") {
+			t.Errorf("got unexpected error %v", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		server := msgpackServer(nil, body.Bytes()[:body.Len()-1])
+		defer server.Close()
+
+		a := api.API{
+			BaseURL: server.URL,
+			Client:  server.Client(),
+			Msgpack: true,
+		}
+
+		_, err := a.GetWireguardPeers(context.Background())
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("trailing data", func(t *testing.T) {
+		server := msgpackServer(nil, append(body.Bytes(), 0xc0))
+		defer server.Close()
+
+		a := api.API{
+			BaseURL: server.URL,
+			Client:  server.Client(),
+			Msgpack: true,
+		}
+
+		_, err := a.GetWireguardPeers(context.Background())
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("nested too deeply", func(t *testing.T) {
+		var nested interface{}
+		for i := 0; i < 100; i++ {
+			nested = []interface{}{nested}
+		}
+
+		var body bytes.Buffer
+		encodeMsgpack(&body, []interface{}{map[string]interface{}{"pubkey": "foo", "unexpected": nested}})
+
+		server := msgpackServer(nil, body.Bytes())
+		defer server.Close()
+
+		a := api.API{
+			BaseURL:        server.URL,
+			Client:         server.Client(),
+			Msgpack:        true,
+			StrictDecoding: true,
+		}
+
+		_, err := a.GetWireguardPeers(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+			t.Errorf("got unexpected error %v", err)
+		}
+	})
+}
+
+func BenchmarkGetWireguardPeers(b *testing.B) {
+	jsonBody, msgpackBody := encodeBoth(b, largePeerFixture(50000))
+
+	for _, bc := range []struct {
+		name    string
+		msgpack bool
+	}{
+		{"json", false},
+		{"msgpack", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			server := msgpackServer(jsonBody, msgpackBody)
+			defer server.Close()
+
+			a := api.API{
+				BaseURL: server.URL,
+				Client:  server.Client(),
+				Msgpack: bc.msgpack,
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, err := a.GetWireguardPeers(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mullvad/wg-manager/tracing"
+)
+
+// Retry configures how failed requests are retried
+// Requests are retried if they fail to get a response, or get a server error response
+type Retry struct {
+	// Attempts is the number of times to retry a failed request, it isn't retried if it's zero
+	Attempts int
+	// Backoff is how long to wait before the first retry, it's doubled for each following retry
+	Backoff time.Duration
+}
+
+// Send a request, retrying it according to the given settings
+// A new request is created for each attempt, as the body of a request can only be read once
+// Each attempt is limited to the timeout if it's non-zero, which includes reading the body of the response
+// An error is returned if the last attempt got a server error response
+func (a *API) do(ctx context.Context, retry Retry, timeout time.Duration, newRequest func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	backoff := retry.Backoff
+
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+
+		req, err := newRequest(attemptCtx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		response, err := a.Client.Do(req)
+		if err == nil {
+			// The timeout has to keep applying until the body is read, so it's canceled when the body is closed
+			response.Body = &cancelBody{response.Body, cancel}
+		} else {
+			cancel()
+		}
+
+		if err == nil && response.StatusCode < http.StatusInternalServerError {
+			// Correlate the span of the request with the API's logs of it
+			if requestID := response.Header.Get("X-Request-Id"); requestID != "" {
+				tracing.FromContext(ctx).SetAttribute("api.request_id", requestID)
+			}
+
+			return response, nil
+		}
+
+		// Give up, returning the error of the last attempt
+		if attempt >= retry.Attempts {
+			if err == nil {
+				response.Body.Close()
+				return nil, checkStatus(response)
+			}
+
+			return nil, err
+		}
+
+		if err == nil {
+			response.Body.Close()
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		backoff *= 2
+	}
+}
+
+// cancelBody cancels the context of a request when the body of its response is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -2,15 +2,22 @@ package subscriber
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/infosum/statsd"
 	"github.com/mullvad/wg-manager/api"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 // Subscriber is a utility for receiving wireguard key events from a message-queue server
@@ -18,18 +25,57 @@ type Subscriber struct {
 	Username string
 	Password string
 	BaseURL  string
+	// BaseURLs are message-queue servers to fail over between, they're used instead of BaseURL if set
+	// The servers are tried in order on every connection attempt, so that the first healthy one is preferred
+	BaseURLs []string
 	Channel  string
 	Metrics  *statsd.Client
+	Filter   FilterFunc
+	// Resolver is used to resolve the hostnames of the message-queue servers, the system resolver is used if it's nil
+	Resolver *net.Resolver
+	// TLSConfig is used for connections to the message-queue servers, the Go defaults are used if it's nil
+	TLSConfig *tls.Config
+	// ReconnectBackoff is the delay before reconnecting, defaultReconnectBackoff is used if it's zero
+	ReconnectBackoff time.Duration
+	// ReconnectMaxBackoff enables randomized reconnection delays, so that a fleet of subscribers spreads its reconnections
+	// The delay is random between zero and ReconnectBackoff doubled for every failed attempt, capped at ReconnectMaxBackoff
+	// The delay is always ReconnectBackoff if it's zero
+	ReconnectMaxBackoff time.Duration
+	// MaxReconnectFailures is the number of consecutive failed reconnection attempts after which the subscriber gives up,
+	// for the process to exit and be restarted fresh by its supervisor. It keeps reconnecting forever if it's zero
+	MaxReconnectFailures int
+	// GaveUp is called with an error wrapping ErrReconnectFailed once the subscriber gives up reconnecting
+	GaveUp func(err error)
+
+	activeURL string
+	// The sequence number of the last received event, to resume from after reconnecting
+	lastSequence uint64
+	// Whether a connection is currently established, read concurrently through Connected
+	connected int32
+	// Source of the reconnection jitter, seeded separately so that subscribers don't share a sequence
+	random *rand.Rand
 }
 
+// FilterFunc is called for every received event before it's emitted
+// It may return a modified event, and returns false if the event should be dropped
+type FilterFunc func(WireguardEvent) (WireguardEvent, bool)
+
 // WireguardEvent is a wireguard key event
 type WireguardEvent struct {
 	Action string            `json:"action"`
 	Peer   api.WireguardPeer `json:"peer"`
+	// Sequence is set by message-queue servers that support replaying events, and is zero otherwise
+	Sequence uint64 `json:"sequence,omitempty"`
 }
 
 const subProtocol = "message-queue-v1"
 
+// The delay before reconnecting if none is configured
+const defaultReconnectBackoff = time.Second
+
+// ErrReconnectFailed is wrapped by the error passed to GaveUp, once MaxReconnectFailures is reached
+var ErrReconnectFailed = errors.New("failed to reconnect to message-queue")
+
 // Subscribe establishes a websocket connection for a message-queue channel, and emits messages on the given channel
 func (s *Subscriber) Subscribe(ctx context.Context, channel chan<- WireguardEvent) error {
 	err := s.connect(ctx, channel)
@@ -42,56 +88,206 @@ func (s *Subscriber) Subscribe(ctx context.Context, channel chan<- WireguardEven
 }
 
 func (s *Subscriber) connect(ctx context.Context, channel chan<- WireguardEvent) error {
+	baseURLs := s.BaseURLs
+	if len(baseURLs) == 0 {
+		baseURLs = []string{s.BaseURL}
+	}
+
+	var err error
+	for _, baseURL := range baseURLs {
+		var conn *websocket.Conn
+		conn, err = s.dial(ctx, baseURL)
+		if err != nil {
+			log.Printf("error connecting to message-queue %s: %s", baseURL, err.Error())
+			continue
+		}
+
+		s.setActiveURL(baseURL)
+		atomic.StoreInt32(&s.connected, 1)
+		go s.read(ctx, channel, conn)
+
+		return nil
+	}
+
+	return err
+}
+
+// Connected checks whether a connection to a message-queue server is currently established
+// It's safe to call concurrently with the subscriber receiving events
+func (s *Subscriber) Connected() bool {
+	return atomic.LoadInt32(&s.connected) == 1
+}
+
+func (s *Subscriber) dial(ctx context.Context, baseURL string) (*websocket.Conn, error) {
 	header := http.Header{}
 
 	if s.Username != "" && s.Password != "" {
 		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(s.Username+":"+s.Password)))
 	}
 
-	conn, _, err := websocket.Dial(ctx, s.BaseURL+"/channel/"+s.Channel, &websocket.DialOptions{
+	// Ask for the events we missed while disconnected to be replayed, if the server supports it
+	channelURL := baseURL + "/channel/" + s.Channel
+	if s.lastSequence > 0 {
+		channelURL += "?from=" + strconv.FormatUint(s.lastSequence+1, 10)
+	}
+
+	options := &websocket.DialOptions{
 		Subprotocols: []string{subProtocol},
 		HTTPHeader:   header,
-	})
+	}
 
-	if err != nil {
-		return err
+	if s.Resolver != nil || s.TLSConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{
+			Resolver: s.Resolver,
+		}).DialContext
+		transport.TLSClientConfig = s.TLSConfig
+		options.HTTPClient = &http.Client{Transport: transport}
 	}
 
-	go s.read(ctx, channel, conn)
+	conn, _, err := websocket.Dial(ctx, channelURL, options)
 
-	return nil
+	return conn, err
+}
+
+// Report which message-queue server is active, by tagging a gauge with it
+func (s *Subscriber) setActiveURL(baseURL string) {
+	if s.activeURL != "" && s.activeURL != baseURL {
+		s.Metrics.Clone(statsd.Tags("endpoint", s.activeURL)).Gauge("websocket_endpoint_active", 0)
+	}
+
+	s.activeURL = baseURL
+	s.Metrics.Clone(statsd.Tags("endpoint", baseURL)).Gauge("websocket_endpoint_active", 1)
 }
 
 func (s *Subscriber) read(ctx context.Context, channel chan<- WireguardEvent, conn *websocket.Conn) {
 	for {
-		v := WireguardEvent{}
-		err := wsjson.Read(ctx, conn, &v)
+		_, payload, err := conn.Read(ctx)
 		if err != nil {
 			log.Println("error reading from websocket, reconnecting", err)
 			s.Metrics.Increment("websocket_error")
+			atomic.StoreInt32(&s.connected, 0)
 
 			// Make sure the connection is closed
 			conn.Close(websocket.StatusInternalError, "")
 
 			// Start attempting to reconnect
-			go s.reconnect(ctx, channel)
+			go s.reconnect(ctx, channel, 0)
 
 			return
 		}
 
+		// Skip malformed messages rather than reconnecting, as the server would send them again when replaying
+		v := WireguardEvent{}
+		err = json.Unmarshal(payload, &v)
+		if err != nil {
+			s.Metrics.Increment("mq_message_parse_error")
+			log.Printf("error parsing message-queue message %s, payload %q", err.Error(), truncatePayload(payload))
+			continue
+		}
+
+		s.Metrics.Clone(statsd.Tags("action", actionTag(v.Action))).Increment("mq_message_received")
+
+		if v.Sequence > 0 {
+			// Drop events that were already received, in case the server replays more than we asked for
+			if v.Sequence <= s.lastSequence {
+				s.Metrics.Increment("event_duplicate")
+				continue
+			}
+
+			s.lastSequence = v.Sequence
+		}
+
+		if s.Filter != nil {
+			var ok bool
+			v, ok = s.Filter(v)
+			if !ok {
+				s.Metrics.Increment("event_filtered")
+				continue
+			}
+		}
+
 		channel <- v
 	}
 }
 
-func (s *Subscriber) reconnect(ctx context.Context, channel chan<- WireguardEvent) {
-	// Sleep
-	time.Sleep(time.Second)
+// The actions of events, anything else is tagged as unknown to keep the number of tags bounded
+var knownActions = map[string]bool{
+	"ADD":          true,
+	"REMOVE":       true,
+	"UPDATE_PORTS": true,
+}
+
+func actionTag(action string) string {
+	if !knownActions[action] {
+		return "unknown"
+	}
+
+	return action
+}
+
+// The max number of bytes of a malformed payload to log
+const maxPayloadSample = 256
+
+func truncatePayload(payload []byte) []byte {
+	if len(payload) > maxPayloadSample {
+		return payload[:maxPayloadSample]
+	}
+
+	return payload
+}
+
+// ReconnectDelay returns the delay before the given reconnection attempt, counting from zero
+// It's random between zero and the backoff for the attempt if ReconnectMaxBackoff is set, see ReconnectMaxBackoff
+func (s *Subscriber) ReconnectDelay(attempt int) time.Duration {
+	backoff := s.ReconnectBackoff
+	if backoff <= 0 {
+		backoff = defaultReconnectBackoff
+	}
+
+	if s.ReconnectMaxBackoff <= 0 {
+		return backoff
+	}
+
+	// Double the backoff for every attempt, stopping at the cap so that it can't overflow
+	for i := 0; i < attempt && backoff < s.ReconnectMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > s.ReconnectMaxBackoff {
+		backoff = s.ReconnectMaxBackoff
+	}
+
+	if s.random == nil {
+		s.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	return time.Duration(s.random.Int63n(int64(backoff) + 1))
+}
+
+func (s *Subscriber) reconnect(ctx context.Context, channel chan<- WireguardEvent, attempt int) {
+	delay := s.ReconnectDelay(attempt)
+	log.Printf("reconnecting to message-queue in %s", delay)
+	s.Metrics.Timing("websocket_reconnect_delay", delay)
+	time.Sleep(delay)
 
 	// Attempt to create a new connection
 	err := s.connect(ctx, channel)
 	if err != nil {
 		s.Metrics.Increment("websocket_reconnect_error")
-		go s.reconnect(ctx, channel)
+
+		// Stop reconnecting once the limit is reached, unless we're shutting down anyway
+		failures := attempt + 1
+		if s.MaxReconnectFailures > 0 && failures >= s.MaxReconnectFailures && ctx.Err() == nil {
+			s.Metrics.Increment("websocket_reconnect_gave_up")
+			if s.GaveUp != nil {
+				s.GaveUp(fmt.Errorf("%w after %d attempts, last error %s", ErrReconnectFailed, failures, err.Error()))
+			}
+
+			return
+		}
+
+		go s.reconnect(ctx, channel, failures)
 	} else {
 		log.Println("successfully reconnected to websocket")
 		s.Metrics.Increment("websocket_reconnect_success")
@@ -2,11 +2,15 @@ package subscriber_test
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -80,11 +84,19 @@ func TestSubscriber(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if s.Connected() {
+		t.Fatal("connected before subscribing")
+	}
+
 	err = s.Subscribe(ctx, channel)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if !s.Connected() {
+		t.Fatal("not connected after subscribing")
+	}
+
 	// Try to recieve two messages
 	// This will also test the reconnection logic, as the mock server closes the connection after sending the message
 	for i := 0; i < 2; i++ {
@@ -94,3 +106,410 @@ func TestSubscriber(t *testing.T) {
 		}
 	}
 }
+
+func TestSubscriberParseError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		err = c.Write(ctx, websocket.MessageText, []byte("not an event"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = wsjson.Write(ctx, c, fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL: "ws://" + parsedURL.Host,
+		Channel: "test",
+		Metrics: metrics,
+	}
+
+	channel := make(chan subscriber.WireguardEvent)
+	defer close(channel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = s.Subscribe(ctx, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The malformed message is skipped, instead of being sent again after reconnecting
+	msg := <-channel
+	if !reflect.DeepEqual(msg, fixture) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+	}
+}
+
+func TestSubscriberFilter(t *testing.T) {
+	removeFixture := fixture
+	removeFixture.Action = "REMOVE"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		for _, event := range []subscriber.WireguardEvent{removeFixture, fixture} {
+			err = wsjson.Write(ctx, c, event)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL: "ws://" + parsedURL.Host,
+		Channel: "test",
+		Metrics: metrics,
+		// Suppress all remove events
+		Filter: func(event subscriber.WireguardEvent) (subscriber.WireguardEvent, bool) {
+			return event, event.Action != "REMOVE"
+		},
+	}
+
+	channel := make(chan subscriber.WireguardEvent)
+	defer close(channel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = s.Subscribe(ctx, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-channel
+	if !reflect.DeepEqual(msg, fixture) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+	}
+}
+
+func TestSubscriberFailover(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		err = wsjson.Write(ctx, c, fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	// A server which is down, to fail over from
+	downServer := httptest.NewServer(http.NotFoundHandler())
+	downServer.Close()
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURLs: []string{
+			"ws://" + strings.TrimPrefix(downServer.URL, "http://"),
+			"ws://" + strings.TrimPrefix(server.URL, "http://"),
+		},
+		Channel: "test",
+		Metrics: metrics,
+	}
+
+	channel := make(chan subscriber.WireguardEvent)
+	defer close(channel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = s.Subscribe(ctx, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-channel
+	if !reflect.DeepEqual(msg, fixture) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+	}
+}
+
+func TestSubscriberTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wsjson.Write(r.Context(), c, fixture)
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate of the test server is only trusted through the given config
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	for _, tc := range []struct {
+		name      string
+		tlsConfig *tls.Config
+		connected bool
+	}{
+		{"default", nil, false},
+		{"trusted", &tls.Config{RootCAs: roots}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := subscriber.Subscriber{
+				BaseURL:   "wss://" + strings.TrimPrefix(server.URL, "https://"),
+				Channel:   "test",
+				Metrics:   metrics,
+				TLSConfig: tc.tlsConfig,
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			err := s.Subscribe(ctx, make(chan subscriber.WireguardEvent, 2))
+			if tc.connected && err != nil {
+				t.Fatal(err)
+			}
+
+			if !tc.connected && err == nil {
+				t.Fatal("connected without trusting the certificate")
+			}
+		})
+	}
+}
+
+func TestSubscriberResume(t *testing.T) {
+	var connections int
+	froms := make(chan string, 2)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case froms <- r.URL.Query().Get("from"):
+		default:
+		}
+
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		// Replay the last event after reconnecting, which should be dropped as a duplicate
+		connections++
+		for i := connections; i < connections+2; i++ {
+			event := fixture
+			event.Sequence = uint64(i)
+
+			err = wsjson.Write(ctx, c, event)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL: "ws://" + strings.TrimPrefix(server.URL, "http://"),
+		Channel: "test",
+		Metrics: metrics,
+	}
+
+	channel := make(chan subscriber.WireguardEvent)
+	defer close(channel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = s.Subscribe(ctx, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		msg := <-channel
+		if msg.Sequence != uint64(i) {
+			t.Errorf("got unexpected sequence, wanted %d, got %d", i, msg.Sequence)
+		}
+	}
+
+	for _, expected := range []string{"", "3"} {
+		from := <-froms
+		if from != expected {
+			t.Errorf("got unexpected replay offset, wanted %q, got %q", expected, from)
+		}
+	}
+}
+
+func TestSubscriberGiveUp(t *testing.T) {
+	var connections int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only accept the first connection, so that every reconnection attempt fails
+		if atomic.AddInt32(&connections, 1) > 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		err = wsjson.Write(ctx, c, fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gaveUp := make(chan error, 1)
+	s := subscriber.Subscriber{
+		BaseURL:              "ws://" + strings.TrimPrefix(server.URL, "http://"),
+		Channel:              "test",
+		Metrics:              metrics,
+		ReconnectBackoff:     time.Millisecond,
+		MaxReconnectFailures: 3,
+		GaveUp: func(err error) {
+			gaveUp <- err
+		},
+	}
+
+	channel := make(chan subscriber.WireguardEvent)
+	defer close(channel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = s.Subscribe(ctx, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-channel
+
+	select {
+	case err := <-gaveUp:
+		if !errors.Is(err, subscriber.ErrReconnectFailed) {
+			t.Errorf("got unexpected error %v", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("the subscriber didn't give up")
+	}
+
+	// The first connection and the failed attempts, without any more after giving up
+	time.Sleep(time.Millisecond * 50)
+	if n := atomic.LoadInt32(&connections); n != 4 {
+		t.Errorf("got unexpected number of connections, wanted 4, got %d", n)
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	t.Run("fixed", func(t *testing.T) {
+		s := subscriber.Subscriber{}
+		for attempt := 0; attempt < 5; attempt++ {
+			if delay := s.ReconnectDelay(attempt); delay != time.Second {
+				t.Errorf("unexpected delay %s for attempt %d", delay, attempt)
+			}
+		}
+	})
+
+	t.Run("jitter", func(t *testing.T) {
+		s := subscriber.Subscriber{
+			ReconnectBackoff:    time.Second,
+			ReconnectMaxBackoff: time.Second * 10,
+		}
+
+		for attempt := 0; attempt < 10; attempt++ {
+			max := time.Second << attempt
+			if max > s.ReconnectMaxBackoff {
+				max = s.ReconnectMaxBackoff
+			}
+
+			distinct := make(map[time.Duration]bool)
+			for i := 0; i < 100; i++ {
+				delay := s.ReconnectDelay(attempt)
+				if delay < 0 || delay > max {
+					t.Fatalf("delay %s for attempt %d is outside of [0, %s]", delay, attempt, max)
+				}
+
+				distinct[delay] = true
+			}
+
+			if len(distinct) < 2 {
+				t.Errorf("delays for attempt %d aren't randomized", attempt)
+			}
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Logger is a utility for writing an append-only audit log of peer changes
+type Logger struct {
+	path  string
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// Entry is a single audit log entry
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Pubkey    string    `json:"pubkey"`
+	Interface string    `json:"interface,omitempty"`
+	Source    string    `json:"source"`
+}
+
+// New opens the audit log at the given path for appending, and returns a new Logger instance
+func New(path string) (*Logger, error) {
+	file, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Logger{
+		path: path,
+		file: file,
+	}, nil
+}
+
+func openFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+// Log writes an entry to the audit log, and flushes it to disk
+// The current time is used if the entry has no time set
+func (l *Logger) Log(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, err = l.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return l.file.Sync()
+}
+
+// Reopen closes and reopens the audit log, so that a log which has been rotated is written to the new file
+func (l *Logger) Reopen() error {
+	file, err := openFile(l.path)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.file.Close()
+	l.file = file
+	return nil
+}
+
+// Close closes the audit log
+func (l *Logger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.file.Close()
+}
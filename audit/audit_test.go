@@ -0,0 +1,97 @@
+package audit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/audit"
+)
+
+var fixture = audit.Entry{
+	Time:      time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC),
+	Action:    "ADD",
+	Pubkey:    strings.Repeat("a", 44),
+	Interface: "wg0",
+	Source:    "sync",
+}
+
+func TestLogger(t *testing.T) {
+	directory, err := ioutil.TempDir("", "wg-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "audit.log")
+
+	logger, err := audit.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	t.Run("log entry", func(t *testing.T) {
+		err := logger.Log(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries := readEntries(t, path)
+		if !reflect.DeepEqual(entries, []audit.Entry{fixture}) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", []audit.Entry{fixture}, entries)
+		}
+	})
+
+	t.Run("reopen after rotation", func(t *testing.T) {
+		err := os.Rename(path, path+".1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = logger.Reopen()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = logger.Log(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries := readEntries(t, path)
+		if !reflect.DeepEqual(entries, []audit.Entry{fixture}) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", []audit.Entry{fixture}, entries)
+		}
+	})
+}
+
+func readEntries(t *testing.T, path string) []audit.Entry {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var entries []audit.Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry audit.Entry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
@@ -0,0 +1,52 @@
+package breaker
+
+import (
+	"time"
+)
+
+// Breaker disables an operation after it fails a number of times in a row, and lets it be retried after a cooldown
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	failures  int
+	openUntil time.Time
+}
+
+// New returns a new Breaker instance, which opens after threshold failures in a row
+// The breaker never opens if the threshold is zero
+func New(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow checks whether the operation should be run
+// Once the cooldown has passed, the operation is allowed again to probe whether it has recovered
+func (b *Breaker) Allow(now time.Time) bool {
+	return !now.Before(b.openUntil)
+}
+
+// Open checks whether the breaker has disabled the operation, which stays true during a probe until it succeeds
+func (b *Breaker) Open() bool {
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+// Success records that the operation succeeded, closing the breaker
+func (b *Breaker) Success() {
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+// Failure records that the operation failed, and returns true if the breaker opened as a result
+// A failed probe opens the breaker again for another cooldown
+func (b *Breaker) Failure(now time.Time) bool {
+	b.failures++
+	if b.threshold < 1 || b.failures < b.threshold {
+		return false
+	}
+
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
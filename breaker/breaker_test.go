@@ -0,0 +1,66 @@
+package breaker_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/breaker"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := breaker.New(2, time.Minute)
+
+	if b.Failure(now) {
+		t.Fatal("opened before reaching the threshold")
+	}
+
+	if !b.Allow(now) || b.Open() {
+		t.Fatal("not allowed before reaching the threshold")
+	}
+
+	if !b.Failure(now) {
+		t.Fatal("didn't open after reaching the threshold")
+	}
+
+	if b.Allow(now.Add(time.Second)) || !b.Open() {
+		t.Fatal("allowed during the cooldown")
+	}
+
+	// Probe after the cooldown, failing opens it again
+	now = now.Add(time.Minute)
+	if !b.Allow(now) {
+		t.Fatal("not allowed after the cooldown")
+	}
+
+	if !b.Failure(now) {
+		t.Fatal("didn't open after a failed probe")
+	}
+
+	if b.Allow(now.Add(time.Second)) {
+		t.Fatal("allowed after a failed probe")
+	}
+
+	// Succeeding closes it
+	now = now.Add(time.Minute)
+	b.Success()
+
+	if !b.Allow(now) || b.Open() {
+		t.Fatal("not allowed after succeeding")
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	now := time.Now()
+	b := breaker.New(0, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		if b.Failure(now) {
+			t.Fatal("opened with a zero threshold")
+		}
+	}
+
+	if !b.Allow(now) || b.Open() {
+		t.Fatal("not allowed with a zero threshold")
+	}
+}
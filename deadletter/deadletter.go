@@ -0,0 +1,127 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mullvad/wg-manager/api/subscriber"
+)
+
+// Writer is a utility for writing events that failed to be applied to a dead-letter file, one JSON object per line
+// The file is rotated once it reaches the max size, keeping the previous file with a .1 suffix, so that at most two files are kept
+type Writer struct {
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+	mutex    sync.Mutex
+}
+
+// Entry is an event that failed to be applied, along with the error
+type Entry struct {
+	Time  time.Time                 `json:"time"`
+	Error string                    `json:"error"`
+	Event subscriber.WireguardEvent `json:"event"`
+}
+
+// New opens the dead-letter file at the given path for appending, and returns a new Writer instance
+// The file is never rotated if maxBytes is zero
+func New(path string, maxBytes int64) (*Writer, error) {
+	w := &Writer{
+		path:     path,
+		maxBytes: maxBytes,
+	}
+
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+// Write writes an entry to the dead-letter file, and flushes it to disk
+// The current time is used if the entry has no time set
+func (w *Writer) Write(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// Rotate before exceeding the max size, unless the file is empty so that an oversized entry is still written
+	if w.maxBytes > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxBytes {
+		err = w.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	return w.file.Sync()
+}
+
+// Replace the previous rotated file with the current one, and start a new one
+func (w *Writer) rotate() error {
+	w.file.Close()
+
+	err := os.Rename(w.path, w.path+".1")
+	if err != nil {
+		// Keep writing to the current file, rotating is attempted again by the next write
+		if openErr := w.open(); openErr != nil {
+			return openErr
+		}
+
+		return err
+	}
+
+	return w.open()
+}
+
+// Reopen closes and reopens the dead-letter file, so that a file which has been rotated externally is written to the new file
+func (w *Writer) Reopen() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.file.Close()
+	return w.open()
+}
+
+// Close closes the dead-letter file
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.file.Close()
+}
@@ -0,0 +1,125 @@
+package deadletter_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/api/subscriber"
+	"github.com/mullvad/wg-manager/deadletter"
+)
+
+var fixture = deadletter.Entry{
+	Time:  time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC),
+	Error: "error adding iptables rule: exit status 1",
+	Event: subscriber.WireguardEvent{
+		Action: "ADD",
+		Peer: api.WireguardPeer{
+			IPv4:   "10.99.0.1/32",
+			IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
+			Ports:  []int{1234},
+			Pubkey: strings.Repeat("a", 44),
+		},
+	},
+}
+
+func readEntries(t *testing.T, path string) []deadletter.Entry {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var entries []deadletter.Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry deadletter.Entry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func TestWriter(t *testing.T) {
+	directory, err := ioutil.TempDir("", "wg-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "dead-letter.jsonl")
+
+	line, err := json.Marshal(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Room for two entries in each file
+	w, err := deadletter.New(path, int64(len(line)+1)*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	t.Run("write entries", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			err := w.Write(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		entries := readEntries(t, path)
+		if !reflect.DeepEqual(entries, []deadletter.Entry{fixture, fixture}) {
+			t.Errorf("got unexpected entries %+v", entries)
+		}
+	})
+
+	t.Run("rotate when full", func(t *testing.T) {
+		err := w.Write(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if entries := readEntries(t, path); len(entries) != 1 {
+			t.Errorf("got unexpected number of entries %d in the current file", len(entries))
+		}
+
+		if entries := readEntries(t, path+".1"); len(entries) != 2 {
+			t.Errorf("got unexpected number of entries %d in the rotated file", len(entries))
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		err := os.Rename(path, path+".old")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = w.Reopen()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = w.Write(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if entries := readEntries(t, path); len(entries) != 1 {
+			t.Errorf("got unexpected number of entries %d after reopening", len(entries))
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package eventsocket
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/webhook"
+)
+
+// How long to wait for a client to accept an event before disconnecting it
+const writeTimeout = time.Second * 5
+
+// Socket is a utility for streaming peer change events to local consumers over a unix socket
+// Events are written as one JSON object per line
+type Socket struct {
+	listener  net.Listener
+	metrics   *statsd.Client
+	queueSize int
+
+	mutex   sync.Mutex
+	clients map[*client]struct{}
+}
+
+type client struct {
+	conn  net.Conn
+	queue chan []byte
+}
+
+// New listens on a unix socket at the given path, and returns a new Socket instance
+// Each client buffers up to queueSize events, after which events are dropped for that client
+func New(path string, queueSize int, metrics *statsd.Client) (*Socket, error) {
+	// Remove a socket left behind by a previous run
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, 0660)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &Socket{
+		listener:  listener,
+		metrics:   metrics,
+		queueSize: queueSize,
+		clients:   make(map[*client]struct{}),
+	}, nil
+}
+
+// Run accepts clients until the given context is canceled, after which the socket and all clients are closed
+func (s *Socket) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		for c := range s.clients {
+			s.removeClient(c)
+		}
+	}()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("error accepting event socket client %s", err.Error())
+			}
+
+			return
+		}
+
+		c := &client{
+			conn:  conn,
+			queue: make(chan []byte, s.queueSize),
+		}
+
+		s.mutex.Lock()
+		s.clients[c] = struct{}{}
+		s.mutex.Unlock()
+
+		go s.write(c)
+	}
+}
+
+// Publish queues an event for every connected client without blocking
+// The event is dropped for clients whose queue is full
+func (s *Socket) Publish(notification webhook.Notification) {
+	event, err := json.Marshal(notification)
+	if err != nil {
+		return
+	}
+	event = append(event, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for c := range s.clients {
+		select {
+		case c.queue <- event:
+		default:
+			s.metrics.Increment("event_socket_dropped")
+		}
+	}
+}
+
+// Write queued events to the client until it disconnects or is removed
+func (s *Socket) write(c *client) {
+	for event := range c.queue {
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+		_, err := c.conn.Write(event)
+		if err != nil {
+			s.mutex.Lock()
+			s.removeClient(c)
+			s.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// Remove a client, the mutex must be held
+func (s *Socket) removeClient(c *client) {
+	if _, ok := s.clients[c]; !ok {
+		return
+	}
+
+	delete(s.clients, c)
+	close(c.queue)
+	c.conn.Close()
+}
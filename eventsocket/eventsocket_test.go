@@ -0,0 +1,100 @@
+package eventsocket_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/eventsocket"
+	"github.com/mullvad/wg-manager/webhook"
+)
+
+var fixture = webhook.Notification{
+	Pubkey:    strings.Repeat("a", 44),
+	Action:    "ADD",
+	Interface: "wg0",
+}
+
+func TestSocket(t *testing.T) {
+	directory, err := ioutil.TempDir("", "wg-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(directory, "events.sock")
+	socket, err := eventsocket.New(path, 10, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go socket.Run(ctx)
+
+	// Connect multiple readers, which should all receive the event
+	var readers []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		readers = append(readers, bufio.NewReader(conn))
+	}
+
+	// Publish until the readers have been accepted, as accepting is asynchronous
+	received := make([]webhook.Notification, len(readers))
+	for i, reader := range readers {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			err = json.Unmarshal(line, &received[i])
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+
+		for {
+			socket.Publish(fixture)
+
+			select {
+			case <-done:
+			case <-time.After(time.Millisecond * 10):
+				continue
+			}
+
+			break
+		}
+	}
+
+	for _, notification := range received {
+		if !reflect.DeepEqual(notification, fixture) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, notification)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package expiry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// Tracker keeps track of peers with an expiry time, so that they can be removed once they expire
+type Tracker struct {
+	peers map[string]api.WireguardPeer
+	mutex sync.Mutex
+}
+
+// New returns a new Tracker instance
+func New() *Tracker {
+	return &Tracker{
+		peers: make(map[string]api.WireguardPeer),
+	}
+}
+
+// Set replaces the tracked peers with the peers in the given list that have an expiry time
+func (t *Tracker) Set(peers api.WireguardPeerList) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.peers = make(map[string]api.WireguardPeer)
+	for _, peer := range peers {
+		if peer.ExpiresAt != nil {
+			t.peers[peer.Pubkey] = peer
+		}
+	}
+}
+
+// Add starts tracking the given peer if it has an expiry time
+func (t *Tracker) Add(peer api.WireguardPeer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if peer.ExpiresAt == nil {
+		delete(t.peers, peer.Pubkey)
+		return
+	}
+
+	t.peers[peer.Pubkey] = peer
+}
+
+// Remove stops tracking the given peer
+func (t *Tracker) Remove(peer api.WireguardPeer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.peers, peer.Pubkey)
+}
+
+// Expired returns the tracked peers that have expired at the given time, and stops tracking them
+func (t *Tracker) Expired(now time.Time) (expired api.WireguardPeerList) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key, peer := range t.peers {
+		if peer.Expired(now) {
+			expired = append(expired, peer)
+			delete(t.peers, key)
+		}
+	}
+
+	return
+}
+
+// Filter splits the given peers into the ones that are still valid, and the ones that have expired at the given time
+func Filter(peers api.WireguardPeerList, now time.Time) (valid api.WireguardPeerList, expired api.WireguardPeerList) {
+	valid = make(api.WireguardPeerList, 0, len(peers))
+	for _, peer := range peers {
+		if peer.Expired(now) {
+			expired = append(expired, peer)
+		} else {
+			valid = append(valid, peer)
+		}
+	}
+
+	return
+}
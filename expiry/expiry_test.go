@@ -0,0 +1,77 @@
+package expiry_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/expiry"
+)
+
+var now = time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+
+var pastTime = now.Add(-time.Minute)
+var futureTime = now.Add(time.Minute)
+
+var expiredPeer = api.WireguardPeer{
+	IPv4:      "10.99.0.1/32",
+	IPv6:      "fc00:bbbb:bbbb:bb01::1/128",
+	Pubkey:    strings.Repeat("a", 44),
+	ExpiresAt: &pastTime,
+}
+
+var validPeer = api.WireguardPeer{
+	IPv4:      "10.99.0.2/32",
+	IPv6:      "fc00:bbbb:bbbb:bb01::2/128",
+	Pubkey:    strings.Repeat("b", 44),
+	ExpiresAt: &futureTime,
+}
+
+var permanentPeer = api.WireguardPeer{
+	IPv4:   "10.99.0.3/32",
+	IPv6:   "fc00:bbbb:bbbb:bb01::3/128",
+	Pubkey: strings.Repeat("c", 44),
+}
+
+func TestTracker(t *testing.T) {
+	tracker := expiry.New()
+	tracker.Set(api.WireguardPeerList{expiredPeer, validPeer, permanentPeer})
+
+	expired := tracker.Expired(now)
+	if !reflect.DeepEqual(expired, api.WireguardPeerList{expiredPeer}) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", api.WireguardPeerList{expiredPeer}, expired)
+	}
+
+	// Expired peers should only be returned once
+	expired = tracker.Expired(now)
+	if len(expired) != 0 {
+		t.Errorf("got unexpected result, wanted no peers, got %+v", expired)
+	}
+
+	expired = tracker.Expired(now.Add(time.Hour))
+	if !reflect.DeepEqual(expired, api.WireguardPeerList{validPeer}) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", api.WireguardPeerList{validPeer}, expired)
+	}
+
+	tracker.Add(expiredPeer)
+	tracker.Remove(expiredPeer)
+
+	expired = tracker.Expired(now)
+	if len(expired) != 0 {
+		t.Errorf("got unexpected result, wanted no peers, got %+v", expired)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	valid, expired := expiry.Filter(api.WireguardPeerList{expiredPeer, validPeer, permanentPeer}, now)
+
+	if !reflect.DeepEqual(valid, api.WireguardPeerList{validPeer, permanentPeer}) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", api.WireguardPeerList{validPeer, permanentPeer}, valid)
+	}
+
+	if !reflect.DeepEqual(expired, api.WireguardPeerList{expiredPeer}) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", api.WireguardPeerList{expiredPeer}, expired)
+	}
+}
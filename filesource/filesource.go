@@ -0,0 +1,130 @@
+package filesource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mullvad/wg-manager/api"
+)
+
+// Source is where a peer came from, used to choose between conflicting peers
+type Source string
+
+// Sources of peers
+const (
+	// SourceAPI is the peers fetched from the API
+	SourceAPI Source = "api"
+	// SourceFile is the peers read from the local file
+	SourceFile Source = "file"
+)
+
+// ParseSource parses the name of a source, an empty name is SourceAPI
+func ParseSource(name string) (Source, error) {
+	switch s := Source(name); s {
+	case "":
+		return SourceAPI, nil
+	case SourceAPI, SourceFile:
+		return s, nil
+	default:
+		return "", fmt.Errorf("invalid peer source %s", name)
+	}
+}
+
+// Read reads the peers from a JSON file, in the format returned by the API
+func Read(path string) (api.WireguardPeerList, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers api.WireguardPeerList
+	err = json.Unmarshal(contents, &peers)
+	if err != nil {
+		return nil, err
+	}
+
+	return peers, nil
+}
+
+// Merge combines the peers from the API with the peers from the file
+// Peers with the same public key in both are taken from the preferred source, and their public keys are returned as conflicts
+func Merge(apiPeers api.WireguardPeerList, filePeers api.WireguardPeerList, prefer Source) (merged api.WireguardPeerList, conflicts []string) {
+	fileKeys := make(map[string]bool, len(filePeers))
+	for _, peer := range filePeers {
+		fileKeys[peer.Pubkey] = true
+	}
+
+	apiKeys := make(map[string]bool, len(apiPeers))
+	merged = make(api.WireguardPeerList, 0, len(apiPeers)+len(filePeers))
+	for _, peer := range apiPeers {
+		apiKeys[peer.Pubkey] = true
+		if fileKeys[peer.Pubkey] {
+			conflicts = append(conflicts, peer.Pubkey)
+			if prefer == SourceFile {
+				continue
+			}
+		}
+
+		merged = append(merged, peer)
+	}
+
+	for _, peer := range filePeers {
+		if apiKeys[peer.Pubkey] && prefer != SourceFile {
+			continue
+		}
+
+		merged = append(merged, peer)
+	}
+
+	return merged, conflicts
+}
+
+// Watch calls changed whenever the file at the path is written, replaced or removed, until the context is done
+// The directory of the file is watched rather than the file itself, so that files renamed over it are noticed,
+// which is how most tools write files atomically
+func Watch(ctx context.Context, path string, changed func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error initializing file watcher: %w", err)
+	}
+
+	err = watcher.Add(filepath.Dir(path))
+	if err != nil {
+		watcher.Close()
+		return fmt.Errorf("error watching %s: %w", filepath.Dir(path), err)
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		path = filepath.Clean(path)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				// Changes of the permissions leave the contents as is
+				if filepath.Clean(event.Name) == path && event.Op != fsnotify.Chmod {
+					changed()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				log.Printf("error watching %s %s", path, err.Error())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package filesource_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/filesource"
+)
+
+const peersFixture = `[{"ipv4":"10.99.0.2/32","ipv6":"fc00:bbbb:bbbb:bb01::2/128","ports":[1234],"pubkey":"b"}]`
+
+func TestRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	err := ioutil.WriteFile(path, []byte(peersFixture), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := filesource.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := api.WireguardPeerList{{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::2/128", Ports: []int{1234}, Pubkey: "b"}}
+	if !reflect.DeepEqual(peers, expected) {
+		t.Errorf("got unexpected peers, wanted %+v, got %+v", expected, peers)
+	}
+
+	err = ioutil.WriteFile(path, []byte("["), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = filesource.Read(path)
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	apiPeers := api.WireguardPeerList{{Pubkey: "a", IPv4: "10.99.0.1/32"}, {Pubkey: "b", IPv4: "10.99.0.2/32"}}
+	filePeers := api.WireguardPeerList{{Pubkey: "b", IPv4: "10.99.1.2/32"}, {Pubkey: "c", IPv4: "10.99.1.3/32"}}
+
+	tests := []struct {
+		Prefer   filesource.Source
+		Expected api.WireguardPeerList
+	}{
+		{filesource.SourceAPI, api.WireguardPeerList{apiPeers[0], apiPeers[1], filePeers[1]}},
+		{filesource.SourceFile, api.WireguardPeerList{apiPeers[0], filePeers[0], filePeers[1]}},
+	}
+
+	for _, test := range tests {
+		merged, conflicts := filesource.Merge(apiPeers, filePeers, test.Prefer)
+		if !reflect.DeepEqual(merged, test.Expected) {
+			t.Errorf("got unexpected peers preferring %s, wanted %+v, got %+v", test.Prefer, test.Expected, merged)
+		}
+
+		if !reflect.DeepEqual(conflicts, []string{"b"}) {
+			t.Errorf("got unexpected conflicts %v", conflicts)
+		}
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	source, err := filesource.ParseSource("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if source != filesource.SourceAPI {
+		t.Errorf("got unexpected default source %s", source)
+	}
+
+	_, err = filesource.ParseSource("foo")
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "peers.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 10)
+	err := filesource.Watch(ctx, path, func() { changed <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectChange := func(t *testing.T) {
+		select {
+		case <-changed:
+		case <-time.After(time.Second * 5):
+			t.Fatal("no change noticed")
+		}
+
+		// Drain the notifications of the same change
+		time.Sleep(time.Millisecond * 50)
+		for len(changed) > 0 {
+			<-changed
+		}
+	}
+
+	t.Run("write", func(t *testing.T) {
+		err := ioutil.WriteFile(path, []byte(peersFixture), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectChange(t)
+	})
+
+	t.Run("atomic rename", func(t *testing.T) {
+		tmp := filepath.Join(dir, "peers.json.tmp")
+		err := ioutil.WriteFile(tmp, []byte(peersFixture), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Writing the temporary file isn't a change
+		time.Sleep(time.Millisecond * 50)
+		if len(changed) > 0 {
+			t.Fatal("change noticed for another file")
+		}
+
+		err = os.Rename(tmp, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectChange(t)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		err := os.Remove(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectChange(t)
+	})
+}
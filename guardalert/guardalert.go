@@ -0,0 +1,143 @@
+package guardalert
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/shell"
+	"github.com/mullvad/wg-manager/webhook"
+)
+
+// Guards that reject synchronizations, or peers of them
+const (
+	// GuardTooLarge rejects a list of peers larger than the max response size
+	GuardTooLarge = "too_large"
+	// GuardIncomplete rejects a list of peers that the API signals is incomplete
+	GuardIncomplete = "incomplete"
+	// GuardOverCapacity leaves out the peers above the max peers per interface
+	GuardOverCapacity = "over_capacity"
+)
+
+// Alert describes a guard tripping, it's posted to the url as JSON and passed to the command as environment variables
+type Alert struct {
+	Guard string `json:"guard"`
+	// OldCount is the number of peers of the last synchronization that passed the guard
+	OldCount int `json:"old_count"`
+	// NewCount is the number of peers of the rejected synchronization, or zero if it's unknown
+	NewCount int `json:"new_count"`
+	// Threshold is the limit that the guard enforces, in the unit of the guard, eg bytes for GuardTooLarge
+	Threshold int64     `json:"threshold"`
+	Detail    string    `json:"detail"`
+	Time      time.Time `json:"time"`
+}
+
+// Hook is a utility for alerting an external url or command when a guard trips
+// Each guard alerts once when it trips, and not again until it's been reset by a synchronization passing it
+type Hook struct {
+	url     string
+	command string
+	client  *http.Client
+	timeout time.Duration
+	metrics *statsd.Client
+	queue   chan Alert
+
+	tripped map[string]bool
+	mutex   sync.Mutex
+}
+
+// The max number of alerts to buffer, there are only a few guards which each alert once until they're reset
+const queueSize = 16
+
+// New returns a new Hook instance, which posts alerts to the url and runs the command with sh for them
+// Either may be empty, and both are abandoned if they take longer than the timeout
+func New(url string, command string, timeout time.Duration, metrics *statsd.Client) *Hook {
+	return &Hook{
+		url:     url,
+		command: command,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		timeout: timeout,
+		metrics: metrics,
+		queue:   make(chan Alert, queueSize),
+		tripped: make(map[string]bool),
+	}
+}
+
+// Trip queues an alert for delivery without blocking, unless the guard has already tripped since it was last reset
+// Returns whether the alert was queued, alerts are dropped if the queue is full
+func (h *Hook) Trip(alert Alert) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.tripped[alert.Guard] {
+		return false
+	}
+
+	if alert.Time.IsZero() {
+		alert.Time = time.Now()
+	}
+
+	select {
+	case h.queue <- alert:
+		h.tripped[alert.Guard] = true
+		return true
+	default:
+		h.metrics.Increment("guard_alert_dropped")
+		return false
+	}
+}
+
+// Reset marks the guard as passed, so that it alerts again the next time it trips
+func (h *Hook) Reset(guard string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.tripped, guard)
+}
+
+// Run delivers queued alerts until the given context is canceled
+func (h *Hook) Run(ctx context.Context) {
+	for {
+		select {
+		case alert := <-h.queue:
+			h.deliver(ctx, alert)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Deliver the alert to the url and the command, delivery is best-effort so errors are only logged
+func (h *Hook) deliver(ctx context.Context, alert Alert) {
+	if h.url != "" {
+		err := webhook.Post(ctx, h.client, h.url, alert)
+		if err != nil {
+			log.Printf("error posting %s guard alert %s", alert.Guard, err.Error())
+			h.metrics.Increment("guard_alert_error")
+		}
+	}
+
+	if h.command != "" {
+		err := shell.Run(ctx, h.command, alert.env(), h.timeout)
+		if err != nil {
+			log.Printf("error running %s guard alert command %s", alert.Guard, err.Error())
+			h.metrics.Increment("guard_alert_error")
+		}
+	}
+}
+
+func (a Alert) env() []string {
+	return []string{
+		"WG_GUARD=" + a.Guard,
+		"WG_OLD_COUNT=" + strconv.Itoa(a.OldCount),
+		"WG_NEW_COUNT=" + strconv.Itoa(a.NewCount),
+		"WG_THRESHOLD=" + strconv.FormatInt(a.Threshold, 10),
+		"WG_GUARD_DETAIL=" + a.Detail,
+	}
+}
@@ -0,0 +1,128 @@
+package guardalert_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/guardalert"
+)
+
+var fixture = guardalert.Alert{
+	Guard:     guardalert.GuardOverCapacity,
+	OldCount:  90,
+	NewCount:  120,
+	Threshold: 100,
+	Detail:    "20 peers left out",
+	Time:      time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC),
+}
+
+func TestHook(t *testing.T) {
+	received := make(chan guardalert.Alert, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var alert guardalert.Alert
+		err := json.NewDecoder(req.Body).Decode(&alert)
+		if err != nil {
+			t.Error(err)
+		}
+
+		received <- alert
+	}))
+	defer server.Close()
+
+	directory, err := ioutil.TempDir("", "wg-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	output := filepath.Join(directory, "alert")
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := guardalert.New(server.URL, "echo $WG_GUARD $WG_OLD_COUNT $WG_NEW_COUNT $WG_THRESHOLD > "+output, time.Second*5, metrics)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go h.Run(ctx)
+
+	if !h.Trip(fixture) {
+		t.Fatal("alert was dropped")
+	}
+
+	// The guard doesn't alert again until it's reset
+	if h.Trip(fixture) {
+		t.Fatal("alert was queued for a guard that already tripped")
+	}
+
+	select {
+	case alert := <-received:
+		if !reflect.DeepEqual(alert, fixture) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, alert)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for alert")
+	}
+
+	// The command runs after the alert is posted
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		contents, err := ioutil.ReadFile(output)
+		if err == nil && strings.TrimSpace(string(contents)) == "over_capacity 90 120 100" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected command output %q, %v", contents, err)
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	h.Reset(guardalert.GuardOverCapacity)
+	if !h.Trip(fixture) {
+		t.Fatal("alert was dropped after resetting the guard")
+	}
+
+	select {
+	case <-received:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for alert")
+	}
+}
+
+func TestHookQueueFull(t *testing.T) {
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Don't run the hook, so that the queue fills up
+	h := guardalert.New("http://127.0.0.1", "", time.Second, metrics)
+
+	queued := 0
+	for i := 0; i < 100; i++ {
+		alert := fixture
+		alert.Guard = strings.Repeat("a", i+1)
+		if h.Trip(alert) {
+			queued++
+		}
+	}
+
+	if queued == 0 || queued == 100 {
+		t.Fatalf("unexpected number of queued alerts %d", queued)
+	}
+}
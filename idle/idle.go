@@ -0,0 +1,147 @@
+package idle
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+)
+
+// Notification actions for peers becoming idle and active again
+const (
+	ActionIdle   = "IDLE"
+	ActionActive = "ACTIVE"
+)
+
+// Watcher keeps track of the peers flagged with AlertOnIdle, to alert when they haven't had a handshake for too long
+// Only flagged peers are tracked, to bound the number of per-peer metrics
+type Watcher struct {
+	threshold time.Duration
+	metrics   *statsd.Client
+
+	// When each peer last had a handshake, or started being tracked if it hasn't had one since
+	lastActive map[string]time.Time
+	idle       map[string]bool
+	mutex      sync.Mutex
+}
+
+// Transition is a tracked peer becoming idle or active again
+type Transition struct {
+	Pubkey string
+	Action string
+	// LastActive is when the peer last had a handshake, or started being tracked if it hasn't had one since
+	LastActive time.Time
+}
+
+// New returns a new Watcher instance, which considers peers idle when they haven't had a handshake within the threshold
+func New(threshold time.Duration, metrics *statsd.Client) *Watcher {
+	return &Watcher{
+		threshold:  threshold,
+		metrics:    metrics,
+		lastActive: make(map[string]time.Time),
+		idle:       make(map[string]bool),
+	}
+}
+
+// Set replaces the tracked peers with the flagged peers in the given list
+// Peers that were already tracked keep their state, so that they aren't alerted for again
+func (w *Watcher) Set(peers api.WireguardPeerList, now time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	lastActive := make(map[string]time.Time)
+	for _, peer := range peers {
+		if !peer.AlertOnIdle {
+			continue
+		}
+
+		if t, ok := w.lastActive[peer.Pubkey]; ok {
+			lastActive[peer.Pubkey] = t
+		} else {
+			lastActive[peer.Pubkey] = now
+		}
+	}
+
+	for pubkey := range w.idle {
+		if _, ok := lastActive[pubkey]; !ok {
+			delete(w.idle, pubkey)
+		}
+	}
+
+	w.lastActive = lastActive
+}
+
+// Add starts tracking the given peer if it's flagged, and stops tracking it otherwise
+func (w *Watcher) Add(peer api.WireguardPeer, now time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !peer.AlertOnIdle {
+		w.remove(peer.Pubkey)
+		return
+	}
+
+	if _, ok := w.lastActive[peer.Pubkey]; !ok {
+		w.lastActive[peer.Pubkey] = now
+	}
+}
+
+// Remove stops tracking the given peer
+func (w *Watcher) Remove(peer api.WireguardPeer) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.remove(peer.Pubkey)
+}
+
+func (w *Watcher) remove(pubkey string) {
+	delete(w.lastActive, pubkey)
+	delete(w.idle, pubkey)
+}
+
+// Check updates the tracked peers with their latest handshakes, keyed by public key, and returns the peers that became idle or active
+// A gauge of whether each tracked peer is idle is sent, tagged with the fingerprint of the peer
+func (w *Watcher) Check(handshakes map[string]time.Time, now time.Time) (transitions []Transition) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	pubkeys := make([]string, 0, len(w.lastActive))
+	for pubkey := range w.lastActive {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	sort.Strings(pubkeys)
+
+	for _, pubkey := range pubkeys {
+		if handshake := handshakes[pubkey]; handshake.After(w.lastActive[pubkey]) {
+			w.lastActive[pubkey] = handshake
+		}
+
+		idle := now.Sub(w.lastActive[pubkey]) > w.threshold
+		if idle != w.idle[pubkey] {
+			action := ActionActive
+			if idle {
+				action = ActionIdle
+			}
+
+			transitions = append(transitions, Transition{
+				Pubkey:     pubkey,
+				Action:     action,
+				LastActive: w.lastActive[pubkey],
+			})
+		}
+
+		gauge := 0
+		if idle {
+			w.idle[pubkey] = true
+			gauge = 1
+		} else {
+			delete(w.idle, pubkey)
+		}
+
+		w.metrics.Clone(statsd.Tags("peer", api.Fingerprint(pubkey))).Gauge("peer_idle", gauge)
+	}
+
+	return transitions
+}
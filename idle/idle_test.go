@@ -0,0 +1,86 @@
+package idle_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/idle"
+)
+
+var now = time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+
+var flaggedPeer = api.WireguardPeer{
+	IPv4:        "10.99.0.1/32",
+	IPv6:        "fc00:bbbb:bbbb:bb01::1/128",
+	Pubkey:      strings.Repeat("a", 44),
+	AlertOnIdle: true,
+}
+
+var unflaggedPeer = api.WireguardPeer{
+	IPv4:   "10.99.0.2/32",
+	IPv6:   "fc00:bbbb:bbbb:bb01::2/128",
+	Pubkey: strings.Repeat("b", 44),
+}
+
+func TestWatcher(t *testing.T) {
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := idle.New(time.Minute*5, metrics)
+	watcher.Set(api.WireguardPeerList{flaggedPeer, unflaggedPeer}, now)
+
+	// Peers aren't idle until the threshold has passed since they started being tracked
+	transitions := watcher.Check(nil, now.Add(time.Minute))
+	if len(transitions) != 0 {
+		t.Fatalf("got unexpected transitions %+v", transitions)
+	}
+
+	transitions = watcher.Check(nil, now.Add(time.Minute*6))
+	expected := []idle.Transition{{Pubkey: flaggedPeer.Pubkey, Action: idle.ActionIdle, LastActive: now}}
+	if !reflect.DeepEqual(transitions, expected) {
+		t.Fatalf("got unexpected transitions, wanted %+v, got %+v", expected, transitions)
+	}
+
+	// Idle peers should only be alerted for once
+	transitions = watcher.Check(nil, now.Add(time.Minute*7))
+	if len(transitions) != 0 {
+		t.Fatalf("got unexpected transitions %+v", transitions)
+	}
+
+	// Synchronizing shouldn't reset the state of tracked peers
+	watcher.Set(api.WireguardPeerList{flaggedPeer, unflaggedPeer}, now.Add(time.Minute*7))
+
+	handshake := now.Add(time.Minute * 8)
+	handshakes := map[string]time.Time{
+		flaggedPeer.Pubkey:   handshake,
+		unflaggedPeer.Pubkey: handshake,
+	}
+
+	transitions = watcher.Check(handshakes, now.Add(time.Minute*8))
+	expected = []idle.Transition{{Pubkey: flaggedPeer.Pubkey, Action: idle.ActionActive, LastActive: handshake}}
+	if !reflect.DeepEqual(transitions, expected) {
+		t.Fatalf("got unexpected transitions, wanted %+v, got %+v", expected, transitions)
+	}
+
+	watcher.Remove(flaggedPeer)
+
+	transitions = watcher.Check(nil, now.Add(time.Hour))
+	if len(transitions) != 0 {
+		t.Fatalf("got unexpected transitions %+v", transitions)
+	}
+
+	// Handshakes from before the peer was tracked don't count
+	watcher.Add(flaggedPeer, now.Add(time.Hour))
+
+	transitions = watcher.Check(handshakes, now.Add(time.Hour+time.Minute*6))
+	expected = []idle.Transition{{Pubkey: flaggedPeer.Pubkey, Action: idle.ActionIdle, LastActive: now.Add(time.Hour)}}
+	if !reflect.DeepEqual(transitions, expected) {
+		t.Fatalf("got unexpected transitions, wanted %+v, got %+v", expected, transitions)
+	}
+}
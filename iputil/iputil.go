@@ -1,8 +1,10 @@
 package iputil
 
 import (
+	"fmt"
 	"net"
 	"sort"
+	"strings"
 )
 
 // EqualIPNet checks whether two slices of IPNet are equal
@@ -15,6 +17,10 @@ func EqualIPNet(a []net.IPNet, b []net.IPNet) bool {
 		return false
 	}
 
+	// Sort copies, so that the slices can be shared between goroutines
+	a = append([]net.IPNet(nil), a...)
+	b = append([]net.IPNet(nil), b...)
+
 	sort.Slice(a, compareIPNet(a))
 	sort.Slice(b, compareIPNet(b))
 
@@ -32,3 +38,92 @@ func compareIPNet(ips []net.IPNet) func(i int, j int) bool {
 		return ips[i].String() < ips[j].String()
 	}
 }
+
+// ExcludeIPNet returns the networks covering the given network, except for the excluded networks
+// Excluded networks of a different address family than the network are ignored
+func ExcludeIPNet(network net.IPNet, exclude []net.IPNet) []net.IPNet {
+	networks := []net.IPNet{canonicalIPNet(network)}
+	for _, e := range exclude {
+		var remaining []net.IPNet
+		for _, n := range networks {
+			remaining = append(remaining, excludeIPNet(n, canonicalIPNet(e))...)
+		}
+
+		networks = remaining
+	}
+
+	return networks
+}
+
+// OverlapsIPNet checks whether the network overlaps any of the other networks
+func OverlapsIPNet(network net.IPNet, others []net.IPNet) bool {
+	network = canonicalIPNet(network)
+	_, bits := network.Mask.Size()
+
+	for _, o := range others {
+		o = canonicalIPNet(o)
+		if _, otherBits := o.Mask.Size(); otherBits != bits {
+			continue
+		}
+
+		if network.Contains(o.IP) || o.Contains(network.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseCIDRs parses a comma delimited list of networks in CIDR notation, eg '10.0.0.0/8,fd00::/8'
+func ParseCIDRs(s string) ([]net.IPNet, error) {
+	var networks []net.IPNet
+	if s == "" {
+		return networks, nil
+	}
+
+	for _, cidr := range strings.Split(s, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %s", cidr)
+		}
+
+		networks = append(networks, *network)
+	}
+
+	return networks, nil
+}
+
+// Remove the excluded network from the network, by splitting the network in halves until the halves don't overlap it
+func excludeIPNet(network net.IPNet, exclude net.IPNet) []net.IPNet {
+	ones, bits := network.Mask.Size()
+	excludeOnes, excludeBits := exclude.Mask.Size()
+
+	// The networks don't overlap
+	if bits != excludeBits || !(network.Contains(exclude.IP) || exclude.Contains(network.IP)) {
+		return []net.IPNet{network}
+	}
+
+	// The excluded network covers the whole network
+	if excludeOnes <= ones {
+		return nil
+	}
+
+	mask := net.CIDRMask(ones+1, bits)
+
+	highIP := make(net.IP, len(network.IP))
+	copy(highIP, network.IP)
+	highIP[ones/8] |= 0x80 >> uint(ones%8)
+
+	low := net.IPNet{IP: network.IP, Mask: mask}
+	high := net.IPNet{IP: highIP, Mask: mask}
+
+	return append(excludeIPNet(low, exclude), excludeIPNet(high, exclude)...)
+}
+
+// Mask the ip of the network, so that it's the first address of the network, of the same length as the mask
+func canonicalIPNet(network net.IPNet) net.IPNet {
+	return net.IPNet{
+		IP:   network.IP.Mask(network.Mask),
+		Mask: network.Mask,
+	}
+}
@@ -2,6 +2,7 @@ package iputil_test
 
 import (
 	"net"
+	"reflect"
 	"testing"
 
 	"github.com/mullvad/wg-manager/iputil"
@@ -51,3 +52,101 @@ func TestEqualIPNet(t *testing.T) {
 		}
 	}
 }
+
+func parseCIDRs(t *testing.T, cidrs ...string) []net.IPNet {
+	t.Helper()
+
+	var networks []net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		networks = append(networks, *network)
+	}
+
+	return networks
+}
+
+func TestExcludeIPNet(t *testing.T) {
+	tests := []struct {
+		Name           string
+		Network        string
+		Exclude        []string
+		ExpectedResult []string
+	}{
+		{"exclude /24 from /16", "10.0.0.0/16", []string{"10.0.5.0/24"}, []string{
+			"10.0.0.0/22",
+			"10.0.4.0/24",
+			"10.0.6.0/23",
+			"10.0.8.0/21",
+			"10.0.16.0/20",
+			"10.0.32.0/19",
+			"10.0.64.0/18",
+			"10.0.128.0/17",
+		}},
+		{"exclude multiple", "10.0.0.0/30", []string{"10.0.0.0/32", "10.0.0.3/32"}, []string{
+			"10.0.0.1/32",
+			"10.0.0.2/32",
+		}},
+		{"exclude ipv6", "fc00::/126", []string{"fc00::2/127"}, []string{
+			"fc00::/127",
+		}},
+		{"no overlap", "10.0.0.0/24", []string{"10.1.0.0/24"}, []string{"10.0.0.0/24"}},
+		{"different family", "10.0.0.0/24", []string{"fc00::/64"}, []string{"10.0.0.0/24"}},
+		{"exclude everything", "10.0.0.0/24", []string{"10.0.0.0/16"}, nil},
+	}
+
+	for _, test := range tests {
+		result := iputil.ExcludeIPNet(parseCIDRs(t, test.Network)[0], parseCIDRs(t, test.Exclude...))
+
+		var resultStrings []string
+		for _, network := range result {
+			resultStrings = append(resultStrings, network.String())
+		}
+
+		if !reflect.DeepEqual(resultStrings, test.ExpectedResult) {
+			t.Errorf("%s: got %v, expected %v", test.Name, resultStrings, test.ExpectedResult)
+		}
+	}
+}
+
+func TestOverlapsIPNet(t *testing.T) {
+	tests := []struct {
+		Name           string
+		Network        string
+		Others         []string
+		ExpectedResult bool
+	}{
+		{"inside", "10.0.5.1/32", []string{"10.0.0.0/16"}, true},
+		{"covering", "10.0.0.0/8", []string{"10.0.5.0/24"}, true},
+		{"ipv6", "fc00::1/128", []string{"fc00::/64"}, true},
+		{"no overlap", "10.0.0.0/24", []string{"10.1.0.0/24", "fc00::/64"}, false},
+		{"different family", "fc00::/64", []string{"0.0.0.0/0"}, false},
+		{"no others", "10.0.0.0/24", nil, false},
+	}
+
+	for _, test := range tests {
+		result := iputil.OverlapsIPNet(parseCIDRs(t, test.Network)[0], parseCIDRs(t, test.Others...))
+		if result != test.ExpectedResult {
+			t.Errorf("%s: got %v, expected %v", test.Name, result, test.ExpectedResult)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := iputil.ParseCIDRs("10.0.0.0/8, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(networks, parseCIDRs(t, "10.0.0.0/8", "fd00::/8")) {
+		t.Errorf("got unexpected networks %v", networks)
+	}
+
+	_, err = iputil.ParseCIDRs("10.0.0.0")
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
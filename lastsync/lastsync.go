@@ -0,0 +1,88 @@
+package lastsync
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mullvad/wg-manager/wireguard"
+)
+
+// Diff is what changed during a synchronization
+type Diff struct {
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration_ns"`
+	Added    []string      `json:"added"`
+	Removed  []string      `json:"removed"`
+	Modified []string      `json:"modified"`
+}
+
+// NewDiff returns the diff of a synchronization which started at the given time and made the given peer changes
+// Peers changed on several interfaces are only listed once
+func NewDiff(start time.Time, changes []wireguard.PeerChange) Diff {
+	actions := map[string]map[string]struct{}{
+		wireguard.ActionAdd:    make(map[string]struct{}),
+		wireguard.ActionRemove: make(map[string]struct{}),
+		wireguard.ActionUpdate: make(map[string]struct{}),
+	}
+
+	for _, change := range changes {
+		if pubkeys, ok := actions[change.Action]; ok {
+			pubkeys[change.Pubkey] = struct{}{}
+		}
+	}
+
+	return Diff{
+		Time:     start,
+		Duration: time.Since(start),
+		Added:    sortedKeys(actions[wireguard.ActionAdd]),
+		Removed:  sortedKeys(actions[wireguard.ActionRemove]),
+		Modified: sortedKeys(actions[wireguard.ActionUpdate]),
+	}
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Recorder keeps the diff of the most recent synchronization
+type Recorder struct {
+	diff  *Diff
+	mutex sync.Mutex
+}
+
+// Set replaces the diff of the most recent synchronization
+func (r *Recorder) Set(diff Diff) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.diff = &diff
+}
+
+// Get returns the diff of the most recent synchronization, or nil if there hasn't been one
+func (r *Recorder) Get() *Diff {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.diff
+}
+
+// ServeHTTP responds with the diff of the most recent synchronization as JSON
+func (r *Recorder) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	diff := r.Get()
+	if diff == nil {
+		http.Error(rw, "no synchronization has completed yet", http.StatusNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(diff)
+}
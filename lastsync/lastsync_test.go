@@ -0,0 +1,68 @@
+package lastsync_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/lastsync"
+	"github.com/mullvad/wg-manager/wireguard"
+)
+
+var changesFixture = []wireguard.PeerChange{
+	{Interface: "wg0", Pubkey: "b", Action: wireguard.ActionAdd},
+	{Interface: "wg1", Pubkey: "b", Action: wireguard.ActionAdd},
+	{Interface: "wg0", Pubkey: "a", Action: wireguard.ActionAdd},
+	{Interface: "wg0", Pubkey: "c", Action: wireguard.ActionRemove},
+	{Interface: "wg0", Pubkey: "d", Action: wireguard.ActionUpdate},
+}
+
+func TestNewDiff(t *testing.T) {
+	diff := lastsync.NewDiff(time.Now(), changesFixture)
+
+	if !reflect.DeepEqual(diff.Added, []string{"a", "b"}) {
+		t.Errorf("got unexpected added peers %v", diff.Added)
+	}
+
+	if !reflect.DeepEqual(diff.Removed, []string{"c"}) {
+		t.Errorf("got unexpected removed peers %v", diff.Removed)
+	}
+
+	if !reflect.DeepEqual(diff.Modified, []string{"d"}) {
+		t.Errorf("got unexpected modified peers %v", diff.Modified)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	var recorder lastsync.Recorder
+
+	t.Run("no synchronization", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		recorder.ServeHTTP(response, httptest.NewRequest("GET", "/last-sync", nil))
+
+		if response.Code != http.StatusNotFound {
+			t.Errorf("got unexpected status code %d", response.Code)
+		}
+	})
+
+	t.Run("serve diff", func(t *testing.T) {
+		diff := lastsync.NewDiff(time.Now(), changesFixture)
+		recorder.Set(diff)
+
+		response := httptest.NewRecorder()
+		recorder.ServeHTTP(response, httptest.NewRequest("GET", "/last-sync", nil))
+
+		var served lastsync.Diff
+		err := json.Unmarshal(response.Body.Bytes(), &served)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !served.Time.Equal(diff.Time) || !reflect.DeepEqual(served.Added, diff.Added) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", diff, served)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package leader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Lease is a file based leader lease, used to ensure that only one instance applies changes at a time
+// The lease is held by whichever instance last wrote it, until it expires
+type Lease struct {
+	path     string
+	id       string
+	duration time.Duration
+}
+
+type leaseFile struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// New returns a new Lease instance, identifying this instance with the given id
+func New(path string, id string, duration time.Duration) *Lease {
+	return &Lease{
+		path:     path,
+		id:       id,
+		duration: duration,
+	}
+}
+
+// Acquire tries to acquire or renew the lease, and returns whether this instance holds it
+func (l *Lease) Acquire(now time.Time) (bool, error) {
+	current, err := l.read()
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	// Someone else holds a valid lease
+	if err == nil && current.Holder != l.id && now.Before(current.Expires) {
+		return false, nil
+	}
+
+	err = l.write(leaseFile{
+		Holder:  l.id,
+		Expires: now.Add(l.duration),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// Read the lease back, in case another instance wrote it at the same time
+	current, err = l.read()
+	if err != nil {
+		return false, err
+	}
+
+	return current.Holder == l.id, nil
+}
+
+// Release gives up the lease if this instance holds it, so that another instance can take over immediately
+func (l *Lease) Release() error {
+	current, err := l.read()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if current.Holder != l.id {
+		return nil
+	}
+
+	return os.Remove(l.path)
+}
+
+func (l *Lease) read() (leaseFile, error) {
+	var lease leaseFile
+
+	contents, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return lease, err
+	}
+
+	err = json.Unmarshal(contents, &lease)
+	return lease, err
+}
+
+// Write the lease atomically, by writing it to a temporary file and renaming it
+func (l *Lease) write(lease leaseFile) error {
+	contents, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(l.path), filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(contents)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), l.path)
+}
@@ -0,0 +1,66 @@
+package leader_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/leader"
+)
+
+func TestLease(t *testing.T) {
+	directory, err := ioutil.TempDir("", "wg-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "leader")
+	now := time.Now()
+
+	active := leader.New(path, "active", time.Minute)
+	passive := leader.New(path, "passive", time.Minute)
+
+	tests := []struct {
+		Name           string
+		Lease          *leader.Lease
+		Time           time.Time
+		ExpectedResult bool
+	}{
+		{"acquire", active, now, true},
+		{"held by other", passive, now, false},
+		{"renew", active, now.Add(time.Second * 30), true},
+		{"held by other after renewal", passive, now.Add(time.Second * 60), false},
+		{"take over after expiry", passive, now.Add(time.Second * 91), true},
+		{"lost after expiry", active, now.Add(time.Second * 92), false},
+	}
+
+	for _, test := range tests {
+		leading, err := test.Lease.Acquire(test.Time)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Name, err)
+		}
+
+		if leading != test.ExpectedResult {
+			t.Errorf("%s: got %v, expected %v", test.Name, leading, test.ExpectedResult)
+		}
+	}
+
+	t.Run("release", func(t *testing.T) {
+		err := passive.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leading, err := active.Acquire(now.Add(time.Second * 93))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !leading {
+			t.Error("lease was not acquired after release")
+		}
+	})
+}
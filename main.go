@@ -2,13 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -18,36 +25,259 @@ import (
 	"github.com/jamiealquiza/envy"
 	"github.com/mullvad/wg-manager/api"
 	"github.com/mullvad/wg-manager/api/subscriber"
+	"github.com/mullvad/wg-manager/audit"
+	"github.com/mullvad/wg-manager/breaker"
+	"github.com/mullvad/wg-manager/deadletter"
+	"github.com/mullvad/wg-manager/eventsocket"
+	"github.com/mullvad/wg-manager/expiry"
+	"github.com/mullvad/wg-manager/filesource"
+	"github.com/mullvad/wg-manager/guardalert"
+	"github.com/mullvad/wg-manager/idle"
+	"github.com/mullvad/wg-manager/iputil"
+	"github.com/mullvad/wg-manager/lastsync"
+	"github.com/mullvad/wg-manager/leader"
+	"github.com/mullvad/wg-manager/peerdefaults"
+	"github.com/mullvad/wg-manager/peererrors"
+	"github.com/mullvad/wg-manager/peerhook"
+	"github.com/mullvad/wg-manager/pinned"
 	"github.com/mullvad/wg-manager/portforward"
+	"github.com/mullvad/wg-manager/postsync"
+	"github.com/mullvad/wg-manager/ratelog"
+	"github.com/mullvad/wg-manager/readiness"
+	"github.com/mullvad/wg-manager/sdnotify"
+	"github.com/mullvad/wg-manager/snapshot"
+	"github.com/mullvad/wg-manager/tlsconfig"
+	"github.com/mullvad/wg-manager/tracing"
+	"github.com/mullvad/wg-manager/webhook"
 	"github.com/mullvad/wg-manager/wireguard"
 )
 
 var (
-	a          *api.API
-	wg         *wireguard.Wireguard
-	pf         *portforward.Portforward
-	metrics    *statsd.Client
-	appVersion string // Populated during build time
+	a           *api.API
+	wg          *wireguard.Wireguard
+	pf          *portforward.Portforward
+	metrics     *statsd.Client
+	hook        *webhook.Webhook
+	events      *eventsocket.Socket
+	postSync    *postsync.Command
+	guardAlerts *guardalert.Hook
+	peerHook    *peerhook.Hook
+	auditLog    *audit.Logger
+	deadLetters *deadletter.Writer
+	expiries    = expiry.New()
+	pins        *pinned.List
+	peerErrors  = peererrors.New(peerErrorsCapacity)
+	lastSync    lastsync.Recorder
+	lease       *leader.Lease
+	leading     = true
+	warmPeers   api.WireguardPeerList // Peers fetched while on standby, applied when promoted
+	syncTimeout time.Duration
+	appVersion  string // Populated during build time
+
+	// Whether the peers have to be applied again even if the API responds that they're not modified,
+	// as something else that they depend on changed, or applying them last time failed
+	reapplyPeers = true
+
+	// Admin actions and background synchronizations that change state are run on the main loop, so that they don't race with it
+	adminActions = make(chan func())
+
+	// Whether to measure the bytes allocated by synchronizations, see measureAllocations
+	allocationMetrics bool
+
+	// Disables portforwarding during synchronizations after repeated failures, so that the peers are still synchronized quickly
+	portforwardBreaker *breaker.Breaker
+
+	// Path of the snapshot of the last synchronized peers, loaded if the API is unreachable at startup
+	peerSnapshotPath string
+
+	// Whether to post the connections and fetch the peers in one request, along with the connections to post with the next one
+	combinedEndpoint   bool
+	pendingConnections api.ConnectedKeysMap
+
+	// Alerts when flagged peers haven't had a handshake for too long, nil if disabled
+	idlePeers *idle.Watcher
+
+	// Pinned peers missing from the API are pruned once idle for the threshold, while there are more peers than the watermark
+	pruneWatermark     int
+	pruneIdleThreshold time.Duration
+
+	// Exports spans of synchronizations and events, nil if tracing is disabled
+	tracer *tracing.Tracer
+
+	interfacesFile string
+	privateKeys    *wireguard.FileKeyProvider
+
+	readyCheck *readiness.Check
+
+	reportEndpoints  bool
+	reportRejections bool
+
+	forwardedPeers api.WireguardPeerList // Peers of the last synchronization, to add their portforwarding back if it's flushed
+
+	deltaConnections     bool
+	deltaConnectionsFull int
+	reportedConnections  api.ConnectedKeysMap // Connections of the last report, which deltas are relative to
+	deltaReports         int                  // Deltas posted since the last full report
+
+	// Whether reconciliation is paused, to freeze the current state during incidents, see setPaused
+	paused bool
+
+	// Locally managed peers merged with the peers from the API, see reconcileFilePeers
+	peersFilePath   string
+	filePeers       api.WireguardPeerList
+	preferredSource filesource.Source
+
+	// Values to fill in for the fields that peers leave unset, applied to the peers from every source
+	peerDefaults peerdefaults.Defaults
+
+	// The counts that guard alerts are relative to, see tripGuard
+	fetchedCount         int // Peers of the last list fetched from the API
+	maxPeersPerInterface int
+)
+
+// The max number of peers to keep the last error of
+const peerErrorsCapacity = 1000
+
+// The reasons a synchronization is skipped for, reported as the reason tag of sync_skipped
+const (
+	skipReasonAPIError           = "api_error"
+	skipReasonIncomplete         = "incomplete"
+	skipReasonTooLarge           = "too_large"
+	skipReasonReportError        = "report_error"
+	skipReasonWatchdog           = "watchdog"
+	skipReasonInitialSyncPending = "initial_sync_pending"
+	skipReasonPaused             = "paused"
 )
 
 func main() {
+	// Exit with a failure status if shutting down due to an error, once everything has been cleaned up by the deferred calls
+	var exitCode int
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	// Set up commandline flags
 	interval := flag.Duration("interval", time.Minute, "how often wireguard peers will be synchronized with the api")
 	delay := flag.Duration("delay", time.Second*45, "max random delay for the synchronization")
+	minInterval := flag.Duration("min-interval", 0, "min interval to use when following the sync interval suggested by the API")
+	maxInterval := flag.Duration("max-interval", 0, "max interval to use when following the sync interval suggested by the API. Suggestions are ignored if set to 0")
+	flag.BoolVar(&allocationMetrics, "allocation-metrics", false, "send metrics of the bytes allocated while fetching and updating peers. Reading the memory statistics briefly pauses the process")
+	flag.DurationVar(&syncTimeout, "sync-timeout", time.Minute*2, "max duration for a synchronization, after which it's aborted")
+	idleAlertThreshold := flag.Duration("idle-alert-threshold", 0, "how long a peer flagged with alert_on_idle may go without a handshake before an alert is sent. Alerting is disabled if set to 0")
+	idleAlertInterval := flag.Duration("idle-alert-interval", time.Minute, "how often to check the handshakes of peers flagged with alert_on_idle")
+	asyncInitialSync := flag.Bool("async-initial-sync", false, "run the initial synchronization in the background, so that events are handled while the peers are fetched. Readiness is only notified once it finishes")
+	expiryInterval := flag.Duration("expiry-interval", time.Second*10, "how often to check for and remove peers whose expiry time has passed")
 	apiTimeout := flag.Duration("api-timeout", time.Second*30, "max duration for API requests")
+	apiGetTimeout := flag.Duration("api-get-timeout", 0, "max duration for each attempt of fetching the peers from the API. The api-timeout is used if set to 0")
+	apiPostTimeout := flag.Duration("api-post-timeout", 0, "max duration for each attempt of posting the connections to the API. The api-timeout is used if set to 0")
+	apiDialTimeout := flag.Duration("api-dial-timeout", time.Second*30, "max duration for establishing connections to the API")
+	apiKeepAlive := flag.Duration("api-keepalive", time.Second*30, "interval between TCP keepalive probes on connections to the API")
+	apiIdleConnTimeout := flag.Duration("api-idle-conn-timeout", time.Second*90, "how long idle connections to the API are kept open for reuse")
+	apiMaxIdleConns := flag.Int("api-max-idle-conns", 100, "max number of idle connections to the API to keep open for reuse")
+	apiGetRetries := flag.Int("api-get-retries", 3, "number of times to retry failed requests for fetching peers from the API")
+	apiGetRetryBackoff := flag.Duration("api-get-retry-backoff", time.Second, "delay before the first retry of fetching peers from the API, doubled for each following retry")
+	apiPostRetries := flag.Int("api-post-retries", 0, "number of times to retry failed requests for posting connections to the API")
+	apiPostRetryBackoff := flag.Duration("api-post-retry-backoff", time.Millisecond*500, "delay before the first retry of posting connections to the API, doubled for each following retry")
+	maxResponseBytes := flag.Int64("max-response-bytes", 64<<20, "max size of API responses, larger responses are treated as errors")
+	flag.BoolVar(&combinedEndpoint, "combined-endpoint", false, "post the connections of the previous synchronization and fetch the peers in one request, instead of in two. Falls back to two requests if the API doesn't support it")
+	flag.BoolVar(&reportRejections, "report-rejections", false, "post the peers that weren't applied to the API after each synchronization, along with why, such as being invalid or over the max peers of an interface")
+	flag.BoolVar(&reportEndpoints, "report-endpoints", false, "post the remote endpoints of connected peers to the API after each synchronization. The endpoints are the ip addresses of the clients, only enable this where reporting them is permitted")
+	flag.BoolVar(&deltaConnections, "delta-connections", false, "post only the changes in connected keys since the previous report, instead of every connected key. Not used with the combined endpoint")
+	flag.IntVar(&deltaConnectionsFull, "delta-connections-full-every", 10, "number of change reports between full reports of the connected keys, for the API to reconcile with")
+	connectionsFormat := flag.String("connections-format", "map", "format of the connection report posted to the API: map for an object of connections keyed by public key, keys for an array of the connected public keys, or list for an array of objects with the public key and connections along with the hostname")
+	msgpack := flag.Bool("api-msgpack", false, "request the peers from the API encoded as MessagePack, which is faster to decode than JSON for large lists. JSON responses are still accepted from APIs that don't support it")
+	conditionalRequests := flag.Bool("conditional-requests", false, "send the ETag and Last-Modified of the last list of peers when fetching them, skipping applying the peers and only posting the connections if the API responds that they're not modified. Only applies to unpaginated lists and when not using the combined sync endpoint")
+	validateSchema := flag.Bool("validate-schema", false, "reject API responses with unknown fields, to detect changes to the API schema")
 	url := flag.String("url", "https://example.com", "api url")
 	username := flag.String("username", "", "api username")
 	password := flag.String("password", "", "api password")
 	hostname := flag.String("hostname", "", "server hostname")
 	interfaces := flag.String("interfaces", "wg0", "wireguard interfaces to configure. Pass a comma delimited list to configure multiple interfaces, eg 'wg0,wg1,wg2'")
+	flag.StringVar(&interfacesFile, "interfaces-file", "", "path to a file with one wireguard interface per line to configure, instead of the interfaces flag. Reloaded on SIGHUP, adding and removing interfaces without a restart")
+	rejectUserspace := flag.Bool("reject-userspace-wireguard", false, "refuse wireguard interfaces using a userspace implementation, such as wireguard-go or boringtun, instead of configuring them like kernel interfaces")
+	parallelInterfaces := flag.Bool("parallel-interfaces", false, "update the peers of all wireguard interfaces concurrently, instead of one at a time")
+	rejectDuplicatePubkeys := flag.Bool("reject-duplicate-pubkeys", false, "leave out peers whose public key appears more than once in the peers from the API, instead of applying the first record")
+	deniedIPs := flag.String("denied-ips", "", "comma delimited list of networks that peers may not have allowed ips in, eg the management network of the server. Peers with allowed ips in them are left out. No networks are denied if empty")
+	flag.IntVar(&maxPeersPerInterface, "max-peers-per-interface", 0, "max number of peers to configure on each wireguard interface, leaving out the peers with the highest public keys. Unlimited if set to 0")
+	replacePeers := flag.Bool("replace-peers", false, "replace every peer of an interface in a single configuration when a synchronization changes its peers, instead of only changing the peers that differ. This drops the sessions of every peer, which then have to handshake again")
+	connectedCriteria := flag.String("connected-criteria", "handshake-recent", "which peers to report to the API as connected: handshake-recent for a handshake within the last 3 minutes, transfer for any data transferred, or any for any handshake. The handshake and transfer of a peer are reset after 3 minutes of inactivity")
+	missingInterface := flag.String("missing-interface", "error", "what to do with a wireguard interface that disappears while running: error to log an error on every synchronization until it reappears, skip to leave it out until it reappears, or recreate to create it again and apply its private key")
+	expectedPublicKeys := flag.String("expected-public-keys", "", "comma delimited list of wireguard interfaces and the public keys they must have, eg 'wg0=<key>,wg1=<key>'. Startup fails if an interface has a different public key, interfaces that aren't listed aren't checked")
+	privateKeyDir := flag.String("private-key-dir", "", "directory containing a private key file named <interface>.key for each wireguard interface. Reloaded on SIGHUP. The private keys are left untouched if empty")
+	pinnedPubkeysFile := flag.String("pinned-pubkeys-file", "", "path to a file with one public key per line of peers that are kept even if the API omits them. Reloaded on SIGHUP")
+	flag.IntVar(&pruneWatermark, "prune-watermark", 0, "number of peers above which pinned peers missing from the API are removed once idle, to reclaim capacity. They're never removed if set to 0")
+	flag.DurationVar(&pruneIdleThreshold, "prune-idle-threshold", time.Hour, "how long a pinned peer missing from the API must go without a handshake to be removed when above the prune watermark")
 	portForwardingChainPrefix := flag.String("portforwarding-chain-prefix", "PORTFORWARDING", "iptables chain prefix to use for portforwarding")
+	portForwardingInterfaceChains := flag.String("portforwarding-interface-chains", "", "comma delimited list of forward interfaces that get portforwarding chains of their own, named <prefix>_<INTERFACE>_TCP and <prefix>_<INTERFACE>_UDP, for the peers forwarding on them. All peers use the chains of the prefix if empty")
 	portForwardingIpsetIPv4 := flag.String("portforwarding-ipset-ipv4", "PORTFORWARDING_IPV4", "ipset table to use for portforwarding for ipv4 addresses.")
 	portForwardingIpsetIPv6 := flag.String("portforwarding-ipset-ipv6", "PORTFORWARDING_IPV6", "ipset table to use for portforwarding for ipv6 addresses.")
+	portForwardingIngressAddresses := flag.String("ingress-addresses", "", "comma delimited list of the public addresses of the server that forwarded traffic arrives on, eg '192.0.2.1,2001:db8::1'")
+	portForwardingPopulateIPSets := flag.Bool("populate-ipsets", false, "fill the portforwarding ipsets with the ingress addresses")
+	portForwardingIPSetOrphanInterval := flag.Duration("ipset-orphan-interval", 0, "how often to remove addresses that aren't ingress addresses from the portforwarding ipsets, when populating them. Addresses are never removed if set to 0")
+	portForwardingMatchAllowedIPs := flag.Bool("portforwarding-match-allowed-ips", false, "match forwarded traffic by the ingress addresses instead of by the portforwarding ipsets, which aren't used at all, and forward it to the allowed ip's of the peers")
+	portForwardingCreateIPSets := flag.Bool("create-ipsets", false, "create the portforwarding ipsets if they don't exist")
+	portForwardingDSCPChainPrefix := flag.String("portforwarding-dscp-chain-prefix", "", "iptables mangle chain prefix to use for DSCP marking of forwarded traffic. DSCP marking is disabled if empty")
+	portForwardingTable := flag.String("portforwarding-table", "nat", "iptables table containing the portforwarding chains")
+	portForwardingLoadBalance := flag.Bool("portforwarding-load-balance", false, "distribute forwarded connections over the forward targets of peers, instead of forwarding to the peer ip")
+	portForwardingFlushConntrack := flag.Bool("flush-conntrack", false, "remove the conntrack entries of forwarded connections when a peer is removed")
+	portForwardingRulePosition := flag.Int("portforwarding-rule-position", 1, "position in the portforwarding chains to insert rules at. Rules are appended to the chains if set to 0")
+	portForwardingRuleCacheSyncs := flag.Int("portforwarding-rule-cache-syncs", 0, "cache the portforwarding rules, and only list them every n synchronizations to detect changes made outside of wg-manager. The rules are listed for every change if set to 0")
+	portForwardingSharedChains := flag.Bool("portforwarding-shared-chains", false, "only remove portforwarding rules added by wg-manager, for chains that are shared with other tools")
+	portForwardingAllowedPorts := flag.String("portforwarding-allowed-ports", "", "comma delimited list of ports and port ranges that peers may have forwarded, eg '1024-65535'. Other ports are rejected. All ports are allowed if empty")
+	portForwardingMaxPortsPerPeer := flag.Int("portforwarding-max-ports-per-peer", 0, "max number of ports to forward for a single peer, keeping the lowest-numbered ports. Unlimited if set to 0")
+	portForwardingFlushCheckInterval := flag.Duration("portforwarding-flush-check-interval", 0, "how often to check whether the portforwarding chains were flushed by another tool, adding the rules back immediately if they were. Never checked if set to 0")
+	portForwardingFailureThreshold := flag.Int("portforwarding-failure-threshold", 0, "number of synchronizations in a row with portforwarding errors after which portforwarding is skipped for the cooldown. Portforwarding is never skipped if set to 0")
+	portForwardingCooldown := flag.Duration("portforwarding-cooldown", time.Minute*5, "how long to skip portforwarding for after repeated failures, before trying it again")
+	printForwarding := flag.Bool("print-forwarding", false, "print the portforwarding rules for the peers in the peers file in the format of iptables-save and exit, without changing the system")
+	flag.StringVar(&peersFilePath, "peers-file", "", "path to a JSON file of locally managed peers in the format returned by the API. They're merged with the peers from the API, and applied whenever the file changes. Also the peers to print the portforwarding rules for. Disabled if empty")
+	peerDefaultsFile := flag.String("peer-defaults-file", "", "path to a JSON file of values to use for the fields that peers leave unset, in the format returned by the API. Environment variables in it are expanded. Disabled if empty")
+	peersFilePrefer := flag.String("peers-file-prefer", "api", "source to take a peer from when the API and the peers file both have its public key, either api or file")
+	portForwardingParallelFamilies := flag.Bool("forwarding-parallel-families", false, "apply the IPv4 and IPv6 portforwarding rules of a synchronization concurrently, instead of one family after the other")
+	portForwardingInstallRate := flag.Int("forwarding-install-rate", 0, "max number of portforwarding rules per second to add until they've been applied once, to pace the initial apply on a cold start. Following updates aren't paced. Unlimited if set to 0")
+	iptablesTimeout := flag.Duration("iptables-timeout", time.Second*30, "max duration for iptables operations, after which they're abandoned. Operations never time out if set to 0")
 	statsdAddress := flag.String("statsd-address", "127.0.0.1:8125", "statsd address to send metrics to")
-	mqURL := flag.String("mq-url", "wss://example.com/mq", "message-queue url")
+	statsdPrefix := flag.String("statsd-prefix", "wireguard", "prefix of the statsd metric names")
+	statsdTags := flag.String("statsd-tags", "", "static tags to attach to all metrics. Pass a comma delimited list of key:value pairs, eg 'env:prod,region:se'")
+	otlpURL := flag.String("otlp-url", "", "url of an OpenTelemetry collector to export traces of synchronizations and events to using OTLP over HTTP, eg 'http://127.0.0.1:4318/v1/traces'. Tracing is disabled if empty")
+	otlpTimeout := flag.Duration("otlp-timeout", time.Second*5, "max duration for exporting traces")
+	otlpQueueSize := flag.Int("otlp-queue-size", 1000, "max number of finished spans to buffer for exporting before dropping them")
+	mqReconnectBackoff := flag.Duration("mq-reconnect-backoff", time.Second, "delay before reconnecting to the message-queue, doubled for every failed attempt when mq-reconnect-max-backoff is set")
+	mqReconnectMaxBackoff := flag.Duration("mq-reconnect-max-backoff", 0, "max delay before reconnecting to the message-queue. The delay is randomized between 0 and the backoff if set, so that a fleet spreads its reconnections. The delay is fixed if set to 0")
+	mqMaxReconnectFailures := flag.Int("mq-max-reconnect-failures", 0, "number of consecutive failed attempts to reconnect to the message-queue after which wg-manager exits, for its supervisor to restart it. Unlimited if set to 0")
+	mqURL := flag.String("mq-url", "wss://example.com/mq", "message-queue url. Pass a comma delimited list to fail over between multiple message-queue servers, preferring the first one")
 	mqUsername := flag.String("mq-username", "", "message-queue username")
 	mqPassword := flag.String("mq-password", "", "message-queue password")
 	mqChannel := flag.String("mq-channel", "wireguard", "message-queue channel")
+	tlsMinVersion := flag.String("tls-min-version", "", "minimum TLS version of connections to the API and message-queue, one of 1.0, 1.1, 1.2 or 1.3. The Go default is used if empty")
+	tlsCipherSuites := flag.String("tls-cipher-suites", "", "comma delimited list of cipher suites allowed for connections to the API and message-queue, by their IANA names. Only applies to TLS 1.2 and lower, the Go defaults are used if empty")
+	dnsResolver := flag.String("dns-resolver", "", "address of the DNS server to resolve the API and message-queue hostnames with, port 53 is used if no port is given. The system resolver is used if empty")
+	webhookURL := flag.String("webhook-url", "", "url to send peer change notifications to. Notifications are disabled if empty")
+	webhookTimeout := flag.Duration("webhook-timeout", time.Second*5, "max duration for webhook requests")
+	webhookQueueSize := flag.Int("webhook-queue-size", 1000, "max number of peer change notifications to buffer before dropping them")
+	deadLetterPath := flag.String("dead-letter-file", "", "path to write the events that failed to be applied to, as JSON lines along with the error. Disabled if empty, and reopened on SIGHUP")
+	deadLetterMaxBytes := flag.Int64("dead-letter-max-bytes", 10<<20, "size at which the dead-letter file is rotated, keeping the previous file with a .1 suffix. Never rotated if set to 0")
+	auditLogPath := flag.String("audit-log", "", "path to write an audit log of peer changes to. The audit log is disabled if empty, and is reopened on SIGHUP")
+	logRateInterval := flag.Duration("log-rate-interval", time.Minute, "interval to coalesce repeated errors of the same kind in, such as failing events or iptables rules. The first error is logged right away, and the rest are summarized once the interval is over. Every error is logged if set to 0")
+	readyMaxSyncAge := flag.Duration("ready-max-sync-age", time.Minute*5, "max age of the last successful synchronization for the /readyz admin endpoint to report ready")
+	adminAddress := flag.String("admin-address", "", "address to serve the admin endpoints on. Binds to localhost if no host is given, and is disabled if empty")
+	pprofAddress := flag.String("pprof-address", "", "address to serve pprof debugging handlers on. Binds to localhost if no host is given, and is disabled if empty")
+	eventSocketPath := flag.String("event-socket", "", "path of a unix socket to stream peer change events to local consumers on. The event socket is disabled if empty")
+	eventSocketQueueSize := flag.Int("event-socket-queue-size", 100, "max number of peer change events to buffer per event socket consumer before dropping them")
+	leaderLeaseFile := flag.String("leader-lease-file", "", "path to a lease file shared with a standby instance. Only the instance holding the lease applies changes, and leader election is disabled if empty")
+	leaderLeaseDuration := flag.Duration("leader-lease-duration", time.Second*30, "how long the leader lease is valid without being renewed, after which a standby instance takes over")
+	postSyncCommand := flag.String("post-sync-command", "", "shell command to run after each successful synchronization, with WG_PEER_COUNT and WG_CHANGE_COUNT set. Disabled if empty")
+	postSyncCommandTimeout := flag.Duration("post-sync-command-timeout", time.Second*30, "max duration for the post-sync command, after which it's killed")
+	peerAddCommand := flag.String("peer-add-command", "", "shell command to run when an event adds a peer, with WG_PEER_PUBKEY, WG_PEER_IPV4, WG_PEER_IPV6 and WG_PEER_KIND set. Disabled if empty")
+	peerRemoveCommand := flag.String("peer-remove-command", "", "shell command to run when an event removes a peer, with the same environment variables as peer-add-command. Disabled if empty")
+	peerCommandTimeout := flag.Duration("peer-command-timeout", time.Second*30, "max duration for the peer add and remove commands, after which they're killed")
+	peerCommandQueueSize := flag.Int("peer-command-queue-size", 1000, "max number of peer add and remove commands to buffer before dropping them")
+	guardAlertURL := flag.String("guard-alert-url", "", "url to post an alert to when a guard rejects a synchronization or leaves out peers. Disabled if empty")
+	guardAlertCommand := flag.String("guard-alert-command", "", "shell command to run when a guard rejects a synchronization or leaves out peers, with WG_GUARD, WG_OLD_COUNT, WG_NEW_COUNT and WG_THRESHOLD set. Disabled if empty")
+	guardAlertTimeout := flag.Duration("guard-alert-timeout", time.Second*10, "max duration for guard alert requests and commands")
+	flag.StringVar(&peerSnapshotPath, "peer-snapshot", "", "path to save the peers to after each successful synchronization. The saved peers are applied if the initial synchronization fails, until the API is reachable. Disabled if empty")
+	leaderID := flag.String("leader-id", "", "id of this instance in the leader lease. Defaults to the hostname and process id")
 
 	// Parse environment variables
 	envy.Parse("WG")
@@ -63,61 +293,437 @@ func main() {
 		os.Exit(0)
 	}
 
+	allowedPorts, err := portforward.ParsePortRanges(*portForwardingAllowedPorts)
+	if err != nil {
+		log.Fatalf("error parsing allowed ports %s", err)
+	}
+
+	ingressAddresses, err := portforward.ParseAddresses(*portForwardingIngressAddresses)
+	if err != nil {
+		log.Fatalf("error parsing ingress addresses %s", err)
+	}
+
+	var interfaceChains []string
+	if *portForwardingInterfaceChains != "" {
+		interfaceChains = strings.Split(*portForwardingInterfaceChains, ",")
+	}
+
+	forwardingOptions := portforward.Options{
+		Table:               *portForwardingTable,
+		RulePosition:        *portForwardingRulePosition,
+		DSCPChainPrefix:     *portForwardingDSCPChainPrefix,
+		CreateIPSets:        *portForwardingCreateIPSets,
+		IngressAddresses:    ingressAddresses,
+		PopulateIPSets:      *portForwardingPopulateIPSets,
+		LoadBalance:         *portForwardingLoadBalance,
+		FlushConntrack:      *portForwardingFlushConntrack,
+		RuleCacheSyncs:      *portForwardingRuleCacheSyncs,
+		IPTablesTimeout:     *iptablesTimeout,
+		SharedChains:        *portForwardingSharedChains,
+		AllowedPorts:        allowedPorts,
+		MaxPortsPerPeer:     *portForwardingMaxPortsPerPeer,
+		IPSetOrphanInterval: *portForwardingIPSetOrphanInterval,
+		MatchAllowedIPs:     *portForwardingMatchAllowedIPs,
+		InstallRate:         *portForwardingInstallRate,
+		ParallelFamilies:    *portForwardingParallelFamilies,
+		InterfaceChains:     interfaceChains,
+	}
+
+	if *peerDefaultsFile != "" {
+		var err error
+		peerDefaults, err = peerdefaults.Read(*peerDefaultsFile)
+		if err != nil {
+			log.Fatalf("error reading peer defaults %s", err)
+		}
+	}
+
+	// Print the portforwarding rules for review, before anything on the system is touched
+	if *printForwarding {
+		if peersFilePath == "" {
+			log.Fatalf("no peers file given to print the portforwarding rules for")
+		}
+
+		peers, err := filesource.Read(peersFilePath)
+		if err != nil {
+			log.Fatalf("error reading peers file %s", err)
+		}
+
+		peers = peerDefaults.Apply(peers)
+		err = portforward.Render(os.Stdout, *portForwardingChainPrefix, *portForwardingIpsetIPv4, *portForwardingIpsetIPv6, peers, forwardingOptions)
+		if err != nil {
+			log.Fatalf("error rendering portforwarding rules %s", err)
+		}
+
+		os.Exit(0)
+	}
+
 	log.Printf("starting wg-manager %s", appVersion)
 
+	ratelog.SetInterval(*logRateInterval)
+
+	// Validate the synchronization timing, as the ticker behaves unexpectedly otherwise
+	if *interval <= 0 {
+		log.Fatalf("invalid interval %s, must be positive", *interval)
+	}
+
+	if *delay <= 0 || *delay >= *interval {
+		log.Fatalf("invalid delay %s, must be positive and less than the interval %s", *delay, *interval)
+	}
+
+	if *maxInterval > 0 && (*minInterval <= *delay || *minInterval > *maxInterval) {
+		log.Fatalf("invalid min interval %s, must be greater than the delay %s and at most the max interval %s", *minInterval, *delay, *maxInterval)
+	}
+
+	if *maxResponseBytes <= 0 {
+		log.Fatalf("invalid max response bytes %d, must be positive", *maxResponseBytes)
+	}
+
+	if deltaConnectionsFull <= 0 {
+		log.Fatalf("invalid delta connections full interval %d, must be positive", deltaConnectionsFull)
+	}
+
+	if *apiGetRetries < 0 || *apiPostRetries < 0 {
+		log.Fatalf("invalid API retries, must not be negative")
+	}
+
+	if *mqReconnectBackoff <= 0 || *mqReconnectMaxBackoff < 0 {
+		log.Fatalf("invalid message-queue reconnect backoff, must be positive")
+	}
+
+	if *mqMaxReconnectFailures < 0 {
+		log.Fatalf("invalid message-queue max reconnect failures, must not be negative")
+	}
+
+	if *peerCommandTimeout <= 0 || *peerCommandQueueSize < 0 {
+		log.Fatalf("invalid peer command timeout or queue size, the timeout must be positive and the queue size not negative")
+	}
+
+	if *apiTimeout < 0 || *apiGetTimeout < 0 || *apiPostTimeout < 0 {
+		log.Fatalf("invalid API timeouts, must not be negative")
+	}
+
+	if *apiGetTimeout == 0 {
+		*apiGetTimeout = *apiTimeout
+	}
+
+	if *apiPostTimeout == 0 {
+		*apiPostTimeout = *apiTimeout
+	}
+
 	// Initialize metrics
-	var err error
-	metrics, err = statsd.New(statsd.TagsFormat(statsd.Datadog), statsd.Prefix("wireguard"), statsd.Address(*statsdAddress))
+	tags, err := parseTags(*statsdTags)
+	if err != nil {
+		log.Fatalf("invalid statsd tags %s", err)
+	}
+
+	metrics, err = statsd.New(statsd.TagsFormat(statsd.Datadog), statsd.Prefix(*statsdPrefix), statsd.Tags(tags...), statsd.Address(*statsdAddress))
 	if err != nil {
 		log.Fatalf("Error initializing metrics %s", err)
 	}
 	defer metrics.Close()
 
+	// Resolve the API and message-queue hostnames with the configured DNS server, if any
+	resolver := newResolver(*dnsResolver)
+
+	tlsConfig, err := tlsconfig.New(*tlsMinVersion, *tlsCipherSuites)
+	if err != nil {
+		log.Fatalf("error parsing tls options %s", err)
+	}
+
 	// Initialize the API
+	format, err := api.ParseConnectionsFormat(*connectionsFormat)
+	if err != nil {
+		log.Fatalf("error parsing connections format %s", err)
+	}
+
 	a = &api.API{
 		Username: *username,
 		Password: *password,
 		BaseURL:  *url,
 		Hostname: *hostname,
+		Version:  appVersion,
+		// The timeouts are applied to each request instead of by the client, so that they can differ between requests
 		Client: &http.Client{
-			Timeout: *apiTimeout,
+			Transport: newAPITransport(*apiDialTimeout, *apiKeepAlive, *apiIdleConnTimeout, *apiMaxIdleConns, resolver, tlsConfig),
+		},
+		MaxResponseBytes:    *maxResponseBytes,
+		StrictDecoding:      *validateSchema,
+		Msgpack:             *msgpack,
+		ConditionalRequests: *conditionalRequests,
+		ConnectionsFormat:   format,
+		GetTimeout:          *apiGetTimeout,
+		PostTimeout:         *apiPostTimeout,
+		GetRetry: api.Retry{
+			Attempts: *apiGetRetries,
+			Backoff:  *apiGetRetryBackoff,
+		},
+		PostRetry: api.Retry{
+			Attempts: *apiPostRetries,
+			Backoff:  *apiPostRetryBackoff,
 		},
 	}
 
 	// Initialize Wireguard
-	if *interfaces == "" {
+	var interfacesList []string
+	if interfacesFile != "" {
+		interfacesList, err = wireguard.ReadInterfacesFile(interfacesFile)
+		if err != nil {
+			log.Fatalf("error reading wireguard interfaces %s", err)
+		}
+	} else if *interfaces != "" {
+		interfacesList = strings.Split(*interfaces, ",")
+	}
+
+	if len(interfacesList) == 0 {
 		log.Fatalf("no wireguard interfaces configured")
 	}
 
-	interfacesList := strings.Split(*interfaces, ",")
+	criteria, err := wireguard.ParseConnectedCriteria(*connectedCriteria)
+	if err != nil {
+		log.Fatalf("error parsing connected criteria %s", err)
+	}
+
+	deniedNetworks, err := iputil.ParseCIDRs(*deniedIPs)
+	if err != nil {
+		log.Fatalf("error parsing denied ips %s", err)
+	}
+
+	missingInterfaceAction, err := wireguard.ParseMissingInterfaceAction(*missingInterface)
+	if err != nil {
+		log.Fatalf("error parsing missing interface action %s", err)
+	}
+
+	publicKeys, err := wireguard.ParsePublicKeys(*expectedPublicKeys)
+	if err != nil {
+		log.Fatalf("error parsing expected public keys %s", err)
+	}
+
+	var keyProvider wireguard.KeyProvider
+	if *privateKeyDir != "" {
+		privateKeys, err = wireguard.NewFileKeyProvider(*privateKeyDir, interfacesList)
+		if err != nil {
+			log.Fatalf("error initializing private keys %s", err)
+		}
+		keyProvider = privateKeys
+	}
 
-	wg, err = wireguard.New(interfacesList, metrics)
+	wg, err = wireguard.New(interfacesList, metrics, wireguard.Options{
+		KeyProvider:            keyProvider,
+		RejectUserspace:        *rejectUserspace,
+		ParallelInterfaces:     *parallelInterfaces,
+		RejectDuplicatePubkeys: *rejectDuplicatePubkeys,
+		ConnectedCriteria:      criteria,
+		ReplacePeers:           *replacePeers,
+		DeniedIPs:              deniedNetworks,
+		MaxPeersPerInterface:   maxPeersPerInterface,
+		ExpectedPublicKeys:     publicKeys,
+		MissingInterface:       missingInterfaceAction,
+	})
 	if err != nil {
 		log.Fatalf("error initializing wireguard %s", err)
 	}
 	defer wg.Close()
 
+	// Read the local peers, they're applied along with the initial synchronization
+	preferredSource, err = filesource.ParseSource(*peersFilePrefer)
+	if err != nil {
+		log.Fatalf("error parsing peers file preference %s", err)
+	}
+
+	if peersFilePath != "" {
+		loadFilePeers()
+	}
+
+	// Initialize the pinned peers
+	if *pinnedPubkeysFile != "" {
+		pins, err = pinned.New(*pinnedPubkeysFile)
+		if err != nil {
+			log.Fatalf("error reading pinned public keys %s", err)
+		}
+		wg.SetPinnedKeys(pins.Keys())
+	}
+
+	if pruneWatermark < 0 {
+		log.Fatalf("invalid prune watermark %d, must not be negative", pruneWatermark)
+	}
+
 	// Initialize portforward
-	pf, err = portforward.New(*portForwardingChainPrefix, *portForwardingIpsetIPv4, *portForwardingIpsetIPv6)
+	pf, err = portforward.New(*portForwardingChainPrefix, *portForwardingIpsetIPv4, *portForwardingIpsetIPv6, metrics, forwardingOptions)
 	if err != nil {
 		log.Fatalf("error initializing portforwarding %s", err)
 	}
 
+	if *portForwardingFailureThreshold < 0 {
+		log.Fatalf("invalid portforwarding failure threshold %d, must not be negative", *portForwardingFailureThreshold)
+	}
+
+	portforwardBreaker = breaker.New(*portForwardingFailureThreshold, *portForwardingCooldown)
+
+	// Initialize the audit log
+	if *auditLogPath != "" {
+		auditLog, err = audit.New(*auditLogPath)
+		if err != nil {
+			log.Fatalf("error initializing audit log %s", err)
+		}
+		defer auditLog.Close()
+	}
+
+	// Initialize the dead-letter file
+	if *deadLetterPath != "" {
+		if *deadLetterMaxBytes < 0 {
+			log.Fatalf("invalid dead-letter max bytes %d, must not be negative", *deadLetterMaxBytes)
+		}
+
+		deadLetters, err = deadletter.New(*deadLetterPath, *deadLetterMaxBytes)
+		if err != nil {
+			log.Fatalf("error initializing dead-letter file %s", err)
+		}
+		defer deadLetters.Close()
+	}
+
 	// Set up context for shutting down
 	shutdownCtx, shutdown := context.WithCancel(context.Background())
 	defer shutdown()
 
-	// Run an initial synchronization
-	synchronize()
+	// Serve pprof debugging handlers
+	if *pprofAddress != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
-	// Set up a connection to receive add/remove events
+		err = serveHTTP(shutdownCtx, localAddress(*pprofAddress), mux)
+		if err != nil {
+			log.Fatalf("error serving pprof %s", err)
+		}
+	}
+
+	// Set up the message-queue subscriber, which is connected once the peers have been synchronized
+	// Shut down if it gives up reconnecting, rather than running without events
+	mqGaveUp := make(chan error, 1)
 	s := subscriber.Subscriber{
-		Username: *mqUsername,
-		Password: *mqPassword,
-		BaseURL:  *mqURL,
-		Channel:  *mqChannel,
-		Metrics:  metrics,
+		Username:             *mqUsername,
+		Password:             *mqPassword,
+		BaseURLs:             strings.Split(*mqURL, ","),
+		Channel:              *mqChannel,
+		Metrics:              metrics,
+		Resolver:             resolver,
+		TLSConfig:            tlsConfig,
+		ReconnectBackoff:     *mqReconnectBackoff,
+		ReconnectMaxBackoff:  *mqReconnectMaxBackoff,
+		MaxReconnectFailures: *mqMaxReconnectFailures,
+		GaveUp: func(err error) {
+			mqGaveUp <- err
+		},
+	}
+
+	// Only report ready while both the API and the message-queue are healthy
+	readyCheck = readiness.New(*readyMaxSyncAge, s.Connected)
+
+	// Serve the admin endpoints
+	if *adminAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/peers/errors", peerErrors)
+		mux.Handle("/last-sync", &lastSync)
+		mux.Handle("/readyz", readyCheck)
+		mux.HandleFunc("/interfaces/", handleInterfaceAction)
+		mux.HandleFunc("/export", handleExport)
+		mux.HandleFunc("/pause", handlePause(true))
+		mux.HandleFunc("/resume", handlePause(false))
+
+		err = serveHTTP(shutdownCtx, localAddress(*adminAddress), mux)
+		if err != nil {
+			log.Fatalf("error serving admin endpoints %s", err)
+		}
+	}
+
+	// Initialize idle alerting
+	if *idleAlertThreshold > 0 {
+		idlePeers = idle.New(*idleAlertThreshold, metrics)
+	}
+
+	// Initialize tracing
+	if *otlpURL != "" {
+		tracer, err = tracing.New(*otlpURL, "wg-manager", *otlpTimeout, *otlpQueueSize, metrics)
+		if err != nil {
+			log.Fatalf("error initializing tracing %s", err)
+		}
+
+		go tracer.Run(shutdownCtx)
+	}
+
+	// Initialize the webhook
+	if *webhookURL != "" {
+		hook = webhook.New(*webhookURL, *webhookTimeout, *webhookQueueSize, metrics)
+		go hook.Run(shutdownCtx)
+	}
+
+	// Initialize the post-sync command
+	if *postSyncCommand != "" {
+		postSync = postsync.New(*postSyncCommand, *postSyncCommandTimeout, metrics)
+		go postSync.Run(shutdownCtx)
+	}
+
+	// Initialize the peer commands
+	if *peerAddCommand != "" || *peerRemoveCommand != "" {
+		peerHook = peerhook.New(*peerAddCommand, *peerRemoveCommand, *peerCommandTimeout, *peerCommandQueueSize, metrics)
+		go peerHook.Run(shutdownCtx)
+	}
+
+	// Initialize the guard alerts
+	if *guardAlertURL != "" || *guardAlertCommand != "" {
+		guardAlerts = guardalert.New(*guardAlertURL, *guardAlertCommand, *guardAlertTimeout, metrics)
+		go guardAlerts.Run(shutdownCtx)
+	}
+
+	// Initialize the event socket
+	if *eventSocketPath != "" {
+		events, err = eventsocket.New(*eventSocketPath, *eventSocketQueueSize, metrics)
+		if err != nil {
+			log.Fatalf("error initializing event socket %s", err)
+		}
+		go events.Run(shutdownCtx)
+	}
+
+	// Set up leader election, so that a standby instance only applies changes once it holds the lease
+	var leaseTicker <-chan time.Time
+	if *leaderLeaseFile != "" {
+		if *leaderLeaseDuration <= 0 {
+			log.Fatalf("invalid leader lease duration %s, must be positive", *leaderLeaseDuration)
+		}
+
+		id := *leaderID
+		if id == "" {
+			host, _ := os.Hostname()
+			id = fmt.Sprintf("%s-%d", host, os.Getpid())
+		}
+
+		lease = leader.New(*leaderLeaseFile, id, *leaderLeaseDuration)
+		defer lease.Release()
+
+		leading = false
+		renewLease(shutdownCtx)
+
+		// Renew well before the lease expires
+		t := time.NewTicker(*leaderLeaseDuration / 3)
+		defer t.Stop()
+		leaseTicker = t.C
+	}
+
+	// Run an initial synchronization, unless it's run in the background once the message-queue is connected
+	synced := false
+	if !*asyncInitialSync {
+		synced = synchronize(shutdownCtx)
+
+		// Fall back to the last known peers if the API is unreachable, the next successful synchronization takes over
+		if !synced && peerSnapshotPath != "" {
+			synced = loadPeerSnapshot(shutdownCtx)
+		}
 	}
+
+	// Set up a connection to receive add/remove events
 	eventChannel := make(chan subscriber.WireguardEvent)
 	defer close(eventChannel)
 
@@ -126,91 +732,1598 @@ func main() {
 		log.Fatal("error connecting to message-queue", err)
 	}
 
+	// Tell systemd that we're ready once the peers have been synchronized, if it's running us with notifications enabled
+	ready := false
+	notifyReady := func() {
+		if ready {
+			return
+		}
+
+		_, err := sdnotify.Notify(sdnotify.Ready)
+		if err != nil {
+			log.Printf("error notifying systemd %s", err.Error())
+			return
+		}
+
+		ready = true
+	}
+
+	if synced {
+		notifyReady()
+	}
+
+	// Handle events while the initial synchronization fetches the peers, readiness waits for it to finish
+	initialSyncPending := *asyncInitialSync
+	if initialSyncPending {
+		synchronizeInBackground(shutdownCtx, func(synced bool) {
+			initialSyncPending = false
+
+			if !synced && peerSnapshotPath != "" {
+				synced = loadPeerSnapshot(shutdownCtx)
+			}
+
+			if synced {
+				notifyReady()
+			}
+		})
+	}
+
+	// Ping the systemd watchdog from the main loop, so that it restarts us if the loop hangs
+	var watchdogTicker <-chan time.Time
+	if interval := sdnotify.WatchdogInterval(); interval > 0 {
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+		watchdogTicker = t.C
+	}
+
+	// Reload configuration on SIGHUP
+	reloadChannel := make(chan os.Signal, 1)
+	signal.Notify(reloadChannel, syscall.SIGHUP)
+
+	// Pause reconciliation on SIGUSR1, and resume it on SIGUSR2
+	pauseChannel := make(chan os.Signal, 1)
+	signal.Notify(pauseChannel, syscall.SIGUSR1, syscall.SIGUSR2)
+
 	// Create a ticker to run our logic for polling the api and updating wireguard peers
 	ticker := jitter.NewTicker(*interval, *delay)
+	expiryTicker := time.NewTicker(*expiryInterval)
+
+	var idleTicker <-chan time.Time
+	if idlePeers != nil {
+		t := time.NewTicker(*idleAlertInterval)
+		defer t.Stop()
+		idleTicker = t.C
+	}
+
+	var flushTicker <-chan time.Time
+	if *portForwardingFlushCheckInterval > 0 {
+		t := time.NewTicker(*portForwardingFlushCheckInterval)
+		defer t.Stop()
+		flushTicker = t.C
+	}
+
+	// Apply the local peers when the file changes, coalescing changes that arrive while they're applied
+	filePeersChanged := make(chan struct{}, 1)
+	if peersFilePath != "" {
+		err = filesource.Watch(shutdownCtx, peersFilePath, func() {
+			select {
+			case filePeersChanged <- struct{}{}:
+			default:
+			}
+		})
+		if err != nil {
+			log.Fatalf("error watching peers file %s", err)
+		}
+	}
 	go func() {
+		// Measure the time between ticks, to detect ticks being dropped due to long synchronizations
+		tickTiming := metrics.NewTiming()
+		currentInterval := *interval
+
 		for {
 			select {
 			case msg := <-eventChannel:
 				handleEvent(msg)
+			case <-reloadChannel:
+				reload()
+			case sig := <-pauseChannel:
+				setPaused(sig == syscall.SIGUSR1)
+			case <-expiryTicker.C:
+				removeExpiredPeers()
+			case <-idleTicker:
+				checkIdlePeers()
+			case <-flushTicker:
+				checkForwardingFlushed(shutdownCtx)
+			case <-filePeersChanged:
+				// Leave the peers to the initial synchronization until it finishes, it applies the ones read here
+				if loadFilePeers() && !initialSyncPending && reconcileFilePeers(shutdownCtx) {
+					notifyReady()
+				}
+			case <-leaseTicker:
+				renewLease(shutdownCtx)
+			case action := <-adminActions:
+				action()
+			case <-watchdogTicker:
+				_, err := sdnotify.Notify(sdnotify.Watchdog)
+				if err != nil {
+					log.Printf("error notifying systemd watchdog %s", err.Error())
+				}
 			case <-ticker.C:
+				tickInterval := tickTiming.Duration()
+				tickTiming = metrics.NewTiming()
+				metrics.Timing("tick_interval", tickInterval)
+				if tickInterval > currentInterval+*delay {
+					metrics.Increment("tick_late")
+				}
+
+				// Leave the API to the initial synchronization until it finishes, it's the only one running in the background
+				if initialSyncPending {
+					metrics.Increment("synchronization_skipped")
+					recordSyncSkipped(skipReasonInitialSyncPending)
+					continue
+				}
+
 				// We run this synchronously, the ticker will drop ticks if this takes too long
 				// This way we don't need a mutex or similar to ensure it doesn't run concurrently either
-				synchronize()
+				if synchronize(shutdownCtx) {
+					notifyReady()
+				}
+
+				// Follow the interval suggested by the API, by replacing the ticker
+				next := syncInterval(*interval, *minInterval, *maxInterval)
+				if next != currentInterval {
+					log.Printf("changing the sync interval from %s to %s", currentInterval, next)
+					ticker.Stop()
+					ticker = jitter.NewTicker(next, *delay)
+					currentInterval = next
+				}
 			case <-shutdownCtx.Done():
 				ticker.Stop()
+				expiryTicker.Stop()
 				return
 			}
 		}
 	}()
 
 	// Wait for shutdown or error
-	err = waitForInterrupt(shutdownCtx)
+	err = waitForInterrupt(shutdownCtx, mqGaveUp)
 	log.Printf("shutting down: %s", err)
+	if errors.Is(err, subscriber.ErrReconnectFailed) {
+		exitCode = 1
+	}
+}
+
+// eventResult is the outcome of handling an event
+type eventResult struct {
+	peerErr        error
+	portforwardErr error
+}
+
+// Returns the first error that occurred while handling the event, if any
+func (r eventResult) err() error {
+	if r.peerErr != nil {
+		return r.peerErr
+	}
+
+	return r.portforwardErr
 }
 
-func handleEvent(event subscriber.WireguardEvent) {
+func handleEvent(event subscriber.WireguardEvent) (result eventResult) {
+	var errorMetric string
+
+	ctx, span := tracer.Start(context.Background(), "handle_event")
+	defer span.End()
+	span.SetAttribute("event.action", event.Action)
+	span.SetAttribute("peer.fingerprint", event.Peer.Fingerprint())
+
+	// The defaults are needed for removals too, to find the portforwarding rules of the peer
+	event.Peer = peerDefaults.ApplyPeer(event.Peer)
+
+	// Leave changes to the leader while on standby, the peers are fetched again by the next synchronization
+	if !leading {
+		metrics.Increment("standby_event_ignored")
+		return
+	}
+
+	// Discard events while paused, the synchronization after resuming catches up with them
+	if reconciliationPaused() {
+		return
+	}
+
+	// Don't add peers that have already expired
+	if event.Action == "ADD" && event.Peer.Expired(time.Now()) {
+		metrics.Increment("peer_expired")
+		log.Printf("ignoring ADD event for expired peer %s", event.Peer.Fingerprint())
+		return
+	}
 
 	switch event.Action {
 	case "ADD":
+		errorMetric = "add_event_error"
 		t := metrics.NewTiming()
-		wg.AddPeer(event.Peer)
+		result.peerErr = traceSpan(ctx, "update_peers", func() error {
+			return wg.AddPeer(event.Peer)
+		})
 		t.Send("add_event_add_peer_time")
 		t = metrics.NewTiming()
-		pf.AddPortforwarding(event.Peer)
+		result.portforwardErr = traceSpan(ctx, "update_portforwarding", func() error {
+			return pf.AddPortforwarding(event.Peer)
+		})
 		t.Send("add_event_add_portforwarding_time")
 	case "REMOVE":
+		errorMetric = "remove_event_error"
 		t := metrics.NewTiming()
-		wg.RemovePeer(event.Peer)
+		result.peerErr = traceSpan(ctx, "update_peers", func() error {
+			return wg.RemovePeer(event.Peer)
+		})
 		t.Send("remove_event_remove_peer_time")
 		t = metrics.NewTiming()
-		pf.RemovePortforwarding(event.Peer)
+		result.portforwardErr = traceSpan(ctx, "update_portforwarding", func() error {
+			return pf.RemovePortforwarding(event.Peer)
+		})
 		t.Send("remove_event_remove_portforwarding_time")
 	case "UPDATE_PORTS":
+		errorMetric = "update_ports_event_error"
 		t := metrics.NewTiming()
-		pf.UpdateSinglePeerPortforwarding(event.Peer)
+		result.portforwardErr = traceSpan(ctx, "update_portforwarding", func() error {
+			return pf.UpdateSinglePeerPortforwarding(event.Peer)
+		})
 		t.Send("update_ports_event_update_portforwarding_time")
 	default: // Bad data from the API, ignore it
+		return
 	}
-}
 
-func synchronize() {
-	defer metrics.NewTiming().Send("synchronize_time")
+	if result.peerErr != nil {
+		ratelog.Printf("event peer", "error handling %s event for peer %s: %s", event.Action, event.Peer.Fingerprint(), result.peerErr.Error())
+	}
 
-	t := metrics.NewTiming()
-	peers, err := a.GetWireguardPeers()
-	if err != nil {
-		metrics.Increment("error_getting_peers")
-		log.Printf("error getting peers %s", err.Error())
-		return
+	if result.portforwardErr != nil {
+		ratelog.Printf("event portforwarding", "error handling %s event for portforwarding of peer %s: %s", event.Action, event.Peer.Fingerprint(), result.portforwardErr.Error())
 	}
-	t.Send("get_wireguard_peers_time")
 
-	t = metrics.NewTiming()
-	connectedKeys := wg.UpdatePeers(peers)
-	t.Send("update_peers_time")
+	if result.err() != nil {
+		metrics.Increment(errorMetric)
+		peerErrors.Record(event.Peer.Pubkey, result.err())
+		writeDeadLetter(event, result.err())
 
-	t = metrics.NewTiming()
-	pf.UpdatePortforwarding(peers)
-	t.Send("update_portforwarding_time")
+		// Correct the peer with the next synchronization, even if the list of peers is unchanged
+		reapplyPeers = true
+	} else {
+		peerErrors.Clear(event.Peer.Pubkey)
+	}
 
-	t = metrics.NewTiming()
-	err = a.PostWireguardConnections(connectedKeys)
-	if err != nil {
-		metrics.Increment("error_posting_connections")
-		log.Printf("error posting connections %s", err.Error())
-		return
+	// Only record peer changes that were applied
+	if event.Action == "UPDATE_PORTS" {
+		if result.portforwardErr == nil {
+			writeAuditLog(audit.Entry{
+				Action: event.Action,
+				Pubkey: event.Peer.Pubkey,
+				Source: "event",
+			})
+		}
+	} else if result.peerErr == nil {
+		if event.Action == "ADD" {
+			expiries.Add(event.Peer)
+			if idlePeers != nil {
+				idlePeers.Add(event.Peer, time.Now())
+			}
+		} else {
+			expiries.Remove(event.Peer)
+			if idlePeers != nil {
+				idlePeers.Remove(event.Peer)
+			}
+		}
+
+		// The commands run in the background, so that a slow one doesn't stall the event loop
+		if peerHook != nil {
+			peerHook.Trigger(peerhook.Event{Action: event.Action, Peer: event.Peer})
+		}
+
+		// Forwarding-only records don't change the wireguard peers
+		if !event.Peer.HasPeer() {
+			return
+		}
+
+		for _, i := range wg.Interfaces() {
+			recordPeerChange("event", wireguard.PeerChange{
+				Interface: i,
+				Pubkey:    event.Peer.Pubkey,
+				Action:    event.Action,
+			})
+		}
 	}
-	t.Send("post_wireguard_connections_time")
+
+	return
 }
 
-func waitForInterrupt(ctx context.Context) error {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	select {
-	case sig := <-c:
-		return fmt.Errorf("received signal %s", sig)
-	case <-ctx.Done():
-		return errors.New("canceled")
+// synchronize returns whether the peers were applied, or kept while on standby
+func synchronize(ctx context.Context) bool {
+	start := time.Now()
+	defer metrics.NewTiming().Send("synchronize_time")
+
+	// Bound the duration of the synchronization, so that a hung operation doesn't block the following ones
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+	defer checkWatchdog(ctx)
+
+	ctx, span := tracer.Start(ctx, "synchronize")
+	defer span.End()
+
+	if reconciliationPaused() {
+		recordSyncSkipped(skipReasonPaused)
+		return false
+	}
+
+	peers, ok := fetchPeers(ctx)
+	if !ok {
+		return false
+	}
+
+	if !applySynchronizedPeers(ctx, start, peers) {
+		return false
 	}
+
+	readyCheck.Synced(time.Now())
+	return true
+}
+
+// Run a synchronization in the background, fetching the peers concurrently with the main loop and applying them on it
+// The result is passed to done on the main loop, along with whether the peers were applied, or kept while on standby
+// This has to be called on the main loop, as it copies the state that fetching depends on
+func synchronizeInBackground(ctx context.Context, done func(synced bool)) {
+	// Fetch with a copy of the API client, as it keeps the state of conditional requests and the suggested interval
+	// Its settings aren't changed at runtime, so the copy replaces it once the fetched peers are applied
+	client := *a
+	combined := combinedEndpoint
+	connections := pendingConnections
+
+	go func() {
+		start := time.Now()
+		timing := metrics.NewTiming()
+
+		syncCtx, cancel := context.WithTimeout(ctx, syncTimeout)
+		syncCtx, span := tracer.Start(syncCtx, "synchronize")
+		fetched := getPeers(syncCtx, &client, combined, connections)
+
+		select {
+		case adminActions <- func() {
+			defer cancel()
+			defer timing.Send("synchronize_time")
+			defer span.End()
+			defer checkWatchdog(syncCtx)
+
+			*a = client
+			peers, ok := handleFetchedPeers(syncCtx, fetched)
+
+			// Reconciliation may have been paused while fetching the peers
+			if ok && reconciliationPaused() {
+				recordSyncSkipped(skipReasonPaused)
+				ok = false
+			}
+
+			synced := ok && applySynchronizedPeers(syncCtx, start, peers)
+			if synced {
+				readyCheck.Synced(time.Now())
+			}
+
+			done(synced)
+		}:
+		case <-ctx.Done():
+			cancel()
+		}
+	}()
+}
+
+// Fetch the peers from the API, returns whether they were fetched
+func fetchPeers(ctx context.Context) (api.WireguardPeerList, bool) {
+	return handleFetchedPeers(ctx, getPeers(ctx, a, combinedEndpoint, pendingConnections))
+}
+
+// Record the result of fetching the peers, returns the peers and whether they were fetched
+// This changes the state of the main loop, so it has to be run on it
+func handleFetchedPeers(ctx context.Context, fetched fetchedPeers) (api.WireguardPeerList, bool) {
+	if fetched.combinedUnsupported {
+		// Fall back to separate requests for good, the connections are posted again once the peers are applied
+		metrics.Increment("combined_endpoint_unsupported")
+		log.Printf("%s, falling back to separate requests", api.ErrCombinedEndpointUnsupported.Error())
+		combinedEndpoint = false
+	}
+
+	// Keep the connections if they changed while fetching, as the new ones haven't been posted
+	if fetched.connectionsPosted && reflect.DeepEqual(pendingConnections, fetched.connections) {
+		pendingConnections = nil
+	}
+
+	peers, err := fetched.peers, fetched.err
+	if errors.Is(err, api.ErrIncompletePeerList) {
+		// Applying a partial list would remove the missing peers
+		metrics.Increment("incomplete_peer_list")
+		recordSyncSkipped(skipReasonIncomplete)
+		log.Printf("aborting synchronization, %s", err.Error())
+		tripGuard(guardalert.Alert{
+			Guard:    guardalert.GuardIncomplete,
+			OldCount: fetchedCount,
+			NewCount: len(peers),
+			Detail:   err.Error(),
+		})
+		return nil, false
+	}
+	if err != nil {
+		metrics.Increment("error_getting_peers")
+		// Requests aborted by the max duration are reported by the watchdog
+		if errors.Is(err, api.ErrResponseTooLarge) {
+			recordSyncSkipped(skipReasonTooLarge)
+			tripGuard(guardalert.Alert{
+				Guard:     guardalert.GuardTooLarge,
+				OldCount:  fetchedCount,
+				Threshold: a.MaxResponseBytes,
+				Detail:    err.Error(),
+			})
+		} else if ctx.Err() == nil {
+			recordSyncSkipped(skipReasonAPIError)
+		}
+		ratelog.Printf("get peers", "error getting peers %s", err.Error())
+		return nil, false
+	}
+
+	resetGuard(guardalert.GuardIncomplete)
+	resetGuard(guardalert.GuardTooLarge)
+	fetchedCount = len(peers)
+
+	if a.NotModified() {
+		metrics.Increment("peer_list_not_modified")
+	}
+
+	return peers, ctx.Err() == nil
+}
+
+// Apply the fetched peers, returns whether they were applied, or kept while on standby
+func applySynchronizedPeers(ctx context.Context, start time.Time, peers api.WireguardPeerList) bool {
+	if !reapplyPeers && a.NotModified() {
+		return reportUnmodifiedPeers(ctx)
+	}
+
+	fetched := len(peers)
+
+	// Add the local peers
+	if peersFilePath != "" {
+		var conflicts []string
+		peers, conflicts = filesource.Merge(peers, filePeers, preferredSource)
+		for _, pubkey := range conflicts {
+			metrics.Increment("file_peer_conflict")
+			log.Printf("peer %s is in both the API and the peers file, using the one from the %s", api.Fingerprint(pubkey), preferredSource)
+		}
+	}
+
+	// Fill in the fields that the peers leave unset, the API only sends the values that differ from the defaults
+	peers = peerDefaults.Apply(peers)
+
+	// Leave out expired peers, so that they're removed
+	peers, expired := expiry.Filter(peers, time.Now())
+	for _, peer := range expired {
+		metrics.Increment("peer_expired")
+		log.Printf("peer %s has expired", peer.Fingerprint())
+	}
+
+	// Keep pinned peers that the API omitted, along with their portforwarding
+	if pins != nil {
+		var missing []string
+		peers, missing = pins.Retain(peers)
+		for _, pubkey := range missing {
+			metrics.Increment("pinned_peer_retained")
+			log.Printf("pinned peer %s is missing from the API, keeping it", api.Fingerprint(pubkey))
+		}
+	}
+
+	// Keep the peers warm while on standby, so that they can be applied immediately when promoted
+	if !leading {
+		warmPeers = peers
+		savePeerSnapshot(peers)
+		return true
+	}
+
+	peers = prunePinnedPeers(peers)
+
+	summary := applyPeers(ctx, peers)
+	if ctx.Err() != nil {
+		return false
+	}
+
+	reapplyPeers = !summary.complete
+
+	log.Printf("synchronized peers: fetched=%d added=%d removed=%d forwarding_rules_changed=%d connections_posted=%d duration=%s",
+		fetched, summary.added, summary.removed, summary.forwardingChanges, summary.connectionsPosted, time.Since(start).Round(time.Millisecond))
+
+	savePeerSnapshot(peers)
+	return true
+}
+
+// Skip applying the peers when the API responded that they're not modified, as they're already applied
+// The connections are still reported while leading, returns whether they were
+func reportUnmodifiedPeers(ctx context.Context) bool {
+	if !leading {
+		return true
+	}
+
+	connectedKeys, err := wg.ConnectedKeys()
+	if err != nil {
+		metrics.Increment("error_getting_connected_keys")
+		recordSyncSkipped(skipReasonReportError)
+		log.Printf("error getting connected keys %s", err.Error())
+		return false
+	}
+
+	if !postConnections(ctx, connectedKeys) {
+		// Requests aborted by the max duration are reported by the watchdog
+		if ctx.Err() == nil {
+			recordSyncSkipped(skipReasonReportError)
+		}
+		return false
+	}
+
+	return true
+}
+
+// Remove the pinned peers missing from the API that have been idle for too long, while there are more peers than the watermark
+// They're otherwise kept until the API returns them again, so capacity is only reclaimed from them when it's needed
+// Returns the peers without the removed ones
+func prunePinnedPeers(peers api.WireguardPeerList) api.WireguardPeerList {
+	if pins == nil || pruneWatermark == 0 {
+		return peers
+	}
+
+	var peerCount int
+	for _, peer := range peers {
+		if peer.HasPeer() {
+			peerCount++
+		}
+	}
+
+	if peerCount <= pruneWatermark {
+		return peers
+	}
+
+	handshakes, err := wg.LastHandshakes()
+	if err != nil {
+		metrics.Increment("error_getting_handshakes")
+		log.Printf("error getting handshakes %s", err.Error())
+		return peers
+	}
+
+	pruned := make(map[string]struct{})
+	for _, peer := range pins.Stale(handshakes, time.Now(), pruneIdleThreshold) {
+		if peerCount-len(pruned) <= pruneWatermark {
+			break
+		}
+
+		// Wireguard leaves pinned peers in place, so they have to be removed explicitly
+		err := wg.RemovePeer(peer)
+		if err != nil {
+			log.Printf("error pruning peer %s: %s", peer.Fingerprint(), err.Error())
+			continue
+		}
+
+		for _, i := range wg.Interfaces() {
+			recordPeerChange("prune", wireguard.PeerChange{
+				Interface: i,
+				Pubkey:    peer.Pubkey,
+				Action:    wireguard.ActionRemove,
+			})
+		}
+
+		pins.Forget(peer.Pubkey)
+		pruned[peer.Pubkey] = struct{}{}
+		log.Printf("pruned idle pinned peer %s, as there are more than %d peers", peer.Fingerprint(), pruneWatermark)
+	}
+
+	if len(pruned) == 0 {
+		return peers
+	}
+
+	metrics.Count("pressure_prune", len(pruned))
+
+	// Leave out the pruned peers, so that their portforwarding is removed as well
+	remaining := make(api.WireguardPeerList, 0, len(peers)-len(pruned))
+	for _, peer := range peers {
+		if _, ok := pruned[peer.Pubkey]; !ok {
+			remaining = append(remaining, peer)
+		}
+	}
+
+	return remaining
+}
+
+// The result of fetching the peers, which is recorded on the main loop by handleFetchedPeers
+type fetchedPeers struct {
+	peers api.WireguardPeerList
+	err   error
+
+	// Whether the API doesn't have the combined endpoint, which isn't used again once it's known
+	combinedUnsupported bool
+
+	// The connections that were posted along with fetching the peers, if connectionsPosted is set
+	connections       api.ConnectedKeysMap
+	connectionsPosted bool
+}
+
+// Fetch the peers with the given API client, posting the given connections in the same request if the combined endpoint is used
+// Only the given client is changed, so that it's safe to run concurrently with the main loop with a copy of it
+func getPeers(ctx context.Context, client *api.API, combined bool, connections api.ConnectedKeysMap) (fetched fetchedPeers) {
+	ctx, span := tracer.Start(ctx, "get_peers")
+	defer span.End()
+
+	t := metrics.NewTiming()
+	allocations := measureAllocations("get_wireguard_peers_allocated_bytes")
+	defer func() {
+		allocations()
+		span.SetError(fetched.err)
+		if fetched.err == nil {
+			t.Send("get_wireguard_peers_time")
+		}
+	}()
+
+	if !combined {
+		fetched.peers, fetched.err = client.GetWireguardPeers(ctx)
+		return fetched
+	}
+
+	fetched.peers, fetched.err = client.SyncWireguardPeers(ctx, connections)
+	if errors.Is(fetched.err, api.ErrCombinedEndpointUnsupported) {
+		fetched.combinedUnsupported = true
+		fetched.peers, fetched.err = client.GetWireguardPeers(ctx)
+		return fetched
+	}
+
+	fetched.connections = connections
+	fetched.connectionsPosted = fetched.err == nil
+	return fetched
+}
+
+// Save the peers, so that they can be applied at startup if the API is unreachable
+func savePeerSnapshot(peers api.WireguardPeerList) {
+	if peerSnapshotPath == "" {
+		return
+	}
+
+	err := snapshot.Write(peerSnapshotPath, peers, time.Now())
+	if err != nil {
+		metrics.Increment("error_saving_peer_snapshot")
+		log.Printf("error saving peer snapshot %s", err.Error())
+	}
+}
+
+// Apply the peers of the snapshot, returns whether they were applied, or kept while on standby
+func loadPeerSnapshot(ctx context.Context) bool {
+	peers, saved, err := snapshot.Read(peerSnapshotPath)
+	if err != nil {
+		metrics.Increment("error_loading_peer_snapshot")
+		log.Printf("error loading peer snapshot %s", err.Error())
+		return false
+	}
+
+	metrics.Increment("peer_snapshot_loaded")
+	log.Printf("api is unreachable, applying %d peers from the snapshot saved at %s", len(peers), saved.Format(time.RFC3339))
+
+	// Peers may have expired since the snapshot was saved
+	peers, _ = expiry.Filter(peers, time.Now())
+
+	if pins != nil {
+		peers, _ = pins.Retain(peers)
+	}
+
+	if !leading {
+		warmPeers = peers
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+
+	applyPeers(ctx, peers)
+	return ctx.Err() == nil
+}
+
+// Apply the peers to wireguard and portforwarding, and report the connected keys to the API
+// Returns a summary of what was changed
+func applyPeers(ctx context.Context, peers api.WireguardPeerList) (summary applySummary) {
+	// Keep what changed for the admin endpoint
+	start := time.Now()
+	var changes []wireguard.PeerChange
+	defer func() {
+		lastSync.Set(lastsync.NewDiff(start, changes))
+	}()
+
+	// Apply the peers in a stable order, so that the order of changes doesn't vary between synchronizations
+	peers = peers.Sorted()
+
+	// Track the peers that will be left out for being invalid, the errors of the others are cleared once they've been applied
+	for _, peer := range peers {
+		err := wireguard.ValidatePeer(peer)
+		if err != nil {
+			peerErrors.Record(peer.Pubkey, fmt.Errorf("invalid peer: %s", err.Error()))
+		}
+	}
+
+	_, span := tracer.Start(ctx, "update_peers")
+	t := metrics.NewTiming()
+	var connectedKeys api.ConnectedKeysMap
+	allocations := measureAllocations("update_peers_allocated_bytes")
+	connectedKeys, changes = wg.UpdatePeers(peers)
+	allocations()
+	t.Send("update_peers_time")
+	span.SetAttribute("peer_changes", strconv.Itoa(len(changes)))
+	span.End()
+
+	checkCapacity(peers)
+
+	expiries.Set(peers)
+	if idlePeers != nil {
+		idlePeers.Set(peers, time.Now())
+	}
+
+	for _, change := range changes {
+		recordPeerChange("sync", change)
+
+		if change.Action == wireguard.ActionRemove {
+			summary.removed++
+		} else {
+			summary.added++
+		}
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	forwardedPeers = peers
+	var forwarded bool
+	summary.forwardingChanges, forwarded = updatePortforwarding(ctx, peers)
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	summary.complete = forwarded && len(wg.FailedInterfaces()) == 0
+	if summary.complete {
+		clearPeerErrors(peers)
+	}
+
+	// The peers have been applied, reporting the connections is best-effort
+	if postSync != nil {
+		postSync.Trigger(postsync.Result{
+			PeerCount:   len(peers),
+			ChangeCount: len(changes),
+		})
+	}
+
+	if reportEndpoints {
+		postEndpoints(ctx)
+	}
+
+	if reportRejections {
+		postRejections(ctx)
+	}
+
+	// Post the connections along with fetching the peers in the next synchronization
+	if combinedEndpoint {
+		pendingConnections = connectedKeys
+		summary.connectionsPosted = len(connectedKeys)
+		return
+	}
+
+	if postConnections(ctx, connectedKeys) {
+		summary.connectionsPosted = len(connectedKeys)
+	}
+
+	return
+}
+
+// applySummary is what applying the peers changed, for the log line summarizing a synchronization
+// The peer changes are counted once for each interface
+type applySummary struct {
+	added             int
+	removed           int
+	forwardingChanges int
+	// The number of connected keys posted, or left to post with the next fetch when using the combined endpoint
+	connectionsPosted int
+	// Whether every interface and the portforwarding rules were updated
+	complete bool
+}
+
+// Post the connected keys to the API, or only the changes since the last report if delta connections are enabled
+// Returns whether they were posted
+func postConnections(ctx context.Context, connectedKeys api.ConnectedKeysMap) bool {
+	postCtx, span := tracer.Start(ctx, "post_connections")
+	defer span.End()
+
+	// Post every connected key periodically, and after a failed report, so that the API can't drift
+	delta := deltaConnections && reportedConnections != nil && deltaReports < deltaConnectionsFull
+
+	t := metrics.NewTiming()
+	var err error
+	if delta {
+		err = a.PostWireguardConnectionsDelta(postCtx, api.DiffConnections(reportedConnections, connectedKeys))
+	} else {
+		err = a.PostWireguardConnections(postCtx, connectedKeys)
+	}
+	span.SetError(err)
+	if err != nil {
+		reportedConnections = nil
+		metrics.Increment("error_posting_connections")
+		ratelog.Printf("post connections", "error posting connections %s", err.Error())
+		return false
+	}
+	t.Send("post_wireguard_connections_time")
+
+	if !deltaConnections {
+		return true
+	}
+
+	reportedConnections = connectedKeys
+	if delta {
+		deltaReports++
+	} else {
+		deltaReports = 0
+	}
+
+	return true
+}
+
+// Post the remote endpoints of the connected peers to the API
+func postEndpoints(ctx context.Context) {
+	endpoints, err := wg.Endpoints()
+	if err != nil {
+		metrics.Increment("error_getting_endpoints")
+		ratelog.Printf("get endpoints", "error getting endpoints %s", err.Error())
+		return
+	}
+
+	report := make([]api.PeerEndpoint, 0, len(endpoints))
+	for pubkey, endpoint := range endpoints {
+		report = append(report, api.PeerEndpoint{Pubkey: pubkey, Endpoint: endpoint})
+	}
+
+	sort.Slice(report, func(i int, j int) bool {
+		return report[i].Pubkey < report[j].Pubkey
+	})
+
+	t := metrics.NewTiming()
+	err = traceSpan(ctx, "post_endpoints", func() error {
+		return a.PostWireguardEndpoints(ctx, report)
+	})
+	if err != nil {
+		metrics.Increment("error_posting_endpoints")
+		ratelog.Printf("post endpoints", "error posting endpoints %s", err.Error())
+		return
+	}
+	t.Send("post_wireguard_endpoints_time")
+}
+
+// Post the peers that the last update of the wireguard peers left out to the API
+func postRejections(ctx context.Context) {
+	rejections := wg.Rejections()
+	if rejections == nil {
+		rejections = []api.PeerRejection{}
+	}
+
+	t := metrics.NewTiming()
+	err := traceSpan(ctx, "post_rejections", func() error {
+		return a.PostWireguardRejections(ctx, rejections)
+	})
+	if err != nil {
+		metrics.Increment("error_posting_rejections")
+		ratelog.Printf("post rejections", "error posting rejections %s", err.Error())
+		return
+	}
+	t.Send("post_wireguard_rejections_time")
+}
+
+// Update portforwarding for the peers, unless it's been disabled for failing repeatedly
+// Returns the number of rules that were added and removed, and whether the rules of every peer were applied
+func updatePortforwarding(ctx context.Context, peers api.WireguardPeerList) (ruleChanges int, applied bool) {
+	if !portforwardBreaker.Allow(time.Now()) {
+		metrics.Increment("portforwarding_skipped")
+		return 0, false
+	}
+
+	t := metrics.NewTiming()
+	err := traceSpan(ctx, "update_portforwarding", func() error {
+		return pf.UpdatePortforwarding(ctx, peers)
+	})
+	t.Send("update_portforwarding_time")
+
+	// Being aborted isn't a failure of portforwarding
+	if ctx.Err() != nil {
+		return pf.RuleChanges(), false
+	}
+
+	if err != nil {
+		if portforwardBreaker.Failure(time.Now()) {
+			log.Printf("disabling portforwarding after repeated failures, last error %s", err.Error())
+		}
+	} else {
+		if portforwardBreaker.Open() {
+			log.Printf("re-enabling portforwarding, as it succeeded")
+		}
+		portforwardBreaker.Success()
+	}
+
+	disabled := 0
+	if portforwardBreaker.Open() {
+		disabled = 1
+	}
+	metrics.Gauge("portforwarding_disabled", disabled)
+
+	return pf.RuleChanges(), err == nil
+}
+
+// Clear the errors of the peers that were applied, leaving those of the peers that were left out
+func clearPeerErrors(peers api.WireguardPeerList) {
+	rejected := make(map[string]bool)
+	for _, rejection := range wg.Rejections() {
+		rejected[rejection.Pubkey] = true
+	}
+
+	for _, peer := range peers {
+		if !rejected[peer.Pubkey] {
+			peerErrors.Clear(peer.Pubkey)
+		}
+	}
+}
+
+// Run the operation in a span that's a child of the span in the context, marking the span as failed if the operation fails
+func traceSpan(ctx context.Context, name string, operation func() error) error {
+	_, span := tracer.Start(ctx, name)
+	defer span.End()
+
+	err := operation()
+	span.SetError(err)
+	return err
+}
+
+// Measure the bytes allocated until the returned function is called, and send them as a metric, if allocation metrics are enabled
+// The allocations are process wide, so they include those of anything running concurrently, such as the webhook
+func measureAllocations(bucket string) func() {
+	if !allocationMetrics {
+		return func() {}
+	}
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	return func() {
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		metrics.Histogram(bucket, after.TotalAlloc-before.TotalAlloc)
+	}
+}
+
+// Get the interval to synchronize at, which is the one suggested by the API clamped to the min and max intervals
+// The configured interval is used if the API doesn't suggest one, or following suggestions is disabled
+func syncInterval(interval time.Duration, minInterval time.Duration, maxInterval time.Duration) time.Duration {
+	suggested := a.SuggestedInterval()
+	if maxInterval <= 0 || suggested <= 0 {
+		return interval
+	}
+
+	if suggested < minInterval {
+		return minInterval
+	}
+
+	if suggested > maxInterval {
+		return maxInterval
+	}
+
+	return suggested
+}
+
+// Count a synchronization that didn't apply the peers, tagged with why
+func recordSyncSkipped(reason string) {
+	metrics.Clone(statsd.Tags("reason", reason)).Increment("sync_skipped")
+}
+
+// Report if the synchronization was aborted due to exceeding its max duration
+func checkWatchdog(ctx context.Context) {
+	if ctx.Err() == context.DeadlineExceeded {
+		metrics.Increment("sync_watchdog_timeout")
+		recordSyncSkipped(skipReasonWatchdog)
+		log.Printf("synchronization exceeded the max duration of %s and was aborted", syncTimeout)
+	}
+}
+
+// Acquire or renew the leader lease, and apply the warm peers when promoted
+func renewLease(ctx context.Context) {
+	acquired, err := lease.Acquire(time.Now())
+	if err != nil {
+		// Step down, as we can't tell whether another instance holds the lease
+		metrics.Increment("leader_lease_error")
+		log.Printf("error acquiring leader lease %s", err.Error())
+		acquired = false
+	}
+
+	if acquired == leading {
+		return
+	}
+
+	leading = acquired
+	if !leading {
+		metrics.Increment("leader_demoted")
+		log.Printf("lost the leader lease, standing by")
+		return
+	}
+
+	metrics.Increment("leader_promoted")
+	log.Printf("acquired the leader lease, applying changes")
+	reapplyPeers = true
+
+	if warmPeers != nil {
+		ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+		defer cancel()
+		defer checkWatchdog(ctx)
+
+		applyPeers(ctx, warmPeers)
+		warmPeers = nil
+	}
+}
+
+// Remove the peers whose expiry time has passed
+func removeExpiredPeers() {
+	if !leading || reconciliationPaused() {
+		return
+	}
+
+	for _, peer := range expiries.Expired(time.Now()) {
+		if pins != nil && pins.Pinned(peer.Pubkey) {
+			continue
+		}
+
+		metrics.Increment("peer_expired")
+		log.Printf("peer %s has expired, removing it", peer.Fingerprint())
+
+		err := wg.RemovePeer(peer)
+		if err != nil {
+			log.Printf("error removing expired peer %s: %s", peer.Fingerprint(), err.Error())
+		} else {
+			for _, i := range wg.Interfaces() {
+				recordPeerChange("expiry", wireguard.PeerChange{
+					Interface: i,
+					Pubkey:    peer.Pubkey,
+					Action:    wireguard.ActionRemove,
+				})
+			}
+		}
+
+		err = pf.RemovePortforwarding(peer)
+		if err != nil {
+			log.Printf("error removing portforwarding for expired peer %s: %s", peer.Fingerprint(), err.Error())
+		}
+	}
+}
+
+// Read the local peers from the peers file, returns whether they were read
+// The previous peers are kept if the file can't be read, as it may be in the middle of being written,
+// while a removed file has no peers
+func loadFilePeers() bool {
+	peers, err := filesource.Read(peersFilePath)
+	if os.IsNotExist(err) {
+		filePeers = nil
+		reapplyPeers = true
+		return true
+	}
+
+	if err != nil {
+		metrics.Increment("error_reading_peers_file")
+		log.Printf("error reading peers file %s", err.Error())
+		return false
+	}
+
+	filePeers = peers
+	reapplyPeers = true
+	return true
+}
+
+// Apply the local peers when the peers file changes, instead of waiting for the next synchronization
+// The peers from the API are fetched again rather than reusing those of the last synchronization,
+// as events may have changed the peers since. Returns whether the peers were applied, or kept while on standby
+func reconcileFilePeers(ctx context.Context) bool {
+	log.Printf("peers file changed, applying its %d peers", len(filePeers))
+
+	return synchronize(ctx)
+}
+
+// Add the portforwarding rules of the last synchronization back if another tool flushed them, instead of waiting for the next synchronization
+// Changes from events since the last synchronization are left to the next one
+func checkForwardingFlushed(ctx context.Context) {
+	if !leading || forwardedPeers == nil || reconciliationPaused() {
+		return
+	}
+
+	flushed, err := pf.Flushed()
+	if err != nil {
+		ratelog.Printf("check flushed", "error checking for flushed portforwarding rules %s", err.Error())
+		return
+	}
+
+	if !flushed {
+		return
+	}
+
+	metrics.Increment("forwarding_reapplied_after_flush")
+	log.Printf("portforwarding rules were flushed, adding them back")
+
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+
+	updatePortforwarding(ctx, forwardedPeers)
+}
+
+// Alert for the flagged peers that haven't had a handshake within the idle threshold, and those that are active again
+func checkIdlePeers() {
+	if !leading {
+		return
+	}
+
+	handshakes, err := wg.LastHandshakes()
+	if err != nil {
+		metrics.Increment("error_getting_handshakes")
+		log.Printf("error getting handshakes %s", err.Error())
+		return
+	}
+
+	for _, transition := range idlePeers.Check(handshakes, time.Now()) {
+		if transition.Action == idle.ActionIdle {
+			metrics.Increment("peer_idle_alert")
+			log.Printf("peer %s hasn't had a handshake since %s", api.Fingerprint(transition.Pubkey), transition.LastActive.Format(time.RFC3339))
+		} else {
+			log.Printf("peer %s is active again", api.Fingerprint(transition.Pubkey))
+		}
+
+		notify(webhook.Notification{
+			Pubkey: transition.Pubkey,
+			Action: transition.Action,
+		})
+	}
+}
+
+// Record a peer change in the audit log, and send notifications for it
+func recordPeerChange(source string, change wireguard.PeerChange) {
+	writeAuditLog(audit.Entry{
+		Action:    change.Action,
+		Pubkey:    change.Pubkey,
+		Interface: change.Interface,
+		Source:    source,
+	})
+
+	notify(webhook.Notification{
+		Pubkey:    change.Pubkey,
+		Action:    change.Action,
+		Interface: change.Interface,
+	})
+}
+
+// Alert that a guard tripped, if guard alerts are enabled
+func tripGuard(alert guardalert.Alert) {
+	if guardAlerts != nil {
+		guardAlerts.Trip(alert)
+	}
+}
+
+// Mark a guard as passed, so that it alerts again the next time it trips
+func resetGuard(guard string) {
+	if guardAlerts != nil {
+		guardAlerts.Reset(guard)
+	}
+}
+
+// Alert if the last update of the wireguard peers left out peers for being over capacity
+func checkCapacity(peers api.WireguardPeerList) {
+	overCapacity := 0
+	for _, rejection := range wg.Rejections() {
+		if rejection.Reason == wireguard.RejectOverCapacity {
+			overCapacity++
+		}
+	}
+
+	if overCapacity == 0 {
+		resetGuard(guardalert.GuardOverCapacity)
+		return
+	}
+
+	tripGuard(guardalert.Alert{
+		Guard:     guardalert.GuardOverCapacity,
+		OldCount:  len(forwardedPeers),
+		NewCount:  len(peers),
+		Threshold: int64(maxPeersPerInterface),
+		Detail:    fmt.Sprintf("%d peers left out", overCapacity),
+	})
+}
+
+// Send a notification to the webhook and the event socket, if they're enabled
+func notify(notification webhook.Notification) {
+	if hook != nil {
+		hook.Notify(notification)
+	}
+
+	if events != nil {
+		events.Publish(notification)
+	}
+}
+
+// Write an event that failed to be applied to the dead-letter file, if it's enabled
+func writeDeadLetter(event subscriber.WireguardEvent, eventErr error) {
+	if deadLetters == nil {
+		return
+	}
+
+	err := deadLetters.Write(deadletter.Entry{
+		Error: eventErr.Error(),
+		Event: event,
+	})
+	if err != nil {
+		metrics.Increment("dead_letter_error")
+		ratelog.Printf("dead-letter", "error writing dead-letter file %s", err.Error())
+		return
+	}
+
+	metrics.Increment("event_dead_lettered")
+}
+
+func writeAuditLog(entry audit.Entry) {
+	if auditLog == nil {
+		return
+	}
+
+	err := auditLog.Log(entry)
+	if err != nil {
+		metrics.Increment("audit_log_error")
+		log.Printf("error writing audit log %s", err.Error())
+	}
+}
+
+// Pause or resume reconciliation, only called on the main loop
+// While paused, synchronizations and expiries are skipped and events are discarded, so that nothing is changed
+func setPaused(p bool) {
+	if paused == p {
+		return
+	}
+
+	paused = p
+	if paused {
+		log.Printf("pausing reconciliation, nothing will be changed until it's resumed")
+	} else {
+		log.Printf("resuming reconciliation, the next synchronization catches up with the changes made while paused")
+		reapplyPeers = true
+	}
+}
+
+// Whether reconciliation is paused, counting the change that's skipped if it is
+func reconciliationPaused() bool {
+	if paused {
+		metrics.Increment("reconciliation_paused")
+	}
+
+	return paused
+}
+
+// Handle the admin actions for pausing reconciliation, POST /pause and POST /resume
+func handlePause(p bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Change the state on the main loop, and wait for it to be changed
+		result := make(chan struct{}, 1)
+		select {
+		case adminActions <- func() {
+			setPaused(p)
+			result <- struct{}{}
+		}:
+		case <-req.Context().Done():
+			return
+		}
+
+		<-result
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Handle the admin actions for a single interface, POST /interfaces/{name}/drain and POST /interfaces/{name}/enable
+// Forwarding isn't tied to an interface, so draining an interface only removes its peers
+func handleInterfaceAction(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/interfaces/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(rw, req)
+		return
+	}
+
+	name := parts[0]
+	var action func() error
+	switch parts[1] {
+	case "drain":
+		action = func() error {
+			changes, err := wg.DrainInterface(name)
+			for _, change := range changes {
+				recordPeerChange("drain", change)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			metrics.Increment("interface_drained")
+			log.Printf("drained wireguard interface %s, removed %d peers", name, len(changes))
+			return nil
+		}
+	case "enable":
+		action = func() error {
+			err := wg.EnableInterface(name)
+			if err != nil {
+				return err
+			}
+
+			reapplyPeers = true
+			log.Printf("enabled wireguard interface %s, its peers will be added by the next synchronization", name)
+			return nil
+		}
+	default:
+		http.NotFound(rw, req)
+		return
+	}
+
+	// Run the action on the main loop, and wait for the result
+	result := make(chan error, 1)
+	select {
+	case adminActions <- func() { result <- action() }:
+	case <-req.Context().Done():
+		return
+	}
+
+	err := <-result
+	if errors.Is(err, wireguard.ErrUnknownInterface) {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Reload configuration that can be changed without restarting
+func reload() {
+	log.Printf("reloading configuration")
+
+	// The reloaded configuration is applied along with the peers by the next synchronization
+	reapplyPeers = true
+
+	if pins != nil {
+		err := pins.Reload()
+		if err != nil {
+			log.Printf("error reloading pinned public keys %s", err.Error())
+		} else {
+			wg.SetPinnedKeys(pins.Keys())
+		}
+	}
+
+	// Rotated private keys are applied to the interfaces that are already configured, added interfaces get theirs when opened
+	if privateKeys != nil {
+		err := wg.RefreshPrivateKeys()
+		if err != nil {
+			metrics.Increment("error_refreshing_private_keys")
+			log.Printf("error refreshing private keys %s", err.Error())
+		}
+	}
+
+	if auditLog != nil {
+		err := auditLog.Reopen()
+		if err != nil {
+			metrics.Increment("audit_log_error")
+			log.Printf("error reopening audit log %s", err.Error())
+		}
+	}
+
+	if deadLetters != nil {
+		err := deadLetters.Reopen()
+		if err != nil {
+			metrics.Increment("dead_letter_error")
+			log.Printf("error reopening dead-letter file %s", err.Error())
+		}
+	}
+
+	if interfacesFile != "" {
+		reloadInterfaces()
+	}
+}
+
+// Read the wireguard interfaces from the interfaces file again, and start or stop managing the ones that were added or removed
+// The peers of added interfaces are applied by the next synchronization
+func reloadInterfaces() {
+	interfaces, err := wireguard.ReadInterfacesFile(interfacesFile)
+	if err != nil {
+		log.Printf("error reloading wireguard interfaces %s", err.Error())
+		return
+	}
+
+	if len(interfaces) == 0 {
+		log.Printf("ignoring the reloaded wireguard interfaces, as none are configured")
+		return
+	}
+
+	// Added interfaces without a private key are retried once the interfaces are reloaded again
+	if privateKeys != nil {
+		err := privateKeys.SetInterfaces(interfaces)
+		if err != nil {
+			log.Printf("error reloading private keys %s", err.Error())
+		}
+	}
+
+	added, removed := wg.SetInterfaces(interfaces)
+	for _, i := range added {
+		metrics.Increment("interface_added")
+		log.Printf("added wireguard interface %s", i)
+	}
+
+	for _, i := range removed {
+		metrics.Increment("interface_removed")
+		log.Printf("removed wireguard interface %s", i)
+	}
+}
+
+// Create a transport for the API client, based on the default transport so that the defaults match it
+func newAPITransport(dialTimeout time.Duration, keepAlive time.Duration, idleConnTimeout time.Duration, maxIdleConns int, resolver *net.Resolver, tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: keepAlive,
+		Resolver:  resolver,
+	}).DialContext
+	transport.IdleConnTimeout = idleConnTimeout
+	transport.MaxIdleConns = maxIdleConns
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport
+}
+
+// Create a resolver which uses the DNS server at the given address, or nil to use the system resolver if it's empty
+func newResolver(address string) *net.Resolver {
+	if address == "" {
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// Parse a comma delimited list of key:value tags into the key-value pairs expected by statsd
+func parseTags(tags string) ([]string, error) {
+	var pairs []string
+	if tags == "" {
+		return pairs, nil
+	}
+
+	for _, tag := range strings.Split(tags, ",") {
+		keyValue := strings.SplitN(tag, ":", 2)
+		if len(keyValue) != 2 || keyValue[0] == "" {
+			return nil, fmt.Errorf("tag %q is not a key:value pair", tag)
+		}
+
+		pairs = append(pairs, keyValue[0], keyValue[1])
+	}
+
+	return pairs, nil
+}
+
+// Serve HTTP on the given address until the context is canceled
+func serveHTTP(ctx context.Context, address string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler: handler,
+	}
+
+	go func() {
+		err := server.Serve(listener)
+		if err != http.ErrServerClosed {
+			log.Printf("error serving http on %s: %s", address, err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	return nil
+}
+
+// Use localhost as the host of the address if none is given
+func localAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host != "" {
+		return address
+	}
+
+	return net.JoinHostPort("localhost", port)
+}
+
+// Wait for a signal to shut down, or a fatal error on the given channel
+func waitForInterrupt(ctx context.Context, errs <-chan error) error {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-c:
+		return fmt.Errorf("received signal %s", sig)
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return errors.New("canceled")
+	}
+}
+
+// Handle exporting the live configuration of an interface in the wg showconf format, GET /export?iface={name}
+func handleExport(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Require the interface even if there's only one, so that requests don't change meaning when interfaces are added
+	name := req.URL.Query().Get("iface")
+	if name == "" {
+		http.Error(rw, "missing iface parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Read the configuration on the main loop, as the wireguard clients aren't safe for concurrent use
+	type export struct {
+		config string
+		err    error
+	}
+
+	result := make(chan export, 1)
+	select {
+	case adminActions <- func() {
+		config, err := wg.ExportInterface(name)
+		result <- export{config, err}
+	}:
+	case <-req.Context().Done():
+		return
+	}
+
+	exported := <-result
+	if errors.Is(exported.err, wireguard.ErrUnknownInterface) {
+		http.Error(rw, exported.err.Error(), http.StatusNotFound)
+		return
+	} else if exported.err != nil {
+		http.Error(rw, exported.err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Write([]byte(exported.config))
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewAPITransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// The certificate of the test server is only trusted through the given config
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	for _, tc := range []struct {
+		name      string
+		tlsConfig *tls.Config
+		trusted   bool
+	}{
+		{"default", nil, false},
+		{"trusted", &tls.Config{RootCAs: roots}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := newAPITransport(time.Second, time.Second, time.Second, 1, nil, tc.tlsConfig)
+			if tc.tlsConfig != nil && transport.TLSClientConfig != tc.tlsConfig {
+				t.Error("the tls config wasn't used")
+			}
+
+			client := &http.Client{Transport: transport}
+			response, err := client.Get(server.URL)
+			if tc.trusted && err != nil {
+				t.Fatal(err)
+			}
+
+			if !tc.trusted && err == nil {
+				t.Fatal("connected without trusting the certificate")
+			}
+
+			if response != nil {
+				response.Body.Close()
+			}
+		})
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		tags     string
+		expected []string
+		valid    bool
+	}{
+		{"empty", "", nil, true},
+		{"single", "region:se", []string{"region", "se"}, true},
+		{"multiple", "region:se,host:se1", []string{"region", "se", "host", "se1"}, true},
+		{"empty value", "region:", []string{"region", ""}, true},
+		{"colon in value", "endpoint:10.0.0.1:80", []string{"endpoint", "10.0.0.1:80"}, true},
+		{"missing value", "region", nil, false},
+		{"empty key", ":se", nil, false},
+		{"empty tag", "region:se,", nil, false},
+		{"only separator", ",", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pairs, err := parseTags(test.tags)
+			if test.valid && err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.valid && err == nil {
+				t.Fatalf("no error parsing %q", test.tags)
+			}
+
+			if diff := cmp.Diff(test.expected, pairs); diff != "" {
+				t.Errorf("unexpected tags (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
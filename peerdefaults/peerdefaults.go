@@ -0,0 +1,135 @@
+package peerdefaults
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/portforward"
+)
+
+// The max value of a DSCP mark
+const maxDSCP = 63
+
+// Defaults are the values to fill in for the fields that peers leave unset, so that the API only has to send overrides
+// The fields have the same names as those of the peers returned by the API, and the value of a peer always wins
+// Boolean fields can't be defaulted, as a peer can't tell them apart from being unset, and neither can the forward comment,
+// which has to be unique per peer. Peers can opt out of a default DSCP mark with a negative value
+type Defaults struct {
+	DSCP             int      `json:"dscp,omitempty"`
+	ForwardTargets   []string `json:"forward_targets,omitempty"`
+	ForwardFamily    string   `json:"forward_family,omitempty"`
+	ForwardInterface string   `json:"forward_interface,omitempty"`
+	ExcludeIPs       []string `json:"exclude_ips,omitempty"`
+}
+
+// Read reads the defaults from a JSON file, expanding the $VAR and ${VAR} references to environment variables in it
+// This allows the same file to be deployed everywhere, with the values that differ between servers in the environment
+func Read(path string) (Defaults, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Defaults{}, err
+	}
+
+	return Parse(os.ExpandEnv(string(contents)))
+}
+
+// Parse parses and validates the defaults from JSON, fields that aren't defaultable are rejected
+func Parse(s string) (Defaults, error) {
+	var defaults Defaults
+	decoder := json.NewDecoder(bytes.NewReader([]byte(s)))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&defaults)
+	if err != nil {
+		return Defaults{}, fmt.Errorf("invalid peer defaults: %w", err)
+	}
+
+	err = defaults.validate()
+	if err != nil {
+		return Defaults{}, fmt.Errorf("invalid peer defaults: %w", err)
+	}
+
+	return defaults, nil
+}
+
+func (d Defaults) validate() error {
+	if d.DSCP < 0 || d.DSCP > maxDSCP {
+		return fmt.Errorf("dscp %d is out of range", d.DSCP)
+	}
+
+	for _, target := range d.ForwardTargets {
+		if net.ParseIP(target) == nil {
+			return fmt.Errorf("invalid forward target %s", target)
+		}
+	}
+
+	// Peers with an invalid interface get no portforwarding rules, so it would disable portforwarding for every peer
+	if d.ForwardInterface != "" && !portforward.ValidInterfaceName(d.ForwardInterface) {
+		return fmt.Errorf("invalid forward interface %q", d.ForwardInterface)
+	}
+
+	switch d.ForwardFamily {
+	case "", api.FamilyIPv4, api.FamilyIPv6:
+	default:
+		return fmt.Errorf("invalid forward family %s", d.ForwardFamily)
+	}
+
+	for _, network := range d.ExcludeIPs {
+		_, _, err := net.ParseCIDR(network)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsZero returns whether there are no defaults to fill in
+func (d Defaults) IsZero() bool {
+	return d.DSCP == 0 && len(d.ForwardTargets) == 0 && d.ForwardFamily == "" && d.ForwardInterface == "" &&
+		len(d.ExcludeIPs) == 0
+}
+
+// ApplyPeer returns the peer with its unset fields filled in from the defaults
+func (d Defaults) ApplyPeer(peer api.WireguardPeer) api.WireguardPeer {
+	if peer.DSCP == 0 {
+		peer.DSCP = d.DSCP
+	}
+
+	if len(peer.ForwardTargets) == 0 {
+		peer.ForwardTargets = d.ForwardTargets
+	}
+
+	if peer.ForwardFamily == "" {
+		peer.ForwardFamily = d.ForwardFamily
+	}
+
+	if peer.ForwardInterface == "" {
+		peer.ForwardInterface = d.ForwardInterface
+	}
+
+	if len(peer.ExcludeIPs) == 0 {
+		peer.ExcludeIPs = d.ExcludeIPs
+	}
+
+	return peer
+}
+
+// Apply returns the peers with their unset fields filled in from the defaults
+// The given list is left unmodified, and returned as is if there are no defaults
+func (d Defaults) Apply(peers api.WireguardPeerList) api.WireguardPeerList {
+	if d.IsZero() {
+		return peers
+	}
+
+	applied := make(api.WireguardPeerList, len(peers))
+	for i, peer := range peers {
+		applied[i] = d.ApplyPeer(peer)
+	}
+
+	return applied
+}
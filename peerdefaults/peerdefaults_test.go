@@ -0,0 +1,150 @@
+package peerdefaults_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/peerdefaults"
+)
+
+var defaultsFixture = peerdefaults.Defaults{
+	DSCP:             10,
+	ForwardTargets:   []string{"10.64.0.1"},
+	ForwardFamily:    api.FamilyIPv4,
+	ForwardInterface: "eth0",
+	ExcludeIPs:       []string{"10.99.0.0/24"},
+}
+
+func TestApplyPeer(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Peer     api.WireguardPeer
+		Expected api.WireguardPeer
+	}{
+		{
+			"unset",
+			api.WireguardPeer{Pubkey: "a"},
+			api.WireguardPeer{
+				Pubkey:           "a",
+				DSCP:             10,
+				ForwardTargets:   []string{"10.64.0.1"},
+				ForwardFamily:    api.FamilyIPv4,
+				ForwardInterface: "eth0",
+				ExcludeIPs:       []string{"10.99.0.0/24"},
+			},
+		},
+		{
+			"dscp",
+			api.WireguardPeer{Pubkey: "a", DSCP: 20},
+			api.WireguardPeer{Pubkey: "a", DSCP: 20, ForwardTargets: []string{"10.64.0.1"}, ForwardFamily: api.FamilyIPv4, ForwardInterface: "eth0", ExcludeIPs: []string{"10.99.0.0/24"}},
+		},
+		{
+			"dscp opt out",
+			api.WireguardPeer{Pubkey: "a", DSCP: -1},
+			api.WireguardPeer{Pubkey: "a", DSCP: -1, ForwardTargets: []string{"10.64.0.1"}, ForwardFamily: api.FamilyIPv4, ForwardInterface: "eth0", ExcludeIPs: []string{"10.99.0.0/24"}},
+		},
+		{
+			"forward targets",
+			api.WireguardPeer{Pubkey: "a", ForwardTargets: []string{"10.64.0.2", "10.64.0.3"}},
+			api.WireguardPeer{Pubkey: "a", DSCP: 10, ForwardTargets: []string{"10.64.0.2", "10.64.0.3"}, ForwardFamily: api.FamilyIPv4, ForwardInterface: "eth0", ExcludeIPs: []string{"10.99.0.0/24"}},
+		},
+		{
+			"forward family",
+			api.WireguardPeer{Pubkey: "a", ForwardFamily: api.FamilyIPv6},
+			api.WireguardPeer{Pubkey: "a", DSCP: 10, ForwardTargets: []string{"10.64.0.1"}, ForwardFamily: api.FamilyIPv6, ForwardInterface: "eth0", ExcludeIPs: []string{"10.99.0.0/24"}},
+		},
+		{
+			"forward interface",
+			api.WireguardPeer{Pubkey: "a", ForwardInterface: "eth1"},
+			api.WireguardPeer{Pubkey: "a", DSCP: 10, ForwardTargets: []string{"10.64.0.1"}, ForwardFamily: api.FamilyIPv4, ForwardInterface: "eth1", ExcludeIPs: []string{"10.99.0.0/24"}},
+		},
+		{
+			"exclude ips",
+			api.WireguardPeer{Pubkey: "a", ExcludeIPs: []string{"10.98.0.0/24"}},
+			api.WireguardPeer{Pubkey: "a", DSCP: 10, ForwardTargets: []string{"10.64.0.1"}, ForwardFamily: api.FamilyIPv4, ForwardInterface: "eth0", ExcludeIPs: []string{"10.98.0.0/24"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			peer := defaultsFixture.ApplyPeer(test.Peer)
+			if !reflect.DeepEqual(peer, test.Expected) {
+				t.Errorf("got unexpected peer, wanted %+v, got %+v", test.Expected, peer)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	peers := api.WireguardPeerList{{Pubkey: "a"}, {Pubkey: "b", ForwardInterface: "eth1"}}
+
+	applied := defaultsFixture.Apply(peers)
+	if applied[0].ForwardInterface != "eth0" || applied[1].ForwardInterface != "eth1" {
+		t.Errorf("got unexpected peers %+v", applied)
+	}
+
+	if peers[0].ForwardInterface != "" {
+		t.Error("the given peers were modified")
+	}
+
+	// Without defaults the list is returned as is
+	applied = peerdefaults.Defaults{}.Apply(peers)
+	if &applied[0] != &peers[0] {
+		t.Error("the peers were copied without defaults")
+	}
+}
+
+func TestParse(t *testing.T) {
+	defaults, err := peerdefaults.Parse(`{"dscp":10,"forward_targets":["10.64.0.1"],"forward_family":"ipv4","forward_interface":"eth0","exclude_ips":["10.99.0.0/24"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(defaults, defaultsFixture) {
+		t.Errorf("got unexpected defaults, wanted %+v, got %+v", defaultsFixture, defaults)
+	}
+
+	for _, invalid := range []string{
+		`{"pubkey":"a"}`,
+		`{"dscp":64}`,
+		`{"dscp":-1}`,
+		`{"forward_targets":["invalid"]}`,
+		`{"forward_family":"ipv5"}`,
+		`{"forward_interface":"wg0 -j ACCEPT"}`,
+		`{"forward_interface":"interfacenametoolong"}`,
+		`{"exclude_ips":["10.99.0.0"]}`,
+		`{`,
+	} {
+		_, err := peerdefaults.Parse(invalid)
+		if err == nil {
+			t.Errorf("no error parsing %s", invalid)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defaults.json")
+	err := ioutil.WriteFile(path, []byte(`{"forward_interface":"${WG_TEST_FORWARD_INTERFACE}","forward_targets":["$WG_TEST_FORWARD_TARGET"]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("WG_TEST_FORWARD_INTERFACE", "eth2")
+	os.Setenv("WG_TEST_FORWARD_TARGET", "10.64.0.5")
+	defer os.Unsetenv("WG_TEST_FORWARD_INTERFACE")
+	defer os.Unsetenv("WG_TEST_FORWARD_TARGET")
+
+	defaults, err := peerdefaults.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := peerdefaults.Defaults{ForwardInterface: "eth2", ForwardTargets: []string{"10.64.0.5"}}
+	if !reflect.DeepEqual(defaults, expected) {
+		t.Errorf("got unexpected defaults, wanted %+v, got %+v", expected, defaults)
+	}
+}
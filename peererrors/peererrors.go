@@ -0,0 +1,90 @@
+package peererrors
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tracker keeps the last error of each peer which failed to be configured
+// Only the most recently failed peers are kept, up to the capacity
+type Tracker struct {
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+	mutex    sync.Mutex
+}
+
+// Entry is the last error of a peer
+type Entry struct {
+	Pubkey string    `json:"pubkey"`
+	Error  string    `json:"error"`
+	Time   time.Time `json:"time"`
+}
+
+// New returns a new Tracker instance, keeping the errors of up to capacity peers
+func New(capacity int) *Tracker {
+	return &Tracker{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Record sets the last error of a peer, evicting the least recently failed peer if the tracker is full
+func (t *Tracker) Record(pubkey string, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry := Entry{
+		Pubkey: pubkey,
+		Error:  err.Error(),
+		Time:   time.Now(),
+	}
+
+	if element, ok := t.entries[pubkey]; ok {
+		element.Value = entry
+		t.order.MoveToFront(element)
+		return
+	}
+
+	t.entries[pubkey] = t.order.PushFront(entry)
+
+	if t.order.Len() > t.capacity {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.entries, oldest.Value.(Entry).Pubkey)
+	}
+}
+
+// Clear removes the error of a peer, once it has been configured successfully
+func (t *Tracker) Clear(pubkey string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if element, ok := t.entries[pubkey]; ok {
+		t.order.Remove(element)
+		delete(t.entries, pubkey)
+	}
+}
+
+// Entries returns the errors of the peers, most recent first
+func (t *Tracker) Entries() []Entry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entries := make([]Entry, 0, t.order.Len())
+	for element := t.order.Front(); element != nil; element = element.Next() {
+		entries = append(entries, element.Value.(Entry))
+	}
+
+	return entries
+}
+
+// ServeHTTP responds with the errors of the peers as JSON
+func (t *Tracker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(t.Entries())
+}
@@ -0,0 +1,77 @@
+package peererrors_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mullvad/wg-manager/peererrors"
+)
+
+func pubkeys(entries []peererrors.Entry) []string {
+	keys := []string{}
+	for _, entry := range entries {
+		keys = append(keys, entry.Pubkey)
+	}
+
+	return keys
+}
+
+func TestTracker(t *testing.T) {
+	tracker := peererrors.New(2)
+
+	tracker.Record("a", errors.New("error a"))
+	tracker.Record("b", errors.New("error b"))
+
+	t.Run("record", func(t *testing.T) {
+		expected := []string{"b", "a"}
+		if keys := pubkeys(tracker.Entries()); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("got unexpected result, wanted %v, got %v", expected, keys)
+		}
+	})
+
+	t.Run("evict least recently failed", func(t *testing.T) {
+		tracker.Record("a", errors.New("error a again"))
+		tracker.Record("c", errors.New("error c"))
+
+		expected := []string{"c", "a"}
+		if keys := pubkeys(tracker.Entries()); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("got unexpected result, wanted %v, got %v", expected, keys)
+		}
+
+		if err := tracker.Entries()[1].Error; err != "error a again" {
+			t.Errorf("got unexpected error %s", err)
+		}
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		tracker.Clear("c")
+
+		expected := []string{"a"}
+		if keys := pubkeys(tracker.Entries()); !reflect.DeepEqual(keys, expected) {
+			t.Errorf("got unexpected result, wanted %v, got %v", expected, keys)
+		}
+	})
+
+	t.Run("serve http", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		tracker.ServeHTTP(recorder, httptest.NewRequest("GET", "/peers/errors", nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got unexpected status code %d", recorder.Code)
+		}
+
+		var entries []peererrors.Entry
+		err := json.Unmarshal(recorder.Body.Bytes(), &entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if keys := pubkeys(entries); !reflect.DeepEqual(keys, []string{"a"}) {
+			t.Errorf("got unexpected result %v", keys)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package peerhook
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/shell"
+)
+
+// Actions of events that commands are run for
+const (
+	ActionAdd    = "ADD"
+	ActionRemove = "REMOVE"
+)
+
+// Hook is a utility for running external commands when peers are added or removed, to provision site-specific resources for them
+// The commands are run one at a time in the order of the events, so that the teardown of a peer never precedes its setup
+type Hook struct {
+	addCommand    string
+	removeCommand string
+	timeout       time.Duration
+	metrics       *statsd.Client
+	queue         chan Event
+}
+
+// Event describes a peer being added or removed, it's passed to the command as environment variables
+type Event struct {
+	Action string
+	Peer   api.WireguardPeer
+}
+
+// New returns a new Hook instance, which runs the add and remove commands with sh, killing them if they run for longer than the timeout
+// Either command may be empty, in which case nothing is run for that action
+// Up to queueSize events are buffered while a command is running, further events are dropped
+func New(addCommand string, removeCommand string, timeout time.Duration, queueSize int, metrics *statsd.Client) *Hook {
+	return &Hook{
+		addCommand:    addCommand,
+		removeCommand: removeCommand,
+		timeout:       timeout,
+		metrics:       metrics,
+		queue:         make(chan Event, queueSize),
+	}
+}
+
+// Trigger queues a run of the command for the action of the event without blocking
+// Returns whether the run was queued, events without a command are ignored and events are dropped if the queue is full
+func (h *Hook) Trigger(event Event) bool {
+	if h.command(event.Action) == "" {
+		return false
+	}
+
+	select {
+	case h.queue <- event:
+		return true
+	default:
+		h.metrics.Increment("peer_command_dropped")
+		return false
+	}
+}
+
+// Run runs the commands for queued events until the given context is canceled
+func (h *Hook) Run(ctx context.Context) {
+	for {
+		select {
+		case event := <-h.queue:
+			err := h.run(ctx, event)
+			if err != nil {
+				log.Printf("error running %s command for peer %s %s", event.Action, event.Peer.Fingerprint(), err.Error())
+				h.metrics.Increment("peer_command_error")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *Hook) command(action string) string {
+	switch action {
+	case ActionAdd:
+		return h.addCommand
+	case ActionRemove:
+		return h.removeCommand
+	default:
+		return ""
+	}
+}
+
+func (h *Hook) run(ctx context.Context, event Event) error {
+	t := h.metrics.NewTiming()
+	err := shell.Run(ctx, h.command(event.Action), event.env(), h.timeout)
+	t.Send("peer_command_time")
+
+	return err
+}
+
+func (e Event) env() []string {
+	return []string{
+		"WG_PEER_ACTION=" + e.Action,
+		"WG_PEER_PUBKEY=" + e.Peer.Pubkey,
+		"WG_PEER_IPV4=" + e.Peer.IPv4,
+		"WG_PEER_IPV6=" + e.Peer.IPv6,
+		"WG_PEER_KIND=" + e.Peer.Kind,
+	}
+}
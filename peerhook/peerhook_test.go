@@ -0,0 +1,113 @@
+package peerhook_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/peerhook"
+)
+
+var peerFixture = api.WireguardPeer{
+	IPv4:   "10.99.0.1/32",
+	IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
+	Pubkey: "a",
+}
+
+func TestHook(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output")
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := peerhook.New(
+		"echo $WG_PEER_ACTION $WG_PEER_PUBKEY $WG_PEER_IPV4 $WG_PEER_IPV6 >> "+output,
+		"echo $WG_PEER_ACTION $WG_PEER_PUBKEY >> "+output,
+		time.Second*5, 10, metrics)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go h.Run(ctx)
+
+	for _, action := range []string{peerhook.ActionAdd, "UPDATE_PORTS", peerhook.ActionRemove} {
+		h.Trigger(peerhook.Event{Action: action, Peer: peerFixture})
+	}
+
+	expected := "ADD a 10.99.0.1/32 fc00:bbbb:bbbb:bb01::1/128\nREMOVE a\n"
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		content, err := ioutil.ReadFile(output)
+		if err == nil && string(content) == expected {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for commands, got %q", content)
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestHookDisabledAction(t *testing.T) {
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := peerhook.New("true", "", time.Second, 1, metrics)
+
+	if h.Trigger(peerhook.Event{Action: peerhook.ActionRemove, Peer: peerFixture}) {
+		t.Error("queued an event without a command")
+	}
+
+	if !h.Trigger(peerhook.Event{Action: peerhook.ActionAdd, Peer: peerFixture}) {
+		t.Error("event was dropped")
+	}
+
+	// The queue is full, as nothing is running the commands
+	if h.Trigger(peerhook.Event{Action: peerhook.ActionAdd, Peer: peerFixture}) {
+		t.Error("event wasn't dropped")
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output")
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The slow command is killed, so that the next one runs
+	h := peerhook.New("exec sleep 10", "echo $WG_PEER_ACTION > "+output, time.Millisecond*100, 10, metrics)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go h.Run(ctx)
+
+	h.Trigger(peerhook.Event{Action: peerhook.ActionAdd, Peer: peerFixture})
+	h.Trigger(peerhook.Event{Action: peerhook.ActionRemove, Peer: peerFixture})
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		content, err := ioutil.ReadFile(output)
+		if err == nil && string(content) == "REMOVE\n" {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for command, got %q", content)
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
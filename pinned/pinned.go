@@ -0,0 +1,171 @@
+package pinned
+
+import (
+	"bufio"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// List is a list of pinned peers, which are kept even if the API omits them
+// The last record seen from the API is kept for each pinned peer, so that its configuration can be retained
+type List struct {
+	path  string
+	keys  map[string]struct{}
+	peers map[string]api.WireguardPeer
+	// When each retained peer last had a handshake, or started being retained if it hasn't had one since, see Stale
+	lastActive map[string]time.Time
+	mutex      sync.Mutex
+}
+
+// New reads the pinned public keys from the file at the given path, and returns a new List instance
+// The file contains one public key per line, empty lines and lines starting with # are ignored
+func New(path string) (*List, error) {
+	l := &List{
+		path:       path,
+		peers:      make(map[string]api.WireguardPeer),
+		lastActive: make(map[string]time.Time),
+	}
+
+	err := l.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Reload reads the pinned public keys from disk again
+func (l *List) Reload() error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	keys := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keys[line] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.keys = keys
+
+	// Forget the records of peers that are no longer pinned
+	for key := range l.peers {
+		if _, ok := keys[key]; !ok {
+			delete(l.peers, key)
+			delete(l.lastActive, key)
+		}
+	}
+
+	return nil
+}
+
+// Keys returns the pinned public keys
+func (l *List) Keys() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	keys := make([]string, 0, len(l.keys))
+	for key := range l.keys {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// Pinned checks whether the peer with the given public key is pinned
+func (l *List) Pinned(pubkey string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, ok := l.keys[pubkey]
+	return ok
+}
+
+// Retain adds the last seen records of the pinned peers that are missing from the given peers
+// It returns the resulting peers, as well as the public keys of the pinned peers that were missing
+func (l *List) Retain(peers api.WireguardPeerList) (api.WireguardPeerList, []string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	present := make(map[string]struct{})
+	for _, peer := range peers {
+		if _, ok := l.keys[peer.Pubkey]; ok {
+			present[peer.Pubkey] = struct{}{}
+			l.peers[peer.Pubkey] = peer
+			delete(l.lastActive, peer.Pubkey)
+		}
+	}
+
+	var missing []string
+	for key := range l.keys {
+		if _, ok := present[key]; ok {
+			continue
+		}
+
+		missing = append(missing, key)
+
+		// Without a record the peer can't be added back, but wireguard still leaves it in place
+		if peer, ok := l.peers[key]; ok {
+			peers = append(peers, peer)
+
+			if _, ok := l.lastActive[key]; !ok {
+				l.lastActive[key] = time.Now()
+			}
+		}
+	}
+
+	return peers, missing
+}
+
+// Stale returns the records of the retained peers that haven't had a handshake within the threshold, least recently active first
+// The handshakes are the latest handshake of each peer keyed by public key, and are used to keep track of when the peers were last active,
+// as wireguard resets the handshakes of inactive peers
+func (l *List) Stale(handshakes map[string]time.Time, now time.Time, threshold time.Duration) (stale api.WireguardPeerList) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for key, lastActive := range l.lastActive {
+		if handshake := handshakes[key]; handshake.After(lastActive) {
+			lastActive = handshake
+			l.lastActive[key] = handshake
+		}
+
+		if now.Sub(lastActive) > threshold {
+			stale = append(stale, l.peers[key])
+		}
+	}
+
+	sort.Slice(stale, func(i int, j int) bool {
+		return l.lastActive[stale[i].Pubkey].Before(l.lastActive[stale[j].Pubkey])
+	})
+
+	return stale
+}
+
+// Forget drops the record of the peer with the given public key, so that it's no longer retained until the API returns it again
+func (l *List) Forget(pubkey string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.peers, pubkey)
+	delete(l.lastActive, pubkey)
+}
@@ -0,0 +1,146 @@
+package pinned_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/pinned"
+)
+
+var pinnedPeer = api.WireguardPeer{
+	IPv4:   "10.99.0.1/32",
+	IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
+	Ports:  []int{1234},
+	Pubkey: strings.Repeat("a", 44),
+}
+
+var otherPeer = api.WireguardPeer{
+	IPv4:   "10.99.0.2/32",
+	IPv6:   "fc00:bbbb:bbbb:bb01::2/128",
+	Pubkey: strings.Repeat("b", 44),
+}
+
+func TestList(t *testing.T) {
+	directory, err := ioutil.TempDir("", "wg-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "pinned")
+	err = ioutil.WriteFile(path, []byte("# monitoring\n"+pinnedPeer.Pubkey+"\n\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := pinned.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("keys", func(t *testing.T) {
+		if !reflect.DeepEqual(list.Keys(), []string{pinnedPeer.Pubkey}) {
+			t.Errorf("got unexpected keys %v", list.Keys())
+		}
+	})
+
+	t.Run("missing without record", func(t *testing.T) {
+		peers, missing := list.Retain(api.WireguardPeerList{otherPeer})
+
+		if !reflect.DeepEqual(peers, api.WireguardPeerList{otherPeer}) {
+			t.Errorf("got unexpected peers %+v", peers)
+		}
+
+		if !reflect.DeepEqual(missing, []string{pinnedPeer.Pubkey}) {
+			t.Errorf("got unexpected missing keys %v", missing)
+		}
+	})
+
+	t.Run("present", func(t *testing.T) {
+		peers, missing := list.Retain(api.WireguardPeerList{pinnedPeer, otherPeer})
+
+		if !reflect.DeepEqual(peers, api.WireguardPeerList{pinnedPeer, otherPeer}) {
+			t.Errorf("got unexpected peers %+v", peers)
+		}
+
+		if len(missing) != 0 {
+			t.Errorf("got unexpected missing keys %v", missing)
+		}
+	})
+
+	t.Run("retained", func(t *testing.T) {
+		peers, missing := list.Retain(api.WireguardPeerList{otherPeer})
+
+		if !reflect.DeepEqual(peers, api.WireguardPeerList{otherPeer, pinnedPeer}) {
+			t.Errorf("got unexpected peers %+v", peers)
+		}
+
+		if !reflect.DeepEqual(missing, []string{pinnedPeer.Pubkey}) {
+			t.Errorf("got unexpected missing keys %v", missing)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		// The peer started being retained by the previous subtest
+		stale := list.Stale(nil, time.Now(), time.Hour)
+		if len(stale) != 0 {
+			t.Errorf("got unexpected stale peers %+v", stale)
+		}
+
+		stale = list.Stale(nil, time.Now().Add(time.Hour*2), time.Hour)
+		if !reflect.DeepEqual(stale, api.WireguardPeerList{pinnedPeer}) {
+			t.Errorf("got unexpected stale peers %+v", stale)
+		}
+
+		// A recent handshake makes the peer active again
+		handshakes := map[string]time.Time{pinnedPeer.Pubkey: time.Now().Add(time.Hour * 2)}
+		stale = list.Stale(handshakes, time.Now().Add(time.Hour*2), time.Hour)
+		if len(stale) != 0 {
+			t.Errorf("got unexpected stale peers %+v", stale)
+		}
+	})
+
+	t.Run("forget", func(t *testing.T) {
+		list.Forget(pinnedPeer.Pubkey)
+
+		peers, missing := list.Retain(api.WireguardPeerList{otherPeer})
+		if !reflect.DeepEqual(peers, api.WireguardPeerList{otherPeer}) {
+			t.Errorf("got unexpected peers %+v", peers)
+		}
+
+		if !reflect.DeepEqual(missing, []string{pinnedPeer.Pubkey}) {
+			t.Errorf("got unexpected missing keys %v", missing)
+		}
+
+		stale := list.Stale(nil, time.Now().Add(time.Hour*24), time.Hour)
+		if len(stale) != 0 {
+			t.Errorf("got unexpected stale peers %+v", stale)
+		}
+
+		// Let the API return the peer again, for the following subtests
+		list.Retain(api.WireguardPeerList{pinnedPeer})
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		err := ioutil.WriteFile(path, []byte(""), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = list.Reload()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peers, missing := list.Retain(api.WireguardPeerList{otherPeer})
+		if !reflect.DeepEqual(peers, api.WireguardPeerList{otherPeer}) || len(missing) != 0 {
+			t.Errorf("got unexpected result %+v, %v", peers, missing)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package portforward
+
+import (
+	"log"
+	"reflect"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Get the current rules of the chain, from the rule cache if it's enabled and populated
+// The returned map is the cached one, so changes to the chain have to go through cacheRule and uncacheRule
+func (p *Portforward) currentRules(chain Chain) (map[string]iptables.Protocol, error) {
+	if p.options.RuleCacheSyncs < 1 {
+		return p.getCurrentRules(chain)
+	}
+
+	if rules, ok := p.ruleCache[chain]; ok {
+		return rules, nil
+	}
+
+	rules, err := p.getCurrentRules(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	p.ruleCache[chain] = rules
+	return rules, nil
+}
+
+// Re-list the rules of every Nth synchronization, to detect rules that were changed outside of wg-manager
+func (p *Portforward) checkRuleDrift() {
+	if p.options.RuleCacheSyncs < 1 {
+		return
+	}
+
+	p.syncCount++
+	if p.syncCount%p.options.RuleCacheSyncs != 0 {
+		return
+	}
+
+	for chain, cachedRules := range p.ruleCache {
+		rules, err := p.getCurrentRules(chain)
+		if err != nil {
+			// Leave it to the next synchronization to list the rules
+			delete(p.ruleCache, chain)
+			continue
+		}
+
+		if !reflect.DeepEqual(rules, cachedRules) {
+			p.metrics.Increment("portforwarding_rule_drift")
+			log.Printf("iptables rules in chain %s were changed outside of wg-manager", chain.name)
+		}
+
+		p.ruleCache[chain] = rules
+	}
+}
+
+// Record a rule that was added to the chain
+func (p *Portforward) cacheRule(chain Chain, rule string, protocol iptables.Protocol) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if rules, ok := p.ruleCache[chain]; ok {
+		rules[rule] = protocol
+	}
+}
+
+// Record a rule that was removed from the chain
+func (p *Portforward) uncacheRule(chain Chain, rule string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if rules, ok := p.ruleCache[chain]; ok {
+		delete(rules, rule)
+	}
+}
+
+// Drop the cached rules of the chain, so that they're listed again
+// This is done when a change fails, as the state of the chain is unknown
+func (p *Portforward) invalidateRules(chain Chain) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.ruleCache, chain)
+}
@@ -0,0 +1,93 @@
+package portforward
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// Matches the summary that conntrack prints after deleting entries
+var conntrackDeletedRegexp = regexp.MustCompile(`(\d+) flow entr(y has|ies have) been deleted`)
+
+// conntrackFilter selects the conntrack entries of connections forwarded to an ip on a port
+type conntrackFilter struct {
+	family            string
+	transportProtocol string
+	ip                net.IP
+	port              int
+}
+
+// Flush the conntrack entries of connections forwarded to the peer, so that they stop being forwarded immediately
+func (p *Portforward) flushConntrack(peer api.WireguardPeer) (lastErr error) {
+	var flushed int
+
+	for _, filter := range p.conntrackFilters(peer) {
+		count, err := deleteConntrackEntries(filter)
+		if err != nil {
+			lastErr = fmt.Errorf("error flushing conntrack entries: %s", err.Error())
+			continue
+		}
+
+		flushed += count
+	}
+
+	p.metrics.Count("conntrack_flushed", flushed)
+	return lastErr
+}
+
+// Get the filters for the connections forwarded to the peer, one for each of its ips, protocols and ports
+func (p *Portforward) conntrackFilters(peer api.WireguardPeer) (filters []conntrackFilter) {
+	for _, ip := range p.peerIPs(peer) {
+		family := "ipv4"
+		if ip.To4() == nil {
+			family = "ipv6"
+		}
+
+		for _, transportProtocol := range transportProtocols {
+			for _, port := range peer.Ports {
+				filters = append(filters, conntrackFilter{
+					family:            family,
+					transportProtocol: transportProtocol,
+					ip:                ip,
+					port:              port,
+				})
+			}
+		}
+	}
+
+	return
+}
+
+// Get the arguments to conntrack for deleting the entries matching the filter
+// Connections forwarded to the ip are the ones where it's the source of the reply
+func (f conntrackFilter) args() []string {
+	return []string{"-D", "-f", f.family, "-p", f.transportProtocol,
+		"--orig-port-dst", strconv.Itoa(f.port), "--reply-src", f.ip.String()}
+}
+
+func deleteConntrackEntries(filter conntrackFilter) (int, error) {
+	output, err := exec.Command("conntrack", filter.args()...).CombinedOutput()
+
+	// Conntrack exits with status 1 if there were no entries to delete
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return parseConntrackDeleted(output)
+}
+
+// Get the number of deleted entries from the output of conntrack, which is zero if it doesn't include the summary
+func parseConntrackDeleted(output []byte) (int, error) {
+	match := conntrackDeletedRegexp.FindSubmatch(output)
+	if match == nil {
+		return 0, nil
+	}
+
+	return strconv.Atoi(string(match[1]))
+}
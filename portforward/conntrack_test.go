@@ -0,0 +1,120 @@
+package portforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mullvad/wg-manager/api"
+)
+
+// Unit tests for the conntrack filters, which test unexported functions as running conntrack requires root
+
+var conntrackPeerFixture = api.WireguardPeer{
+	IPv4:           "10.99.0.1/32",
+	IPv6:           "fc00:bbbb:bbbb:bb01::1/128",
+	Ports:          []int{1234},
+	ForwardTargets: []string{"10.64.0.1"},
+}
+
+func TestConntrackFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  Options
+		peer     api.WireguardPeer
+		expected [][]string
+	}{
+		{
+			"both families",
+			Options{},
+			conntrackPeerFixture,
+			[][]string{
+				{"-D", "-f", "ipv4", "-p", "tcp", "--orig-port-dst", "1234", "--reply-src", "10.99.0.1"},
+				{"-D", "-f", "ipv4", "-p", "udp", "--orig-port-dst", "1234", "--reply-src", "10.99.0.1"},
+				{"-D", "-f", "ipv6", "-p", "tcp", "--orig-port-dst", "1234", "--reply-src", "fc00:bbbb:bbbb:bb01::1"},
+				{"-D", "-f", "ipv6", "-p", "udp", "--orig-port-dst", "1234", "--reply-src", "fc00:bbbb:bbbb:bb01::1"},
+			},
+		},
+		{
+			"ipv4 only",
+			Options{},
+			api.WireguardPeer{IPv4: "10.99.0.1/32", Ports: []int{1234, 4321}},
+			[][]string{
+				{"-D", "-f", "ipv4", "-p", "tcp", "--orig-port-dst", "1234", "--reply-src", "10.99.0.1"},
+				{"-D", "-f", "ipv4", "-p", "tcp", "--orig-port-dst", "4321", "--reply-src", "10.99.0.1"},
+				{"-D", "-f", "ipv4", "-p", "udp", "--orig-port-dst", "1234", "--reply-src", "10.99.0.1"},
+				{"-D", "-f", "ipv4", "-p", "udp", "--orig-port-dst", "4321", "--reply-src", "10.99.0.1"},
+			},
+		},
+		{
+			"load balanced targets",
+			Options{LoadBalance: true},
+			api.WireguardPeer{IPv6: "fc00:bbbb:bbbb:bb01::1/128", Ports: []int{1234}, ForwardTargets: []string{"10.64.0.1"}},
+			[][]string{
+				{"-D", "-f", "ipv6", "-p", "tcp", "--orig-port-dst", "1234", "--reply-src", "fc00:bbbb:bbbb:bb01::1"},
+				{"-D", "-f", "ipv6", "-p", "udp", "--orig-port-dst", "1234", "--reply-src", "fc00:bbbb:bbbb:bb01::1"},
+				{"-D", "-f", "ipv4", "-p", "tcp", "--orig-port-dst", "1234", "--reply-src", "10.64.0.1"},
+				{"-D", "-f", "ipv4", "-p", "udp", "--orig-port-dst", "1234", "--reply-src", "10.64.0.1"},
+			},
+		},
+		{
+			"no ports",
+			Options{},
+			api.WireguardPeer{IPv4: "10.99.0.1/32", IPv6: "fc00:bbbb:bbbb:bb01::1/128"},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Portforward{options: test.options}
+
+			var args [][]string
+			for _, filter := range p.conntrackFilters(test.peer) {
+				args = append(args, filter.args())
+			}
+
+			if diff := cmp.Diff(test.expected, args); diff != "" {
+				t.Errorf("unexpected conntrack arguments (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConntrackFilterFamily(t *testing.T) {
+	// IPv4-mapped IPv6 addresses are 16 bytes long, but are still IPv4 addresses to conntrack
+	p := &Portforward{}
+	filters := p.conntrackFilters(api.WireguardPeer{IPv4: "::ffff:10.99.0.1/128", Ports: []int{1234}})
+	if len(filters) != 2 {
+		t.Fatalf("got %d filters, wanted 2", len(filters))
+	}
+
+	for _, filter := range filters {
+		if filter.family != "ipv4" || !filter.ip.Equal(net.ParseIP("10.99.0.1")) {
+			t.Errorf("unexpected filter %+v", filter)
+		}
+	}
+}
+
+func TestParseConntrackDeleted(t *testing.T) {
+	tests := []struct {
+		output   string
+		expected int
+	}{
+		{"conntrack v1.4.5 (conntrack-tools): 1 flow entry has been deleted.\n", 1},
+		{"conntrack v1.4.5 (conntrack-tools): 12 flow entries have been deleted.\n", 12},
+		{"tcp      6 431999 ESTABLISHED src=10.64.0.2 dst=10.99.0.1\nconntrack v1.4.5 (conntrack-tools): 3 flow entries have been deleted.\n", 3},
+		{"", 0},
+	}
+
+	for _, test := range tests {
+		count, err := parseConntrackDeleted([]byte(test.output))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != test.expected {
+			t.Errorf("got %d deleted entries from %q, wanted %d", count, test.output, test.expected)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package portforward
+
+import (
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Flushed checks whether every rule was removed from a family of a chain that the last update left rules in,
+// which happens when another tool flushes the chains
+// Each family is checked on its own, as iptables and ip6tables are flushed separately
+// The rule cache of the flushed chains is dropped, so that the next update adds the rules again
+// Only the chains are listed, so that it's cheap enough to check frequently
+func (p *Portforward) Flushed() (bool, error) {
+	flushed := false
+	for _, chain := range p.chains {
+		if len(p.populated[chain]) == 0 {
+			continue
+		}
+
+		rules, err := p.getCurrentRules(chain)
+		if err != nil {
+			return false, err
+		}
+
+		owned := make(map[iptables.Protocol]bool)
+		for rule, family := range rules {
+			if p.ownsRule(rule) {
+				owned[family] = true
+			}
+		}
+
+		for family := range p.populated[chain] {
+			if !owned[family] {
+				p.invalidateRules(chain)
+				flushed = true
+				break
+			}
+		}
+	}
+
+	return flushed, nil
+}
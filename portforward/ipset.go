@@ -0,0 +1,125 @@
+package portforward
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/digineo/go-ipset/v2"
+	"github.com/mdlayher/netlink"
+	"github.com/mullvad/wg-manager/ratelog"
+	"github.com/ti-mo/netfilter"
+)
+
+// Reconcile the ipsets with the ingress addresses, adding the missing ones and periodically removing any other members
+// The ipsets are the destinations that the DNAT rules match, so they must only hold the addresses that forwarded traffic arrives on
+func (p *Portforward) updateIPSets() {
+	conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+	if err != nil {
+		log.Printf("error connecting to ipset %s", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	members, err := getIPSetMembers(conn)
+	if err != nil {
+		log.Printf("error listing ipsets %s", err.Error())
+		return
+	}
+
+	ipv4Members := members[p.ipsetIPv4]
+	ipv6Members := members[p.ipsetIPv6]
+	if ipv4Members == nil {
+		ipv4Members = make(map[string]struct{})
+	}
+	if ipv6Members == nil {
+		ipv6Members = make(map[string]struct{})
+	}
+
+	ipv4Addresses := make(map[string]struct{})
+	ipv6Addresses := make(map[string]struct{})
+
+	for _, ip := range p.options.IngressAddresses {
+		if ip.To4() != nil {
+			p.addIPSetMember(conn, p.ipsetIPv4, ip, ipv4Members)
+			ipv4Addresses[ip.String()] = struct{}{}
+		} else {
+			p.addIPSetMember(conn, p.ipsetIPv6, ip, ipv6Members)
+			ipv6Addresses[ip.String()] = struct{}{}
+		}
+	}
+
+	// Remove the members that aren't ingress addresses, periodically as it's rarely needed
+	if p.options.IPSetOrphanInterval > 0 && time.Since(p.lastOrphanCheck) >= p.options.IPSetOrphanInterval {
+		p.lastOrphanCheck = time.Now()
+
+		removed := p.removeIPSetOrphans(conn, p.ipsetIPv4, ipv4Members, ipv4Addresses)
+		removed += p.removeIPSetOrphans(conn, p.ipsetIPv6, ipv6Members, ipv6Addresses)
+		if removed > 0 {
+			p.metrics.Count("ipset_orphans_removed", removed)
+			log.Printf("removed %d ipset members that aren't ingress addresses", removed)
+		}
+	}
+
+	p.metrics.Gauge("ipset_members_ipv4", len(ipv4Members))
+	p.metrics.Gauge("ipset_members_ipv6", len(ipv6Members))
+}
+
+func (p *Portforward) addIPSetMember(conn *ipset.Conn, name string, ip net.IP, members map[string]struct{}) {
+	if _, ok := members[ip.String()]; ok {
+		return
+	}
+
+	err := conn.Add(name, ipset.NewEntry(ipset.EntryIP(ip)))
+	if err != nil {
+		ratelog.Printf("ipset", "error adding %s to ipset %s: %s", ip, name, err.Error())
+		return
+	}
+
+	members[ip.String()] = struct{}{}
+}
+
+// Remove the members of the ipset which aren't one of the given addresses, returning how many were removed
+func (p *Portforward) removeIPSetOrphans(conn *ipset.Conn, name string, members map[string]struct{}, addresses map[string]struct{}) (removed int) {
+	for member := range members {
+		if _, ok := addresses[member]; ok {
+			continue
+		}
+
+		err := conn.Delete(name, ipset.NewEntry(ipset.EntryIP(net.ParseIP(member))))
+		if err != nil {
+			ratelog.Printf("ipset", "error removing %s from ipset %s: %s", member, name, err.Error())
+			continue
+		}
+
+		delete(members, member)
+		removed++
+	}
+
+	return removed
+}
+
+// Get the ip's in each ipset, keyed by ipset name
+func getIPSetMembers(conn *ipset.Conn) (map[string]map[string]struct{}, error) {
+	ipsets, err := conn.ListAll()
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[string]map[string]struct{})
+	for _, set := range ipsets {
+		// Large sets may be split over several messages
+		name := set.Name.Get()
+		if _, ok := members[name]; !ok {
+			members[name] = make(map[string]struct{})
+		}
+
+		for _, entry := range set.Entries {
+			if entry.IP.IsSet() {
+				members[name][entry.IP.Get().String()] = struct{}{}
+			}
+		}
+	}
+
+	return members, nil
+}
@@ -1,17 +1,24 @@
 package portforward
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/digineo/go-ipset/v2"
+	"github.com/infosum/statsd"
 	"github.com/mdlayher/netlink"
 	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/ratelog"
 	"github.com/ti-mo/netfilter"
 )
 
@@ -22,30 +29,120 @@ type Portforward struct {
 	chains    []Chain
 	ipsetIPv4 string
 	ipsetIPv6 string
+	metrics   *statsd.Client
+	options   Options
+
+	// The rules in each chain, if the rule cache is enabled
+	ruleCache map[Chain]map[string]iptables.Protocol
+	syncCount int
+
+	// When orphaned ipset members were last removed
+	lastOrphanCheck time.Time
+
+	// Whether an update has run to completion, after which adding rules is no longer paced
+	installed bool
+
+	// The families of each chain that the last update left rules in, to detect them being flushed, see Flushed
+	populated map[Chain]map[iptables.Protocol]bool
+
+	// The number of rules added and removed by the last update, see RuleChanges
+	ruleChanges int
+
+	// The rejected ports of each peer, so that a rejection is only counted when it's new rather than on every update
+	rejectedPorts map[string]map[int]bool
+	// The number of ports of each peer that was truncated, so that a truncation is only counted when it's new
+	truncatedPorts map[string]int
+
+	// Guards the rule cache and the rule changes while the families are applied concurrently
+	mutex sync.Mutex
+}
+
+// Options contains optional settings for portforwarding
+type Options struct {
+	// Table is the iptables table containing the portforwarding chains, the nat table is used if it's empty
+	Table string
+	// RulePosition is the position in the chain to insert rules at, rules are appended to the chain if it's zero
+	RulePosition int
+	// DSCPChainPrefix is the prefix of the mangle chains to use for DSCP marking of forwarded traffic
+	// DSCP marking is disabled if it's empty
+	DSCPChainPrefix string
+	// CreateIPSets creates the ipsets if they don't exist, instead of returning an error
+	CreateIPSets bool
+	// IngressAddresses are the public addresses of the server that forwarded traffic arrives on
+	IngressAddresses []net.IP
+	// PopulateIPSets fills the ipsets with the IngressAddresses when updating portforwarding, see IPSetOrphanInterval for removing other members
+	PopulateIPSets bool
+	// LoadBalance distributes forwarded connections over the forward targets of peers, instead of the peer ip
+	LoadBalance bool
+	// FlushConntrack removes the conntrack entries of forwarded connections when removing portforwarding for a peer
+	FlushConntrack bool
+	// RuleCacheSyncs enables caching of the rules in each chain, instead of listing them for every change
+	// The rules are listed again every RuleCacheSyncs synchronizations to detect changes made outside of wg-manager
+	// The rule cache is disabled if it's zero
+	RuleCacheSyncs int
+	// IPTablesTimeout is the max duration of an iptables operation, after which it's abandoned and an error is returned
+	// Operations never time out if it's zero
+	IPTablesTimeout time.Duration
+	// SharedChains leaves rules that weren't added by wg-manager in the chains, for chains that are shared with other tools
+	// Rules added by wg-manager are recognized by their comment, see ruleComment
+	SharedChains bool
+	// AllowedPorts are the ports that peers may have forwarded, other ports are left out of the rules
+	// All ports are allowed if it's empty
+	AllowedPorts []PortRange
+	// MaxPortsPerPeer is the max number of ports forwarded for a single peer, the lowest-numbered ports are kept
+	// The number of ports is unlimited if it's zero
+	MaxPortsPerPeer int
+	// IPSetOrphanInterval is how often to remove ipset members that aren't ingress addresses when populating the ipsets
+	// Orphaned members are never removed if it's zero
+	IPSetOrphanInterval time.Duration
+	// MatchAllowedIPs matches forwarded traffic by the IngressAddresses instead of by the ipsets, forwarding it to the allowed ip's of the peer
+	// The ipsets aren't used at all, and don't have to exist
+	MatchAllowedIPs bool
+	// InstallRate is the max number of rules per second to add until an update has run to completion,
+	// to avoid a spike in CPU usage when adding the rules of every peer on a cold start
+	// Rules are added as fast as possible if it's zero
+	InstallRate int
+	// ParallelFamilies applies the IPv4 and IPv6 rules of UpdatePortforwarding concurrently, instead of one family after the other
+	// With the legacy iptables backend both families take the same xtables lock, which limits the speedup to the work outside of it
+	ParallelFamilies bool
+	// InterfaceChains are the forward interfaces that get chains of their own, named <prefix>_<INTERFACE>_<PROTOCOL>, eg PORTFORWARDING_ETH1_TCP
+	// The rules of peers forwarding on one of them are put in its chains, and those of other peers in the chains of the prefix
+	// All rules are put in the chains of the prefix if it's empty
+	InterfaceChains []string
 }
 
-// Chain contains a chain name and a transport protocol
+// Chain contains a chain name, the table it belongs to, a transport protocol and the forward interface it's for, if any
 type Chain struct {
 	name              string
+	table             string
 	transportProtocol string
+	forwardInterface  string
 }
 
-// Iptables table to operate against
-const table = "nat"
+// Iptables tables to operate against
+const (
+	defaultTable = "nat"
+	mangleTable  = "mangle"
+)
+
+// The max value of a DSCP mark
+const maxDSCP = 63
+
+// The type of ipset to create if they don't exist
+const ipsetType = "hash:ip"
 
 // Transport protocols that we want to create chains for
 var transportProtocols = []string{"tcp", "udp"}
 
 // New validates the addresses, ensures that the iptables portforwarding chains exists, and returns a new Portforward instance
-func New(chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string) (*Portforward, error) {
-	var chains []Chain
-	for _, transportProtocol := range transportProtocols {
-		chains = append(chains, Chain{
-			name:              chainPrefix + "_" + strings.ToUpper(transportProtocol),
-			transportProtocol: transportProtocol,
-		})
+func New(chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string, metrics *statsd.Client, options Options) (*Portforward, error) {
+	options, err := validateOptions(options)
+	if err != nil {
+		return nil, err
 	}
 
+	chains := newOptionChains(chainPrefix, options)
+
 	ipt, err := newIPTables(chains, iptables.ProtocolIPv4)
 	if err != nil {
 		return nil, err
@@ -56,14 +153,16 @@ func New(chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string) (*Por
 		return nil, err
 	}
 
-	err = validateIPSet(ipsetTableIPv4)
-	if err != nil {
-		return nil, err
-	}
+	if !options.MatchAllowedIPs {
+		err = validateIPSet(ipsetTableIPv4, netfilter.ProtoIPv4, options.CreateIPSets)
+		if err != nil {
+			return nil, err
+		}
 
-	err = validateIPSet(ipsetTableIPv6)
-	if err != nil {
-		return nil, err
+		err = validateIPSet(ipsetTableIPv6, netfilter.ProtoIPv6, options.CreateIPSets)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &Portforward{
@@ -72,23 +171,121 @@ func New(chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string) (*Por
 		chains:    chains,
 		ipsetIPv4: ipsetTableIPv4,
 		ipsetIPv6: ipsetTableIPv6,
+		metrics:   metrics,
+		options:   options,
+		ruleCache: make(map[Chain]map[string]iptables.Protocol),
+		populated: make(map[Chain]map[iptables.Protocol]bool),
+
+		rejectedPorts:  make(map[string]map[int]bool),
+		truncatedPorts: make(map[string]int),
 	}, nil
 }
 
-func newIPTables(chains []Chain, protocol iptables.Protocol) (*iptables.IPTables, error) {
-	ipt, err := iptables.NewWithProtocol(protocol)
-	if err != nil {
-		return nil, err
+// Validate the options, and fill in the defaults of the ones that aren't set
+func validateOptions(options Options) (Options, error) {
+	if options.RulePosition < 0 {
+		return options, fmt.Errorf("invalid rule position %d", options.RulePosition)
+	}
+
+	if options.RuleCacheSyncs < 0 {
+		return options, fmt.Errorf("invalid rule cache synchronizations %d", options.RuleCacheSyncs)
+	}
+
+	if options.MaxPortsPerPeer < 0 {
+		return options, fmt.Errorf("invalid max ports per peer %d", options.MaxPortsPerPeer)
 	}
 
-	currentChains, err := ipt.ListChains("nat")
+	if options.InstallRate < 0 || options.InstallRate > int(time.Second) {
+		return options, fmt.Errorf("invalid rule install rate %d", options.InstallRate)
+	}
+
+	if options.MatchAllowedIPs && (options.PopulateIPSets || options.CreateIPSets) {
+		return options, fmt.Errorf("the ipsets can't be created or populated when matching allowed ip's")
+	}
+
+	if (options.PopulateIPSets || options.MatchAllowedIPs) && len(options.IngressAddresses) == 0 {
+		return options, fmt.Errorf("ingress addresses are required to populate the ipsets or match allowed ip's")
+	}
+
+	for _, forwardInterface := range options.InterfaceChains {
+		if !ValidInterfaceName(forwardInterface) {
+			return options, fmt.Errorf("invalid interface chain interface %q", forwardInterface)
+		}
+	}
+
+	if options.Table == "" {
+		options.Table = defaultTable
+	}
+
+	return options, nil
+}
+
+// ParseAddresses parses a comma delimited list of ip addresses, such as the ingress addresses
+func ParseAddresses(s string) ([]net.IP, error) {
+	var ips []net.IP
+	if s == "" {
+		return ips, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		ip := net.ParseIP(part)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s", part)
+		}
+
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
+
+// Get the portforwarding chains, along with the chains of the interface chain interfaces and the DSCP chains if DSCP marking is enabled
+func newOptionChains(chainPrefix string, options Options) []Chain {
+	chains := newChains(chainPrefix, options.Table)
+	for _, forwardInterface := range options.InterfaceChains {
+		for _, chain := range newChains(chainPrefix+"_"+strings.ToUpper(forwardInterface), options.Table) {
+			chain.forwardInterface = forwardInterface
+			chains = append(chains, chain)
+		}
+	}
+
+	if options.DSCPChainPrefix != "" {
+		chains = append(chains, newChains(options.DSCPChainPrefix, mangleTable)...)
+	}
+
+	return chains
+}
+
+func newChains(chainPrefix string, table string) []Chain {
+	var chains []Chain
+	for _, transportProtocol := range transportProtocols {
+		chains = append(chains, Chain{
+			name:              chainPrefix + "_" + strings.ToUpper(transportProtocol),
+			table:             table,
+			transportProtocol: transportProtocol,
+		})
+	}
+
+	return chains
+}
+
+func newIPTables(chains []Chain, protocol iptables.Protocol) (*iptables.IPTables, error) {
+	ipt, err := iptables.NewWithProtocol(protocol)
 	if err != nil {
 		return nil, err
 	}
 
+	currentChains := make(map[string][]string)
 	for _, chain := range chains {
-		if !chainExists(chain.name, currentChains) {
-			return nil, fmt.Errorf("an iptables chain named %s does not exist", chain)
+		if _, ok := currentChains[chain.table]; !ok {
+			currentChains[chain.table], err = ipt.ListChains(chain.table)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !chainExists(chain.name, currentChains[chain.table]) {
+			return nil, fmt.Errorf("an iptables chain named %s does not exist in the %s table", chain.name, chain.table)
 		}
 	}
 
@@ -106,13 +303,18 @@ func chainExists(chain string, currentChains []string) bool {
 	return false
 }
 
-func validateIPSet(name string) error {
+// Ensure that the ipset exists, optionally creating it for the given family if it doesn't
+func validateIPSet(name string, family netfilter.ProtoFamily, create bool) error {
 	conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
 	ipsets, err := conn.ListAll()
+	if err != nil {
+		return err
+	}
 
 	for _, p := range ipsets {
 		if p.Name.Get() == name {
@@ -120,223 +322,742 @@ func validateIPSet(name string) error {
 		}
 	}
 
-	return fmt.Errorf("an ipset named %s does not exist", name)
+	if !create {
+		return fmt.Errorf("an ipset named %s does not exist", name)
+	}
+
+	err = conn.Create(name, ipsetType, 0, family)
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("permission denied creating ipset %s, CAP_NET_ADMIN is required", name)
+	} else if err != nil {
+		return fmt.Errorf("error creating ipset %s: %s", name, err.Error())
+	}
+
+	log.Printf("created ipset %s", name)
+	return nil
 }
 
 // UpdatePortforwarding updates the iptables rules for portforwarding to match the given list of peers
-func (p *Portforward) UpdatePortforwarding(peers api.WireguardPeerList) {
+// All rules are attempted even if one fails, and the last error is returned
+// The update is aborted between rules if the context is canceled, leaving the rules partially updated until the next update
+func (p *Portforward) UpdatePortforwarding(ctx context.Context, peers api.WireguardPeerList) (lastErr error) {
+	p.checkRuleDrift()
+	p.ruleChanges = 0
+
+	allowedPeers := make(api.WireguardPeerList, 0, len(peers))
+	for _, peer := range peers {
+		allowedPeers = append(allowedPeers, p.allowedPorts(peer, true))
+	}
+	peers = allowedPeers
+	p.forgetLimitedPorts(peers)
+
+	// Pace adding rules until they've been fully applied once
+	var pace <-chan time.Time
+	if p.options.InstallRate > 0 && !p.installed {
+		ticker := time.NewTicker(time.Second / time.Duration(p.options.InstallRate))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
 	for _, chain := range p.chains {
 		rules := make(map[string]iptables.Protocol)
 		for _, peer := range peers {
-			if len(peer.Ports) < 1 {
+			if len(peer.Ports) < 1 || !peer.HasForwarding() {
 				continue
 			}
 
-			p.createPeerRules(peer, chain.transportProtocol, rules)
+			p.createChainRules(peer, chain, rules)
 		}
 
-		currentRules, err := p.getCurrentRules(chain.name)
+		currentRules, err := p.currentRules(chain)
 		if err != nil {
 			log.Printf("error getting current iptables rules %s", err.Error())
-			return
+			return fmt.Errorf("error getting current iptables rules: %s", err.Error())
 		}
 
-		// Add new portforwarding rules
-		for rule, protocol := range rules {
-			if _, ok := currentRules[rule]; !ok {
+		p.populated[chain] = make(map[iptables.Protocol]bool)
+		for _, family := range rules {
+			p.populated[chain][family] = true
+		}
 
-				p.insertPeerRule(protocol, table, chain.name, rule)
-				if err != nil {
-					log.Printf("error adding iptables rule")
-					continue
-				}
+		var errs []error
+		if p.options.ParallelFamilies {
+			// The families have separate tables, so their rules can be changed concurrently
+			// The current rules are split by family first, as the cached ones are changed along with the chain
+			errs = make([]error, len(families))
+			var wg sync.WaitGroup
+			for i, family := range families {
+				wg.Add(1)
+				go func(i int, family iptables.Protocol, currentRules map[string]iptables.Protocol) {
+					defer wg.Done()
+					errs[i] = p.applyChainRules(ctx, chain, []iptables.Protocol{family}, rules, currentRules, pace)
+				}(i, family, filterFamily(currentRules, family))
+			}
+			wg.Wait()
+		} else {
+			errs = []error{p.applyChainRules(ctx, chain, families, rules, currentRules, pace)}
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
+		for _, err := range errs {
+			if err != nil {
+				lastErr = err
 			}
 		}
+	}
 
-		// Remove old portforwarding rules
-		for rule, protocol := range currentRules {
-			if _, ok := rules[rule]; !ok {
-				ipt := p.iptables
-				if protocol == iptables.ProtocolIPv6 {
-					ipt = p.ip6tables
-				}
+	if p.options.PopulateIPSets {
+		p.updateIPSets()
+	}
+
+	p.installed = true
+	return lastErr
+}
 
-				err := ipt.Delete(table, chain.name, strings.Split(rule, " ")...)
-				if err != nil {
-					log.Printf("error deleting iptables rule")
-					continue
+// The families of the rules, in the order they're applied in
+var families = []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6}
+
+// Get the rules of the given family
+func filterFamily(rules map[string]iptables.Protocol, family iptables.Protocol) map[string]iptables.Protocol {
+	filtered := make(map[string]iptables.Protocol)
+	for rule, protocol := range rules {
+		if protocol == family {
+			filtered[rule] = protocol
+		}
+	}
+
+	return filtered
+}
+
+func containsFamily(families []iptables.Protocol, family iptables.Protocol) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Add the rules of the given families that are missing from the current rules of the chain,
+// and remove the current rules owned by wg-manager that aren't in the rules
+// The current rules are expected to only contain the given families, see filterFamily
+// All rules are attempted even if one fails, and the last error is returned
+func (p *Portforward) applyChainRules(ctx context.Context, chain Chain, applyFamilies []iptables.Protocol, rules map[string]iptables.Protocol,
+	currentRules map[string]iptables.Protocol, pace <-chan time.Time) (lastErr error) {
+	// Add new portforwarding rules
+	for _, rule := range p.orderRules(rules) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !containsFamily(applyFamilies, rules[rule]) {
+			continue
+		}
+
+		if _, ok := currentRules[rule]; !ok {
+			if pace != nil {
+				select {
+				case <-pace:
+				case <-ctx.Done():
+					return ctx.Err()
 				}
+			}
+
+			err := p.insertPeerRule(chain, rule, rules[rule])
+			if err != nil {
+				ratelog.Printf("iptables", "error adding iptables rule")
+				lastErr = fmt.Errorf("error adding iptables rule: %s", err.Error())
+				continue
+			}
+
+			p.countRuleChange()
+		}
+	}
+
+	// Remove old portforwarding rules
+	for rule, protocol := range currentRules {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
+		if !p.ownsRule(rule) {
+			continue
+		}
+
+		if _, ok := rules[rule]; !ok {
+			err := p.deletePeerRule(chain, rule, protocol)
+			if err != nil {
+				ratelog.Printf("iptables", "error deleting iptables rule")
+				lastErr = fmt.Errorf("error deleting iptables rule: %s", err.Error())
+				continue
 			}
+
+			p.countRuleChange()
 		}
 	}
+
+	return lastErr
+}
+
+// RuleChanges returns the number of rules that the last UpdatePortforwarding added and removed
+func (p *Portforward) RuleChanges() int {
+	return p.ruleChanges
+}
+
+func (p *Portforward) countRuleChange() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.ruleChanges++
 }
 
 // UpdateSinglePeerPortforwarding tries to add portforwarding rules for a peer while also trying to remove old rules for said peer
-func (p *Portforward) UpdateSinglePeerPortforwarding(peer api.WireguardPeer) {
-	if len(peer.Ports) < 1 {
-		return
+// A peer without ports has all of its old rules removed
+// All rules are attempted even if one fails, and the last error is returned
+func (p *Portforward) UpdateSinglePeerPortforwarding(peer api.WireguardPeer) (lastErr error) {
+	peer = p.allowedPorts(peer, true)
+	if !peer.HasForwarding() {
+		return nil
 	}
 
 	for _, chain := range p.chains {
 		rules := make(map[string]iptables.Protocol)
-		p.createPeerRules(peer, chain.transportProtocol, rules)
+		p.createChainRules(peer, chain, rules)
 
-		oldRules, err := p.getCurrentRules(chain.name)
+		oldRules, err := p.currentRules(chain)
 		if err != nil {
-			log.Printf("error getting current iptables rules %s", err.Error())
-			return
+			ratelog.Printf("iptables", "error getting current iptables rules for peer %s: %s", peer.Fingerprint(), err.Error())
+			return fmt.Errorf("error getting current iptables rules: %s", err.Error())
 		}
 
-		for rule, protocol := range rules {
-			// Add new portforwarding rules
-			p.insertPeerRule(protocol, table, chain.name, rule)
-			if err != nil {
-				log.Printf("error adding iptables rule")
+		// Add new portforwarding rules
+		var insertErr error
+		for _, rule := range p.orderRules(rules) {
+			if _, ok := oldRules[rule]; ok {
 				continue
 			}
-			// Remove old portforwarding rules
-			p.removeOldPeerRules(peer, protocol, table, chain.name, oldRules, rule)
+
+			err := p.insertPeerRule(chain, rule, rules[rule])
+			if err != nil {
+				ratelog.Printf("iptables", "error adding iptables rule for peer %s: %s", peer.Fingerprint(), err.Error())
+				insertErr = fmt.Errorf("error adding iptables rule: %s", err.Error())
+			}
 		}
 
+		// Keep the old portforwarding rules if the new ones couldn't be added
+		if insertErr != nil {
+			lastErr = insertErr
+			continue
+		}
+
+		// Remove old portforwarding rules
+		err = p.removeOldPeerRules(peer, chain, oldRules, rules)
+		if err != nil {
+			lastErr = err
+		}
 	}
+
+	return lastErr
 }
 
 // AddPortforwarding tries to add portforwarding rules for a peer without checking existing ones
-func (p *Portforward) AddPortforwarding(peer api.WireguardPeer) {
-	if len(peer.Ports) < 1 {
-		return
+// All rules are attempted even if one fails, and the last error is returned
+func (p *Portforward) AddPortforwarding(peer api.WireguardPeer) (lastErr error) {
+	peer = p.allowedPorts(peer, true)
+	if len(peer.Ports) < 1 || !peer.HasForwarding() {
+		return nil
 	}
 
 	for _, chain := range p.chains {
 		rules := make(map[string]iptables.Protocol)
-		p.createPeerRules(peer, chain.transportProtocol, rules)
+		p.createChainRules(peer, chain, rules)
 
-		for rule, protocol := range rules {
-			err := p.insertPeerRule(protocol, table, chain.name, rule)
+		for _, rule := range p.orderRules(rules) {
+			err := p.insertPeerRule(chain, rule, rules[rule])
 			if err != nil {
-				log.Printf("error adding iptables rule")
+				ratelog.Printf("iptables", "error adding iptables rule for peer %s: %s", peer.Fingerprint(), err.Error())
+				lastErr = fmt.Errorf("error adding iptables rule: %s", err.Error())
 			}
 		}
 	}
 
-	return
+	return lastErr
 }
 
 // RemovePortforwarding tries to remove portforwarding rules for a peer without checking existing ones
-func (p *Portforward) RemovePortforwarding(peer api.WireguardPeer) {
-	if len(peer.Ports) < 1 {
-		return
+// All rules are attempted even if one fails, and the last error is returned
+func (p *Portforward) RemovePortforwarding(peer api.WireguardPeer) (lastErr error) {
+	peer = p.allowedPorts(peer, false)
+	if len(peer.Ports) < 1 || !peer.HasForwarding() {
+		return nil
 	}
 
 	for _, chain := range p.chains {
 		rules := make(map[string]iptables.Protocol)
-		p.createPeerRules(peer, chain.transportProtocol, rules)
+		p.createChainRules(peer, chain, rules)
 
 		// Remove old portforwarding rules
 		for rule, protocol := range rules {
-			ipt := p.iptables
-			if protocol == iptables.ProtocolIPv6 {
-				ipt = p.ip6tables
-			}
-
-			err := ipt.Delete(table, chain.name, strings.Split(rule, " ")...)
+			err := p.deletePeerRule(chain, rule, protocol)
 			if err != nil {
-				log.Printf("error deleting iptables rule")
+				ratelog.Printf("iptables", "error deleting iptables rule for peer %s: %s", peer.Fingerprint(), err.Error())
+				lastErr = fmt.Errorf("error deleting iptables rule: %s", err.Error())
 				continue
 			}
 		}
 	}
+
+	if p.options.FlushConntrack {
+		err := p.flushConntrack(peer)
+		if err != nil {
+			ratelog.Printf("conntrack", "error flushing conntrack entries for peer %s: %s", peer.Fingerprint(), err.Error())
+			lastErr = err
+		}
+	}
+
+	return lastErr
 }
 
-func (p *Portforward) insertPeerRule(protocol iptables.Protocol, table string, chain string, rule string) error {
+func (p *Portforward) insertPeerRule(chain Chain, rule string, protocol iptables.Protocol) error {
 	ipt := p.iptables
 	if protocol == iptables.ProtocolIPv6 {
 		ipt = p.ip6tables
 	}
 
-	err := ipt.Insert(table, chain, 1, strings.Split(rule, " ")...)
-	return err
-}
+	err := p.withTimeout(func() error {
+		if p.options.RulePosition > 0 {
+			return ipt.Insert(chain.table, chain.name, p.options.RulePosition, strings.Split(rule, " ")...)
+		}
 
-func (p *Portforward) removeOldPeerRules(peer api.WireguardPeer, protocol iptables.Protocol, table string, chain string,
-	oldRules map[string]iptables.Protocol, rule string) {
-	var ipt *iptables.IPTables
-	var peerIP net.IP
+		return ipt.Append(chain.table, chain.name, strings.Split(rule, " ")...)
+	})
+	if err != nil {
+		p.invalidateRules(chain)
+		return err
+	}
 
+	p.cacheRule(chain, rule, protocol)
+	return nil
+}
+
+func (p *Portforward) deletePeerRule(chain Chain, rule string, protocol iptables.Protocol) error {
+	ipt := p.iptables
 	if protocol == iptables.ProtocolIPv6 {
 		ipt = p.ip6tables
-		peerIP, _, _ = net.ParseCIDR(peer.IPv6)
-	} else {
-		ipt = p.iptables
-		peerIP, _, _ = net.ParseCIDR(peer.IPv4)
-	}
-
-	for oldRule := range oldRules {
-		if oldRule != rule {
-			oldRuleSlice := strings.Split(oldRule, " ")
-			oldIP := net.ParseIP(oldRuleSlice[len(oldRuleSlice)-1])
-
-			if oldIP.Equal(peerIP) {
-				err := ipt.Delete(table, chain, strings.Split(oldRule, " ")...)
-				if err != nil {
-					log.Printf("error deleting iptables rule")
-					continue
-				}
+	}
+
+	err := p.withTimeout(func() error {
+		return ipt.Delete(chain.table, chain.name, strings.Split(rule, " ")...)
+	})
+	if err != nil {
+		p.invalidateRules(chain)
+		return err
+	}
+
+	p.uncacheRule(chain, rule)
+	return nil
+}
+
+// Remove the rules in the chain that belong to the peer, but aren't part of the given new rules
+func (p *Portforward) removeOldPeerRules(peer api.WireguardPeer, chain Chain, oldRules map[string]iptables.Protocol,
+	newRules map[string]iptables.Protocol) (lastErr error) {
+	peerIPs := p.peerIPs(peer)
+
+	for oldRule, protocol := range oldRules {
+		if _, ok := newRules[oldRule]; ok {
+			continue
+		}
+
+		oldIP := ruleIP(oldRule)
+		if !containsIP(peerIPs, oldIP) || !p.ownsRule(oldRule) {
+			continue
+		}
+
+		err := p.deletePeerRule(chain, oldRule, protocol)
+		if err != nil {
+			ratelog.Printf("iptables", "error deleting iptables rule for peer %s: %s", peer.Fingerprint(), err.Error())
+			lastErr = fmt.Errorf("error deleting iptables rule: %s", err.Error())
+			continue
+		}
+	}
+
+	return lastErr
+}
+
+// Get the ip's that rules for the peer may contain
+func (p *Portforward) peerIPs(peer api.WireguardPeer) (ips []net.IP) {
+	for _, cidr := range []string{peer.IPv4, peer.IPv6} {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err == nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	if p.options.LoadBalance {
+		for _, target := range peer.ForwardTargets {
+			ip := net.ParseIP(target)
+			if ip != nil {
+				ips = append(ips, ip)
 			}
 		}
 	}
+
+	return
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the peer ip of a rule, which is the DNAT target, or the destination of the rules without one such as the DSCP rules
+// The destination of DNAT rules is the ingress address when matching allowed ip's, so the target takes precedence
+func ruleIP(rule string) net.IP {
+	var destination net.IP
+	ruleSlice := strings.Split(rule, " ")
+	for i := 0; i < len(ruleSlice)-1; i++ {
+		switch ruleSlice[i] {
+		case "--to-destination":
+			return net.ParseIP(ruleSlice[i+1])
+		case "-d":
+			destination = net.ParseIP(ruleSlice[i+1])
+		}
+	}
+
+	return destination
+}
+
+// Create the rules of the peer in the chain, a peer without ports has no rules
+func (p *Portforward) createChainRules(peer api.WireguardPeer, chain Chain, rules map[string]iptables.Protocol) {
+	if len(peer.Ports) < 1 {
+		return
+	}
+
+	if chain.table == mangleTable {
+		createPeerDSCPRules(peer, chain.transportProtocol, rules)
+		return
+	}
+
+	if chain.forwardInterface != p.interfaceChain(peer) {
+		return
+	}
+
+	p.createPeerRules(peer, chain.transportProtocol, rules)
+}
+
+// Get the forward interface of the chains that the rules of the peer belong in, or an empty string for the chains of the prefix
+func (p *Portforward) interfaceChain(peer api.WireguardPeer) string {
+	for _, forwardInterface := range p.options.InterfaceChains {
+		if peer.ForwardInterface == forwardInterface {
+			return forwardInterface
+		}
+	}
+
+	return ""
 }
 
 func (p *Portforward) createPeerRules(peer api.WireguardPeer, transportProtocol string, rules map[string]iptables.Protocol) {
-	// Ignore ip's with errors, in-case we get bad data from the API
-	ipv4, _, err := net.ParseCIDR(peer.IPv4)
+	ports := getPortsString(peer.Ports)
+	comment := ruleComment(peer)
+
+	// Ignore interfaces and ip's with errors, in-case we get bad data from the API
+	if peer.ForwardInterface != "" && !ValidInterfaceName(peer.ForwardInterface) {
+		return
+	}
+
+	if peer.ForwardsIPv4() {
+		ipv4, _, err := net.ParseCIDR(peer.IPv4)
+		if err != nil {
+			return
+		}
+
+		for _, destination := range p.destinationMatches(transportProtocol, p.ipsetIPv4, true, peer.ForwardInterface) {
+			match := fmt.Sprintf("%s -m multiport --dports %s -m comment --comment %s", destination, ports, comment)
+			createDNATRules(match, p.forwardTargets(peer, ipv4), iptables.ProtocolIPv4, rules)
+		}
+	}
+
+	if !peer.ForwardsIPv6() {
+		return
+	}
+
+	ipv6, _, err := net.ParseCIDR(peer.IPv6)
 	if err != nil {
 		return
 	}
 
-	rule := fmt.Sprintf("-p %s -m set --match-set %s dst -m multiport --dports %s -j DNAT --to-destination %s", transportProtocol, p.ipsetIPv4, getPortsString(peer.Ports), ipv4)
-	rules[rule] = iptables.ProtocolIPv4
+	for _, destination := range p.destinationMatches(transportProtocol, p.ipsetIPv6, false, peer.ForwardInterface) {
+		match := fmt.Sprintf("%s -m multiport --dports %s -m comment --comment %s", destination, ports, comment)
+		createDNATRules(match, p.forwardTargets(peer, ipv6), iptables.ProtocolIPv6, rules)
+	}
+}
+
+// Get the starts of the matches of the DNAT rules of a family, along with the inbound interface if one is given
+// The destination is matched by the ipset, or by each ingress address of the family when matching allowed ip's,
+// in which case the rules forward to the allowed ip's of the peer without depending on the ipsets
+func (p *Portforward) destinationMatches(transportProtocol string, ipset string, ipv4 bool, inInterface string) []string {
+	if !p.options.MatchAllowedIPs {
+		return []string{p.destinationMatch(transportProtocol, ipset, nil, inInterface)}
+	}
+
+	var matches []string
+	for _, address := range p.options.IngressAddresses {
+		if (address.To4() != nil) == ipv4 {
+			matches = append(matches, p.destinationMatch(transportProtocol, ipset, address, inInterface))
+		}
+	}
+
+	return matches
+}
+
+// Get the start of the match of a DNAT rule, which matches the destination either by the ipset or by the given ingress address
+// The order of the arguments is the order that iptables lists them in, to be able to compare the rules with the listed ones
+func (p *Portforward) destinationMatch(transportProtocol string, ipset string, ingressAddress net.IP, inInterface string) string {
+	var args []string
+	if p.options.MatchAllowedIPs {
+		args = append(args, "-d", ingressAddress.String())
+	}
+
+	if inInterface != "" {
+		args = append(args, "-i", inInterface)
+	}
+
+	args = append(args, "-p", transportProtocol)
+	if !p.options.MatchAllowedIPs {
+		args = append(args, "-m", "set", "--match-set", ipset, "dst")
+	}
+
+	return strings.Join(args, " ")
+}
+
+// The max length of a network interface name on Linux
+const maxInterfaceNameLength = 15
+
+// ValidInterfaceName checks whether the interface name is one that iptables accepts and lists unchanged, so that it's safe to use in rules
+func ValidInterfaceName(name string) bool {
+	if name == "" || len(name) > maxInterfaceNameLength {
+		return false
+	}
+
+	for _, r := range name {
+		if !((r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' || r == '.') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The max length of an iptables comment
+const maxCommentLength = 255
+
+// The start of the comment of every rule added by wg-manager, to tell them apart from rules added by other tools
+const commentPrefix = "wg-manager_"
+
+// Get the comment for the rules of the peer, which is the comment from the API or the fingerprint of the peer
+// Iptables quotes comments containing other characters than letters, digits, underscores and dashes when listing rules,
+// so they're replaced with underscores, to be able to compare the rules with the listed ones
+func ruleComment(peer api.WireguardPeer) string {
+	comment := peer.ForwardComment
+	if comment == "" {
+		comment = peer.Fingerprint()
+	}
+
+	if len(comment) > maxCommentLength-len(commentPrefix) {
+		comment = comment[:maxCommentLength-len(commentPrefix)]
+	}
+
+	return commentPrefix + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+
+		return '_'
+	}, comment)
+}
+
+// Whether a rule in the chains is one that wg-manager may remove
+// Every rule is, unless the chains are shared with other tools
+func (p *Portforward) ownsRule(rule string) bool {
+	if !p.options.SharedChains {
+		return true
+	}
+
+	return strings.Contains(rule, "-m comment --comment "+commentPrefix)
+}
+
+// Get the targets to forward to for the family of the given peer ip
+// This is the peer ip itself, unless load balancing is enabled and the peer has targets of the same family
+func (p *Portforward) forwardTargets(peer api.WireguardPeer, peerIP net.IP) []net.IP {
+	if !p.options.LoadBalance {
+		return []net.IP{peerIP}
+	}
+
+	var targets []net.IP
+	for _, target := range peer.ForwardTargets {
+		ip := net.ParseIP(target)
+		if ip == nil || (ip.To4() == nil) != (peerIP.To4() == nil) {
+			continue
+		}
+
+		targets = append(targets, ip)
+	}
+
+	if len(targets) == 0 {
+		return []net.IP{peerIP}
+	}
+
+	return targets
+}
+
+// Create DNAT rules which distribute connections evenly over the targets
+// Every rule except the last one matches every nth connection reaching it, and the last one matches the rest
+// This means that the rules have to be kept in order, see orderRules
+func createDNATRules(match string, targets []net.IP, protocol iptables.Protocol, rules map[string]iptables.Protocol) {
+	for i, target := range targets {
+		rule := match
+		if i < len(targets)-1 {
+			rule += fmt.Sprintf(" -m statistic --mode nth --every %d --packet 0", len(targets)-i)
+		}
+
+		rule += fmt.Sprintf(" -j DNAT --to-destination %s", target)
+		rules[rule] = protocol
+	}
+}
+
+// Order the rules for insertion, so that load balanced rules end up before the rules they fall through to
+func (p *Portforward) orderRules(rules map[string]iptables.Protocol) []string {
+	ordered := sortRules(rules)
+
+	// Rules inserted at a fixed position end up in the reverse order of insertion
+	if p.options.RulePosition > 0 {
+		for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+	}
+
+	return ordered
+}
+
+// Sort the rules in the order they should have in the chain
+func sortRules(rules map[string]iptables.Protocol) []string {
+	ordered := make([]string, 0, len(rules))
+	for rule := range rules {
+		ordered = append(ordered, rule)
+	}
+
+	sort.Slice(ordered, func(i int, j int) bool {
+		everyI, everyJ := ruleEvery(ordered[i]), ruleEvery(ordered[j])
+		if everyI != everyJ {
+			return everyI > everyJ
+		}
+
+		return ordered[i] < ordered[j]
+	})
+
+	return ordered
+}
+
+// Get the nth value of a load balanced rule, or 0 if the rule isn't load balanced
+func ruleEvery(rule string) int {
+	ruleSlice := strings.Split(rule, " ")
+	for i := 0; i < len(ruleSlice)-1; i++ {
+		if ruleSlice[i] == "--every" {
+			every, _ := strconv.Atoi(ruleSlice[i+1])
+			return every
+		}
+	}
+
+	return 0
+}
+
+func createPeerDSCPRules(peer api.WireguardPeer, transportProtocol string, rules map[string]iptables.Protocol) {
+	// Only mark traffic for peers with a valid DSCP value
+	if peer.DSCP < 1 || peer.DSCP > maxDSCP {
+		return
+	}
+
+	// Iptables lists the DSCP value in hex
+	dscp := fmt.Sprintf("0x%02x", peer.DSCP)
+
+	comment := ruleComment(peer)
+
+	// Ignore ip's with errors, in-case we get bad data from the API
+	if peer.ForwardsIPv4() {
+		ipv4, _, err := net.ParseCIDR(peer.IPv4)
+		if err != nil {
+			return
+		}
+
+		rule := fmt.Sprintf("-d %s -p %s -m multiport --dports %s -m comment --comment %s -j DSCP --set-dscp %s", ipv4, transportProtocol, getPortsString(peer.Ports), comment, dscp)
+		rules[rule] = iptables.ProtocolIPv4
+	}
+
+	if !peer.ForwardsIPv6() {
+		return
+	}
 
 	ipv6, _, err := net.ParseCIDR(peer.IPv6)
 	if err != nil {
 		return
 	}
 
-	rule = fmt.Sprintf("-p %s -m set --match-set %s dst -m multiport --dports %s -j DNAT --to-destination %s", transportProtocol, p.ipsetIPv6, getPortsString(peer.Ports), ipv6)
+	rule := fmt.Sprintf("-d %s -p %s -m multiport --dports %s -m comment --comment %s -j DSCP --set-dscp %s", ipv6, transportProtocol, getPortsString(peer.Ports), comment, dscp)
 	rules[rule] = iptables.ProtocolIPv6
 }
 
+// Get the ports as a sorted list without duplicates, so that the rules for the same set of ports are always identical
 func getPortsString(ports []int) string {
-	sort.Ints(ports)
+	sorted := make([]int, len(ports))
+	copy(sorted, ports)
+	sort.Ints(sorted)
+
+	slice := make([]string, 0, len(sorted))
+	for i, v := range sorted {
+		if i > 0 && v == sorted[i-1] {
+			continue
+		}
 
-	slice := make([]string, len(ports))
-	for i, v := range ports {
-		slice[i] = strconv.Itoa(v)
+		slice = append(slice, strconv.Itoa(v))
 	}
 
 	return strings.Join(slice, ",")
 }
 
-func (p *Portforward) getCurrentRules(chain string) (map[string]iptables.Protocol, error) {
+func (p *Portforward) getCurrentRules(chain Chain) (map[string]iptables.Protocol, error) {
 	rules := make(map[string]iptables.Protocol)
 
-	ipv4Rules, err := p.iptables.List("nat", chain)
+	var ipv4Rules, ipv6Rules []string
+	err := p.withTimeout(func() (err error) {
+		ipv4Rules, err = p.iptables.List(chain.table, chain.name)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	ipv6Rules, err := p.ip6tables.List("nat", chain)
+	err = p.withTimeout(func() (err error) {
+		ipv6Rules, err = p.ip6tables.List(chain.table, chain.name)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	for _, rule := range p.filterRules(chain, ipv4Rules) {
+	for _, rule := range p.filterRules(chain.name, ipv4Rules) {
 		rules[rule] = iptables.ProtocolIPv4
 	}
 
-	for _, rule := range p.filterRules(chain, ipv6Rules) {
+	for _, rule := range p.filterRules(chain.name, ipv6Rules) {
 		rules[rule] = iptables.ProtocolIPv6
 	}
 
@@ -1,19 +1,30 @@
 package portforward_test
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/coreos/go-iptables/iptables"
+	"github.com/digineo/go-ipset/v2"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/infosum/statsd"
+	"github.com/mdlayher/netlink"
 	"github.com/mullvad/wg-manager/api"
 	"github.com/mullvad/wg-manager/portforward"
+	"github.com/ti-mo/netfilter"
 )
 
 // Integration tests for portforwarding, not ran in short mode
-// Requires iptables nat chains named PORTFORWARDING_TCP and PORTFORWARDING_UDP in both iptables and ip6tables
+// Requires iptables nat chains named PORTFORWARDING_TCP and PORTFORWARDING_UDP in both iptables and ip6tables,
+// along with PORTFORWARDING_WG0_TCP and PORTFORWARDING_WG0_UDP for the interface chains
 
 var apiFixture = api.WireguardPeerList{
 	api.WireguardPeer{
@@ -25,18 +36,92 @@ var apiFixture = api.WireguardPeerList{
 }
 
 var rulesFixture = []string{
-	"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -j DNAT --to-destination 10.99.0.1",
-	"-A PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -j DNAT --to-destination 10.99.0.1",
-	"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
-	"-A PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
 }
 
 var rulesUpdatedPortsFixture = []int{1234, 4322, 1337}
 var rulesUpdatedFixture = []string{
-	"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,1337,4322 -j DNAT --to-destination 10.99.0.1",
-	"-A PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,1337,4322 -j DNAT --to-destination 10.99.0.1",
-	"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,1337,4322 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
-	"-A PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,1337,4322 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,1337,4322 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,1337,4322 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,1337,4322 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,1337,4322 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+}
+
+// Ports outside of the allowed ranges are rejected, leaving the ports of rulesFixture
+var mixedPortsFixture = []int{22, 4321, 80, 1234, 8080}
+var allowedPortsFixture = []portforward.PortRange{{Min: 1024, Max: 5000}}
+
+// Ports above the max ports per peer are truncated, keeping the lowest ports of rulesFixture
+var excessPortsFixture = []int{8080, 4321, 1234, 4321}
+
+const maxPortsPerPeerFixture = 2
+
+// A peer without ports, which has no rules
+var emptyPortsFixture = api.WireguardPeer{
+	IPv4:   "10.99.0.2/32",
+	IPv6:   "fc00:bbbb:bbbb:bb01::2/128",
+	Ports:  []int{},
+	Pubkey: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32))),
+}
+
+var dscpRulesFixture = []string{
+	"-A PORTFORWARDING_DSCP_TCP -d 10.99.0.1/32 -p tcp -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DSCP --set-dscp 0x0a",
+	"-A PORTFORWARDING_DSCP_UDP -d 10.99.0.1/32 -p udp -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DSCP --set-dscp 0x0a",
+	"-A PORTFORWARDING_DSCP_TCP -d fc00:bbbb:bbbb:bb01::1/128 -p tcp -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DSCP --set-dscp 0x0a",
+	"-A PORTFORWARDING_DSCP_UDP -d fc00:bbbb:bbbb:bb01::1/128 -p udp -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DSCP --set-dscp 0x0a",
+}
+
+var allowedIPsRulesFixture = []string{
+	"-A PORTFORWARDING_TCP -d 192.0.2.1/32 -p tcp -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING_UDP -d 192.0.2.1/32 -p udp -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING_TCP -d 2001:db8::1/128 -p tcp -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING_UDP -d 2001:db8::1/128 -p udp -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+}
+
+var ipv6OnlyRulesFixture = []string{
+	"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+}
+
+// Peers forwarding only the traffic arriving on their interface have an inbound interface match
+const forwardInterfaceFixture = "wg0"
+
+var interfaceRulesFixture = []string{
+	"-A PORTFORWARDING_TCP -i wg0 -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING_UDP -i wg0 -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING_TCP -i wg0 -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING_UDP -i wg0 -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+}
+
+var allowedIPsInterfaceRulesFixture = []string{
+	"-A PORTFORWARDING_TCP -d 192.0.2.1/32 -i wg0 -p tcp -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING_UDP -d 192.0.2.1/32 -i wg0 -p udp -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING_TCP -d 2001:db8::1/128 -i wg0 -p tcp -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING_UDP -d 2001:db8::1/128 -i wg0 -p udp -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+}
+
+// The rules of interfaceRulesFixture, in the chains of the forward interface
+var interfaceChainRulesFixture = []string{
+	"-A PORTFORWARDING_WG0_TCP -i wg0 -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING_WG0_UDP -i wg0 -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.1",
+	"-A PORTFORWARDING_WG0_TCP -i wg0 -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING_WG0_UDP -i wg0 -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+}
+
+// The public addresses of the server, which forwarded traffic arrives on
+var ingressAddressesFixture = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+
+var loadBalanceTargetsFixture = []string{"10.99.0.5", "10.99.0.6"}
+var loadBalanceRulesFixture = []string{
+	"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -m statistic --mode nth --every 2 --packet 0 -j DNAT --to-destination 10.99.0.5",
+	"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.6",
+	"-A PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -m statistic --mode nth --every 2 --packet 0 -j DNAT --to-destination 10.99.0.5",
+	"-A PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination 10.99.0.6",
+	"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+	"-A PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234,4321 -m comment --comment wg-manager_059a4896 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
 }
 
 var chains = []string{
@@ -44,11 +129,25 @@ var chains = []string{
 	"PORTFORWARDING_UDP",
 }
 
+var interfaceChains = []string{
+	"PORTFORWARDING_WG0_TCP",
+	"PORTFORWARDING_WG0_UDP",
+}
+
+var dscpChains = []string{
+	"PORTFORWARDING_DSCP_TCP",
+	"PORTFORWARDING_DSCP_UDP",
+}
+
+var metrics, _ = statsd.New()
+
 const (
-	chainPrefix = "PORTFORWARDING"
-	ipsetIPv4   = "PORTFORWARDING_IPV4"
-	ipsetIPv6   = "PORTFORWARDING_IPV6"
-	table       = "nat"
+	chainPrefix     = "PORTFORWARDING"
+	dscpChainPrefix = "PORTFORWARDING_DSCP"
+	ipsetIPv4       = "PORTFORWARDING_IPV4"
+	ipsetIPv6       = "PORTFORWARDING_IPV6"
+	table           = "nat"
+	dscpTable       = "mangle"
 )
 
 func TestPortforward(t *testing.T) {
@@ -56,7 +155,7 @@ func TestPortforward(t *testing.T) {
 		t.Skip("skipping integration tests")
 	}
 
-	pf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6)
+	pf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{Table: table})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -64,16 +163,120 @@ func TestPortforward(t *testing.T) {
 	ipts := setupIptables(t)
 
 	t.Run("add rules", func(t *testing.T) {
-		pf.UpdatePortforwarding(apiFixture)
+		pf.UpdatePortforwarding(context.Background(), apiFixture)
 
 		rules := getRules(t, ipts)
 		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
 			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
 		}
+
+		if pf.RuleChanges() != len(rulesFixture) {
+			t.Errorf("unexpected number of rule changes %d", pf.RuleChanges())
+		}
 	})
 
 	t.Run("remove rules", func(t *testing.T) {
-		pf.UpdatePortforwarding(api.WireguardPeerList{})
+		pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		if pf.RuleChanges() != len(rulesFixture) {
+			t.Errorf("unexpected number of rule changes %d", pf.RuleChanges())
+		}
+	})
+
+	t.Run("detect flushed rules", func(t *testing.T) {
+		pf.UpdatePortforwarding(context.Background(), apiFixture)
+		defer pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+
+		flushed, err := pf.Flushed()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if flushed {
+			t.Fatal("rules detected as flushed before flushing them")
+		}
+
+		for _, ipt := range ipts {
+			for _, chain := range chains {
+				err := ipt.ClearChain(table, chain)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		flushed, err = pf.Flushed()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !flushed {
+			t.Fatal("flushed rules not detected")
+		}
+
+		pf.UpdatePortforwarding(context.Background(), apiFixture)
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("detect flushed rules of one family", func(t *testing.T) {
+		for i, ipt := range ipts {
+			pf.UpdatePortforwarding(context.Background(), apiFixture)
+
+			// Only the chains of this family are flushed, the other family keeps its rules
+			for _, chain := range chains {
+				err := ipt.ClearChain(table, chain)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			flushed, err := pf.Flushed()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !flushed {
+				t.Fatalf("flushed rules of family %d not detected", i)
+			}
+
+			pf.UpdatePortforwarding(context.Background(), apiFixture)
+
+			rules := getRules(t, ipts)
+			if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+				t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+			}
+		}
+
+		pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+	})
+
+	t.Run("add rules with duplicate ports", func(t *testing.T) {
+		duplicateFixture := apiFixture[0]
+		duplicateFixture.Ports = []int{4321, 1234, 4321}
+		pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{duplicateFixture})
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+	})
+
+	t.Run("ignore peer-only records", func(t *testing.T) {
+		peerOnlyFixture := apiFixture[0]
+		peerOnlyFixture.Kind = api.KindPeer
+		pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{peerOnlyFixture})
+		pf.AddPortforwarding(peerOnlyFixture)
 
 		rules := getRules(t, ipts)
 		if diff := cmp.Diff([]string{}, rules); diff != "" {
@@ -115,6 +318,558 @@ func TestPortforward(t *testing.T) {
 		}
 	})
 
+	t.Run("skip peers without ports", func(t *testing.T) {
+		pf.UpdatePortforwarding(context.Background(), append(api.WireguardPeerList{emptyPortsFixture}, apiFixture...))
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		err := pf.AddPortforwarding(emptyPortsFixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = pf.UpdateSinglePeerPortforwarding(emptyPortsFixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rules = getRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("remove rules when ports are removed", func(t *testing.T) {
+		pf.UpdatePortforwarding(context.Background(), apiFixture)
+
+		removedFixture := apiFixture[0]
+		removedFixture.Ports = []int{}
+
+		err := pf.UpdateSinglePeerPortforwarding(removedFixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("insert rules at position", func(t *testing.T) {
+		pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+
+		insertPf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{Table: table, RulePosition: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pf.AddPortforwarding(apiFixture[0])
+
+		updatedFixture := apiFixture[0]
+		updatedFixture.Ports = rulesUpdatedPortsFixture
+		insertPf.AddPortforwarding(updatedFixture)
+
+		rules := getRules(t, ipts)
+		expectedRules := []string{
+			rulesUpdatedFixture[0], rulesFixture[0],
+			rulesUpdatedFixture[1], rulesFixture[1],
+			rulesUpdatedFixture[2], rulesFixture[2],
+			rulesUpdatedFixture[3], rulesFixture[3],
+		}
+		if diff := cmp.Diff(expectedRules, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+	})
+
+	t.Run("populate ipsets", func(t *testing.T) {
+		populatePf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{
+			IngressAddresses:    ingressAddressesFixture,
+			PopulateIPSets:      true,
+			IPSetOrphanInterval: time.Nanosecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// A member that isn't an ingress address, such as the address of a peer
+		stray := net.ParseIP("10.99.0.1")
+		err = conn.Add(ipsetIPv4, ipset.NewEntry(ipset.EntryIP(stray)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		populatePf.UpdatePortforwarding(context.Background(), apiFixture)
+		defer populatePf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+
+		err = conn.Test(ipsetIPv4, ipset.EntryIP(stray))
+		if err == nil {
+			t.Fatalf("member %s was not removed", stray)
+		}
+
+		members := map[string]net.IP{
+			ipsetIPv4: ingressAddressesFixture[0],
+			ipsetIPv6: ingressAddressesFixture[1],
+		}
+
+		for name, ip := range members {
+			err = conn.Test(name, ipset.EntryIP(ip))
+			if err != nil {
+				t.Fatalf("%s is not a member of %s: %s", ip, name, err)
+			}
+
+			err = conn.Delete(name, ipset.NewEntry(ipset.EntryIP(ip)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("keep orphaned ipset members without an orphan interval", func(t *testing.T) {
+		populatePf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{
+			IngressAddresses: ingressAddressesFixture,
+			PopulateIPSets:   true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		orphan := net.ParseIP("10.99.0.99")
+		err = conn.Add(ipsetIPv4, ipset.NewEntry(ipset.EntryIP(orphan)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		populatePf.UpdatePortforwarding(context.Background(), apiFixture)
+		defer populatePf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+
+		err = conn.Test(ipsetIPv4, ipset.EntryIP(orphan))
+		if err != nil {
+			t.Fatalf("orphaned member %s was removed: %s", orphan, err)
+		}
+
+		for _, ip := range []net.IP{ingressAddressesFixture[0], ingressAddressesFixture[1], orphan} {
+			name := ipsetIPv4
+			if ip.To4() == nil {
+				name = ipsetIPv6
+			}
+
+			err = conn.Delete(name, ipset.NewEntry(ipset.EntryIP(ip)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("load balance rules", func(t *testing.T) {
+		loadBalancePf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{LoadBalance: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loadBalanceFixture := apiFixture[0]
+		loadBalanceFixture.ForwardTargets = loadBalanceTargetsFixture
+		loadBalancePf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{loadBalanceFixture})
+
+		// The order of the rules matters, as the last rule for each chain catches the connections the first one doesn't
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(loadBalanceRulesFixture, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		loadBalancePf.RemovePortforwarding(loadBalanceFixture)
+
+		rules = getRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("paced install", func(t *testing.T) {
+		pacedPf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{InstallRate: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pacedPf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+
+		// The 4 rules of the fixture are added at 4 rules per second
+		start := time.Now()
+		pacedPf.UpdatePortforwarding(context.Background(), apiFixture)
+		if time.Since(start) < time.Millisecond*900 {
+			t.Fatalf("adding the rules wasn't paced, took %s", time.Since(start))
+		}
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		// Following updates aren't paced
+		updatedFixture := apiFixture[0]
+		updatedFixture.Ports = rulesUpdatedPortsFixture
+
+		start = time.Now()
+		pacedPf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{updatedFixture})
+		if time.Since(start) >= time.Millisecond*900 {
+			t.Fatalf("adding the rules was paced, took %s", time.Since(start))
+		}
+	})
+
+	t.Run("abort when canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := pf.UpdatePortforwarding(ctx, apiFixture)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ipv6 only rules", func(t *testing.T) {
+		ipv6OnlyFixture := apiFixture[0]
+		ipv6OnlyFixture.ForwardFamily = api.FamilyIPv6
+		pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{ipv6OnlyFixture})
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(ipv6OnlyRulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		pf.RemovePortforwarding(ipv6OnlyFixture)
+
+		rules = getRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("forward interface rules", func(t *testing.T) {
+		interfaceFixture := apiFixture[0]
+		interfaceFixture.ForwardInterface = forwardInterfaceFixture
+		pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{interfaceFixture})
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(interfaceRulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		// Removing the interface of the peer replaces its rules
+		pf.UpdateSinglePeerPortforwarding(apiFixture[0])
+
+		rules = getRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		pf.RemovePortforwarding(apiFixture[0])
+
+		rules = getRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("interface chain rules", func(t *testing.T) {
+		interfaceChainPf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{Table: table, InterfaceChains: []string{forwardInterfaceFixture}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		interfaceFixture := apiFixture[0]
+		interfaceFixture.ForwardInterface = forwardInterfaceFixture
+		interfaceChainPf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{interfaceFixture})
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		interfaceRules := getTableRules(t, ipts, table, interfaceChains)
+		if diff := cmp.Diff(interfaceChainRulesFixture, interfaceRules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected interface chain rules (-want +got):\n%s", diff)
+		}
+
+		// Removing the interface of the peer moves its rules to the chains of the prefix
+		interfaceChainPf.UpdateSinglePeerPortforwarding(apiFixture[0])
+
+		rules = getRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		interfaceRules = getTableRules(t, ipts, table, interfaceChains)
+		if diff := cmp.Diff([]string{}, interfaceRules); diff != "" {
+			t.Fatalf("unexpected interface chain rules (-want +got):\n%s", diff)
+		}
+
+		interfaceChainPf.RemovePortforwarding(apiFixture[0])
+
+		rules = getRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("parallel families", func(t *testing.T) {
+		parallelPf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{Table: table, ParallelFamilies: true, RuleCacheSyncs: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parallelPf.UpdatePortforwarding(context.Background(), apiFixture)
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		if parallelPf.RuleChanges() != len(rulesFixture) {
+			t.Errorf("unexpected number of rule changes %d", parallelPf.RuleChanges())
+		}
+
+		parallelPf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+
+		rules = getRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("match allowed ips", func(t *testing.T) {
+		// The ipsets aren't used, so they don't have to exist
+		allowedIPsPf, err := portforward.New(chainPrefix, "", "", metrics, portforward.Options{
+			IngressAddresses: ingressAddressesFixture,
+			MatchAllowedIPs:  true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		allowedIPsPf.UpdatePortforwarding(context.Background(), apiFixture)
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(allowedIPsRulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		allowedIPsPf.RemovePortforwarding(apiFixture[0])
+
+		rules = getRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("add rules with forward comment", func(t *testing.T) {
+		commentFixture := apiFixture[0]
+		commentFixture.ForwardComment = "TICKET-123 acct/1"
+		pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{commentFixture})
+		defer pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+
+		var expectedRules []string
+		for _, rule := range rulesFixture {
+			expectedRules = append(expectedRules, strings.Replace(rule, "--comment wg-manager_059a4896", "--comment wg-manager_TICKET-123_acct_1", 1))
+		}
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(expectedRules, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		// Synchronizing again shouldn't replace the rules, as the comment is the same
+		pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{commentFixture})
+
+		rules = getRules(t, ipts)
+		if diff := cmp.Diff(expectedRules, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("reject ports outside of the allowed ranges", func(t *testing.T) {
+		allowedPf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{AllowedPorts: allowedPortsFixture})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mixedFixture := apiFixture[0]
+		mixedFixture.Ports = mixedPortsFixture
+		allowedPf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{mixedFixture})
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		allowedPf.RemovePortforwarding(mixedFixture)
+
+		rules = getRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("truncate ports above the max ports per peer", func(t *testing.T) {
+		truncatedPf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{MaxPortsPerPeer: maxPortsPerPeerFixture})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		excessFixture := apiFixture[0]
+		excessFixture.Ports = excessPortsFixture
+		truncatedPf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{excessFixture})
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		truncatedPf.RemovePortforwarding(excessFixture)
+
+		rules = getRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("keep foreign rules in shared chains", func(t *testing.T) {
+		sharedPf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{SharedChains: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A rule added by another tool
+		foreignRule := "-A PORTFORWARDING_TCP -p tcp -m multiport --dports 5555 -j DNAT --to-destination 10.99.0.9"
+		err = ipts[0].Append(table, chains[0], strings.Split(strings.TrimPrefix(foreignRule, "-A "+chains[0]+" "), " ")...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ipts[0].ClearChain(table, chains[0])
+
+		sharedPf.UpdatePortforwarding(context.Background(), apiFixture)
+		sharedPf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff([]string{foreignRule}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("restore rules changed outside of the rule cache", func(t *testing.T) {
+		cachePf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{RuleCacheSyncs: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cachePf.UpdatePortforwarding(context.Background(), apiFixture)
+		defer cachePf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+
+		// Remove a rule behind the back of the cache, the second synchronization should list the rules and restore it
+		err = ipts[0].Delete(table, chains[0], strings.Split(strings.TrimPrefix(rulesFixture[0], "-A "+chains[0]+" "), " ")...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cachePf.UpdatePortforwarding(context.Background(), apiFixture)
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("add dscp rules", func(t *testing.T) {
+		dscpPf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{DSCPChainPrefix: dscpChainPrefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dscpFixture := apiFixture[0]
+		dscpFixture.DSCP = 10
+		dscpPf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{dscpFixture})
+
+		rules := getRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		dscpRules := getTableRules(t, ipts, dscpTable, dscpChains)
+		if diff := cmp.Diff(dscpRulesFixture, dscpRules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected dscp rules (-want +got):\n%s", diff)
+		}
+
+		dscpPf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+
+		dscpRules = getTableRules(t, ipts, dscpTable, dscpChains)
+		if diff := cmp.Diff([]string{}, dscpRules); diff != "" {
+			t.Fatalf("unexpected dscp rules (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func BenchmarkUpdatePortforwarding(b *testing.B) {
+	if testing.Short() {
+		b.Skip("skipping integration tests")
+	}
+
+	var peers api.WireguardPeerList
+	for i := 0; i < 1000; i++ {
+		peers = append(peers, api.WireguardPeer{
+			IPv4:   fmt.Sprintf("10.99.%d.%d/32", i/256, i%256),
+			IPv6:   fmt.Sprintf("fc00:bbbb:bbbb:bb01::%x/128", i),
+			Ports:  []int{1024 + i},
+			Pubkey: base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%032d", i))),
+		})
+	}
+
+	for _, bc := range []struct {
+		name             string
+		parallelFamilies bool
+	}{
+		{"sequential", false},
+		{"parallel families", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			pf, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{Table: table, ParallelFamilies: bc.parallelFamilies})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			// Each iteration adds the rules of every peer, and removes them again
+			for i := 0; i < b.N; i++ {
+				err := pf.UpdatePortforwarding(context.Background(), peers)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				err = pf.UpdatePortforwarding(context.Background(), api.WireguardPeerList{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
 }
 
 func stringCompare(i string, j string) bool {
@@ -124,6 +879,12 @@ func stringCompare(i string, j string) bool {
 func getRules(t *testing.T, ipts []*iptables.IPTables) []string {
 	t.Helper()
 
+	return getTableRules(t, ipts, table, chains)
+}
+
+func getTableRules(t *testing.T, ipts []*iptables.IPTables, table string, chains []string) []string {
+	t.Helper()
+
 	rules := []string{}
 	for _, ipt := range ipts {
 		for _, chain := range chains {
@@ -166,14 +927,310 @@ func TestInvalidChain(t *testing.T) {
 		t.Skip("skipping integration tests")
 	}
 
-	_, err := portforward.New("nonexistant", ipsetIPv4, ipsetIPv6)
+	_, err := portforward.New("nonexistant", ipsetIPv4, ipsetIPv6, metrics, portforward.Options{})
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestInvalidTable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	_, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{Table: "filter"})
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestInvalidRulePosition(t *testing.T) {
+	_, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{RulePosition: -1})
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestInvalidRuleCacheSyncs(t *testing.T) {
+	_, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{RuleCacheSyncs: -1})
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestInvalidMaxPortsPerPeer(t *testing.T) {
+	_, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{MaxPortsPerPeer: -1})
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestInvalidInstallRate(t *testing.T) {
+	_, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{InstallRate: -1})
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestInvalidInterfaceChains(t *testing.T) {
+	for _, forwardInterface := range []string{"", "wg0 -j ACCEPT", strings.Repeat("a", 16)} {
+		_, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, portforward.Options{InterfaceChains: []string{forwardInterface}})
+		if err == nil {
+			t.Errorf("no error for %q", forwardInterface)
+		}
+	}
+}
+
+func TestMissingIngressAddresses(t *testing.T) {
+	for _, options := range []portforward.Options{{PopulateIPSets: true}, {MatchAllowedIPs: true}} {
+		_, err := portforward.New(chainPrefix, ipsetIPv4, ipsetIPv6, metrics, options)
+		if err == nil {
+			t.Errorf("no error for %+v", options)
+		}
+	}
+}
+
+func TestParseAddresses(t *testing.T) {
+	ips, err := portforward.ParseAddresses("192.0.2.1,2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(ingressAddressesFixture, ips); diff != "" {
+		t.Fatalf("unexpected addresses (-want +got):\n%s", diff)
+	}
+
+	for _, invalid := range []string{"foo", "192.0.2.0/24", "192.0.2.1,"} {
+		_, err := portforward.ParseAddresses(invalid)
+		if err == nil {
+			t.Errorf("no error for %s", invalid)
+		}
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := portforward.ParsePortRanges("80,1024-65535")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []portforward.PortRange{{Min: 80, Max: 80}, {Min: 1024, Max: 65535}}
+	if diff := cmp.Diff(expected, ranges); diff != "" {
+		t.Fatalf("unexpected ranges (-want +got):\n%s", diff)
+	}
+
+	for _, invalid := range []string{"foo", "0", "1-70000", "2000-1000", "80,"} {
+		_, err := portforward.ParsePortRanges(invalid)
+		if err == nil {
+			t.Errorf("no error for %s", invalid)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	var output bytes.Buffer
+	err := portforward.Render(&output, "PORTFORWARDING", "PORTFORWARDING_IPV4", "PORTFORWARDING_IPV6", apiFixture, portforward.Options{
+		DSCPChainPrefix: "PORTFORWARDING_DSCP",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The DSCP rules are only created for peers with a DSCP value
+	expected := strings.Join([]string{
+		"# iptables-save",
+		"*nat",
+		":PORTFORWARDING_TCP - [0:0]",
+		":PORTFORWARDING_UDP - [0:0]",
+		rulesFixture[0],
+		rulesFixture[1],
+		"COMMIT",
+		"*mangle",
+		":PORTFORWARDING_DSCP_TCP - [0:0]",
+		":PORTFORWARDING_DSCP_UDP - [0:0]",
+		"COMMIT",
+		"# ip6tables-save",
+		"*nat",
+		":PORTFORWARDING_TCP - [0:0]",
+		":PORTFORWARDING_UDP - [0:0]",
+		rulesFixture[2],
+		rulesFixture[3],
+		"COMMIT",
+		"*mangle",
+		":PORTFORWARDING_DSCP_TCP - [0:0]",
+		":PORTFORWARDING_DSCP_UDP - [0:0]",
+		"COMMIT",
+	}, "\n") + "\n"
+
+	if diff := cmp.Diff(expected, output.String()); diff != "" {
+		t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+	}
+
+	t.Run("match allowed ips", func(t *testing.T) {
+		peers := make(api.WireguardPeerList, len(apiFixture))
+		copy(peers, apiFixture)
+		peers[0].DSCP = 10
+
+		output.Reset()
+		err := portforward.Render(&output, "PORTFORWARDING", "", "", peers, portforward.Options{
+			DSCPChainPrefix:  "PORTFORWARDING_DSCP",
+			IngressAddresses: ingressAddressesFixture,
+			MatchAllowedIPs:  true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, rule := range append(allowedIPsRulesFixture, dscpRulesFixture...) {
+			if !strings.Contains(output.String(), rule+"\n") {
+				t.Errorf("missing rule %s", rule)
+			}
+		}
+	})
+
+	t.Run("forward interface", func(t *testing.T) {
+		peers := make(api.WireguardPeerList, len(apiFixture))
+		copy(peers, apiFixture)
+		peers[0].ForwardInterface = forwardInterfaceFixture
+
+		for _, tc := range []struct {
+			name            string
+			matchAllowedIPs bool
+			expected        []string
+		}{
+			{"ipset", false, interfaceRulesFixture},
+			{"match allowed ips", true, allowedIPsInterfaceRulesFixture},
+		} {
+			output.Reset()
+			err := portforward.Render(&output, "PORTFORWARDING", "PORTFORWARDING_IPV4", "PORTFORWARDING_IPV6", peers, portforward.Options{
+				IngressAddresses: ingressAddressesFixture,
+				MatchAllowedIPs:  tc.matchAllowedIPs,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, rule := range tc.expected {
+				if !strings.Contains(output.String(), rule+"\n") {
+					t.Errorf("%s: missing rule %s", tc.name, rule)
+				}
+			}
+		}
+
+		// Peers with an invalid interface get no rules, as they'd match on the wrong interface otherwise
+		peers[0].ForwardInterface = "wg0 -j ACCEPT"
+
+		output.Reset()
+		err := portforward.Render(&output, "PORTFORWARDING", "PORTFORWARDING_IPV4", "PORTFORWARDING_IPV6", peers, portforward.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(output.String(), "-A ") {
+			t.Fatalf("got rules for a peer with an invalid interface:\n%s", output.String())
+		}
+	})
+
+	t.Run("interface chains", func(t *testing.T) {
+		peers := api.WireguardPeerList{apiFixture[0], apiFixture[0]}
+		peers[0].ForwardInterface = forwardInterfaceFixture
+		peers[1].Pubkey = "b"
+		peers[1].ForwardInterface = "wg1"
+
+		output.Reset()
+		err := portforward.Render(&output, "PORTFORWARDING", "PORTFORWARDING_IPV4", "PORTFORWARDING_IPV6", peers, portforward.Options{
+			InterfaceChains: []string{forwardInterfaceFixture},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, chain := range interfaceChains {
+			if !strings.Contains(output.String(), ":"+chain+" - [0:0]\n") {
+				t.Errorf("missing chain %s", chain)
+			}
+		}
+
+		for _, rule := range interfaceChainRulesFixture {
+			if !strings.Contains(output.String(), rule+"\n") {
+				t.Errorf("missing rule %s", rule)
+			}
+		}
+
+		// The peer forwarding on an interface without chains of its own is in the chains of the prefix
+		for _, rule := range interfaceRulesFixture {
+			if strings.Contains(output.String(), rule+"\n") {
+				t.Errorf("got rule of the interface chains in the chains of the prefix %s", rule)
+			}
+		}
+
+		if !strings.Contains(output.String(), "-A PORTFORWARDING_TCP -i wg1 -p tcp") {
+			t.Errorf("missing rules of the peer without interface chains:\n%s", output.String())
+		}
+	})
+
+	t.Run("peer without ports", func(t *testing.T) {
+		output.Reset()
+		err := portforward.Render(&output, "PORTFORWARDING", "PORTFORWARDING_IPV4", "PORTFORWARDING_IPV6", api.WireguardPeerList{emptyPortsFixture}, portforward.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(output.String(), "-A ") {
+			t.Fatalf("got rules for a peer without ports:\n%s", output.String())
+		}
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		err := portforward.Render(&output, "PORTFORWARDING", "", "", apiFixture, portforward.Options{
+			RulePosition: -1,
+		})
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
+
+func TestCreateIPSet(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	createIPSetIPv4 := "PORTFORWARDING_CREATE_IPV4"
+	createIPSetIPv6 := "PORTFORWARDING_CREATE_IPV6"
+
+	_, err := portforward.New(chainPrefix, createIPSetIPv4, createIPSetIPv6, metrics, portforward.Options{})
 	if err == nil {
 		t.Fatal("no error")
 	}
+
+	_, err = portforward.New(chainPrefix, createIPSetIPv4, createIPSetIPv6, metrics, portforward.Options{CreateIPSets: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ipsets should exist now, so the strict check should pass
+	_, err = portforward.New(chainPrefix, createIPSetIPv4, createIPSetIPv6, metrics, portforward.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, name := range []string{createIPSetIPv4, createIPSetIPv6} {
+		err = conn.Destroy(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
 }
 
 func TestInvalidIPSet(t *testing.T) {
-	_, err := portforward.New(chainPrefix, "nonexistant", "nonexistant")
+	_, err := portforward.New(chainPrefix, "nonexistant", "nonexistant", metrics, portforward.Options{})
 	if err == nil {
 		t.Fatal("no error")
 	}
@@ -0,0 +1,169 @@
+package portforward
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRanges parses a comma delimited list of ports and port ranges, eg '80,1024-65535'
+func ParsePortRanges(s string) ([]PortRange, error) {
+	var ranges []PortRange
+	if s == "" {
+		return ranges, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+
+		min, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid port range %s", part)
+		}
+
+		max := min
+		if len(bounds) == 2 {
+			max, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid port range %s", part)
+			}
+		}
+
+		if min < 1 || max > 65535 || min > max {
+			return nil, fmt.Errorf("invalid port range %s", part)
+		}
+
+		ranges = append(ranges, PortRange{Min: min, Max: max})
+	}
+
+	return ranges, nil
+}
+
+// Get a copy of the peer with only the ports that are allowed to be forwarded, limited to the max ports per peer
+// The rejected and truncated ports are counted if count is set and they weren't already counted for the peer
+// Removing portforwarding doesn't count them, but forgets them so that they're counted again if the peer is added back
+func (p *Portforward) allowedPorts(peer api.WireguardPeer, count bool) api.WireguardPeer {
+	if len(p.options.AllowedPorts) == 0 && p.options.MaxPortsPerPeer == 0 {
+		return peer
+	}
+
+	ports := make([]int, 0, len(peer.Ports))
+	rejected := make(map[int]bool)
+	for _, port := range peer.Ports {
+		if len(p.options.AllowedPorts) > 0 && !portAllowed(port, p.options.AllowedPorts) {
+			rejected[port] = true
+			continue
+		}
+
+		ports = append(ports, port)
+	}
+
+	truncated := 0
+	if p.options.MaxPortsPerPeer > 0 {
+		ports = uniquePorts(ports)
+		if len(ports) > p.options.MaxPortsPerPeer {
+			truncated = len(ports)
+			ports = ports[:p.options.MaxPortsPerPeer]
+		}
+	}
+
+	if count {
+		p.countRejectedPorts(peer.Pubkey, rejected)
+		p.countTruncatedPorts(peer, truncated)
+	} else {
+		delete(p.rejectedPorts, peer.Pubkey)
+		delete(p.truncatedPorts, peer.Pubkey)
+	}
+
+	peer.Ports = ports
+	return peer
+}
+
+// Count the rejected ports of the peer which weren't rejected by the previous update of it
+func (p *Portforward) countRejectedPorts(pubkey string, rejected map[int]bool) {
+	previous := p.rejectedPorts[pubkey]
+	for port := range rejected {
+		if !previous[port] {
+			p.metrics.Increment("forwarding_port_rejected")
+		}
+	}
+
+	if len(rejected) == 0 {
+		delete(p.rejectedPorts, pubkey)
+		return
+	}
+
+	p.rejectedPorts[pubkey] = rejected
+}
+
+// Count and log the truncation of the ports of the peer, unless it was truncated from the same number of ports by the previous update of it
+// The truncated number is the number of ports the peer had before being truncated, or 0 if it wasn't
+func (p *Portforward) countTruncatedPorts(peer api.WireguardPeer, truncated int) {
+	if truncated == 0 {
+		delete(p.truncatedPorts, peer.Pubkey)
+		return
+	}
+
+	if p.truncatedPorts[peer.Pubkey] != truncated {
+		p.metrics.Increment("forwarding_ports_truncated")
+		log.Printf("peer %s has %d ports, only forwarding the lowest %d", peer.Fingerprint(), truncated, p.options.MaxPortsPerPeer)
+	}
+
+	p.truncatedPorts[peer.Pubkey] = truncated
+}
+
+// Forget the rejected and truncated ports of peers that are no longer in the list, so that they're counted again if the peers are added back
+func (p *Portforward) forgetLimitedPorts(peers api.WireguardPeerList) {
+	pubkeys := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		pubkeys[peer.Pubkey] = true
+	}
+
+	for pubkey := range p.rejectedPorts {
+		if !pubkeys[pubkey] {
+			delete(p.rejectedPorts, pubkey)
+		}
+	}
+
+	for pubkey := range p.truncatedPorts {
+		if !pubkeys[pubkey] {
+			delete(p.truncatedPorts, pubkey)
+		}
+	}
+}
+
+// Sort the ports and remove duplicates, in place
+func uniquePorts(ports []int) []int {
+	sort.Ints(ports)
+
+	unique := ports[:0]
+	for i, port := range ports {
+		if i > 0 && port == ports[i-1] {
+			continue
+		}
+
+		unique = append(unique, port)
+	}
+
+	return unique
+}
+
+func portAllowed(port int, ranges []PortRange) bool {
+	for _, r := range ranges {
+		if port >= r.Min && port <= r.Max {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,139 @@
+package portforward
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+)
+
+func TestRejectedPortsCountedOnce(t *testing.T) {
+	// Receive the metrics, to check how many times the limited ports are counted
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	metrics, err := statsd.New(statsd.Address(conn.LocalAddr().String()), statsd.FlushPeriod(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.Close()
+
+	p := &Portforward{
+		options: Options{AllowedPorts: []PortRange{{Min: 1024, Max: 65535}}},
+		metrics: metrics,
+
+		rejectedPorts: make(map[string]map[int]bool),
+	}
+
+	peer := api.WireguardPeer{Pubkey: "a", Ports: []int{80, 443, 1234}}
+	other := api.WireguardPeer{Pubkey: "b", Ports: []int{80}}
+
+	steps := []struct {
+		name     string
+		update   func()
+		rejected int
+	}{
+		{"new peer", func() { p.allowedPorts(peer, true) }, 2},
+		{"unchanged peer", func() { p.allowedPorts(peer, true) }, 0},
+		{"new rejected port", func() {
+			peer.Ports = append(peer.Ports, 22)
+			p.allowedPorts(peer, true)
+		}, 1},
+		{"other peer", func() { p.allowedPorts(other, true) }, 1},
+		{"removed peer", func() {
+			p.allowedPorts(peer, false)
+			p.allowedPorts(peer, true)
+		}, 3},
+		{"peer left out of the list", func() {
+			p.forgetLimitedPorts(api.WireguardPeerList{peer})
+			p.allowedPorts(other, true)
+		}, 1},
+	}
+
+	for _, step := range steps {
+		step.update()
+
+		rejected := countMetric(t, conn, metrics, "forwarding_port_rejected")
+		if rejected != step.rejected {
+			t.Errorf("%s: got %d rejected ports, wanted %d", step.name, rejected, step.rejected)
+		}
+	}
+}
+
+func TestTruncatedPortsCountedOnce(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	metrics, err := statsd.New(statsd.Address(conn.LocalAddr().String()), statsd.FlushPeriod(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.Close()
+
+	p := &Portforward{
+		options: Options{MaxPortsPerPeer: 2},
+		metrics: metrics,
+
+		truncatedPorts: make(map[string]int),
+	}
+
+	peer := api.WireguardPeer{Pubkey: "a", Ports: []int{1234, 1235, 1236}}
+
+	steps := []struct {
+		name      string
+		update    func()
+		truncated int
+	}{
+		{"new peer", func() { p.allowedPorts(peer, true) }, 1},
+		{"unchanged peer", func() { p.allowedPorts(peer, true) }, 0},
+		{"more ports", func() {
+			peer.Ports = append(peer.Ports, 1237)
+			p.allowedPorts(peer, true)
+		}, 1},
+		{"within the limit", func() {
+			p.allowedPorts(api.WireguardPeer{Pubkey: "a", Ports: []int{1234}}, true)
+			p.allowedPorts(peer, true)
+		}, 1},
+		{"removed peer", func() {
+			p.allowedPorts(peer, false)
+			p.allowedPorts(peer, true)
+		}, 1},
+		{"peer left out of the list", func() {
+			p.forgetLimitedPorts(api.WireguardPeerList{})
+			p.allowedPorts(peer, true)
+		}, 1},
+	}
+
+	for _, step := range steps {
+		step.update()
+
+		truncated := countMetric(t, conn, metrics, "forwarding_ports_truncated")
+		if truncated != step.truncated {
+			t.Errorf("%s: got %d truncations, wanted %d", step.name, truncated, step.truncated)
+		}
+	}
+}
+
+// Count the increments of the metric since the last call, by flushing the metrics along with a marker so that there's always a packet to read
+func countMetric(t *testing.T, conn net.PacketConn, metrics *statsd.Client, name string) int {
+	metrics.Increment("marker")
+	metrics.Flush()
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Count(string(buf[:n]), name+":1|c")
+}
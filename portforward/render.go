@@ -0,0 +1,106 @@
+package portforward
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/mullvad/wg-manager/api"
+)
+
+// Render writes the rules that UpdatePortforwarding would leave in the chains for the given peers, without touching the system
+// The rules are written in the format of iptables-save followed by ip6tables-save, so that they can be diffed
+// Rules added to shared chains by other tools aren't included
+func Render(w io.Writer, chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string, peers api.WireguardPeerList, options Options) error {
+	options, err := validateOptions(options)
+	if err != nil {
+		return err
+	}
+
+	p := &Portforward{
+		chains:    newOptionChains(chainPrefix, options),
+		ipsetIPv4: ipsetTableIPv4,
+		ipsetIPv6: ipsetTableIPv6,
+		options:   options,
+	}
+
+	// Create the rules of every chain once, and split them by protocol when writing
+	rules := make(map[Chain]map[string]iptables.Protocol)
+	for _, chain := range p.chains {
+		rules[chain] = make(map[string]iptables.Protocol)
+		for _, peer := range peers {
+			peer = p.allowedPorts(peer, false)
+			if len(peer.Ports) < 1 || !peer.HasForwarding() {
+				continue
+			}
+
+			p.createChainRules(peer, chain, rules[chain])
+		}
+	}
+
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		if protocol == iptables.ProtocolIPv4 {
+			fmt.Fprintln(w, "# iptables-save")
+		} else {
+			fmt.Fprintln(w, "# ip6tables-save")
+		}
+
+		for _, table := range p.tables() {
+			fmt.Fprintf(w, "*%s\n", table)
+			for _, chain := range p.chains {
+				if chain.table == table {
+					fmt.Fprintf(w, ":%s - [0:0]\n", chain.name)
+				}
+			}
+
+			for _, chain := range p.chains {
+				if chain.table != table {
+					continue
+				}
+
+				for _, rule := range sortRules(rules[chain]) {
+					if rules[chain][rule] == protocol {
+						fmt.Fprintf(w, "-A %s %s\n", chain.name, saveRule(rule, protocol))
+					}
+				}
+			}
+
+			_, err := fmt.Fprintln(w, "COMMIT")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Get the tables of the chains, in the order of the chains
+func (p *Portforward) tables() []string {
+	var tables []string
+	for _, chain := range p.chains {
+		if len(tables) == 0 || tables[len(tables)-1] != chain.table {
+			tables = append(tables, chain.table)
+		}
+	}
+
+	return tables
+}
+
+// Add the masks of destination addresses back to a rule, which are removed when listing rules, see filterRules
+func saveRule(rule string, protocol iptables.Protocol) string {
+	mask := "/32"
+	if protocol == iptables.ProtocolIPv6 {
+		mask = "/128"
+	}
+
+	ruleSlice := strings.Split(rule, " ")
+	for i := 0; i < len(ruleSlice)-1; i++ {
+		if ruleSlice[i] == "-d" {
+			ruleSlice[i+1] += mask
+		}
+	}
+
+	return strings.Join(ruleSlice, " ")
+}
@@ -0,0 +1,34 @@
+package portforward
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrIPTablesTimeout is returned when an iptables operation doesn't complete within the timeout
+var ErrIPTablesTimeout = errors.New("iptables operation timed out")
+
+// Run an iptables operation, abandoning it if it doesn't complete within the timeout
+// go-iptables doesn't support cancellation, so an abandoned operation keeps running in the background until iptables exits
+func (p *Portforward) withTimeout(operation func() error) error {
+	if p.options.IPTablesTimeout <= 0 {
+		return operation()
+	}
+
+	// Buffered, so that an abandoned operation doesn't block forever when it completes
+	result := make(chan error, 1)
+	go func() {
+		result <- operation()
+	}()
+
+	timer := time.NewTimer(p.options.IPTablesTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		p.metrics.Increment("iptables_timeout")
+		return ErrIPTablesTimeout
+	}
+}
@@ -0,0 +1,77 @@
+package portforward
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infosum/statsd"
+)
+
+func TestWithTimeout(t *testing.T) {
+	// Receive the metrics, to check that the timeout is counted
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	metrics, err := statsd.New(statsd.Address(conn.LocalAddr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.Close()
+
+	p := &Portforward{options: Options{IPTablesTimeout: time.Millisecond * 10}, metrics: metrics}
+
+	t.Run("completed", func(t *testing.T) {
+		errOperation := errors.New("operation failed")
+		err := p.withTimeout(func() error {
+			return errOperation
+		})
+		if err != errOperation {
+			t.Errorf("got unexpected error %v", err)
+		}
+	})
+
+	t.Run("timed out", func(t *testing.T) {
+		block := make(chan struct{})
+		defer close(block)
+
+		err := p.withTimeout(func() error {
+			<-block
+			return nil
+		})
+		if !errors.Is(err, ErrIPTablesTimeout) {
+			t.Fatalf("got unexpected error %v", err)
+		}
+
+		metrics.Flush()
+
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(buf[:n]), "iptables_timeout:1|c") {
+			t.Errorf("timeout wasn't counted, got metrics %q", buf[:n])
+		}
+	})
+
+	t.Run("no timeout", func(t *testing.T) {
+		p := &Portforward{metrics: metrics}
+
+		// Operations are run directly without a timeout, so they complete however long they take
+		err := p.withTimeout(func() error {
+			time.Sleep(time.Millisecond * 20)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("got unexpected error %v", err)
+		}
+	})
+}
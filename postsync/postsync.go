@@ -0,0 +1,79 @@
+package postsync
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/shell"
+)
+
+// Command is a utility for running an external command after each successful synchronization
+type Command struct {
+	command string
+	timeout time.Duration
+	metrics *statsd.Client
+	queue   chan Result
+}
+
+// Result describes a successful synchronization, it's passed to the command as environment variables
+type Result struct {
+	PeerCount   int
+	ChangeCount int
+}
+
+// New returns a new Command instance, which runs the given command with sh, killing it if it runs for longer than the timeout
+func New(command string, timeout time.Duration, metrics *statsd.Client) *Command {
+	return &Command{
+		command: command,
+		timeout: timeout,
+		metrics: metrics,
+		// Only one run is queued, so that a slow command doesn't pile up runs
+		queue: make(chan Result, 1),
+	}
+}
+
+// Trigger queues a run of the command without blocking
+// The run is skipped if one is already queued, in which case false is returned
+func (c *Command) Trigger(result Result) bool {
+	select {
+	case c.queue <- result:
+		return true
+	default:
+		c.metrics.Increment("post_sync_command_skipped")
+		return false
+	}
+}
+
+// Run runs the command for queued results until the given context is canceled
+func (c *Command) Run(ctx context.Context) {
+	for {
+		select {
+		case result := <-c.queue:
+			err := c.run(ctx, result)
+			if err != nil {
+				log.Printf("error running post-sync command %s", err.Error())
+				c.metrics.Increment("post_sync_command_error")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Command) run(ctx context.Context, result Result) error {
+	t := c.metrics.NewTiming()
+	err := shell.Run(ctx, c.command, result.env(), c.timeout)
+	t.Send("post_sync_command_time")
+
+	return err
+}
+
+func (r Result) env() []string {
+	return []string{
+		"WG_PEER_COUNT=" + strconv.Itoa(r.PeerCount),
+		"WG_CHANGE_COUNT=" + strconv.Itoa(r.ChangeCount),
+	}
+}
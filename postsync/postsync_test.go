@@ -0,0 +1,71 @@
+package postsync_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/postsync"
+)
+
+func TestCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "output")
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := postsync.New("echo $WG_PEER_COUNT $WG_CHANGE_COUNT > "+output, time.Second*5, metrics)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go c.Run(ctx)
+
+	if !c.Trigger(postsync.Result{PeerCount: 3, ChangeCount: 1}) {
+		t.Fatal("run was skipped")
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		content, err := ioutil.ReadFile(output)
+		if err == nil && string(content) == "3 1\n" {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for command, got %q", content)
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestCommandSkipped(t *testing.T) {
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing runs the queued result, so the queue stays full
+	c := postsync.New("true", time.Second, metrics)
+
+	if !c.Trigger(postsync.Result{}) {
+		t.Fatal("run was skipped")
+	}
+
+	if c.Trigger(postsync.Result{}) {
+		t.Fatal("run wasn't skipped")
+	}
+}
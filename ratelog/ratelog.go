@@ -0,0 +1,100 @@
+package ratelog
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Limiter logs the first message of each category, and coalesces the following ones within the interval into a count
+// Once the interval is over, the number of coalesced messages is logged along with the last one of them,
+// and the next message of the category is logged right away again
+type Limiter struct {
+	interval   time.Duration
+	categories map[string]*category
+	mutex      sync.Mutex
+}
+
+// The messages of a category coalesced in the current interval
+type category struct {
+	count int
+	last  string
+}
+
+// New returns a new Limiter, coalescing the messages of each category within the given interval
+// Every message is logged if the interval is zero
+func New(interval time.Duration) *Limiter {
+	return &Limiter{
+		interval:   interval,
+		categories: make(map[string]*category),
+	}
+}
+
+var std = New(0)
+
+// SetInterval sets the interval of the standard limiter, used by Printf
+func SetInterval(interval time.Duration) {
+	std.mutex.Lock()
+	defer std.mutex.Unlock()
+
+	std.interval = interval
+}
+
+// Printf logs a message of the given category through the standard limiter
+func Printf(category string, format string, v ...interface{}) {
+	std.Printf(category, format, v...)
+}
+
+// Printf logs a message of the given category, unless one of the same category has been logged within the interval
+func (l *Limiter) Printf(name string, format string, v ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.interval <= 0 {
+		log.Printf(format, v...)
+		return
+	}
+
+	if c, ok := l.categories[name]; ok {
+		c.count++
+		c.last = fmt.Sprintf(format, v...)
+		return
+	}
+
+	log.Printf(format, v...)
+
+	c := &category{}
+	l.categories[name] = c
+	time.AfterFunc(l.interval, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+
+		// The category may already have been flushed, and started over
+		if l.categories[name] == c {
+			l.flush(name)
+		}
+	})
+}
+
+// Flush logs the coalesced messages of every category right away, without waiting for the interval to be over,
+// and starts logging the messages of the categories again
+func (l *Limiter) Flush() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for name := range l.categories {
+		l.flush(name)
+	}
+}
+
+// Log the messages of the category coalesced in the interval that's over, and start logging them again
+// The mutex has to be held by the caller
+func (l *Limiter) flush(name string) {
+	c := l.categories[name]
+	delete(l.categories, name)
+
+	if c.count > 0 {
+		log.Printf("%s (%d more occurrences in the last %s)", c.last, c.count, l.interval)
+	}
+}
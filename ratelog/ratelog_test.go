@@ -0,0 +1,85 @@
+package ratelog_test
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mullvad/wg-manager/ratelog"
+)
+
+// A log output that's safe to read while the limiter writes to it
+type logBuffer struct {
+	buf   bytes.Buffer
+	mutex sync.Mutex
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) lines() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+func captureLog(t *testing.T) *logBuffer {
+	buf := &logBuffer{}
+	log.SetOutput(buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+
+	return buf
+}
+
+func TestLimiter(t *testing.T) {
+	buf := captureLog(t)
+
+	// The interval is never over during the test, the coalesced messages are flushed directly instead
+	limiter := ratelog.New(time.Hour)
+
+	for i := 0; i < 5; i++ {
+		limiter.Printf("iptables", "error adding rule %d", i)
+	}
+	limiter.Printf("api", "error getting peers")
+
+	expected := []string{"error adding rule 0", "error getting peers"}
+	if diff := cmp.Diff(expected, buf.lines()); diff != "" {
+		t.Fatalf("unexpected log lines (-want +got):\n%s", diff)
+	}
+
+	// The coalesced messages are summarized once flushed, and new messages are logged right away again
+	limiter.Flush()
+	limiter.Printf("iptables", "error adding rule 5")
+
+	expected = append(expected, "error adding rule 4 (4 more occurrences in the last 1h0m0s)", "error adding rule 5")
+	if diff := cmp.Diff(expected, buf.lines()); diff != "" {
+		t.Fatalf("unexpected log lines (-want +got):\n%s", diff)
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	buf := captureLog(t)
+
+	limiter := ratelog.New(0)
+	limiter.Printf("iptables", "error adding rule")
+	limiter.Printf("iptables", "error adding rule")
+
+	expected := []string{"error adding rule", "error adding rule"}
+	if diff := cmp.Diff(expected, buf.lines()); diff != "" {
+		t.Fatalf("unexpected log lines (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,64 @@
+package readiness
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check reports whether the instance is ready to be routed to
+// It's ready when the peers were recently synchronized with the API, and events are being received from the message-queue
+type Check struct {
+	maxSyncAge time.Duration
+	connected  func() bool
+	lastSync   time.Time
+	mutex      sync.Mutex
+}
+
+// New returns a new Check instance, which requires a synchronization within maxSyncAge and connected to report true
+func New(maxSyncAge time.Duration, connected func() bool) *Check {
+	return &Check{
+		maxSyncAge: maxSyncAge,
+		connected:  connected,
+	}
+}
+
+// Synced records that the peers were successfully synchronized at the given time
+func (c *Check) Synced(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.lastSync = t
+}
+
+// Ready checks whether the instance is ready at the given time, and returns why if it isn't
+func (c *Check) Ready(now time.Time) (bool, string) {
+	c.mutex.Lock()
+	lastSync := c.lastSync
+	c.mutex.Unlock()
+
+	if lastSync.IsZero() {
+		return false, "no synchronization has succeeded yet"
+	}
+
+	if now.Sub(lastSync) > c.maxSyncAge {
+		return false, "the last successful synchronization is older than " + c.maxSyncAge.String()
+	}
+
+	if !c.connected() {
+		return false, "not connected to the message-queue"
+	}
+
+	return true, ""
+}
+
+// ServeHTTP responds with 200 if the instance is ready, and with 503 and the reason otherwise
+func (c *Check) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ready, reason := c.Ready(time.Now())
+	if !ready {
+		http.Error(rw, reason, http.StatusServiceUnavailable)
+		return
+	}
+
+	rw.Write([]byte("ok\n"))
+}
@@ -0,0 +1,62 @@
+package readiness_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/readiness"
+)
+
+func TestCheck(t *testing.T) {
+	now := time.Now()
+	connected := true
+	check := readiness.New(time.Minute, func() bool { return connected })
+
+	t.Run("not synchronized", func(t *testing.T) {
+		if ready, _ := check.Ready(now); ready {
+			t.Fatal("ready without a synchronization")
+		}
+	})
+
+	t.Run("recently synchronized", func(t *testing.T) {
+		check.Synced(now.Add(-time.Second * 30))
+
+		if ready, reason := check.Ready(now); !ready {
+			t.Fatalf("not ready: %s", reason)
+		}
+	})
+
+	t.Run("stale synchronization", func(t *testing.T) {
+		if ready, _ := check.Ready(now.Add(time.Minute)); ready {
+			t.Fatal("ready with a stale synchronization")
+		}
+	})
+
+	t.Run("disconnected", func(t *testing.T) {
+		connected = false
+		defer func() { connected = true }()
+
+		if ready, _ := check.Ready(now); ready {
+			t.Fatal("ready while disconnected")
+		}
+	})
+
+	t.Run("serve http", func(t *testing.T) {
+		check.Synced(time.Now())
+
+		recorder := httptest.NewRecorder()
+		check.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("got unexpected status %d", recorder.Code)
+		}
+
+		connected = false
+		recorder = httptest.NewRecorder()
+		check.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if recorder.Code != http.StatusServiceUnavailable {
+			t.Errorf("got unexpected status %d", recorder.Code)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package sdnotify_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/sdnotify"
+)
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdnotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	sent, err := sdnotify.Notify(sdnotify.Ready)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sent {
+		t.Fatal("notification wasn't sent")
+	}
+
+	buffer := make([]byte, 64)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buffer[:n]) != sdnotify.Ready {
+		t.Errorf("got unexpected notification, wanted %s, got %s", sdnotify.Ready, buffer[:n])
+	}
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+
+	sent, err := sdnotify.Notify(sdnotify.Ready)
+	if err != nil || sent {
+		t.Fatalf("unexpected result %t, %v", sent, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	if interval := sdnotify.WatchdogInterval(); interval != time.Second*30 {
+		t.Errorf("got unexpected interval %s", interval)
+	}
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if interval := sdnotify.WatchdogInterval(); interval != 0 {
+		t.Errorf("got unexpected interval %s for another process", interval)
+	}
+
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	if interval := sdnotify.WatchdogInterval(); interval != 0 {
+		t.Errorf("got unexpected interval %s without a watchdog", interval)
+	}
+}
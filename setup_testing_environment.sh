@@ -15,5 +15,13 @@ iptables -t nat -N PORTFORWARDING_TCP
 ip6tables -t nat -N PORTFORWARDING_TCP
 iptables -t nat -N PORTFORWARDING_UDP
 ip6tables -t nat -N PORTFORWARDING_UDP
+iptables -t nat -N PORTFORWARDING_WG0_TCP
+ip6tables -t nat -N PORTFORWARDING_WG0_TCP
+iptables -t nat -N PORTFORWARDING_WG0_UDP
+ip6tables -t nat -N PORTFORWARDING_WG0_UDP
+iptables -t mangle -N PORTFORWARDING_DSCP_TCP
+ip6tables -t mangle -N PORTFORWARDING_DSCP_TCP
+iptables -t mangle -N PORTFORWARDING_DSCP_UDP
+ip6tables -t mangle -N PORTFORWARDING_DSCP_UDP
 ipset create PORTFORWARDING_IPV4 hash:ip
 ipset create PORTFORWARDING_IPV6 hash:ip family inet6
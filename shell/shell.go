@@ -0,0 +1,22 @@
+package shell
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Run runs the command with sh, with the given variables added to the environment of wg-manager
+// The output of the command goes to the output of wg-manager, and the command is killed if it runs for longer than the timeout
+func Run(ctx context.Context, command string, env []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
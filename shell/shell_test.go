@@ -0,0 +1,48 @@
+package shell_test
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/shell"
+)
+
+func TestRun(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output")
+
+	err := shell.Run(context.Background(), "echo $WG_TEST_VALUE > "+output, []string{"WG_TEST_VALUE=a"}, time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "a\n" {
+		t.Errorf("got unexpected output %q", content)
+	}
+}
+
+func TestRunError(t *testing.T) {
+	err := shell.Run(context.Background(), "exit 1", nil, time.Second*5)
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	start := time.Now()
+	err := shell.Run(context.Background(), "exec sleep 10", nil, time.Millisecond*100)
+	if err == nil {
+		t.Fatal("no error")
+	}
+
+	if time.Since(start) > time.Second*5 {
+		t.Fatalf("command wasn't killed after the timeout, took %s", time.Since(start))
+	}
+}
@@ -0,0 +1,99 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// ErrInvalidSnapshot is returned when the snapshot file doesn't match its checksum
+var ErrInvalidSnapshot = errors.New("invalid peer snapshot")
+
+// snapshotFile is the contents of the snapshot file
+type snapshotFile struct {
+	Time  time.Time       `json:"time"`
+	Peers json.RawMessage `json:"peers"`
+	// Checksum is the hex encoded SHA-256 of the peers, to detect truncated or corrupted files
+	Checksum string `json:"checksum"`
+}
+
+// Write saves the peers to the snapshot file at the given path
+// The file is replaced atomically, so that a crash while writing never leaves a partial snapshot behind
+func Write(path string, peers api.WireguardPeerList, now time.Time) error {
+	encodedPeers, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(encodedPeers)
+	contents, err := json.Marshal(snapshotFile{
+		Time:     now,
+		Peers:    encodedPeers,
+		Checksum: hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(contents)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Read loads the peers from the snapshot file at the given path, along with when the snapshot was written
+// ErrInvalidSnapshot is returned if the file doesn't match its checksum
+func Read(path string) (api.WireguardPeerList, time.Time, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var file snapshotFile
+	err = json.Unmarshal(contents, &file)
+	if err != nil {
+		return nil, time.Time{}, ErrInvalidSnapshot
+	}
+
+	// The raw peers are compacted by json.Marshal when writing, compact them the same way to verify them
+	var encodedPeers bytes.Buffer
+	err = json.Compact(&encodedPeers, file.Peers)
+	if err != nil {
+		return nil, time.Time{}, ErrInvalidSnapshot
+	}
+
+	sum := sha256.Sum256(encodedPeers.Bytes())
+	if hex.EncodeToString(sum[:]) != file.Checksum {
+		return nil, time.Time{}, ErrInvalidSnapshot
+	}
+
+	var peers api.WireguardPeerList
+	err = json.Unmarshal(encodedPeers.Bytes(), &peers)
+	if err != nil {
+		return nil, time.Time{}, ErrInvalidSnapshot
+	}
+
+	return peers, file.Time, nil
+}
@@ -0,0 +1,91 @@
+package snapshot_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/snapshot"
+)
+
+var peersFixture = api.WireguardPeerList{
+	api.WireguardPeer{
+		IPv4:   "10.99.0.1/32",
+		IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
+		Ports:  []int{1234, 4321},
+		Pubkey: strings.Repeat("a", 44),
+	},
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "peers.json")
+	now := time.Now().UTC().Truncate(time.Second)
+
+	t.Run("missing", func(t *testing.T) {
+		_, _, err := snapshot.Read(path)
+		if !os.IsNotExist(err) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("write and read", func(t *testing.T) {
+		err := snapshot.Write(path, peersFixture, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peers, written, err := snapshot.Read(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(peers, peersFixture) {
+			t.Errorf("got unexpected peers, wanted %+v, got %+v", peersFixture, peers)
+		}
+
+		if !written.Equal(now) {
+			t.Errorf("got unexpected time, wanted %s, got %s", now, written)
+		}
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(path, []byte(strings.Replace(string(contents), "10.99.0.1", "10.99.0.2", 1)), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = snapshot.Read(path)
+		if !errors.Is(err, snapshot.ErrInvalidSnapshot) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		err := ioutil.WriteFile(path, []byte(`{"time":`), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = snapshot.Read(path)
+		if !errors.Is(err, snapshot.ErrInvalidSnapshot) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// New returns a TLS configuration requiring the given minimum version, and restricted to the given comma delimited cipher suites
+// The Go defaults are used for empty values, and nil is returned if both are empty
+// Cipher suites only apply to TLS 1.2 and lower, as the TLS 1.3 suites aren't configurable
+func New(minVersion string, cipherSuites string) (*tls.Config, error) {
+	if minVersion == "" && cipherSuites == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if minVersion != "" {
+		version, ok := versions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls version %s", minVersion)
+		}
+
+		config.MinVersion = version
+	}
+
+	if cipherSuites != "" {
+		suites, err := parseCipherSuites(cipherSuites)
+		if err != nil {
+			return nil, err
+		}
+
+		config.CipherSuites = suites
+	}
+
+	return config, nil
+}
+
+// Parse a comma delimited list of cipher suite names, only the suites considered secure by Go are accepted
+func parseCipherSuites(names string) ([]uint16, error) {
+	ids := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		ids[suite.Name] = suite.ID
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(names, ",") {
+		id, ok := ids[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("invalid cipher suite %s", name)
+		}
+
+		suites = append(suites, id)
+	}
+
+	return suites, nil
+}
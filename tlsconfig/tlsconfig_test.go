@@ -0,0 +1,59 @@
+package tlsconfig_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/mullvad/wg-manager/tlsconfig"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		config, err := tlsconfig.New("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if config != nil {
+			t.Fatal("got a configuration without any options")
+		}
+	})
+
+	t.Run("minimum version", func(t *testing.T) {
+		config, err := tlsconfig.New("1.3", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+
+		if transport.TLSClientConfig.MinVersion != tls.VersionTLS13 {
+			t.Errorf("got unexpected minimum version %x", transport.TLSClientConfig.MinVersion)
+		}
+	})
+
+	t.Run("cipher suites", func(t *testing.T) {
+		config, err := tlsconfig.New("1.2", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(config.CipherSuites) != 2 || config.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 || config.CipherSuites[1] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+			t.Errorf("got unexpected cipher suites %v", config.CipherSuites)
+		}
+	})
+
+	t.Run("invalid version", func(t *testing.T) {
+		if _, err := tlsconfig.New("1.4", ""); err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("insecure cipher suite", func(t *testing.T) {
+		if _, err := tlsconfig.New("", "TLS_RSA_WITH_RC4_128_SHA"); err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/infosum/statsd"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer is a utility for exporting spans to an OpenTelemetry collector, using the OTLP over HTTP exporter of the SDK
+// A nil Tracer doesn't record any spans, so that tracing has no overhead when it's disabled
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// Span is a single timed operation within a trace
+// A nil Span ignores all calls, which is what a nil Tracer starts
+type Span struct {
+	span trace.Span
+}
+
+// The max number of spans to export in a single request
+const batchSize = 100
+
+// How long to wait for the queued spans to be exported when shutting down
+const shutdownTimeout = time.Second * 5
+
+// New returns a new Tracer instance, which buffers up to queueSize finished spans before dropping them
+// The url is the full url of the traces endpoint of the collector, such as http://127.0.0.1:4318/v1/traces
+func New(rawURL string, serviceName string, timeout time.Duration, queueSize int, metrics *statsd.Client) (*Tracer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(u.Path),
+		otlptracehttp.WithTimeout(timeout),
+	}
+
+	switch u.Scheme {
+	case "https":
+	case "http":
+		options = append(options, otlptracehttp.WithInsecure())
+	default:
+		return nil, fmt.Errorf("invalid otlp url scheme %q", u.Scheme)
+	}
+
+	client, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	maxBatchSize := batchSize
+	if queueSize < maxBatchSize {
+		maxBatchSize = queueSize
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter{SpanExporter: client, metrics: metrics},
+			sdktrace.WithMaxQueueSize(queueSize),
+			sdktrace.WithMaxExportBatchSize(maxBatchSize),
+		),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+
+	return &Tracer{
+		provider: provider,
+		tracer:   provider.Tracer(serviceName),
+	}, nil
+}
+
+// exporter logs and counts the errors of exporting spans
+type exporter struct {
+	sdktrace.SpanExporter
+	metrics *statsd.Client
+}
+
+func (e exporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	if err != nil {
+		log.Printf("error exporting spans %s", err.Error())
+		e.metrics.Increment("tracing_error")
+	}
+
+	// The error has been handled, rather than passing it on to the global error handler of the SDK
+	return nil
+}
+
+// Start starts a span, as a child of the span in the given context if there is one
+// The returned context contains the new span, so that it's the parent of spans started with it
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, &Span{span: span}
+}
+
+// FromContext returns the span in the given context, or nil if there is none
+func FromContext(ctx context.Context) *Span {
+	span := trace.SpanFromContext(ctx)
+	if !span.SpanContext().IsValid() {
+		return nil
+	}
+
+	return &Span{span: span}
+}
+
+// TraceParent returns the W3C traceparent header value for the span in the given context, to propagate the trace to other services
+// It's empty if there's no span in the context
+func TraceParent(ctx context.Context) string {
+	header := http.Header{}
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(header))
+	return header.Get("traceparent")
+}
+
+// SetAttribute sets an attribute of the span
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+// SetError marks the span as failed with the given error, if it isn't nil
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends the span and queues it for export without blocking
+// The span is dropped if the queue is full
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.span.End()
+}
+
+// Run waits until the given context is canceled, and then stops the tracer once the spans that are still queued are exported
+// Spans are exported in the background by the SDK, in batches of up to batchSize spans
+func (t *Tracer) Run(ctx context.Context) {
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := t.provider.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("error shutting down tracing %s", err.Error())
+	}
+}
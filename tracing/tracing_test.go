@@ -0,0 +1,154 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/tracing"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTracer(t *testing.T) {
+	received := make(chan *collectortrace.ExportTraceServiceRequest, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" {
+			t.Errorf("got unexpected path %s", req.URL.Path)
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		var request collectortrace.ExportTraceServiceRequest
+		err = proto.Unmarshal(body, &request)
+		if err != nil {
+			t.Error(err)
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		received <- &request
+	}))
+	defer server.Close()
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracer, err := tracing.New(server.URL+"/v1/traces", "wg-manager", time.Second, 10, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, root := tracer.Start(context.Background(), "synchronize")
+	childCtx, child := tracer.Start(ctx, "get_peers")
+	tracing.FromContext(childCtx).SetAttribute("api.request_id", "abc")
+	child.SetError(errors.New("failed"))
+
+	traceParent := tracing.TraceParent(childCtx)
+	if !regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`).MatchString(traceParent) {
+		t.Errorf("got unexpected traceparent %s", traceParent)
+	}
+
+	child.End()
+	root.End()
+
+	// The queued spans are exported together when the tracer is stopped
+	runCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tracer.Run(runCtx)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	var request *collectortrace.ExportTraceServiceRequest
+	select {
+	case request = <-received:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for spans")
+	}
+
+	resourceSpans := request.GetResourceSpans()[0]
+	serviceName := resourceSpans.GetResource().GetAttributes()
+	if !hasAttribute(serviceName, "service.name", "wg-manager") {
+		t.Errorf("got unexpected resource attributes %+v", serviceName)
+	}
+
+	spans := resourceSpans.GetInstrumentationLibrarySpans()[0].GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got unexpected number of spans %d", len(spans))
+	}
+
+	if spans[0].GetName() != "get_peers" || spans[1].GetName() != "synchronize" {
+		t.Errorf("got unexpected span names %s and %s", spans[0].GetName(), spans[1].GetName())
+	}
+
+	if hex.EncodeToString(spans[0].GetTraceId()) != hex.EncodeToString(spans[1].GetTraceId()) ||
+		hex.EncodeToString(spans[0].GetParentSpanId()) != hex.EncodeToString(spans[1].GetSpanId()) ||
+		len(spans[1].GetParentSpanId()) != 0 {
+		t.Errorf("spans aren't correlated %+v", spans)
+	}
+
+	if traceParent != "00-"+hex.EncodeToString(spans[0].GetTraceId())+"-"+hex.EncodeToString(spans[0].GetSpanId())+"-01" {
+		t.Errorf("traceparent %s doesn't match the span", traceParent)
+	}
+
+	if len(spans[0].GetAttributes()) != 1 || !hasAttribute(spans[0].GetAttributes(), "api.request_id", "abc") {
+		t.Errorf("got unexpected attributes %+v", spans[0].GetAttributes())
+	}
+
+	status := spans[0].GetStatus()
+	if status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || status.GetMessage() != "failed" {
+		t.Errorf("got unexpected status %+v", status)
+	}
+}
+
+func TestInvalidURL(t *testing.T) {
+	for _, invalid := range []string{"127.0.0.1:4318", "ftp://127.0.0.1/v1/traces", "http://[::1"} {
+		_, err := tracing.New(invalid, "wg-manager", time.Second, 10, nil)
+		if err == nil {
+			t.Errorf("no error for url %s", invalid)
+		}
+	}
+}
+
+func TestDisabledTracer(t *testing.T) {
+	var tracer *tracing.Tracer
+
+	ctx, span := tracer.Start(context.Background(), "synchronize")
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("failed"))
+	span.End()
+
+	if tracing.TraceParent(ctx) != "" {
+		t.Error("disabled tracer propagated a trace")
+	}
+
+	if tracing.FromContext(ctx) != nil {
+		t.Error("disabled tracer started a span")
+	}
+}
+
+func hasAttribute(attributes []*commonpb.KeyValue, key string, value string) bool {
+	for _, attribute := range attributes {
+		if attribute.GetKey() == key && attribute.GetValue().GetStringValue() == value {
+			return true
+		}
+	}
+
+	return false
+}
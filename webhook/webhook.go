@@ -0,0 +1,101 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/infosum/statsd"
+)
+
+// Webhook is a utility for sending peer change notifications to an external url
+type Webhook struct {
+	url     string
+	client  *http.Client
+	metrics *statsd.Client
+	queue   chan Notification
+}
+
+// Notification is a peer change notification
+type Notification struct {
+	Pubkey    string `json:"pubkey"`
+	Action    string `json:"action"`
+	Interface string `json:"interface"`
+}
+
+// New returns a new Webhook instance, which buffers up to queueSize notifications
+func New(url string, timeout time.Duration, queueSize int, metrics *statsd.Client) *Webhook {
+	return &Webhook{
+		url: url,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+		metrics: metrics,
+		queue:   make(chan Notification, queueSize),
+	}
+}
+
+// Notify queues a notification for delivery without blocking
+// The notification is dropped if the queue is full, in which case false is returned
+func (w *Webhook) Notify(notification Notification) bool {
+	select {
+	case w.queue <- notification:
+		return true
+	default:
+		w.metrics.Increment("webhook_dropped")
+		return false
+	}
+}
+
+// Run delivers queued notifications until the given context is canceled
+func (w *Webhook) Run(ctx context.Context) {
+	for {
+		select {
+		case notification := <-w.queue:
+			err := w.send(ctx, notification)
+			if err != nil {
+				log.Printf("error sending webhook %s", err.Error())
+				w.metrics.Increment("webhook_error")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Webhook) send(ctx context.Context, notification Notification) error {
+	return Post(ctx, w.client, w.url, notification)
+}
+
+// Post posts the value as JSON to the url with the client, returning an error for responses without a 2xx status code
+func Post(ctx context.Context, client *http.Client, url string, value interface{}) error {
+	buffer := new(bytes.Buffer)
+	err := json.NewEncoder(buffer).Encode(value)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, buffer)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+
+	return nil
+}
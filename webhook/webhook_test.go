@@ -0,0 +1,79 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/webhook"
+)
+
+var fixture = webhook.Notification{
+	Pubkey:    strings.Repeat("a", 44),
+	Action:    "ADD",
+	Interface: "wg0",
+}
+
+func TestWebhook(t *testing.T) {
+	received := make(chan webhook.Notification)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var notification webhook.Notification
+		err := json.NewDecoder(req.Body).Decode(&notification)
+		if err != nil {
+			t.Error(err)
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		received <- notification
+	}))
+	defer server.Close()
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := webhook.New(server.URL, time.Second, 1, metrics)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go w.Run(ctx)
+
+	if !w.Notify(fixture) {
+		t.Fatal("notification was dropped")
+	}
+
+	select {
+	case notification := <-received:
+		if !reflect.DeepEqual(notification, fixture) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, notification)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for notification")
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Don't run the webhook, so that the queue fills up
+	w := webhook.New("http://127.0.0.1", time.Second, 1, metrics)
+
+	if !w.Notify(fixture) {
+		t.Fatal("notification was dropped")
+	}
+
+	if w.Notify(fixture) {
+		t.Fatal("notification was not dropped")
+	}
+}
@@ -0,0 +1,47 @@
+package wireguard
+
+import (
+	"fmt"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ConnectedCriteria decides which peers are reported to the API as connected
+type ConnectedCriteria string
+
+// Criteria for considering a peer connected
+const (
+	// ConnectedHandshakeRecent considers peers with a handshake within the connected interval connected
+	ConnectedHandshakeRecent ConnectedCriteria = "handshake-recent"
+	// ConnectedTransfer considers peers that have sent or received any data connected
+	ConnectedTransfer ConnectedCriteria = "transfer"
+	// ConnectedAny considers peers with any handshake connected
+	ConnectedAny ConnectedCriteria = "any"
+)
+
+// ParseConnectedCriteria parses the name of a connected criteria, an empty name is ConnectedHandshakeRecent
+func ParseConnectedCriteria(name string) (ConnectedCriteria, error) {
+	switch c := ConnectedCriteria(name); c {
+	case "":
+		return ConnectedHandshakeRecent, nil
+	case ConnectedHandshakeRecent, ConnectedTransfer, ConnectedAny:
+		return c, nil
+	default:
+		return "", fmt.Errorf("invalid connected criteria %s", name)
+	}
+}
+
+// Connected checks whether the peer is considered connected at the given time
+// The handshake and transfer of peers are reset once they've been inactive for a while, see needsReset,
+// so every criteria stops considering a peer connected after some inactivity
+func (c ConnectedCriteria) Connected(peer wgtypes.Peer, now time.Time) bool {
+	switch c {
+	case ConnectedTransfer:
+		return peer.ReceiveBytes > 0 || peer.TransmitBytes > 0
+	case ConnectedAny:
+		return !peer.LastHandshakeTime.IsZero()
+	default:
+		return now.Sub(peer.LastHandshakeTime) <= connectedInterval
+	}
+}
@@ -0,0 +1,65 @@
+package wireguard_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestConnectedCriteria(t *testing.T) {
+	now := time.Now()
+
+	recentPeer := wgtypes.Peer{LastHandshakeTime: now.Add(-time.Minute)}
+	stalePeer := wgtypes.Peer{LastHandshakeTime: now.Add(-time.Minute * 10)}
+	transferPeer := wgtypes.Peer{LastHandshakeTime: now.Add(-time.Minute * 10), ReceiveBytes: 148}
+	newPeer := wgtypes.Peer{}
+
+	tests := []struct {
+		criteria wireguard.ConnectedCriteria
+		peer     wgtypes.Peer
+		expected bool
+	}{
+		{wireguard.ConnectedHandshakeRecent, recentPeer, true},
+		{wireguard.ConnectedHandshakeRecent, stalePeer, false},
+		{wireguard.ConnectedHandshakeRecent, newPeer, false},
+		{wireguard.ConnectedTransfer, recentPeer, false},
+		{wireguard.ConnectedTransfer, transferPeer, true},
+		{wireguard.ConnectedTransfer, newPeer, false},
+		{wireguard.ConnectedAny, recentPeer, true},
+		{wireguard.ConnectedAny, stalePeer, true},
+		{wireguard.ConnectedAny, newPeer, false},
+	}
+
+	for _, test := range tests {
+		if connected := test.criteria.Connected(test.peer, now); connected != test.expected {
+			t.Errorf("got unexpected result for %s with %+v, wanted %t, got %t", test.criteria, test.peer, test.expected, connected)
+		}
+	}
+}
+
+func TestParseConnectedCriteria(t *testing.T) {
+	criteria, err := wireguard.ParseConnectedCriteria("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if criteria != wireguard.ConnectedHandshakeRecent {
+		t.Errorf("got unexpected default criteria %s", criteria)
+	}
+
+	criteria, err = wireguard.ParseConnectedCriteria("transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if criteria != wireguard.ConnectedTransfer {
+		t.Errorf("got unexpected criteria %s", criteria)
+	}
+
+	_, err = wireguard.ParseConnectedCriteria("sometimes")
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
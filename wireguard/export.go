@@ -0,0 +1,69 @@
+package wireguard
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ExportInterface returns the live configuration of the given interface in the format of wg showconf, for debugging and backups
+// The private key and preshared keys are left out, so that the export can be shared safely
+func (w *Wireguard) ExportInterface(name string) (string, error) {
+	client, ok := w.clients[name]
+	if !ok {
+		return "", fmt.Errorf("%w %s", ErrUnknownInterface, name)
+	}
+
+	device, err := client.Device(name)
+	if err != nil {
+		return "", fmt.Errorf("error getting wireguard interface %s: %s", name, err.Error())
+	}
+
+	return formatConfig(device), nil
+}
+
+// Format the configuration of a device, with the peers sorted by public key so that exports can be compared
+func formatConfig(device *wgtypes.Device) string {
+	var b bytes.Buffer
+
+	b.WriteString("[Interface]\n")
+	if device.ListenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", device.ListenPort)
+	}
+	if device.FirewallMark != 0 {
+		fmt.Fprintf(&b, "FwMark = 0x%x\n", device.FirewallMark)
+	}
+
+	peers := make([]wgtypes.Peer, len(device.Peers))
+	copy(peers, device.Peers)
+	sort.Slice(peers, func(i int, j int) bool {
+		return bytes.Compare(peers[i].PublicKey[:], peers[j].PublicKey[:]) < 0
+	})
+
+	for _, peer := range peers {
+		b.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", peer.PublicKey)
+
+		if len(peer.AllowedIPs) > 0 {
+			allowedIPs := make([]string, 0, len(peer.AllowedIPs))
+			for _, ipNet := range peer.AllowedIPs {
+				allowedIPs = append(allowedIPs, ipNet.String())
+			}
+
+			fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(allowedIPs, ", "))
+		}
+
+		if peer.Endpoint != nil {
+			fmt.Fprintf(&b, "Endpoint = %s\n", peer.Endpoint)
+		}
+
+		if peer.PersistentKeepaliveInterval > 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", int(peer.PersistentKeepaliveInterval.Seconds()))
+		}
+	}
+
+	return b.String()
+}
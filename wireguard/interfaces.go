@@ -0,0 +1,107 @@
+package wireguard
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+)
+
+// ReadInterfacesFile reads a list of wireguard interfaces from the file at the given path
+// The file contains one interface per line, empty lines and lines starting with # are ignored
+func ReadInterfacesFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var interfaces []string
+	seen := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if _, ok := seen[line]; ok {
+			continue
+		}
+
+		seen[line] = struct{}{}
+		interfaces = append(interfaces, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return interfaces, nil
+}
+
+// SetInterfaces replaces the wireguard interfaces that are being managed, returning the interfaces that were added and removed
+// Added interfaces that can't be opened yet, such as ones that don't exist, are retried by each UpdatePeers until they can be
+// Removed interfaces are no longer updated, their peers are left in place
+func (w *Wireguard) SetInterfaces(interfaces []string) (added []string, removed []string) {
+	configured := make(map[string]struct{})
+	for _, i := range interfaces {
+		configured[i] = struct{}{}
+	}
+
+	for _, i := range w.interfaces {
+		if _, ok := configured[i]; ok {
+			delete(configured, i)
+			continue
+		}
+
+		if client, ok := w.clients[i]; ok {
+			client.Close()
+			delete(w.clients, i)
+		}
+
+		delete(w.drained, i)
+		delete(w.settings, i)
+		removed = append(removed, i)
+	}
+
+	for _, i := range interfaces {
+		if _, ok := configured[i]; ok {
+			added = append(added, i)
+		}
+	}
+
+	w.interfaces = interfaces
+	w.openPendingInterfaces()
+
+	return added, removed
+}
+
+// Open the interfaces that have been added but couldn't be opened yet, leaving them pending if they still can't be
+func (w *Wireguard) openPendingInterfaces() {
+	for _, i := range w.interfaces {
+		if _, ok := w.clients[i]; ok {
+			continue
+		}
+
+		err := w.openInterface(i)
+		if err == nil {
+			err = w.applyPrivateKey(i)
+			if err == nil {
+				err = w.verifyPublicKey(i)
+			}
+			if err != nil {
+				w.clients[i].Close()
+				delete(w.clients, i)
+			}
+		}
+
+		if err != nil {
+			w.metrics.Increment("error_opening_interface")
+			log.Printf("error opening wireguard interface %s, retrying on the next update: %s", i, err.Error())
+			continue
+		}
+
+		log.Printf("started managing wireguard interface %s", i)
+	}
+}
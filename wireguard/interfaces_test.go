@@ -0,0 +1,94 @@
+package wireguard_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/wireguard"
+)
+
+func TestReadInterfacesFile(t *testing.T) {
+	directory, err := ioutil.TempDir("", "wg-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "interfaces")
+	err = ioutil.WriteFile(path, []byte("# comment\nwg0\n\n  wg1 \nwg0\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interfaces, err := wireguard.ReadInterfacesFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"wg0", "wg1"}, interfaces); diff != "" {
+		t.Fatalf("unexpected interfaces (-want +got):\n%s", diff)
+	}
+
+	_, err = wireguard.ReadInterfacesFile(filepath.Join(directory, "nonexistant"))
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestSetInterfaces(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg, err := wireguard.New([]string{testInterface}, metrics, wireguard.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wg.Close()
+
+	t.Run("add interfaces", func(t *testing.T) {
+		added, removed := wg.SetInterfaces([]string{testInterface, testClientInterface, "nonexistant"})
+
+		if diff := cmp.Diff([]string{testClientInterface, "nonexistant"}, added); diff != "" {
+			t.Fatalf("unexpected added interfaces (-want +got):\n%s", diff)
+		}
+
+		if len(removed) != 0 {
+			t.Fatalf("unexpected removed interfaces %v", removed)
+		}
+
+		// The nonexistant interface is left out until it can be opened
+		if diff := cmp.Diff([]string{testInterface, testClientInterface}, wg.Interfaces()); diff != "" {
+			t.Fatalf("unexpected interfaces (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("remove interfaces", func(t *testing.T) {
+		added, removed := wg.SetInterfaces([]string{testClientInterface})
+
+		if len(added) != 0 {
+			t.Fatalf("unexpected added interfaces %v", added)
+		}
+
+		if diff := cmp.Diff([]string{testInterface, "nonexistant"}, removed); diff != "" {
+			t.Fatalf("unexpected removed interfaces (-want +got):\n%s", diff)
+		}
+
+		if diff := cmp.Diff([]string{testClientInterface}, wg.Interfaces()); diff != "" {
+			t.Fatalf("unexpected interfaces (-want +got):\n%s", diff)
+		}
+
+		if _, err := wg.ExportInterface(testInterface); err == nil {
+			t.Fatal("removed interface is still managed")
+		}
+	})
+}
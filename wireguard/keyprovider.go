@@ -0,0 +1,157 @@
+package wireguard
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// KeyProvider provides the private keys to use for the wireguard interfaces
+type KeyProvider interface {
+	// PrivateKey returns the private key for the given interface
+	PrivateKey(iface string) (wgtypes.Key, error)
+	// Refresh reloads the private keys from the underlying source
+	Refresh() error
+}
+
+// FileKeyProvider reads private keys from files named <interface>.key in a directory
+// The files are expected to contain a base64 encoded key, as generated by wg genkey
+type FileKeyProvider struct {
+	directory string
+	keys      map[string]wgtypes.Key
+	mutex     sync.RWMutex
+}
+
+// NewFileKeyProvider returns a new FileKeyProvider for the given interfaces, reading the keys from the given directory
+func NewFileKeyProvider(directory string, interfaces []string) (*FileKeyProvider, error) {
+	provider := &FileKeyProvider{
+		directory: directory,
+		keys:      make(map[string]wgtypes.Key),
+	}
+
+	for _, i := range interfaces {
+		provider.keys[i] = wgtypes.Key{}
+	}
+
+	err := provider.Refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+// PrivateKey returns the private key for the given interface
+func (f *FileKeyProvider) PrivateKey(iface string) (wgtypes.Key, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	key, ok := f.keys[iface]
+	if !ok {
+		return wgtypes.Key{}, fmt.Errorf("no private key for interface %s", iface)
+	}
+
+	return key, nil
+}
+
+// Refresh reads the private keys from disk again
+// If any key fails to be read, none of the keys are updated
+func (f *FileKeyProvider) Refresh() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	keys := make(map[string]wgtypes.Key)
+	for i := range f.keys {
+		key, err := readKeyFile(filepath.Join(f.directory, i+".key"))
+		if err != nil {
+			return fmt.Errorf("error reading private key for interface %s: %s", i, err.Error())
+		}
+
+		keys[i] = key
+	}
+
+	f.keys = keys
+	return nil
+}
+
+// SetInterfaces replaces the interfaces to provide keys for, reading the keys of the new interfaces from disk
+// If any key fails to be read, the interfaces and keys are left unchanged
+func (f *FileKeyProvider) SetInterfaces(interfaces []string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	keys := make(map[string]wgtypes.Key)
+	for _, i := range interfaces {
+		if key, ok := f.keys[i]; ok {
+			keys[i] = key
+			continue
+		}
+
+		key, err := readKeyFile(filepath.Join(f.directory, i+".key"))
+		if err != nil {
+			return fmt.Errorf("error reading private key for interface %s: %s", i, err.Error())
+		}
+
+		keys[i] = key
+	}
+
+	f.keys = keys
+	return nil
+}
+
+func readKeyFile(path string) (wgtypes.Key, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+
+	return parseKey(strings.TrimSpace(string(contents)))
+}
+
+// Parse a base64 encoded wireguard key, which is the same format for private and public keys
+func parseKey(encodedKey string) (wgtypes.Key, error) {
+	decodedKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("invalid base64 encoding: %s", err.Error())
+	}
+
+	if len(decodedKey) != wgtypes.KeyLen {
+		return wgtypes.Key{}, fmt.Errorf("invalid key length %d, expected %d bytes", len(decodedKey), wgtypes.KeyLen)
+	}
+
+	return wgtypes.NewKey(decodedKey)
+}
+
+// ParsePublicKeys parses a comma delimited list of interfaces and their base64 encoded public keys, eg 'wg0=<key>,wg1=<key>'
+func ParsePublicKeys(s string) (map[string]wgtypes.Key, error) {
+	keys := make(map[string]wgtypes.Key)
+	if s == "" {
+		return keys, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		// Only split on the first '=', as base64 encoded keys are padded with '='
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid public key entry %s, expected <interface>=<key>", entry)
+		}
+
+		key, err := parseKey(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key for interface %s: %s", parts[0], err.Error())
+		}
+
+		if _, ok := keys[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate public key for interface %s", parts[0])
+		}
+
+		keys[parts[0]] = key
+	}
+
+	return keys, nil
+}
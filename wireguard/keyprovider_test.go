@@ -0,0 +1,233 @@
+package wireguard_test
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestFileKeyProvider(t *testing.T) {
+	directory, err := ioutil.TempDir("", "wg-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	writeKey := func(t *testing.T, iface string, key string) {
+		t.Helper()
+
+		err := ioutil.WriteFile(filepath.Join(directory, iface+".key"), []byte(key+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32)))
+	writeKey(t, testInterface, key)
+
+	provider, err := wireguard.NewFileKeyProvider(directory, []string{testInterface})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("read key", func(t *testing.T) {
+		privateKey, err := provider.PrivateKey(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if privateKey.String() != key {
+			t.Errorf("got unexpected key, wanted %s, got %s", key, privateKey.String())
+		}
+	})
+
+	t.Run("unknown interface", func(t *testing.T) {
+		_, err := provider.PrivateKey("nonexistant")
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("refresh key", func(t *testing.T) {
+		refreshedKey := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32)))
+		writeKey(t, testInterface, refreshedKey)
+
+		err := provider.Refresh()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		privateKey, err := provider.PrivateKey(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if privateKey.String() != refreshedKey {
+			t.Errorf("got unexpected key, wanted %s, got %s", refreshedKey, privateKey.String())
+		}
+	})
+
+	t.Run("invalid key length", func(t *testing.T) {
+		writeKey(t, testInterface, base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 16))))
+
+		err := provider.Refresh()
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("missing key file", func(t *testing.T) {
+		_, err := wireguard.NewFileKeyProvider(directory, []string{"nonexistant"})
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("set interfaces", func(t *testing.T) {
+		writeKey(t, testClientInterface, key)
+
+		err := provider.SetInterfaces([]string{testClientInterface})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		privateKey, err := provider.PrivateKey(testClientInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if privateKey.String() != key {
+			t.Errorf("got unexpected key, wanted %s, got %s", key, privateKey.String())
+		}
+
+		_, err = provider.PrivateKey(testInterface)
+		if err == nil {
+			t.Fatal("no error for removed interface")
+		}
+	})
+
+	t.Run("set interfaces with missing key file", func(t *testing.T) {
+		err := provider.SetInterfaces([]string{testClientInterface, "nonexistant"})
+		if err == nil {
+			t.Fatal("no error")
+		}
+
+		_, err = provider.PrivateKey(testClientInterface)
+		if err != nil {
+			t.Fatalf("interfaces changed despite the error: %s", err)
+		}
+	})
+}
+
+func TestRefreshPrivateKeys(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Restore the private key of the interface for the other tests
+	device, err := client.Device(testInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalKey := device.PrivateKey
+	defer client.ConfigureDevice(testInterface, wgtypes.Config{PrivateKey: &originalKey})
+
+	directory := t.TempDir()
+	writeKey := func(t *testing.T, key string) {
+		t.Helper()
+
+		err := ioutil.WriteFile(filepath.Join(directory, testInterface+".key"), []byte(key+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectKey := func(t *testing.T, key string) {
+		t.Helper()
+
+		device, err := client.Device(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if device.PrivateKey.String() != key {
+			t.Errorf("got unexpected key, wanted %s, got %s", key, device.PrivateKey.String())
+		}
+	}
+
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32)))
+	writeKey(t, key)
+
+	provider, err := wireguard.NewFileKeyProvider(directory, []string{testInterface})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg, err := wireguard.New([]string{testInterface}, metrics, wireguard.Options{KeyProvider: provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wg.Close()
+
+	expectKey(t, key)
+
+	// The key is left as is until the keys are refreshed
+	refreshedKey := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32)))
+	writeKey(t, refreshedKey)
+	expectKey(t, key)
+
+	err = wg.RefreshPrivateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectKey(t, refreshedKey)
+}
+
+func TestParsePublicKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32)))
+
+	keys, err := wireguard.ParsePublicKeys(testInterface + "=" + key + ", " + testClientInterface + "=" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 2 || keys[testInterface].String() != key || keys[testClientInterface].String() != key {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	keys, err = wireguard.ParsePublicKeys("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 0 {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	for _, s := range []string{key, "=" + key, testInterface + "=invalid", testInterface + "=" + key + "," + testInterface + "=" + key} {
+		_, err := wireguard.ParsePublicKeys(s)
+		if err == nil {
+			t.Errorf("no error for %s", s)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package wireguard
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// MissingInterfaceAction decides what UpdatePeers does with an interface that has disappeared since it was opened
+type MissingInterfaceAction string
+
+// Actions for interfaces that have disappeared
+const (
+	// MissingInterfaceError logs an error for the interface on every update until it reappears
+	MissingInterfaceError MissingInterfaceAction = "error"
+	// MissingInterfaceSkip leaves out the interface until it reappears
+	MissingInterfaceSkip MissingInterfaceAction = "skip"
+	// MissingInterfaceRecreate creates the interface again with the listen port and firewall mark it had when it was opened,
+	// and applies its private key if there's a key provider
+	MissingInterfaceRecreate MissingInterfaceAction = "recreate"
+)
+
+// ParseMissingInterfaceAction parses the name of a missing interface action, an empty name is MissingInterfaceError
+func ParseMissingInterfaceAction(name string) (MissingInterfaceAction, error) {
+	switch a := MissingInterfaceAction(name); a {
+	case "":
+		return MissingInterfaceError, nil
+	case MissingInterfaceError, MissingInterfaceSkip, MissingInterfaceRecreate:
+		return a, nil
+	default:
+		return "", fmt.Errorf("invalid missing interface action %s", name)
+	}
+}
+
+// Create the given interface again, and bring it up, returning the device once it's been configured
+// The private key is restored along with the listen port and firewall mark that the interface had when it was opened,
+// addresses and routes of the interface are left to whoever created it originally
+func (w *Wireguard) recreateInterface(i string) (*wgtypes.Device, error) {
+	err := createInterface(i)
+	if err != nil {
+		return nil, fmt.Errorf("error recreating wireguard interface %s: %s", i, err.Error())
+	}
+
+	w.metrics.Increment("interface_recreated")
+
+	// Apply everything at once, so that the interface never listens on a random port with the private key
+	settings := w.settings[i]
+	config := wgtypes.Config{}
+	if settings.listenPort != 0 {
+		config.ListenPort = &settings.listenPort
+	}
+
+	if settings.firewallMark != 0 {
+		config.FirewallMark = &settings.firewallMark
+	}
+
+	if w.options.KeyProvider != nil {
+		key, err := w.options.KeyProvider.PrivateKey(i)
+		if err != nil {
+			return nil, err
+		}
+
+		config.PrivateKey = &key
+	}
+
+	err = w.clients[i].ConfigureDevice(i, config)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring recreated wireguard interface %s: %s", i, err.Error())
+	}
+
+	err = w.verifyPublicKey(i)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.clients[i].Device(i)
+}
+
+func createInterface(i string) error {
+	for _, args := range [][]string{
+		{"link", "add", "dev", i, "type", "wireguard"},
+		{"link", "set", "dev", i, "up"},
+	} {
+		output, err := exec.Command("ip", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(output)))
+		}
+	}
+
+	return nil
+}
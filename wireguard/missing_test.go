@@ -0,0 +1,140 @@
+package wireguard_test
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// An interface created and deleted by the test, to simulate an interface disappearing while running
+const testMissingInterface = "wg-missing"
+
+// The settings of the missing interface, which are restored when recreating it
+const (
+	testMissingListenPort   = 51999
+	testMissingFirewallMark = 0x1234
+)
+
+func TestMissingInterface(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ip := func(t *testing.T, args ...string) {
+		t.Helper()
+
+		output, err := exec.Command("ip", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("error running ip %v: %s: %s", args, err, output)
+		}
+	}
+
+	// Open the interfaces, and remove the interface once it's been opened, before the next update
+	open := func(t *testing.T, action wireguard.MissingInterfaceAction) *wireguard.Wireguard {
+		t.Helper()
+
+		ip(t, "link", "add", "dev", testMissingInterface, "type", "wireguard")
+		listenPort, firewallMark := testMissingListenPort, testMissingFirewallMark
+		err := client.ConfigureDevice(testMissingInterface, wgtypes.Config{ListenPort: &listenPort, FirewallMark: &firewallMark})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg, err := wireguard.New([]string{testMissingInterface, testInterface}, metrics, wireguard.Options{MissingInterface: action})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip(t, "link", "del", "dev", testMissingInterface)
+
+		return wg
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		wg := open(t, wireguard.MissingInterfaceSkip)
+		defer wg.Close()
+		defer wg.UpdatePeers(api.WireguardPeerList{})
+
+		// The missing interface is left out, while the rest are still updated
+		_, changes := wg.UpdatePeers(apiFixture)
+		expectedChanges := []wireguard.PeerChange{{Interface: testInterface, Pubkey: apiFixture[0].Pubkey, Action: wireguard.ActionAdd}}
+		if diff := cmp.Diff(expectedChanges, changes); diff != "" {
+			t.Errorf("unexpected changes (-want +got):\n%s", diff)
+		}
+
+		if _, err := client.Device(testMissingInterface); err == nil {
+			t.Error("missing interface was recreated")
+		}
+
+		if diff := cmp.Diff([]string{testMissingInterface}, wg.FailedInterfaces()); diff != "" {
+			t.Errorf("unexpected failed interfaces (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("recreate", func(t *testing.T) {
+		wg := open(t, wireguard.MissingInterfaceRecreate)
+		defer wg.Close()
+		defer wg.UpdatePeers(api.WireguardPeerList{})
+		defer exec.Command("ip", "link", "del", "dev", testMissingInterface).Run()
+
+		wg.UpdatePeers(apiFixture)
+
+		device, err := client.Device(testMissingInterface)
+		if err != nil {
+			t.Fatalf("missing interface wasn't recreated: %s", err)
+		}
+
+		if len(device.Peers) != 1 || device.Peers[0].PublicKey != wgKey() {
+			t.Errorf("unexpected peers on %s: %+v", testMissingInterface, device.Peers)
+		}
+
+		if device.ListenPort != testMissingListenPort || device.FirewallMark != testMissingFirewallMark {
+			t.Errorf("listen port %d and firewall mark %d of %s weren't restored", device.ListenPort, device.FirewallMark, testMissingInterface)
+		}
+
+		if failed := wg.FailedInterfaces(); len(failed) != 0 {
+			t.Errorf("got failed interfaces %v", failed)
+		}
+	})
+}
+
+func TestParseMissingInterfaceAction(t *testing.T) {
+	action, err := wireguard.ParseMissingInterfaceAction("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if action != wireguard.MissingInterfaceError {
+		t.Errorf("got unexpected default action %s", action)
+	}
+
+	action, err = wireguard.ParseMissingInterfaceAction("recreate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if action != wireguard.MissingInterfaceRecreate {
+		t.Errorf("got unexpected action %s", action)
+	}
+
+	_, err = wireguard.ParseMissingInterfaceAction("ignore")
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
@@ -1,9 +1,14 @@
 package wireguard
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/infosum/statsd"
@@ -14,54 +19,296 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// ErrUnknownInterface is returned when draining or enabling an interface that isn't being managed
+var ErrUnknownInterface = errors.New("unknown wireguard interface")
+
+// ErrDeniedIP is returned when adding a peer with allowed ips in a denied network
+var ErrDeniedIP = errors.New("allowed ips in a denied network")
+
 // Wireguard is a utility for managing wireguard configuration
 type Wireguard struct {
-	client     *wgctrl.Client
+	// Each interface has its own client, as clients aren't safe for concurrent use
+	clients    map[string]*wgctrl.Client
 	interfaces []string
 	metrics    *statsd.Client
+	options    Options
+	pinnedKeys map[wgtypes.Key]struct{}
+	// Drained interfaces have had their peers removed, and are left out of updates until enabled again
+	drained map[string]bool
+	// The peers left out by the last UpdatePeers, see Rejections
+	rejections []api.PeerRejection
+	// The interfaces that the last UpdatePeers failed to update, see FailedInterfaces
+	failedInterfaces []string
+	// The settings of the interfaces when they were opened, to restore when recreating them
+	settings map[string]interfaceSettings
+}
+
+// interfaceSettings are the settings of an interface that are lost along with it, apart from the private key and the peers
+type interfaceSettings struct {
+	listenPort   int
+	firewallMark int
+}
+
+// Options contains optional settings for wireguard
+type Options struct {
+	// KeyProvider is used to set the private keys of the interfaces, they're left untouched if it's nil
+	KeyProvider KeyProvider
+	// RejectUserspace refuses interfaces using a userspace implementation, such as wireguard-go or boringtun,
+	// which are configured through their configuration socket rather than the kernel. They're allowed and counted otherwise
+	RejectUserspace bool
+	// ParallelInterfaces updates the peers of all interfaces concurrently, instead of one at a time
+	ParallelInterfaces bool
+	// RejectDuplicatePubkeys leaves out every record of a public key that appears more than once in the peers given to UpdatePeers,
+	// instead of applying the first one
+	RejectDuplicatePubkeys bool
+	// ReplacePeers replaces every peer of an interface in a single configuration when UpdatePeers changes it,
+	// instead of only adding, updating and removing the peers that changed
+	// Wireguard drops the sessions of every peer when replacing them, so all peers have to handshake again after a change
+	ReplacePeers bool
+	// DeniedIPs are networks that peers may not have allowed ips in, such as the management network of the server
+	// Peers with allowed ips overlapping them are left out, no networks are denied if it's empty
+	DeniedIPs []net.IPNet
+	// MaxPeersPerInterface is the max number of peers from UpdatePeers to configure on each interface, the rest are left out
+	// The number of peers is unlimited if it's zero
+	MaxPeersPerInterface int
+	// ConnectedCriteria decides which peers are returned as connected by UpdatePeers, ConnectedHandshakeRecent is used if it's empty
+	ConnectedCriteria ConnectedCriteria
+	// ExpectedPublicKeys are the public keys the interfaces must have, keyed by interface name
+	// Opening an interface with a different public key fails, interfaces without an expected key aren't checked
+	ExpectedPublicKeys map[string]wgtypes.Key
+	// MissingInterface decides what UpdatePeers does with interfaces that have disappeared, MissingInterfaceError is used if it's empty
+	MissingInterface MissingInterfaceAction
+}
+
+// PeerChange is a change made to a peer on a wireguard interface
+type PeerChange struct {
+	Interface string
+	Pubkey    string
+	Action    string
 }
 
+// Peer change actions
+const (
+	ActionAdd    = "ADD"
+	ActionRemove = "REMOVE"
+	ActionUpdate = "UPDATE"
+)
+
+// Reasons for leaving out peers in UpdatePeers, see Rejections
+const (
+	RejectInvalid         = "invalid"
+	RejectDeniedIP        = "denied_ip"
+	RejectDuplicatePubkey = "duplicate_pubkey"
+	RejectOverCapacity    = "over_capacity"
+)
+
 // New ensures that the interfaces given are valid, and returns a new Wireguard instance
-func New(interfaces []string, metrics *statsd.Client) (*Wireguard, error) {
-	client, err := wgctrl.New()
+func New(interfaces []string, metrics *statsd.Client, options Options) (*Wireguard, error) {
+	if _, err := ParseConnectedCriteria(string(options.ConnectedCriteria)); err != nil {
+		return nil, err
+	}
+
+	if _, err := ParseMissingInterfaceAction(string(options.MissingInterface)); err != nil {
+		return nil, err
+	}
+
+	if options.MaxPeersPerInterface < 0 {
+		return nil, fmt.Errorf("invalid max peers per interface %d", options.MaxPeersPerInterface)
+	}
+
+	w := &Wireguard{
+		clients:    make(map[string]*wgctrl.Client),
+		drained:    make(map[string]bool),
+		settings:   make(map[string]interfaceSettings),
+		interfaces: interfaces,
+		metrics:    metrics,
+		options:    options,
+	}
+
+	for _, i := range interfaces {
+		err := w.openInterface(i)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+
+	err := w.applyPrivateKeys()
 	if err != nil {
+		w.Close()
 		return nil, err
 	}
 
 	for _, i := range interfaces {
-		_, err := client.Device(i)
+		err := w.verifyPublicKey(i)
 		if err != nil {
-			return nil, fmt.Errorf("error getting wireguard interface %s: %s", i, err.Error())
+			w.Close()
+			return nil, err
 		}
 	}
 
-	return &Wireguard{
-		client:     client,
-		interfaces: interfaces,
-		metrics:    metrics,
-	}, nil
+	return w, nil
 }
 
-// UpdatePeers updates the configuration of the wireguard interfaces to match the given list of peers
-func (w *Wireguard) UpdatePeers(peers api.WireguardPeerList) (connectedKeyList api.ConnectedKeysMap) {
-	peerMap := w.mapPeers(peers)
+// Create a client for the given interface, after checking that the interface is valid
+func (w *Wireguard) openInterface(i string) error {
+	client, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
 
-	var peerCount, devicePeerCount int
-	connectedKeysMap := make(api.ConnectedKeysMap)
-	for _, d := range w.interfaces {
-		var deviceConnectedKeys []string
+	device, err := client.Device(i)
+	if err != nil {
+		client.Close()
+		return fmt.Errorf("error getting wireguard interface %s: %s", i, err.Error())
+	}
 
-		device, err := w.client.Device(d)
-		// Log an error, but move on, so that one broken wireguard interface doesn't prevent us from configuring the rest
-		if err != nil {
-			log.Printf("error connecting to wireguard interface %s: %s", d, err.Error())
+	log.Printf("wireguard interface %s is using the %s implementation", i, device.Type)
+	if device.Type == wgtypes.Userspace {
+		if w.options.RejectUserspace {
+			client.Close()
+			return fmt.Errorf("wireguard interface %s is using a userspace implementation, which isn't allowed", i)
+		}
+
+		w.metrics.Increment("userspace_interface")
+	}
+
+	w.clients[i] = client
+	w.settings[i] = interfaceSettings{
+		listenPort:   device.ListenPort,
+		firewallMark: device.FirewallMark,
+	}
+	return nil
+}
+
+// RefreshPrivateKeys reloads the private keys from the key provider, and applies them to the interfaces
+func (w *Wireguard) RefreshPrivateKeys() error {
+	if w.options.KeyProvider == nil {
+		return nil
+	}
+
+	err := w.options.KeyProvider.Refresh()
+	if err != nil {
+		return err
+	}
+
+	return w.applyPrivateKeys()
+}
+
+// Set the private key of each interface from the key provider, if it differs from the current one
+func (w *Wireguard) applyPrivateKeys() error {
+	if w.options.KeyProvider == nil {
+		return nil
+	}
+
+	for _, i := range w.interfaces {
+		// Interfaces that haven't been opened yet get their key once they are
+		if _, ok := w.clients[i]; !ok {
 			continue
 		}
 
-		devicePeerCount, deviceConnectedKeys = countConnectedPeers(device.Peers)
-		peerCount += devicePeerCount
+		err := w.applyPrivateKey(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Set the private key of the given interface from the key provider, if it differs from the current one
+func (w *Wireguard) applyPrivateKey(i string) error {
+	if w.options.KeyProvider == nil {
+		return nil
+	}
+
+	key, err := w.options.KeyProvider.PrivateKey(i)
+	if err != nil {
+		return err
+	}
+
+	device, err := w.clients[i].Device(i)
+	if err != nil {
+		return fmt.Errorf("error getting wireguard interface %s: %s", i, err.Error())
+	}
+
+	if device.PrivateKey == key {
+		return nil
+	}
+
+	err = w.clients[i].ConfigureDevice(i, wgtypes.Config{
+		PrivateKey: &key,
+	})
+	if err != nil {
+		return fmt.Errorf("error setting private key for wireguard interface %s: %s", i, err.Error())
+	}
+
+	return nil
+}
+
+// Check that the public key of the given interface matches the expected one, if there is one
+func (w *Wireguard) verifyPublicKey(i string) error {
+	expected, ok := w.options.ExpectedPublicKeys[i]
+	if !ok {
+		return nil
+	}
+
+	device, err := w.clients[i].Device(i)
+	if err != nil {
+		return fmt.Errorf("error getting wireguard interface %s: %s", i, err.Error())
+	}
+
+	if device.PublicKey != expected {
+		return fmt.Errorf("wireguard interface %s has public key %s, expected %s", i, device.PublicKey.String(), expected.String())
+	}
+
+	return nil
+}
+
+// UpdatePeers updates the configuration of the wireguard interfaces to match the given list of peers
+// It returns the connected keys, as well as the changes that were made to the peers of each interface
+func (w *Wireguard) UpdatePeers(peers api.WireguardPeerList) (connectedKeyList api.ConnectedKeysMap, changes []PeerChange) {
+	w.openPendingInterfaces()
+
+	peerMap, rejections := w.mapPeers(peers)
+	interfaces := w.Interfaces()
+
+	results := make([]deviceResult, len(interfaces))
+	if w.options.ParallelInterfaces {
+		var wg sync.WaitGroup
+		for i, d := range interfaces {
+			wg.Add(1)
+			go func(i int, d string) {
+				defer wg.Done()
+				results[i] = w.updateDevice(d, peerMap)
+			}(i, d)
+		}
+		wg.Wait()
+	} else {
+		for i, d := range interfaces {
+			results[i] = w.updateDevice(d, peerMap)
+		}
+	}
+
+	// Combine the results in the order of the interfaces
+	var peerCount int
+	var failedInterfaces []string
+	connectedKeysMap := make(api.ConnectedKeysMap)
+	overCapacity := make(map[wgtypes.Key]bool)
+	for i, result := range results {
+		peerCount += result.peerCount
+		if result.failed {
+			failedInterfaces = append(failedInterfaces, interfaces[i])
+		}
+
+		for _, key := range result.capped {
+			if !overCapacity[key] {
+				overCapacity[key] = true
+				rejections = append(rejections, api.PeerRejection{Pubkey: key.String(), Reason: RejectOverCapacity})
+			}
+		}
 
-		for _, deviceKey := range deviceConnectedKeys {
+		for _, deviceKey := range result.connectedKeys {
 			if _, ok := connectedKeysMap[deviceKey]; !ok {
 				connectedKeysMap[deviceKey] = 1
 			} else {
@@ -70,115 +317,447 @@ func (w *Wireguard) UpdatePeers(peers api.WireguardPeerList) (connectedKeyList a
 			}
 		}
 
-		existingPeerMap := mapExistingPeers(device.Peers)
-		cfgPeers := []wgtypes.PeerConfig{}
-		resetPeers := []wgtypes.PeerConfig{}
+		changes = append(changes, result.changes...)
+	}
 
-		// Loop through peers from the API
-		// Add peers not currently existing in the wireguard config
-		// Update peers that exist in the wireguard config but has changed
-		for key, allowedIPs := range peerMap {
-			existingPeer, ok := existingPeerMap[key]
-			if !ok || !iputil.EqualIPNet(allowedIPs, existingPeer.AllowedIPs) {
-				cfgPeers = append(cfgPeers, wgtypes.PeerConfig{
-					PublicKey:         key,
-					ReplaceAllowedIPs: true,
-					AllowedIPs:        allowedIPs,
-				})
-			}
+	sort.Slice(rejections, func(i int, j int) bool {
+		return rejections[i].Pubkey < rejections[j].Pubkey
+	})
+	w.rejections = rejections
+	w.failedInterfaces = failedInterfaces
+
+	// Send metrics
+	allowedIPsTotal, allowedIPsMax := countAllowedIPs(peerMap)
+	w.metrics.Gauge("connected_peers", peerCount)
+	w.metrics.Gauge("allowed_ips_total", allowedIPsTotal)
+	w.metrics.Gauge("allowed_ips_max_per_peer", allowedIPsMax)
+	return connectedKeysMap, changes
+}
+
+// Count the allowed ips of all peers, and the largest number of allowed ips of a single peer
+func countAllowedIPs(peerMap map[wgtypes.Key][]net.IPNet) (total int, max int) {
+	for _, ips := range peerMap {
+		total += len(ips)
+		if len(ips) > max {
+			max = len(ips)
 		}
+	}
 
-		// Loop through the current peers in the wireguard config
-		for key, peer := range existingPeerMap {
-			if _, ok := peerMap[key]; !ok {
-				// Remove peers that doesn't exist in the API
-				cfgPeers = append(cfgPeers, wgtypes.PeerConfig{
-					PublicKey: key,
-					Remove:    true,
-				})
-			} else if needsReset(peer) {
-				// Remove peers that's previously been active and should be reset to remove data
-				cfgPeers = append(cfgPeers, wgtypes.PeerConfig{
-					PublicKey: key,
-					Remove:    true,
-				})
+	return total, max
+}
 
-				peerCfg := wgtypes.PeerConfig{
-					PublicKey:         key,
-					ReplaceAllowedIPs: true,
-					AllowedIPs:        peer.AllowedIPs,
-				}
-
-				// Copy the preshared key if one is set
-				var emptyKey wgtypes.Key
-				if peer.PresharedKey != emptyKey {
-					// We need to copy the key, or the pointer gets corrupted for some reason
-					var copiedKey wgtypes.Key
-					copy(copiedKey[:], peer.PresharedKey[:])
-					peerCfg.PresharedKey = &copiedKey
-				}
-
-				// Re-add the peer later
-				resetPeers = append(resetPeers, peerCfg)
+// Rejections returns the peers that the last UpdatePeers left out, sorted by public key
+// A peer left out on any interface is included, and peer-only records that aren't wireguard peers never are
+func (w *Wireguard) Rejections() []api.PeerRejection {
+	return w.rejections
+}
+
+// FailedInterfaces returns the interfaces that the last UpdatePeers failed to update, in the order of the interfaces
+// The peers may be missing from them, or have outdated allowed ip's
+func (w *Wireguard) FailedInterfaces() []string {
+	return w.failedInterfaces
+}
+
+// deviceResult is the outcome of updating the peers of a single interface
+type deviceResult struct {
+	peerCount     int
+	connectedKeys []string
+	changes       []PeerChange
+	// The peers left out for exceeding the max peers of the interface
+	capped []wgtypes.Key
+	// Whether the interface is missing or couldn't be configured
+	failed bool
+}
+
+// Update the peers of a single interface, using the client of the interface
+// The peer map is only read, so that it can be shared between interfaces being updated concurrently
+func (w *Wireguard) updateDevice(d string, peerMap map[wgtypes.Key][]net.IPNet) (result deviceResult) {
+	client := w.clients[d]
+	var deviceChanges []PeerChange
+
+	device, err := client.Device(d)
+	if errors.Is(err, os.ErrNotExist) {
+		w.metrics.Increment("interface_missing")
+
+		switch w.options.MissingInterface {
+		case MissingInterfaceSkip:
+			log.Printf("wireguard interface %s is missing, skipping it", d)
+			result.failed = true
+			return
+		case MissingInterfaceRecreate:
+			log.Printf("wireguard interface %s is missing, recreating it", d)
+			device, err = w.recreateInterface(d)
+		}
+	}
+
+	// Log an error, but move on, so that one broken wireguard interface doesn't prevent us from configuring the rest
+	if err != nil {
+		log.Printf("error connecting to wireguard interface %s: %s", d, err.Error())
+		result.failed = true
+		return
+	}
+
+	result.peerCount, result.connectedKeys = countConnectedPeers(device.Peers, w.options.ConnectedCriteria)
+	peerMap, result.capped = w.capPeers(d, peerMap)
+
+	existingPeerMap := mapExistingPeers(device.Peers)
+	cfgPeers := []wgtypes.PeerConfig{}
+	resetPeers := []wgtypes.PeerConfig{}
+
+	// Loop through peers from the API
+	// Add peers not currently existing in the wireguard config
+	// Update peers that exist in the wireguard config but has changed
+	keys := make([]wgtypes.Key, 0, len(peerMap))
+	for key := range peerMap {
+		keys = append(keys, key)
+	}
+
+	for _, key := range sortKeys(keys) {
+		allowedIPs := peerMap[key]
+		existingPeer, ok := existingPeerMap[key]
+		if !ok || !iputil.EqualIPNet(allowedIPs, existingPeer.AllowedIPs) {
+			cfgPeers = append(cfgPeers, wgtypes.PeerConfig{
+				PublicKey:         key,
+				ReplaceAllowedIPs: true,
+				AllowedIPs:        allowedIPs,
+			})
+
+			action := ActionAdd
+			if ok {
+				action = ActionUpdate
 			}
+
+			deviceChanges = append(deviceChanges, PeerChange{
+				Interface: d,
+				Pubkey:    key.String(),
+				Action:    action,
+			})
 		}
+	}
 
-		// No changes needed
-		if len(cfgPeers) == 0 {
-			continue
+	// Loop through the current peers in the wireguard config
+	keys = keys[:0]
+	for key := range existingPeerMap {
+		keys = append(keys, key)
+	}
+
+	for _, key := range sortKeys(keys) {
+		peer := existingPeerMap[key]
+		if _, ok := peerMap[key]; !ok {
+			// Keep pinned peers even if they're missing from the API
+			if _, pinned := w.pinnedKeys[key]; pinned {
+				continue
+			}
+
+			// Remove peers that doesn't exist in the API
+			cfgPeers = append(cfgPeers, wgtypes.PeerConfig{
+				PublicKey: key,
+				Remove:    true,
+			})
+
+			deviceChanges = append(deviceChanges, PeerChange{
+				Interface: d,
+				Pubkey:    key.String(),
+				Action:    ActionRemove,
+			})
+		} else if needsReset(peer) {
+			// Remove peers that's previously been active and should be reset to remove data
+			cfgPeers = append(cfgPeers, wgtypes.PeerConfig{
+				PublicKey: key,
+				Remove:    true,
+			})
+
+			peerCfg := wgtypes.PeerConfig{
+				PublicKey:         key,
+				ReplaceAllowedIPs: true,
+				AllowedIPs:        peer.AllowedIPs,
+			}
+
+			// Copy the preshared key if one is set
+			var emptyKey wgtypes.Key
+			if peer.PresharedKey != emptyKey {
+				// We need to copy the key, or the pointer gets corrupted for some reason
+				var copiedKey wgtypes.Key
+				copy(copiedKey[:], peer.PresharedKey[:])
+				peerCfg.PresharedKey = &copiedKey
+			}
+
+			// Re-add the peer later
+			resetPeers = append(resetPeers, peerCfg)
 		}
+	}
 
-		// Add new peers, remove deleted peers, and remove peers should be reset
-		err = w.client.ConfigureDevice(d, wgtypes.Config{
-			Peers: cfgPeers,
+	// No changes needed
+	if len(cfgPeers) == 0 {
+		return
+	}
+
+	// Swap the whole peer set at once, which also resets every peer
+	if w.options.ReplacePeers {
+		err = client.ConfigureDevice(d, wgtypes.Config{
+			ReplacePeers: true,
+			Peers:        w.replacementPeers(peerMap, existingPeerMap),
 		})
 
 		if err != nil {
 			log.Printf("error configuring wireguard interface %s: %s", d, err.Error())
-			continue
+			result.failed = true
+			return
 		}
 
-		// No peers to re-add for reset
-		if len(resetPeers) == 0 {
+		result.changes = deviceChanges
+		return
+	}
+
+	// Add new peers, remove deleted peers, and remove peers should be reset
+	err = client.ConfigureDevice(d, wgtypes.Config{
+		Peers: cfgPeers,
+	})
+
+	if err != nil {
+		log.Printf("error configuring wireguard interface %s: %s", d, err.Error())
+		result.failed = true
+		return
+	}
+
+	result.changes = deviceChanges
+
+	// No peers to re-add for reset
+	if len(resetPeers) == 0 {
+		return
+	}
+
+	// Re-add the peers we removed to reset in the previous step
+	err = client.ConfigureDevice(d, wgtypes.Config{
+		Peers: resetPeers,
+	})
+
+	if err != nil {
+		log.Printf("error configuring wireguard interface %s: %s", d, err.Error())
+		result.failed = true
+	}
+
+	return
+}
+
+// Limit the peers to the max peers per interface, keeping the peers with the lowest public keys so that the same peers are kept on every update
+// A copy is returned if the peers are limited, as the peer map is shared between interfaces
+func (w *Wireguard) capPeers(d string, peerMap map[wgtypes.Key][]net.IPNet) (capped map[wgtypes.Key][]net.IPNet, rejected []wgtypes.Key) {
+	if w.options.MaxPeersPerInterface == 0 || len(peerMap) <= w.options.MaxPeersPerInterface {
+		return peerMap, nil
+	}
+
+	keys := make([]wgtypes.Key, 0, len(peerMap))
+	for key := range peerMap {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+
+	capped = make(map[wgtypes.Key][]net.IPNet, w.options.MaxPeersPerInterface)
+	for _, key := range keys[:w.options.MaxPeersPerInterface] {
+		capped[key] = peerMap[key]
+	}
+	rejected = keys[w.options.MaxPeersPerInterface:]
+
+	w.metrics.Clone(statsd.Tags("interface", d)).Count("interface_peer_cap_exceeded", len(rejected))
+	log.Printf("leaving out %d peers on wireguard interface %s, as it's limited to %d peers", len(rejected), d, w.options.MaxPeersPerInterface)
+
+	return capped, rejected
+}
+
+// Get the configuration of every peer an interface should have, to replace its peers with
+// Existing pinned peers missing from the peer map are kept as they are
+func (w *Wireguard) replacementPeers(peerMap map[wgtypes.Key][]net.IPNet, existingPeerMap map[wgtypes.Key]wgtypes.Peer) []wgtypes.PeerConfig {
+	keys := make([]wgtypes.Key, 0, len(peerMap))
+	for key := range peerMap {
+		keys = append(keys, key)
+	}
+
+	for key := range existingPeerMap {
+		if _, ok := peerMap[key]; ok {
 			continue
 		}
 
-		// Re-add the peers we removed to reset in the previous step
-		err = w.client.ConfigureDevice(d, wgtypes.Config{
-			Peers: resetPeers,
-		})
+		if _, pinned := w.pinnedKeys[key]; pinned {
+			keys = append(keys, key)
+		}
+	}
+
+	peers := make([]wgtypes.PeerConfig, 0, len(keys))
+	for _, key := range sortKeys(keys) {
+		existingPeer, exists := existingPeerMap[key]
+
+		allowedIPs, ok := peerMap[key]
+		if !ok {
+			allowedIPs = existingPeer.AllowedIPs
+		}
+
+		peerCfg := wgtypes.PeerConfig{
+			PublicKey:         key,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        allowedIPs,
+		}
+
+		// Keep the preshared key if one is set, as it would be lost when replacing the peer
+		var emptyKey wgtypes.Key
+		if exists && existingPeer.PresharedKey != emptyKey {
+			var copiedKey wgtypes.Key
+			copy(copiedKey[:], existingPeer.PresharedKey[:])
+			peerCfg.PresharedKey = &copiedKey
+		}
 
+		peers = append(peers, peerCfg)
+	}
+
+	return peers
+}
+
+// SetPinnedKeys sets the public keys of the peers that UpdatePeers never removes, even if they're missing from the list of peers
+// Invalid keys are ignored
+func (w *Wireguard) SetPinnedKeys(keys []string) {
+	pinnedKeys := make(map[wgtypes.Key]struct{})
+	for _, k := range keys {
+		key, err := wgtypes.ParseKey(k)
 		if err != nil {
-			log.Printf("error configuring wireguard interface %s: %s", d, err.Error())
+			log.Printf("ignoring invalid pinned key %s", api.Fingerprint(k))
 			continue
 		}
+
+		pinnedKeys[key] = struct{}{}
 	}
 
-	// Send metrics
-	w.metrics.Gauge("connected_peers", peerCount)
-	return connectedKeysMap
+	w.pinnedKeys = pinnedKeys
+}
+
+// Interfaces returns the wireguard interfaces that are being managed, leaving out drained interfaces
+// and interfaces added by SetInterfaces that couldn't be opened yet
+func (w *Wireguard) Interfaces() []string {
+	var interfaces []string
+	for _, i := range w.interfaces {
+		if _, ok := w.clients[i]; ok && !w.drained[i] {
+			interfaces = append(interfaces, i)
+		}
+	}
+
+	return interfaces
+}
+
+// DrainInterface removes all peers from the given interface, and leaves it out of updates until EnableInterface is called
+// It returns the peers that were removed, and the interface stays drained even if removing them fails
+func (w *Wireguard) DrainInterface(name string) (changes []PeerChange, err error) {
+	client, ok := w.clients[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownInterface, name)
+	}
+
+	w.drained[name] = true
+
+	device, err := client.Device(name)
+	if err != nil {
+		return nil, fmt.Errorf("error getting wireguard interface %s: %s", name, err.Error())
+	}
+
+	err = client.ConfigureDevice(name, wgtypes.Config{
+		ReplacePeers: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error configuring wireguard interface %s: %s", name, err.Error())
+	}
+
+	for _, peer := range device.Peers {
+		changes = append(changes, PeerChange{
+			Interface: name,
+			Pubkey:    peer.PublicKey.String(),
+			Action:    ActionRemove,
+		})
+	}
+
+	return changes, nil
+}
+
+// EnableInterface includes a drained interface in updates again, its peers are added back by the next UpdatePeers
+func (w *Wireguard) EnableInterface(name string) error {
+	if _, ok := w.clients[name]; !ok {
+		return fmt.Errorf("%w %s", ErrUnknownInterface, name)
+	}
+
+	delete(w.drained, name)
+	return nil
+}
+
+// Drained checks whether the given interface is drained
+func (w *Wireguard) Drained(name string) bool {
+	return w.drained[name]
 }
 
 // Take the wireguard peers and convert them into a map for easier comparison
-func (w *Wireguard) mapPeers(peers api.WireguardPeerList) (peerMap map[wgtypes.Key][]net.IPNet) {
+// The peers that are left out are returned as rejections
+func (w *Wireguard) mapPeers(peers api.WireguardPeerList) (peerMap map[wgtypes.Key][]net.IPNet, rejections []api.PeerRejection) {
 	peerMap = make(map[wgtypes.Key][]net.IPNet)
+	duplicates := make(map[wgtypes.Key]struct{})
 
 	// Ignore peers with errors, in-case we get bad data from the API
 	for _, peer := range peers {
-		key, ipv4, ipv6, err := parsePeer(peer)
+		if !peer.HasPeer() {
+			continue
+		}
+
+		key, allowedIPs, err := parsePeer(peer)
 		if err != nil {
+			rejections = append(rejections, api.PeerRejection{Pubkey: peer.Pubkey, Reason: RejectInvalid, Detail: err.Error()})
 			continue
 		}
 
-		peerMap[key] = []net.IPNet{
-			*ipv4,
-			*ipv6,
+		if w.deniedPeer(peer, allowedIPs) {
+			rejections = append(rejections, api.PeerRejection{Pubkey: peer.Pubkey, Reason: RejectDeniedIP})
+			continue
+		}
+
+		// Every interface is configured with the same peers, so a duplicate record would configure the key with conflicting addresses
+		if _, ok := peerMap[key]; ok {
+			w.metrics.Increment("duplicate_pubkey_across_interfaces")
+			duplicates[key] = struct{}{}
+			continue
+		}
+
+		peerMap[key] = allowedIPs
+	}
+
+	for key := range duplicates {
+		if w.options.RejectDuplicatePubkeys {
+			log.Printf("rejecting peer %s, as its public key appears more than once", api.Fingerprint(key.String()))
+			delete(peerMap, key)
+			rejections = append(rejections, api.PeerRejection{Pubkey: key.String(), Reason: RejectDuplicatePubkey})
+		} else {
+			log.Printf("public key of peer %s appears more than once, applying the first record", api.Fingerprint(key.String()))
 		}
 	}
 
 	return
 }
 
+// Check whether the allowed ips of the peer overlap the denied networks, counting and logging it if they do
+func (w *Wireguard) deniedPeer(peer api.WireguardPeer, allowedIPs []net.IPNet) bool {
+	for _, network := range allowedIPs {
+		if iputil.OverlapsIPNet(network, w.options.DeniedIPs) {
+			w.metrics.Increment("reserved_ip_rejected")
+			log.Printf("rejecting peer %s, as its allowed ip %s is in a denied network", peer.Fingerprint(), network.String())
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sort keys in place, so that peers are applied in the same order on every update regardless of map order
+func sortKeys(keys []wgtypes.Key) []wgtypes.Key {
+	sort.Slice(keys, func(i int, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+
+	return keys
+}
+
 // Take the existing wireguard peers and convert them into a map for easier comparison
 func mapExistingPeers(peers []wgtypes.Peer) (peerMap map[wgtypes.Key]wgtypes.Peer) {
 	peerMap = make(map[wgtypes.Key]wgtypes.Peer)
@@ -190,6 +769,76 @@ func mapExistingPeers(peers []wgtypes.Peer) (peerMap map[wgtypes.Key]wgtypes.Pee
 	return
 }
 
+// LastHandshakes returns the time of the latest handshake of each peer on the interfaces, keyed by public key
+// Peers without a handshake, including those whose handshake information has been reset, are left out
+func (w *Wireguard) LastHandshakes() (map[string]time.Time, error) {
+	handshakes := make(map[string]time.Time)
+	for _, i := range w.Interfaces() {
+		device, err := w.clients[i].Device(i)
+		if err != nil {
+			return nil, fmt.Errorf("error getting wireguard interface %s: %s", i, err.Error())
+		}
+
+		for _, peer := range device.Peers {
+			pubkey := peer.PublicKey.String()
+			if peer.LastHandshakeTime.After(handshakes[pubkey]) {
+				handshakes[pubkey] = peer.LastHandshakeTime
+			}
+		}
+	}
+
+	return handshakes, nil
+}
+
+// ConnectedKeys returns the number of interfaces that each peer is connected on, like UpdatePeers does, without changing the peers
+// Peers that UpdatePeers would reset for being inactive aren't connected, as they wouldn't be after the reset
+func (w *Wireguard) ConnectedKeys() (api.ConnectedKeysMap, error) {
+	connectedKeys := make(api.ConnectedKeysMap)
+	now := time.Now()
+	for _, i := range w.Interfaces() {
+		device, err := w.clients[i].Device(i)
+		if err != nil {
+			return nil, fmt.Errorf("error getting wireguard interface %s: %s", i, err.Error())
+		}
+
+		for _, peer := range device.Peers {
+			if !needsReset(peer) && w.options.ConnectedCriteria.Connected(peer, now) {
+				connectedKeys[peer.PublicKey.String()]++
+			}
+		}
+	}
+
+	return connectedKeys, nil
+}
+
+// Endpoints returns the remote endpoint of each connected peer on the interfaces, keyed by public key
+// Peers without an endpoint, or without a handshake within the connected interval, are left out
+// If a peer is connected on several interfaces, the endpoint of the latest handshake is used
+func (w *Wireguard) Endpoints() (map[string]string, error) {
+	endpoints := make(map[string]string)
+	handshakes := make(map[string]time.Time)
+	for _, i := range w.Interfaces() {
+		device, err := w.clients[i].Device(i)
+		if err != nil {
+			return nil, fmt.Errorf("error getting wireguard interface %s: %s", i, err.Error())
+		}
+
+		for _, peer := range device.Peers {
+			if peer.Endpoint == nil || time.Since(peer.LastHandshakeTime) > connectedInterval {
+				continue
+			}
+
+			pubkey := peer.PublicKey.String()
+			if peer.LastHandshakeTime.After(handshakes[pubkey]) {
+				handshakes[pubkey] = peer.LastHandshakeTime
+				endpoints[pubkey] = peer.Endpoint.String()
+			}
+		}
+	}
+
+	return endpoints, nil
+}
+
 // Wireguard sends a handshake roughly every 2 minutes
 // So we consider all peers with a handshake within that interval to be connected
 const handshakeInterval = time.Minute * 2
@@ -198,13 +847,14 @@ const handshakeInterval = time.Minute * 2
 const connectedInterval = time.Minute * 3
 
 // Count the connected wireguard peers
-func countConnectedPeers(peers []wgtypes.Peer) (devicePeerCount int, deviceConnectedKeys []string) {
+func countConnectedPeers(peers []wgtypes.Peer, criteria ConnectedCriteria) (devicePeerCount int, deviceConnectedKeys []string) {
+	now := time.Now()
 	for _, peer := range peers {
-		lastHandShakeTime := time.Since(peer.LastHandshakeTime)
+		lastHandShakeTime := now.Sub(peer.LastHandshakeTime)
 		if lastHandShakeTime <= handshakeInterval {
 			devicePeerCount++
 		}
-		if lastHandShakeTime <= connectedInterval {
+		if criteria.Connected(peer, now) {
 			deviceConnectedKeys = append(deviceConnectedKeys, peer.PublicKey.String())
 		}
 	}
@@ -225,44 +875,58 @@ func needsReset(peer wgtypes.Peer) bool {
 }
 
 // AddPeer adds the given peer to the wireguard interfaces, without checking the existing configuration
-func (w *Wireguard) AddPeer(peer api.WireguardPeer) {
-	key, ipv4, ipv6, err := parsePeer(peer)
+// All interfaces are attempted even if one fails, and the last error is returned
+func (w *Wireguard) AddPeer(peer api.WireguardPeer) (lastErr error) {
+	if !peer.HasPeer() {
+		return nil
+	}
+
+	key, allowedIPs, err := parsePeer(peer)
 	if err != nil {
-		return
+		return fmt.Errorf("error parsing peer: %s", err.Error())
 	}
 
-	for _, d := range w.interfaces {
+	if w.deniedPeer(peer, allowedIPs) {
+		return ErrDeniedIP
+	}
+
+	for _, d := range w.Interfaces() {
 		// Add the peer
-		err := w.client.ConfigureDevice(d, wgtypes.Config{
+		err := w.clients[d].ConfigureDevice(d, wgtypes.Config{
 			Peers: []wgtypes.PeerConfig{
 				{
 					PublicKey:         key,
 					ReplaceAllowedIPs: true,
-					AllowedIPs: []net.IPNet{
-						*ipv4,
-						*ipv6,
-					},
+					AllowedIPs:        allowedIPs,
 				},
 			},
 		})
 
 		if err != nil {
-			log.Printf("error configuring wireguard interface %s: %s", d, err.Error())
+			log.Printf("error configuring wireguard interface %s for peer %s: %s", d, peer.Fingerprint(), err.Error())
+			lastErr = fmt.Errorf("error configuring wireguard interface %s: %s", d, err.Error())
 			continue
 		}
 	}
+
+	return lastErr
 }
 
 // RemovePeer removes the given peer from the wireguard interfaces, without checking the existing configuration
-func (w *Wireguard) RemovePeer(peer api.WireguardPeer) {
-	key, _, _, err := parsePeer(peer)
+// All interfaces are attempted even if one fails, and the last error is returned
+func (w *Wireguard) RemovePeer(peer api.WireguardPeer) (lastErr error) {
+	if !peer.HasPeer() {
+		return nil
+	}
+
+	key, _, err := parsePeer(peer)
 	if err != nil {
-		return
+		return fmt.Errorf("error parsing peer: %s", err.Error())
 	}
 
-	for _, d := range w.interfaces {
+	for _, d := range w.Interfaces() {
 		// Remove the peer
-		err := w.client.ConfigureDevice(d, wgtypes.Config{
+		err := w.clients[d].ConfigureDevice(d, wgtypes.Config{
 			Peers: []wgtypes.PeerConfig{
 				{
 					PublicKey: key,
@@ -272,32 +936,66 @@ func (w *Wireguard) RemovePeer(peer api.WireguardPeer) {
 		})
 
 		if err != nil {
-			log.Printf("error configuring wireguard interface %s: %s", d, err.Error())
+			log.Printf("error configuring wireguard interface %s for peer %s: %s", d, peer.Fingerprint(), err.Error())
+			lastErr = fmt.Errorf("error configuring wireguard interface %s: %s", d, err.Error())
 			continue
 		}
 	}
+
+	return lastErr
+}
+
+// ValidatePeer checks that the key and addresses of a peer are valid, as invalid peers are left out when updating peers
+func ValidatePeer(peer api.WireguardPeer) error {
+	if !peer.HasPeer() {
+		return nil
+	}
+
+	_, _, err := parsePeer(peer)
+	return err
 }
 
-func parsePeer(peer api.WireguardPeer) (key wgtypes.Key, ipv4 *net.IPNet, ipv6 *net.IPNet, err error) {
+// Parse the key and allowed ips of a peer, leaving out the IPv6 address if it's disabled for the peer
+// The excluded ips of the peer are removed from the allowed ips, by splitting them into smaller networks
+func parsePeer(peer api.WireguardPeer) (key wgtypes.Key, allowedIPs []net.IPNet, err error) {
 	key, err = wgtypes.ParseKey(peer.Pubkey)
 	if err != nil {
 		return
 	}
 
-	_, ipv4, err = net.ParseCIDR(peer.IPv4)
+	var excludeIPs []net.IPNet
+	for _, cidr := range peer.ExcludeIPs {
+		var network *net.IPNet
+		_, network, err = net.ParseCIDR(cidr)
+		if err != nil {
+			return
+		}
+
+		excludeIPs = append(excludeIPs, *network)
+	}
+
+	_, ipv4, err := net.ParseCIDR(peer.IPv4)
 	if err != nil {
 		return
 	}
 
-	_, ipv6, err = net.ParseCIDR(peer.IPv6)
+	allowedIPs = append(allowedIPs, iputil.ExcludeIPNet(*ipv4, excludeIPs)...)
+	if peer.DisableIPv6 {
+		return
+	}
+
+	_, ipv6, err := net.ParseCIDR(peer.IPv6)
 	if err != nil {
 		return
 	}
 
+	allowedIPs = append(allowedIPs, iputil.ExcludeIPNet(*ipv6, excludeIPs)...)
 	return
 }
 
-// Close closes the underlying wireguard client
+// Close closes the underlying wireguard clients
 func (w *Wireguard) Close() {
-	w.client.Close()
+	for _, client := range w.clients {
+		client.Close()
+	}
 }
@@ -2,6 +2,9 @@ package wireguard_test
 
 import (
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"strings"
 	"testing"
@@ -129,14 +132,35 @@ func TestWireguard(t *testing.T) {
 	// Sleep so that there's time for a handshake between the peers
 	time.Sleep(time.Second * 2)
 
-	wg, err := wireguard.New([]string{testInterface}, metrics)
+	wg, err := wireguard.New([]string{testInterface}, metrics, wireguard.Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer wg.Close()
 
+	t.Run("read endpoints", func(t *testing.T) {
+		endpoints, err := wg.Endpoints()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The peer without a handshake has no endpoint
+		if len(endpoints) != 1 {
+			t.Fatalf("unexpected endpoints %v", endpoints)
+		}
+
+		host, _, err := net.SplitHostPort(endpoints[wgClientPrivkey.PublicKey().String()])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if host != "127.0.0.1" {
+			t.Errorf("got unexpected endpoint host %s", host)
+		}
+	})
+
 	t.Run("check connected keys", func(t *testing.T) {
-		connectedKeys := wg.UpdatePeers(apiFixture)
+		connectedKeys, _ := wg.UpdatePeers(apiFixture)
 
 		expectedKeys := api.ConnectedKeysMap{
 			wgClientPrivkey.PublicKey().String(): 1,
@@ -164,13 +188,20 @@ func TestWireguard(t *testing.T) {
 	t.Run("update peer ip", func(t *testing.T) {
 		apiFixture[0].IPv4 = "10.99.0.2/32"
 		apiFixture[0].IPv6 = "fc00:bbbb:bbbb:bb01::2/128"
-		wg.UpdatePeers(apiFixture)
+		_, changes := wg.UpdatePeers(apiFixture)
 
 		device, err := client.Device(testInterface)
 		if err != nil {
 			t.Fatal(err)
 		}
 
+		expectedChanges := []wireguard.PeerChange{
+			{Interface: testInterface, Pubkey: apiFixture[0].Pubkey, Action: wireguard.ActionUpdate},
+		}
+		if diff := cmp.Diff(expectedChanges, changes); diff != "" {
+			t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+		}
+
 		peerFixture[0].AllowedIPs[0].IP = net.ParseIP("10.99.0.2")
 		peerFixture[0].AllowedIPs[1].IP = net.ParseIP("fc00:bbbb:bbbb:bb01::2")
 
@@ -180,13 +211,20 @@ func TestWireguard(t *testing.T) {
 	})
 
 	t.Run("remove peers", func(t *testing.T) {
-		wg.UpdatePeers(api.WireguardPeerList{})
+		_, changes := wg.UpdatePeers(api.WireguardPeerList{})
 
 		device, err := client.Device(testInterface)
 		if err != nil {
 			t.Fatal(err)
 		}
 
+		expectedChanges := []wireguard.PeerChange{
+			{Interface: testInterface, Pubkey: apiFixture[0].Pubkey, Action: wireguard.ActionRemove},
+		}
+		if diff := cmp.Diff(expectedChanges, changes); diff != "" {
+			t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+		}
+
 		if diff := cmp.Diff([]wgtypes.Peer(nil), device.Peers); diff != "" {
 			t.Fatalf("unexpected peers (-want +got):\n%s", diff)
 		}
@@ -217,6 +255,179 @@ func TestWireguard(t *testing.T) {
 			t.Fatalf("unexpected peers (-want +got):\n%s", diff)
 		}
 	})
+
+	t.Run("keep pinned peers", func(t *testing.T) {
+		wg.SetPinnedKeys([]string{apiFixture[0].Pubkey})
+		defer wg.SetPinnedKeys(nil)
+
+		wg.UpdatePeers(apiFixture)
+		_, changes := wg.UpdatePeers(api.WireguardPeerList{})
+
+		if len(changes) != 0 {
+			t.Fatalf("unexpected changes %+v", changes)
+		}
+
+		device, err := client.Device(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(peerFixture, device.Peers); diff != "" {
+			t.Fatalf("unexpected peers (-want +got):\n%s", diff)
+		}
+
+		wg.RemovePeer(apiFixture[0])
+	})
+
+	t.Run("ignore forwarding-only peers", func(t *testing.T) {
+		peer := apiFixture[0]
+		peer.Kind = api.KindForwarding
+		wg.UpdatePeers(api.WireguardPeerList{peer})
+		wg.AddPeer(peer)
+
+		device, err := client.Device(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]wgtypes.Peer(nil), device.Peers); diff != "" {
+			t.Fatalf("unexpected peers (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("add peer with ipv6 disabled", func(t *testing.T) {
+		peer := apiFixture[0]
+		peer.DisableIPv6 = true
+		wg.UpdatePeers(api.WireguardPeerList{peer})
+
+		device, err := client.Device(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedPeers := []wgtypes.Peer{peerFixture[0]}
+		expectedPeers[0].AllowedIPs = peerFixture[0].AllowedIPs[:1]
+
+		if diff := cmp.Diff(expectedPeers, device.Peers); diff != "" {
+			t.Fatalf("unexpected peers (-want +got):\n%s", diff)
+		}
+
+		wg.RemovePeer(peer)
+	})
+
+	t.Run("apply first record of duplicate peer", func(t *testing.T) {
+		duplicate := apiFixture[0]
+		duplicate.IPv4 = "10.99.0.3/32"
+		wg.UpdatePeers(api.WireguardPeerList{apiFixture[0], duplicate})
+
+		device, err := client.Device(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(peerFixture, device.Peers); diff != "" {
+			t.Fatalf("unexpected peers (-want +got):\n%s", diff)
+		}
+
+		wg.RemovePeer(apiFixture[0])
+	})
+
+	t.Run("stable order of changes", func(t *testing.T) {
+		var peers api.WireguardPeerList
+		for i := 0; i < 5; i++ {
+			peers = append(peers, api.WireguardPeer{
+				IPv4:   fmt.Sprintf("10.99.1.%d/32", i),
+				IPv6:   fmt.Sprintf("fc00:bbbb:bbbb:bb02::%d/128", i),
+				Pubkey: base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune('b'+i)), 32))),
+			})
+		}
+
+		var expectedChanges []wireguard.PeerChange
+		for _, peer := range peers {
+			expectedChanges = append(expectedChanges, wireguard.PeerChange{Interface: testInterface, Pubkey: peer.Pubkey, Action: wireguard.ActionAdd})
+		}
+
+		rand.Shuffle(len(peers), func(i int, j int) {
+			peers[i], peers[j] = peers[j], peers[i]
+		})
+
+		_, changes := wg.UpdatePeers(peers)
+		defer wg.UpdatePeers(api.WireguardPeerList{})
+
+		if diff := cmp.Diff(expectedChanges, changes); diff != "" {
+			t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("drain interface", func(t *testing.T) {
+		wg.UpdatePeers(apiFixture)
+
+		changes, err := wg.DrainInterface(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(changes) != len(apiFixture) {
+			t.Fatalf("unexpected changes %+v", changes)
+		}
+
+		// Drained interfaces are left out of updates
+		wg.UpdatePeers(apiFixture)
+
+		device, err := client.Device(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(device.Peers) != 0 {
+			t.Fatalf("unexpected peers %+v", device.Peers)
+		}
+
+		err = wg.EnableInterface(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.UpdatePeers(apiFixture)
+
+		device, err = client.Device(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(peerFixture, device.Peers); diff != "" {
+			t.Fatalf("unexpected peers (-want +got):\n%s", diff)
+		}
+
+		wg.UpdatePeers(api.WireguardPeerList{})
+	})
+
+	t.Run("drain unknown interface", func(t *testing.T) {
+		_, err := wg.DrainInterface("nonexistant")
+		if !errors.Is(err, wireguard.ErrUnknownInterface) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("export interface", func(t *testing.T) {
+		wg.UpdatePeers(apiFixture)
+		defer wg.UpdatePeers(api.WireguardPeerList{})
+
+		config, err := wg.ExportInterface(testInterface)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := fmt.Sprintf("\n[Peer]\nPublicKey = %s\nAllowedIPs = 10.99.0.1/32, fc00:bbbb:bbbb:bb01::1/128\n", wgKey())
+		if !strings.HasPrefix(config, "[Interface]\n") || !strings.HasSuffix(config, expected) {
+			t.Fatalf("unexpected config %q", config)
+		}
+
+		_, err = wg.ExportInterface("nonexistant")
+		if !errors.Is(err, wireguard.ErrUnknownInterface) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
 }
 
 func resetDevice(t *testing.T, c *wgctrl.Client) {
@@ -238,8 +449,346 @@ func TestInvalidInterface(t *testing.T) {
 
 	interfaceName := "nonexistant"
 
-	_, err := wireguard.New([]string{interfaceName}, nil)
+	_, err := wireguard.New([]string{interfaceName}, nil, wireguard.Options{})
 	if err == nil {
 		t.Fatal("no error")
 	}
 }
+
+func TestParallelInterfaces(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	interfaces := []string{testInterface, testClientInterface}
+
+	wg, err := wireguard.New(interfaces, metrics, wireguard.Options{ParallelInterfaces: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wg.Close()
+	defer wg.UpdatePeers(api.WireguardPeerList{})
+
+	// Update the peers repeatedly, so that the race detector has a chance to catch concurrent use of a client
+	for i := 0; i < 10; i++ {
+		wg.UpdatePeers(apiFixture)
+	}
+
+	for _, i := range interfaces {
+		device, err := client.Device(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(device.Peers) != 1 || device.Peers[0].PublicKey != wgKey() {
+			t.Errorf("unexpected peers on %s: %+v", i, device.Peers)
+		}
+	}
+}
+
+func TestRejectDuplicatePubkeys(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	wg, err := wireguard.New([]string{testInterface}, metrics, wireguard.Options{RejectDuplicatePubkeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wg.Close()
+	defer wg.UpdatePeers(api.WireguardPeerList{})
+
+	duplicate := apiFixture[0]
+	duplicate.IPv4 = "10.99.0.3/32"
+	wg.UpdatePeers(api.WireguardPeerList{apiFixture[0], duplicate})
+
+	device, err := client.Device(testInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]wgtypes.Peer(nil), device.Peers); diff != "" {
+		t.Fatalf("unexpected peers (-want +got):\n%s", diff)
+	}
+}
+
+func TestDuplicatePubkeyAcrossInterfaces(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	interfaces := []string{testInterface, testClientInterface}
+
+	duplicate := apiFixture[0]
+	duplicate.IPv4 = "10.99.0.3/32"
+
+	for _, tc := range []struct {
+		name     string
+		reject   bool
+		expected []wgtypes.Peer
+	}{
+		{"apply first record", false, peerFixture},
+		{"reject", true, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			wg, err := wireguard.New(interfaces, metrics, wireguard.Options{RejectDuplicatePubkeys: tc.reject})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wg.Close()
+			defer wg.UpdatePeers(api.WireguardPeerList{})
+
+			wg.UpdatePeers(api.WireguardPeerList{apiFixture[0], duplicate})
+
+			// The key is never configured with the addresses of the first record on one interface and the duplicate on another
+			for _, i := range interfaces {
+				device, err := client.Device(i)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(tc.expected, device.Peers); diff != "" {
+					t.Errorf("unexpected peers on %s (-want +got):\n%s", i, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestReplacePeers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	wg, err := wireguard.New([]string{testInterface}, metrics, wireguard.Options{ReplacePeers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wg.Close()
+	defer wg.UpdatePeers(api.WireguardPeerList{})
+
+	_, changes := wg.UpdatePeers(apiFixture)
+
+	expectedChanges := []wireguard.PeerChange{
+		{Interface: testInterface, Pubkey: apiFixture[0].Pubkey, Action: wireguard.ActionAdd},
+	}
+	if diff := cmp.Diff(expectedChanges, changes); diff != "" {
+		t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+	}
+
+	device, err := client.Device(testInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(peerFixture, device.Peers); diff != "" {
+		t.Fatalf("unexpected peers (-want +got):\n%s", diff)
+	}
+
+	// The peers are only replaced when something changed
+	_, changes = wg.UpdatePeers(apiFixture)
+	if len(changes) != 0 {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+
+	_, changes = wg.UpdatePeers(api.WireguardPeerList{})
+
+	expectedChanges[0].Action = wireguard.ActionRemove
+	if diff := cmp.Diff(expectedChanges, changes); diff != "" {
+		t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+	}
+
+	device, err = client.Device(testInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]wgtypes.Peer(nil), device.Peers); diff != "" {
+		t.Fatalf("unexpected peers (-want +got):\n%s", diff)
+	}
+}
+
+func TestDeniedIPs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, deniedNet, _ := net.ParseCIDR("10.99.0.0/24")
+	wg, err := wireguard.New([]string{testInterface}, metrics, wireguard.Options{DeniedIPs: []net.IPNet{*deniedNet}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wg.Close()
+	defer wg.UpdatePeers(api.WireguardPeerList{})
+
+	// The peer of the fixture claims an address in the denied network
+	wg.UpdatePeers(apiFixture)
+
+	expectedRejections := []api.PeerRejection{{Pubkey: apiFixture[0].Pubkey, Reason: wireguard.RejectDeniedIP}}
+	if diff := cmp.Diff(expectedRejections, wg.Rejections()); diff != "" {
+		t.Errorf("unexpected rejections (-want +got):\n%s", diff)
+	}
+
+	err = wg.AddPeer(apiFixture[0])
+	if !errors.Is(err, wireguard.ErrDeniedIP) {
+		t.Errorf("got unexpected error, wanted %s, got %v", wireguard.ErrDeniedIP, err)
+	}
+
+	device, err := client.Device(testInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]wgtypes.Peer(nil), device.Peers); diff != "" {
+		t.Fatalf("unexpected peers (-want +got):\n%s", diff)
+	}
+}
+
+func TestMaxPeersPerInterface(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg, err := wireguard.New([]string{testInterface}, metrics, wireguard.Options{MaxPeersPerInterface: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wg.Close()
+	defer wg.UpdatePeers(api.WireguardPeerList{})
+
+	var peers api.WireguardPeerList
+	for i := 0; i < 5; i++ {
+		peers = append(peers, api.WireguardPeer{
+			IPv4:   fmt.Sprintf("10.99.1.%d/32", i),
+			IPv6:   fmt.Sprintf("fc00:bbbb:bbbb:bb02::%d/128", i),
+			Pubkey: base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune('b'+i)), 32))),
+		})
+	}
+
+	// The peers with the lowest public keys are kept, regardless of the order of the peers
+	var expectedChanges []wireguard.PeerChange
+	for _, peer := range peers[:2] {
+		expectedChanges = append(expectedChanges, wireguard.PeerChange{Interface: testInterface, Pubkey: peer.Pubkey, Action: wireguard.ActionAdd})
+	}
+
+	var expectedRejections []api.PeerRejection
+	for _, peer := range peers[2:] {
+		expectedRejections = append(expectedRejections, api.PeerRejection{Pubkey: peer.Pubkey, Reason: wireguard.RejectOverCapacity})
+	}
+
+	rand.Shuffle(len(peers), func(i int, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+
+	_, changes := wg.UpdatePeers(peers)
+	if diff := cmp.Diff(expectedChanges, changes); diff != "" {
+		t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(expectedRejections, wg.Rejections()); diff != "" {
+		t.Fatalf("unexpected rejections (-want +got):\n%s", diff)
+	}
+}
+
+func TestInvalidMaxPeersPerInterface(t *testing.T) {
+	_, err := wireguard.New([]string{testInterface}, nil, wireguard.Options{MaxPeersPerInterface: -1})
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestExpectedPublicKeys(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration tests")
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	device, err := client.Device(testInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("matching key", func(t *testing.T) {
+		wg, err := wireguard.New([]string{testInterface}, nil, wireguard.Options{
+			ExpectedPublicKeys: map[string]wgtypes.Key{testInterface: device.PublicKey},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Close()
+	})
+
+	t.Run("mismatching key", func(t *testing.T) {
+		_, err := wireguard.New([]string{testInterface}, nil, wireguard.Options{
+			ExpectedPublicKeys: map[string]wgtypes.Key{testInterface: wgKey()},
+		})
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+}